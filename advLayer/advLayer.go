@@ -58,7 +58,9 @@ type Conf struct {
 	Headers *httpLayer.HeaderPreset
 	IsEarly bool           //is 0-rtt or not; for quic and ws.
 	Xver    int            //for Super, like quic, PROXY protocol
-	Extra   map[string]any //quic: useHysteria, hysteria_manual, maxbyte; grpc: multiMode
+	Extra   map[string]any //quic: congestion_control, mbps, hy_manual, hop_ports; grpc: grpc_multi; kcp: kcp_header, kcp_seed, etc.
+
+	ListenAddrs []string //for Super server, 监听 多个 地址 时 给出, 第一个 与 Addr 相同
 }
 
 type Common interface {
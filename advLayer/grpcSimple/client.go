@@ -152,7 +152,8 @@ type Client struct {
 
 	cachedTransport *http2.Transport //一个 transport 对应 一个提供的 dial好的 tls 连接，正好作为CommonConn。
 
-	path string
+	path  string
+	multi bool //是否使用 multiMode (TunMulti)
 }
 
 func (c *Client) dealErr(err error) {
@@ -215,6 +216,9 @@ func (c *Client) DialSubConn(underlay any) (net.Conn, error) {
 	request.Body = reader
 
 	conn := &ClientConn{
+		commonPart: commonPart{
+			multi: c.multi,
+		},
 		request:     &request,
 		transport:   transport,
 		writer:      writer,
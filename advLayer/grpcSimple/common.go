@@ -30,12 +30,20 @@ func commonWrite(b []byte) *bytes.Buffer {
 	return buf
 }
 
+func uvarintSize(x uint64) int {
+	var tmp [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(tmp[:], x)
+}
+
 type commonPart struct {
 	netLayer.EasyDeadline
 
 	remain int
 	br     *bufio.Reader
 
+	multi     bool //是否为 multiMode (TunMulti)
+	msgRemain int  //multiMode 时, 当前 grpc消息中 在 当前 data字段 之后 还剩余的 字节数
+
 	la, ra net.Addr
 }
 
@@ -71,6 +79,10 @@ func (c *commonPart) read(b []byte) (n int, err error) {
 		return
 	}
 
+	if c.multi {
+		return c.readMulti(b)
+	}
+
 	_, err = c.br.Discard(6)
 	if err != nil {
 
@@ -82,7 +94,60 @@ func (c *commonPart) read(b []byte) (n int, err error) {
 		return 0, utils.ErrInErr{ErrDesc: "Failed in grpc Read, binary.ReadUvarint", ErrDetail: err, ExtraIs: []error{utils.ErrInvalidData}}
 	}
 
-	size := int(protobufPayloadLen)
+	return c.readPayload(b, int(protobufPayloadLen))
+}
+
+/*
+multiMode 的 消息 为
+
+	message MultiHunk {
+		repeated bytes data = 1;
+	}
+
+即 一个 grpc消息 中 可以有 多个 data字段, 每个都是 0x0A + varint长度 + 数据.
+只有一个 data字段 时, 与 Hunk 的 编码 完全相同, 所以 我们 写入时 直接用 commonWrite.
+*/
+func (c *commonPart) readMulti(b []byte) (n int, err error) {
+	for {
+		if c.msgRemain <= 0 {
+			var grpcHeader [5]byte
+			if _, err = io.ReadFull(c.br, grpcHeader[:]); err != nil {
+				return 0, err
+			}
+			c.msgRemain = int(binary.BigEndian.Uint32(grpcHeader[1:]))
+			continue
+		}
+
+		var tag byte
+		tag, err = c.br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if tag != 0x0A {
+			return 0, utils.ErrInErr{ErrDesc: "Failed in grpc multi Read, wrong protobuf tag", ErrDetail: utils.ErrInvalidData, Data: tag}
+		}
+
+		var protobufPayloadLen uint64
+		protobufPayloadLen, err = binary.ReadUvarint(c.br)
+		if err != nil {
+			return 0, utils.ErrInErr{ErrDesc: "Failed in grpc multi Read, binary.ReadUvarint", ErrDetail: err, ExtraIs: []error{utils.ErrInvalidData}}
+		}
+
+		c.msgRemain -= 1 + uvarintSize(protobufPayloadLen) + int(protobufPayloadLen)
+		if c.msgRemain < 0 {
+			return 0, utils.ErrInErr{ErrDesc: "Failed in grpc multi Read, data longer than message", ErrDetail: utils.ErrInvalidData}
+		}
+
+		if protobufPayloadLen > 0 {
+			return c.readPayload(b, int(protobufPayloadLen))
+		}
+	}
+}
+
+// 读取 一个 长度为 protobufPayloadLen 的 data字段, 读不完的 部分 记录在 c.remain
+func (c *commonPart) readPayload(b []byte, protobufPayloadLen int) (n int, err error) {
+
+	size := protobufPayloadLen
 	if len(b) < size {
 		size = len(b)
 	}
@@ -92,7 +157,7 @@ func (c *commonPart) read(b []byte) (n int, err error) {
 		return
 	}
 
-	remain := int(protobufPayloadLen) - n
+	remain := protobufPayloadLen - n
 	if remain > 0 {
 		c.remain = remain
 	}
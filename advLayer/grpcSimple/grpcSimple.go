@@ -13,7 +13,7 @@ https://github.com/Dreamacro/clash/blob/master/transport/gun/gun.go, which is un
 
 # Advantages
 
-grpcSimple包 比grpc包 小很多，替代grpc包的话，可以减小 4MB 左右的可执行文件大小。但是目前不支持 multiMode。
+grpcSimple包 比grpc包 小很多，替代grpc包的话，可以减小 4MB 左右的可执行文件大小。
 
 grpcSimple包 是很棒 很有用的 实现，而且支持  grpc的 path 的回落。
 
@@ -22,6 +22,13 @@ grpc虽然是定义 serviceName的，但是实际上和其他http请求一样，
 path就是  /serviceName/Tun
 之所以叫Tun，只不过是为了兼容xray/v2ray，技术上叫啥都行
 
+# MultiMode
+
+客户端 配置 extra.grpc_multi = true 后, 使用 /serviceName/TunMulti 这个path, 消息为 MultiHunk (repeated bytes),
+与 xray/v2ray 的 multiMode 兼容。
+
+服务端 自动适配, 同时接受 Tun 和 TunMulti 两个path, 其它path 依然会回落。
+
 # Fallback
 
 grpcSimple can fallback to h2c.
@@ -50,6 +57,7 @@ import (
 	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
 const grpcContentType = "application/grpc"
@@ -103,6 +111,17 @@ func getTunPath(serviceName string) string {
 	return sb.String()
 }
 
+func getTunMultiPath(serviceName string) string {
+	return getTunPath(serviceName) + "Multi"
+}
+
+func getMultiFromConf(conf *advLayer.Conf) (multi bool) {
+	if conf.Extra != nil {
+		multi, _ = utils.AnyToBool(conf.Extra["grpc_multi"])
+	}
+	return
+}
+
 func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
 
 	serviceName := getServiceNameFromConf(conf)
@@ -112,7 +131,11 @@ func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
 			ServiceName: serviceName,
 			Host:        conf.Host,
 		},
-		path: getTunPath(conf.Path),
+		path:  getTunPath(conf.Path),
+		multi: getMultiFromConf(conf),
+	}
+	if c.multi {
+		c.path = getTunMultiPath(serviceName)
 	}
 
 	c.handshakeRequest = http.Request{
@@ -154,8 +177,9 @@ func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
 			ServiceName: serviceName,
 			Host:        conf.Host,
 		},
-		path:    getTunPath(serviceName),
-		Headers: conf.Headers,
+		path:      getTunPath(serviceName),
+		multiPath: getTunMultiPath(serviceName),
+		Headers:   conf.Headers,
 	}
 
 	return s, nil
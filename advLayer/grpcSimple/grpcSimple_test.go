@@ -0,0 +1,138 @@
+package grpcSimple
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+)
+
+// 一个 grpc消息 中 含有 多个 data字段 (包括 空字段) 时, 也要 能 正确读出
+func TestMultiHunkRead(t *testing.T) {
+	var msg []byte
+	for _, d := range []string{"hello", "", "verysimple"} {
+		msg = append(msg, 0x0A)
+		msg = binary.AppendUvarint(msg, uint64(len(d)))
+		msg = append(msg, d...)
+	}
+	grpcHeader := make([]byte, 5)
+	binary.BigEndian.PutUint32(grpcHeader[1:], uint32(len(msg)))
+
+	stream := append(grpcHeader, msg...)
+
+	//单个 data字段 的 MultiHunk 与 Hunk 相同
+	buf := commonWrite([]byte("world"))
+	stream = append(stream, buf.Bytes()...)
+
+	c := &commonPart{br: bufio.NewReader(bytes.NewReader(stream)), multi: true}
+
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "helloverysimpleworld" {
+		t.Fatal("got", string(got))
+	}
+
+	c = &commonPart{br: bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 0, 2, 0x12, 0})), multi: true}
+	if _, err := c.Read(make([]byte, 10)); err == nil {
+		t.Fatal("should fail on wrong tag")
+	}
+}
+
+func TestMultiMode(t *testing.T) {
+	conf := &advLayer.Conf{Path: "grpc_multi_test", Extra: map[string]any{"grpc_multi": true}}
+
+	cli, err := Creator{}.NewClientFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := cli.(*Client).path; p != "/grpc_multi_test/TunMulti" {
+		t.Fatal("wrong path", p)
+	}
+
+	srv, err := Creator{}.NewServerFromConf(&advLayer.Conf{Path: "grpc_multi_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := srv.(*Server)
+	defer server.Stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fallbackPaths := make(chan string, 1)
+
+	go func() {
+		lc, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server.StartHandle(lc, func(sc net.Conn) {
+			if !sc.(*ServerConn).multi {
+				t.Log("server didn't detect multiMode")
+				sc.Close()
+				return
+			}
+			io.Copy(sc, sc)
+		}, func(fm httpLayer.FallbackMeta) {
+			fallbackPaths <- fm.Path
+			fm.H2RW.WriteHeader(404)
+		})
+	}()
+
+	rc, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	cc, err := cli.(*Client).DialSubConn(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	cc.SetDeadline(time.Now().Add(time.Second * 5))
+
+	for i := 0; i < 5; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 1000*(i+1))
+		if _, err := cc.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(cc, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatal("not equal", i)
+		}
+	}
+
+	//其它path 依然回落
+	wrongCli, _ := Creator{}.NewClientFromConf(&advLayer.Conf{Path: "wrong"})
+	wc, err := wrongCli.(*Client).DialSubConn(cli.(*Client).cachedTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+	wc.Write([]byte("a"))
+	wc.Read(make([]byte, 1))
+
+	select {
+	case p := <-fallbackPaths:
+		if p != "/wrong/Tun" {
+			t.Fatal("wrong fallback path", p)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no fallback")
+	}
+}
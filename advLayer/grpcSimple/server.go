@@ -25,7 +25,8 @@ type Server struct {
 
 	Headers *httpLayer.HeaderPreset
 
-	path string
+	path      string
+	multiPath string // TunMulti 的 path, 服务端 自动适配 multiMode
 
 	closed bool
 }
@@ -129,7 +130,9 @@ func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), f
 
 			p := rq.URL.Path
 
-			if p != s.path {
+			isMulti := p == s.multiPath
+
+			if p != s.path && !isMulti {
 				if ce := utils.CanLogWarn("grpc Server got wrong path"); ce != nil {
 					ce.Write(zap.String("path", p))
 				}
@@ -171,15 +174,18 @@ func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), f
 							zap.String("raddr", rq.RemoteAddr))
 					}
 
+					ra := httpLayer.GetRequestRemoteAddr(rq)
 					respConn := &netLayer.IOWrapper{
-						Reader:   rq.Body,
-						Writer:   rw,
-						Rejecter: httpLayer.RejectConn{ResponseWriter: rw},
+						EasyNetAddresser: netLayer.EasyNetAddresser{LA: underlay.LocalAddr(), RA: ra},
+						Reader:           rq.Body,
+						Writer:           rw,
+						Rejecter:         httpLayer.RejectConn{ResponseWriter: rw},
 					}
 
 					fm := httpLayer.FallbackMeta{
 						Path: p,
 						Conn: respConn,
+						XFF:  ra,
 					}
 
 					fm.IsH2 = true
@@ -212,7 +218,7 @@ func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), f
 				flusher.Flush()
 			}
 
-			sc := newServerConn(rw, rq)
+			sc := newServerConn(rw, rq, isMulti)
 			if s.closed {
 				return
 			}
@@ -224,10 +230,11 @@ func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), f
 
 }
 
-func newServerConn(rw http.ResponseWriter, rq *http.Request) (sc *ServerConn) {
+func newServerConn(rw http.ResponseWriter, rq *http.Request, multi bool) (sc *ServerConn) {
 	sc = &ServerConn{
 		commonPart: commonPart{
-			br: bufio.NewReader(rq.Body),
+			br:    bufio.NewReader(rq.Body),
+			multi: multi,
 		},
 
 		Writer: rw,
@@ -0,0 +1,249 @@
+package h2
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// implements advLayer.MuxClient
+type Client struct {
+	Creator
+
+	hosts   []string
+	urlHost string
+	path    string
+	method  string
+
+	requestHeader  http.Header
+	responseHeader map[string][]string
+
+	cachedTransport *http2.Transport //与 grpcSimple 一样, 一个 transport 对应 一个 dial好的 tls 连接
+}
+
+func NewClient(hosts []string, path, method string, headers *httpLayer.HeaderPreset) *Client {
+	c := &Client{
+		hosts:  hosts,
+		path:   path,
+		method: method,
+	}
+	if len(hosts) > 0 {
+		c.urlHost = hosts[0]
+	}
+	if headers != nil && headers.Request != nil && len(headers.Request.Headers) > 0 {
+		c.requestHeader = http.Header(headers.Request.Headers).Clone()
+	}
+	if headers != nil && headers.Response != nil && len(headers.Response.Headers) > 0 {
+		c.responseHeader = headers.Response.Headers
+	}
+	return c
+}
+
+func (c *Client) GetPath() string {
+	return c.path
+}
+
+func (c *Client) IsEarly() bool {
+	return false
+}
+
+// 随机选择 一个 host
+func (c *Client) getHost() string {
+	switch len(c.hosts) {
+	case 0:
+		return ""
+	case 1:
+		return c.hosts[0]
+	}
+	return c.hosts[rand.Intn(len(c.hosts))]
+}
+
+func (c *Client) dealErr(err error) {
+	if errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed") {
+		c.cachedTransport = nil
+	}
+}
+
+func (c *Client) GetCommonConn(underlay net.Conn) (any, error) {
+	if underlay == nil {
+		if c.cachedTransport != nil {
+			return c.cachedTransport, nil
+		} else {
+			return nil, errors.New("h2.GetCommonConn: underlay==nil and no cachedTranspot")
+		}
+	} else {
+		return underlay, nil
+	}
+}
+
+func (c *Client) DialSubConn(underlay any) (net.Conn, error) {
+	if underlay == nil {
+		return nil, utils.ErrNilParameter
+	}
+
+	var transport *http2.Transport
+
+	if t, ok := underlay.(*http2.Transport); ok && t != nil {
+		transport = t
+	} else {
+		transport = &http2.Transport{
+			DialTLS: func(_, _ string, cfg *tls.Config) (net.Conn, error) {
+				return underlay.(net.Conn), nil
+			},
+			AllowHTTP:          false,
+			DisableCompression: true,
+		}
+		c.cachedTransport = transport
+	}
+
+	reader, writer := io.Pipe()
+
+	//url 的 host 决定了 transport 所用的 连接, 所以 要 固定, 随机的 host 只放在 :authority 里,
+	// 否则 transport 会 以为 是 另一个 host 而 试图 再次 拨号
+	request := &http.Request{
+		Method: c.method,
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   c.urlHost,
+			Path:   c.path,
+		},
+		Host:       c.getHost(),
+		Proto:      "HTTP/2",
+		ProtoMajor: 2,
+		ProtoMinor: 0,
+		Header:     make(http.Header),
+		Body:       reader,
+	}
+	for k, vs := range c.requestHeader {
+		request.Header[k] = vs
+	}
+
+	conn := &ClientConn{
+		request:     request,
+		transport:   transport,
+		writer:      writer,
+		shouldClose: atomic.NewBool(false),
+		client:      c,
+	}
+	conn.InitEasyDeadline()
+
+	go conn.handshakeOnce.Do(conn.handshake) //与 grpcSimple 一样, handshake 不会立刻退出, 所以要用 goroutine
+
+	return conn, nil
+}
+
+// implements net.Conn
+type ClientConn struct {
+	netLayer.EasyDeadline
+
+	client *Client
+
+	response      *http.Response
+	request       *http.Request
+	transport     *http2.Transport
+	writer        *io.PipeWriter
+	handshakeOnce sync.Once
+	shouldClose   *atomic.Bool
+	err           error
+}
+
+func (c *ClientConn) handshake() {
+	response, err := c.transport.RoundTrip(c.request)
+	if err != nil {
+		c.err = err
+		c.writer.Close()
+		c.client.dealErr(err)
+		return
+	}
+
+	notOK := false
+
+	if c.shouldClose.Load() {
+		notOK = true
+
+	} else if response.StatusCode != http.StatusOK {
+		if ce := utils.CanLogWarn("h2 Client got wrong status"); ce != nil {
+			ce.Write(zap.String("status", response.Status))
+		}
+		c.err = utils.ErrInErr{ErrDesc: "h2 Client got wrong status", ErrDetail: utils.ErrInvalidData, Data: response.Status}
+		notOK = true
+
+	} else if len(c.client.responseHeader) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.client.responseHeader, response.Header); !ok {
+
+			if ce := utils.CanLogWarn("h2 Client configured custom header, but the server response doesn't have all of them"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", firstNotMatchKey))
+			}
+			c.err = utils.ErrInErr{ErrDesc: "h2 Client response header not match", ErrDetail: utils.ErrInvalidData, Data: firstNotMatchKey}
+			notOK = true
+		}
+	}
+
+	if notOK {
+		response.Body.Close()
+		c.writer.Close()
+	} else {
+		c.response = response
+	}
+}
+
+func (c *ClientConn) Read(b []byte) (n int, err error) {
+	c.handshakeOnce.Do(c.handshake)
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.response == nil {
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return c.response.Body.Read(b)
+	}
+}
+
+func (c *ClientConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		n, err = c.writer.Write(b)
+
+		if err == io.ErrClosedPipe && c.err != nil {
+			err = c.err
+		}
+		if err != nil {
+			c.client.dealErr(err)
+		}
+		return
+	}
+}
+
+func (c *ClientConn) Close() error {
+	c.shouldClose.Store(true)
+	if r := c.response; r != nil {
+		r.Body.Close()
+	}
+
+	return c.writer.Close()
+}
+
+func (c *ClientConn) LocalAddr() net.Addr  { return nil }
+func (c *ClientConn) RemoteAddr() net.Addr { return nil }
@@ -0,0 +1,92 @@
+/*
+Package h2 implements the "h2" (http) transport of v2ray/xray for advLayer.
+
+h2 就是 在 一个 path 上 的 双向流式 http2 请求: 客户端 发送 一个 PUT 请求, 请求的 body 为 上行数据,
+服务端 返回 200, 响应的 body 为 下行数据. 没有 任何 额外的 封包.
+
+与 grpcSimple 一样, 不引用 google 的 grpc 包, 直接用 golang.org/x/net/http2 实现, 也支持 回落到 h2c.
+
+可以用 extra.h2_hosts 给出 一个 host 列表, 客户端 每个 请求 会 随机 选择 一个 host, 服务端 只接受 host 在 列表 中 的 请求.
+客户端 没给出 h2_hosts 时 使用 host 项; 服务端 没给出 时 不检查 host.
+
+可以用 extra.h2_method 指定 请求方法, 默认为 PUT, 与 v2ray 一致.
+*/
+package h2
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const DefaultMethod = http.MethodPut
+
+func init() {
+	advLayer.ProtocolsMap["h2"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) PackageID() string {
+	return "h2"
+}
+
+func (Creator) ProtocolName() string {
+	return "h2"
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return "h2", true
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+func (Creator) IsMux() bool {
+	return true
+}
+
+func getHostsFromConf(conf *advLayer.Conf) (hosts []string) {
+	if conf.Extra != nil {
+		hosts, _ = utils.AnyToStringArray(conf.Extra["h2_hosts"])
+	}
+	return
+}
+
+func getMethodFromConf(conf *advLayer.Conf) string {
+	if conf.Extra != nil {
+		if m, ok := conf.Extra["h2_method"].(string); ok && m != "" {
+			return strings.ToUpper(m)
+		}
+	}
+	return DefaultMethod
+}
+
+func getPathFromConf(conf *advLayer.Conf) string {
+	if conf.Path == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(conf.Path, "/") {
+		return "/" + conf.Path
+	}
+	return conf.Path
+}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	hosts := getHostsFromConf(conf)
+	if len(hosts) == 0 && conf.Host != "" {
+		hosts = []string{conf.Host}
+	}
+	return NewClient(hosts, getPathFromConf(conf), getMethodFromConf(conf), conf.Headers), nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(getHostsFromConf(conf), getPathFromConf(conf), conf.Headers), nil
+}
@@ -0,0 +1,114 @@
+package h2
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+)
+
+func TestH2(t *testing.T) {
+	headers := &httpLayer.HeaderPreset{
+		Request: &httpLayer.RequestHeader{
+			Headers: map[string][]string{"X-Test": {"verysimple"}},
+		},
+	}
+
+	cli, err := Creator{}.NewClientFromConf(&advLayer.Conf{
+		Path:    "/h2path",
+		Headers: headers,
+		Extra:   map[string]any{"h2_hosts": []any{"a.com", "b.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := cli.(*Client)
+
+	server := NewServer([]string{"a.com", "b.com"}, "/h2path", headers)
+	defer server.Stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fallbackPaths := make(chan string, 3)
+
+	go func() {
+		lc, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server.StartHandle(lc, func(sc net.Conn) {
+			io.Copy(sc, sc)
+		}, func(fm httpLayer.FallbackMeta) {
+			fallbackPaths <- fm.H2Request.Host + fm.Path
+			fm.H2RW.WriteHeader(http.StatusNotFound)
+		})
+	}()
+
+	rc, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	for i := 0; i < 3; i++ {
+		var underlay any = rc
+		if i > 0 {
+			underlay = client.cachedTransport
+		}
+		cc, err := client.DialSubConn(underlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc.SetDeadline(time.Now().Add(time.Second * 5))
+
+		msg := bytes.Repeat([]byte{byte(i)}, 10000)
+		if _, err := cc.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(cc, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatal("not equal", i)
+		}
+		cc.Close()
+	}
+
+	wrongHostClient := NewClient([]string{"c.com"}, "/h2path", DefaultMethod, headers)
+	wrongHostClient.urlHost = client.urlHost //使用 同一个 transport 中的 连接
+
+	// path, host 或 header 不对 时 回落
+	for _, c := range []*Client{
+		NewClient([]string{"a.com"}, "/other", DefaultMethod, headers),
+		wrongHostClient,
+		NewClient([]string{"a.com"}, "/h2path", DefaultMethod, nil),
+	} {
+		wc, _ := c.DialSubConn(client.cachedTransport)
+		wc.Write([]byte("a"))
+		if _, err := wc.Read(make([]byte, 1)); err == nil {
+			t.Fatal("should fail")
+		}
+		wc.Close()
+	}
+
+	for _, expected := range []string{"a.com/other", "c.com/h2path", "a.com/h2path"} {
+		select {
+		case p := <-fallbackPaths:
+			if p != expected {
+				t.Fatal("wrong fallback", p, expected)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("no fallback")
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package h2
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// implements advLayer.MuxServer
+type Server struct {
+	Creator
+	http2.Server
+	netLayer.ConnList
+
+	Headers *httpLayer.HeaderPreset
+
+	hosts []string
+	path  string
+
+	closed bool
+}
+
+func NewServer(hosts []string, path string, headers *httpLayer.HeaderPreset) *Server {
+	return &Server{
+		hosts:   hosts,
+		path:    path,
+		Headers: headers,
+	}
+}
+
+func (s *Server) GetPath() string {
+	return s.path
+}
+
+func (s *Server) Stop() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	s.CloseDeleteAll()
+}
+
+// 没有配置 hosts 时 不检查
+func (s *Server) hostAllowed(host string) bool {
+	if len(s.hosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range s.hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+var clientPreface = []byte(http2.ClientPreface)
+
+// 阻塞. 与 grpcSimple 一样, 先过滤 h2c 的 preface, 不是 h2c 的 话 试图 回落到 h1.
+func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	s.closed = false
+
+	oldUnderlay := underlay
+
+	s.Insert(oldUnderlay)
+
+	bs := utils.GetPacket()
+	netLayer.SetCommonReadTimeout(underlay)
+
+	n, err := underlay.Read(bs)
+	if err != nil {
+		if ce := utils.CanLogDebug("h2 try read preface failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return
+	}
+
+	netLayer.PersistConn(underlay)
+
+	firstBuf := bytes.NewBuffer(bs[:n])
+
+	if n < len(clientPreface) || !bytes.Equal(bs[:len(clientPreface)], clientPreface) {
+		if ce := utils.CanLogInfo("h2 got not h2c request"); ce != nil {
+			ce.Write()
+		}
+
+		if fallbackFunc != nil {
+			_, method, path, _, failreason := httpLayer.ParseH1Request(bs, false)
+			fm := httpLayer.FallbackMeta{
+				Conn:         underlay,
+				H1RequestBuf: firstBuf,
+			}
+			if failreason == 0 {
+				fm.Path = path
+				fm.Method = method
+			}
+			go fallbackFunc(fm)
+
+		} else {
+			underlay.Write([]byte(httpLayer.Err403response))
+			underlay.Close()
+		}
+		return
+	}
+
+	underlay = &netLayer.ReadWrapper{
+		Conn:              underlay,
+		OptionalReader:    io.MultiReader(firstBuf, underlay),
+		RemainFirstBufLen: n,
+	}
+
+	s.Server.ServeConn(underlay, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			if s.closed {
+				return
+			}
+
+			p := rq.URL.Path
+
+			shouldFallback := false
+
+			if p != s.path {
+				if ce := utils.CanLogWarn("h2 Server got wrong path"); ce != nil {
+					ce.Write(zap.String("path", p))
+				}
+				shouldFallback = true
+
+			} else if !s.hostAllowed(rq.Host) {
+				if ce := utils.CanLogWarn("h2 Server got right path but with wrong host"); ce != nil {
+					ce.Write(zap.String("host", rq.Host))
+				}
+				shouldFallback = true
+
+			} else if s.Headers != nil && s.Headers.Request != nil && len(s.Headers.Request.Headers) > 0 {
+
+				if ok, fnmk := httpLayer.AllHeadersIn(s.Headers.Request.Headers, rq.Header); !ok {
+
+					if ce := utils.CanLogWarn("h2 Server has custom header configured, but the client request have notMatched Header(s)"); ce != nil {
+						ce.Write(zap.String("firstNotMatchKey", fnmk))
+					}
+					shouldFallback = true
+				}
+			}
+
+			if shouldFallback {
+				if fallbackFunc == nil {
+					rw.WriteHeader(http.StatusNotFound)
+
+				} else {
+					if ce := utils.CanLogInfo("h2 will fallback"); ce != nil {
+						ce.Write(
+							zap.String("path", p),
+							zap.String("method", rq.Method),
+							zap.String("raddr", rq.RemoteAddr))
+					}
+
+					if s.closed {
+						return
+					}
+
+					ra := httpLayer.GetRequestRemoteAddr(rq)
+					fallbackFunc(httpLayer.FallbackMeta{
+						Path: p,
+						Conn: &netLayer.IOWrapper{
+							EasyNetAddresser: netLayer.EasyNetAddresser{LA: underlay.LocalAddr(), RA: ra},
+							Reader:           rq.Body,
+							Writer:           rw,
+							Rejecter:         httpLayer.RejectConn{ResponseWriter: rw},
+						},
+						IsH2:      true,
+						H2Request: rq,
+						H2RW:      rw,
+						XFF:       ra,
+					})
+				}
+				return
+			}
+
+			headerMap := rw.Header()
+			headerMap.Set("Cache-Control", "no-store")
+
+			if s.Headers != nil && s.Headers.Response != nil && len(s.Headers.Response.Headers) > 0 {
+				for k, vs := range httpLayer.TrimHeaders(s.Headers.Response.Headers) {
+					if len(vs) > 0 {
+						headerMap.Add(k, vs[0])
+					}
+				}
+			}
+			rw.WriteHeader(http.StatusOK)
+			if flusher, ok := rw.(http.Flusher); ok {
+				flusher.Flush()
+			}
+
+			sc := newServerConn(rw, rq)
+			if s.closed {
+				return
+			}
+			newSubConnFunc(sc)
+		}),
+	})
+
+	s.CloseDelete(oldUnderlay)
+}
+
+// implements net.Conn
+type ServerConn struct {
+	netLayer.EasyDeadline
+
+	io.ReadCloser
+	Writer http.ResponseWriter
+
+	closeOnce sync.Once
+	closed    bool
+
+	ra net.Addr
+}
+
+func newServerConn(rw http.ResponseWriter, rq *http.Request) *ServerConn {
+	sc := &ServerConn{
+		ReadCloser: rq.Body,
+		Writer:     rw,
+	}
+	sc.InitEasyDeadline()
+
+	sc.ra = httpLayer.GetRequestRemoteAddr(rq)
+	return sc
+}
+
+func (sc *ServerConn) Read(b []byte) (n int, err error) {
+	select {
+	case <-sc.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return sc.ReadCloser.Read(b)
+	}
+}
+
+func (sc *ServerConn) Write(b []byte) (n int, err error) {
+	//与 grpcSimple 一样, 要判断 closed, 否则 可能 在 handler 结束后 Write 或 Flush 而 panic
+	if sc.closed {
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case <-sc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		n, err = sc.Writer.Write(b)
+
+		if err == nil && !sc.closed {
+			sc.Writer.(http.Flusher).Flush() //necessary
+		}
+		return
+	}
+}
+
+func (sc *ServerConn) Close() error {
+	sc.closeOnce.Do(func() {
+		sc.closed = true
+		sc.ReadCloser.Close()
+	})
+	return nil
+}
+
+func (sc *ServerConn) LocalAddr() net.Addr  { return nil }
+func (sc *ServerConn) RemoteAddr() net.Addr { return sc.ra }
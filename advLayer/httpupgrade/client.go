@@ -0,0 +1,164 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// implements advLayer.SingleClient
+type Client struct {
+	Creator
+	host         string
+	path         string
+	UseEarlyData bool
+
+	requestHeaders http.Header
+}
+
+// 这里默认，传入的path必须 以 "/" 为前缀. 若path为空，本函数 将自动使用 "/"
+func NewClient(hostAddr, path string, headers *httpLayer.HeaderPreset, isEarly bool) *Client {
+	if path == "" {
+		path = "/"
+	}
+	c := &Client{
+		host:         hostAddr,
+		path:         path,
+		UseEarlyData: isEarly,
+	}
+
+	if headers != nil && headers.Request != nil && len(headers.Request.Headers) > 0 {
+		c.requestHeaders = make(http.Header)
+		for k, vs := range headers.Request.Headers {
+			if isReservedHeader(k) {
+				continue
+			}
+			for _, v := range vs {
+				c.requestHeaders.Add(k, v)
+			}
+		}
+	}
+	return c
+}
+
+func (c *Client) GetPath() string {
+	return c.path
+}
+
+func (c *Client) IsEarly() bool {
+	return c.UseEarlyData
+}
+
+func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, error) {
+	if c.IsEarly() && firstPayloadLen > 0 && firstPayloadLen <= MaxEarlyDataLen {
+		// 与 ws 一样, 先返回一个 Conn, 等 第一次Write 时 再与 数据 一起 握手
+		return &EarlyDataConn{
+			Conn:                 underlay,
+			client:               c,
+			firstHandshakeOkChan: make(chan struct{}),
+		}, nil
+	}
+
+	return c.handshake(underlay, nil)
+}
+
+func (c *Client) handshake(underlay net.Conn, earlyData []byte) (net.Conn, error) {
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	buf.WriteString("GET ")
+	buf.WriteString(c.path)
+	buf.WriteString(" HTTP/1.1\r\nHost: ")
+	buf.WriteString(c.host)
+	buf.WriteString("\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n")
+
+	if len(earlyData) > 0 {
+		buf.WriteString(earlyDataHeaderStr)
+		buf.WriteString(": ")
+		buf.WriteString(base64.RawURLEncoding.EncodeToString(earlyData))
+		buf.WriteString("\r\n")
+	}
+	if c.requestHeaders != nil {
+		c.requestHeaders.Write(buf)
+	}
+	buf.WriteString("\r\n")
+
+	_, err := underlay.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(underlay)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade read response", ErrDetail: err}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || !headerContainsToken(resp.Header, "Connection", "upgrade") {
+		return nil, utils.ErrInErr{ErrDesc: "httpupgrade got wrong response", ErrDetail: utils.ErrInvalidData, Data: resp.Status}
+	}
+
+	//服务端 可能 在 响应 后 紧接着 就发来了 数据
+	if n := br.Buffered(); n > 0 {
+		bs, _ := br.Peek(n)
+		return &netLayer.ReadWrapper{
+			Conn:              underlay,
+			OptionalReader:    bytes.NewReader(bs),
+			RemainFirstBufLen: n,
+		}, nil
+	}
+
+	return underlay, nil
+}
+
+type EarlyDataConn struct {
+	net.Conn
+	client *Client
+
+	realConn net.Conn
+
+	firstWriteOnce       sync.Once
+	firstHandshakeOkChan chan struct{}
+	handshakeErr         error
+}
+
+// 第一次Write 的 数据 会作为 earlydata 与 握手 一起 发送
+func (edc *EarlyDataConn) Write(p []byte) (int, error) {
+	isFirst := false
+	edc.firstWriteOnce.Do(func() {
+		isFirst = true
+
+		edc.realConn, edc.handshakeErr = edc.client.handshake(edc.Conn, p)
+		close(edc.firstHandshakeOkChan)
+	})
+
+	if isFirst {
+		if edc.handshakeErr != nil {
+			return 0, edc.handshakeErr
+		}
+		return len(p), nil
+	}
+
+	if edc.realConn == nil {
+		return 0, errors.New("httpupgrade EarlyDataConn write after handshake failed")
+	}
+
+	return edc.realConn.Write(p)
+}
+
+func (edc *EarlyDataConn) Read(p []byte) (int, error) {
+	<-edc.firstHandshakeOkChan
+	if edc.handshakeErr != nil {
+		return 0, edc.handshakeErr
+	}
+	return edc.realConn.Read(p)
+}
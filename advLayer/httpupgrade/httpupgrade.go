@@ -0,0 +1,90 @@
+/*
+Package httpupgrade implements httpupgrade for advLayer.
+
+httpupgrade 就是 一个 普通的 http1.1 Upgrade 握手, 握手完成后 直接 传输 原始数据, 没有 websocket 的 帧结构,
+
+这样 可以 减少 ws 的 封包开销, 同时 对 cdn 来说 看起来 仍然 是一个 websocket 连接。与 xray 的 httpupgrade 兼容.
+
+Request
+
+	GET /path HTTP/1.1
+	Host: server.example.com
+	Connection: Upgrade
+	Upgrade: websocket
+
+Response
+
+	HTTP/1.1 101 Switching Protocols
+	Connection: Upgrade
+	Upgrade: websocket
+
+early data 与 ws 一样, 用 Sec-WebSocket-Protocol 字段 传输 base64 编码的 数据.
+
+path 不符合 或 不是 Upgrade 请求 时, 会 回落.
+*/
+package httpupgrade
+
+import (
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+)
+
+// 与 ws 一样, 2048 字节 base64 后 为 2732
+const MaxEarlyDataLen_Base64 = 2732
+const MaxEarlyDataLen = 2048
+
+const (
+	upgradeResponseStr = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"
+
+	earlyDataHeaderStr = "Sec-WebSocket-Protocol"
+)
+
+func init() {
+	advLayer.ProtocolsMap["httpupgrade"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	hn := conf.Host
+	if conf.Addr.Network == "unix" {
+		hn = ""
+	}
+	return NewClient(hn, conf.Path, conf.Headers, conf.IsEarly), nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(conf.Path, conf.Headers, conf.IsEarly), nil
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return
+}
+
+func (Creator) PackageID() string {
+	return "httpupgrade"
+}
+
+func (Creator) ProtocolName() string {
+	return "httpupgrade"
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsMux() bool {
+	return false
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+// 这些 header 由 httpupgrade 自己 处理, 自定义header 中 的 同名项 会被 忽略
+func isReservedHeader(k string) bool {
+	switch k {
+	case "Host", "Connection", "Upgrade", earlyDataHeaderStr:
+		return true
+	}
+	return false
+}
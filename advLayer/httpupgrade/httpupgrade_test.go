@@ -0,0 +1,94 @@
+package httpupgrade_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer/httpupgrade"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+func testHttpUpgrade(t *testing.T, early bool) {
+	listenAddr := netLayer.GetRandLocalAddr(true, false)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	thePath := "/thepath"
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s := httpupgrade.NewServer(thePath, nil, early)
+
+		c, err := s.Handshake(conn)
+		if err != nil {
+			t.Log(err)
+			conn.Close()
+			return
+		}
+		io.Copy(c, c)
+	}()
+
+	cli := httpupgrade.NewClient(listenAddr, thePath, nil, early)
+
+	tcpConn, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	first := []byte("hello")
+	c, err := cli.Handshake(tcpConn, len(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range [][]byte{first, bytes.Repeat([]byte("a"), 10240)} {
+		if _, err = c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		bs := make([]byte, len(msg))
+		if _, err = io.ReadFull(c, bs); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, msg) {
+			t.Fatal("not equal")
+		}
+	}
+}
+
+func TestHttpUpgrade(t *testing.T) {
+	testHttpUpgrade(t, false)
+}
+
+func TestHttpUpgradeEarlyData(t *testing.T) {
+	testHttpUpgrade(t, true)
+}
+
+func TestHttpUpgradeFallback(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c1.Write([]byte("GET /other HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+
+	s := httpupgrade.NewServer("/thepath", nil, false)
+	result, err := s.Handshake(c2)
+	if !errors.Is(err, httpLayer.ErrShouldFallback) {
+		t.Fatal("should fallback", err)
+	}
+	if fm := result.(httpLayer.FallbackMeta); fm.Path != "/other" {
+		t.Fatal("wrong fallback path", fm.Path)
+	}
+}
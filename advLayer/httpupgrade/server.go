@@ -0,0 +1,194 @@
+package httpupgrade
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// implements advLayer.SingleServer
+type Server struct {
+	Creator
+	UseEarlyData   bool
+	Thepath        string
+	RequestHeaders map[string][]string
+
+	responseHeaders http.Header
+}
+
+// 这里默认: 传入的path必须 以 "/" 为前缀. 若path为空，本函数 将自动使用 "/"
+func NewServer(path string, headers *httpLayer.HeaderPreset, UseEarlyData bool) *Server {
+	if path == "" {
+		path = "/"
+	}
+	s := &Server{
+		Thepath:      path,
+		UseEarlyData: UseEarlyData,
+	}
+
+	if headers != nil && headers.Request != nil && len(headers.Request.Headers) > 0 {
+		s.RequestHeaders = make(map[string][]string)
+		for k, vs := range headers.Request.Headers {
+			if isReservedHeader(k) {
+				continue
+			}
+			s.RequestHeaders[k] = vs
+		}
+	}
+
+	if headers != nil && headers.Response != nil && len(headers.Response.Headers) > 0 {
+		s.responseHeaders = make(http.Header)
+		for k, vs := range httpLayer.TrimHeaders(headers.Response.Headers) {
+			if isReservedHeader(k) || len(vs) == 0 {
+				continue
+			}
+			s.responseHeaders.Add(k, vs[0])
+		}
+	}
+	return s
+}
+
+func (s *Server) GetPath() string {
+	return s.Thepath
+}
+
+func (*Server) Stop() {}
+
+// Handshake 读取 http1.1 的 Upgrade 请求 并 返回 101 响应, 之后 返回的 net.Conn 直接 读写 原始数据.
+//
+// 如果遇到不符合的http1.1请求，会返回 httpLayer.FallbackMeta 和 httpLayer.ErrShouldFallback
+func (s *Server) Handshake(underlay net.Conn) (net.Conn, error) {
+
+	var rp httpLayer.H1RequestParser
+	re := rp.ReadAndParse_2(underlay)
+	if re != nil {
+		if errors.Is(re, httpLayer.ErrNotHTTP_Request) {
+			return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade check parse http", ErrDetail: re, ExtraIs: []error{httpLayer.ErrNotHTTP_Request}, Data: rp.Failreason}
+		}
+		return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade check handshake read", ErrDetail: re}
+	}
+
+	optionalFirstBuffer := rp.WholeRequestBuf
+
+	requestHeader := make(http.Header, len(rp.Headers))
+	for _, rh := range rp.Headers {
+		requestHeader.Add(string(rh.Head), string(bytes.TrimSpace(rh.Value)))
+	}
+
+	var realAddr net.Addr
+	if xffs := requestHeader.Get(httpLayer.XForwardStr); xffs != "" {
+		ta, e := net.ResolveIPAddr("ip", strings.TrimSpace(strings.SplitN(xffs, ",", 2)[0]))
+		if e == nil {
+			realAddr = ta
+		} else {
+			if ce := utils.CanLogWarn("Failed in httpupgrade parse X-Forwarded-For"); ce != nil {
+				ce.Write(zap.Error(e), zap.String(httpLayer.XForwardStr, xffs))
+			}
+		}
+	}
+
+	notReason := ""
+
+	if rp.Method != "GET" || s.Thepath != rp.Path {
+		notReason = `rp.Method != "GET" || s.Thepath != rp.Path`
+
+	} else if !headerContainsToken(requestHeader, "Connection", "upgrade") || !strings.EqualFold(requestHeader.Get("Upgrade"), "websocket") {
+		notReason = "not upgrade request"
+
+	} else if len(s.RequestHeaders) > 0 {
+		if ok, fnmk := httpLayer.AllHeadersIn(s.RequestHeaders, requestHeader); !ok {
+			notReason = "custom header not match: " + fnmk
+		}
+	}
+
+	if notReason != "" {
+		return httpLayer.FallbackMeta{
+			Conn:         underlay,
+			H1RequestBuf: optionalFirstBuffer,
+			Path:         rp.Path,
+			Method:       rp.Method,
+			Reason:       notReason,
+			XFF:          realAddr,
+		}, httpLayer.ErrShouldFallback
+	}
+
+	var earlyData []byte
+	if s.UseEarlyData {
+		if ed := requestHeader.Get(earlyDataHeaderStr); ed != "" && len(ed) <= MaxEarlyDataLen_Base64 {
+			bs, err := base64.RawURLEncoding.DecodeString(ed)
+			if err != nil {
+				return nil, utils.ErrInErr{ErrDesc: "httpupgrade failed to decode early data", ErrDetail: err}
+			}
+			earlyData = bs
+		}
+	}
+
+	//请求头 之后 可能 还跟着 数据
+	var remainData []byte
+	if wholeBs := optionalFirstBuffer.Bytes(); len(wholeBs) > 0 {
+		if idx := bytes.Index(wholeBs, []byte("\r\n\r\n")); idx >= 0 {
+			remainData = wholeBs[idx+4:]
+		}
+	}
+
+	buf := utils.GetBuf()
+	buf.WriteString(upgradeResponseStr)
+	if s.responseHeaders != nil {
+		s.responseHeaders.Write(buf)
+	}
+	buf.WriteString("\r\n")
+	_, err := underlay.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	firstData := append(earlyData, remainData...)
+
+	if len(firstData) == 0 && realAddr == nil {
+		return underlay, nil
+	}
+
+	return &Conn{
+		ReadWrapper: netLayer.ReadWrapper{
+			Conn:              underlay,
+			OptionalReader:    bytes.NewReader(firstData),
+			RemainFirstBufLen: len(firstData),
+		},
+		realRaddr: realAddr,
+	}, nil
+}
+
+// 带有 首包数据 和 X-Forwarded-For 地址 的 Conn
+type Conn struct {
+	netLayer.ReadWrapper
+
+	realRaddr net.Addr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.realRaddr != nil {
+		return c.realRaddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// 判断 header 中 以逗号分隔的 值 是否 含有 token, 忽略大小写
+func headerContainsToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
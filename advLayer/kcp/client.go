@@ -0,0 +1,114 @@
+package kcp
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/xtaci/smux"
+)
+
+// implements advLayer.MuxClient
+type Client struct {
+	Creator
+
+	serverAddrStr string
+	config        Config
+
+	mutex   sync.Mutex
+	session *smux.Session
+}
+
+func NewClient(addr string, config Config) *Client {
+	return &Client{
+		serverAddrStr: addr,
+		config:        config,
+	}
+}
+
+func (c *Client) IsEarly() bool {
+	return false
+}
+
+func (c *Client) GetPath() string {
+	return ""
+}
+
+// 获取 已拨号的 smux.Session / 重新拨号。返回 可作 c.DialSubConn 参数 的值.
+func (c *Client) GetCommonConn(_ net.Conn) (any, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.session != nil && !c.session.IsClosed() {
+		return c.session, nil
+	}
+
+	conn, err := Dial(c.serverAddrStr, &c.config)
+	if err != nil {
+		return nil, err
+	}
+	session, err := smux.Client(conn, smux.DefaultConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.session = session
+	return session, nil
+}
+
+func (c *Client) DialSubConn(thing any) (net.Conn, error) {
+	session, ok := thing.(*smux.Session)
+	if !ok || session == nil {
+		return nil, utils.ErrNilOrWrongParameter
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// 拨号 一条 kcp 连接. kcp 没有 握手, 直接 返回.
+func Dial(addr string, config *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper := config.newPacketWrapper()
+
+	conn := newConn(uint16(rand.Uint32()), udpConn.LocalAddr(), raddr, config, wrapper, func(b []byte) error {
+		_, err := udpConn.Write(b)
+		return err
+	}, func() {
+		udpConn.Close()
+	})
+
+	go func() {
+		buf := utils.GetPacket()
+		defer utils.PutPacket(buf)
+
+		//wrapper 的 伪装头 有状态, 解包 时 另用 一个
+		unwrapper := config.newPacketWrapper()
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				conn.mutex.Lock()
+				conn.terminate(conn.elapsed())
+				conn.mutex.Unlock()
+				return
+			}
+			if segs := unwrapper.unwrap(buf[:n]); len(segs) > 0 {
+				conn.input(segs)
+			}
+		}
+	}()
+
+	return conn, nil
+}
@@ -0,0 +1,613 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+type connState int32
+
+const (
+	stateActive       connState = iota
+	stateReadyToClose           //本地 已 Close, 等待 已写入的 数据 发送完毕
+	statePeerClosed             //对端 已 发来 terminate, 已读完的 数据 读完后 就 EOF
+	stateTerminating            //向 对端 发送 terminate
+	stateTerminated
+)
+
+const (
+	pingInterval           = 3000  //ms
+	idleTimeout            = 30000 //ms, 这么久 没有 收到 任何 数据 就 认为 对端 已断开
+	readyToCloseTimeout    = 15000
+	terminatingTimeout     = 8000
+	initialRTO             = 100
+	maxRTO                 = 10000
+	initialRemoteNextLimit = 32
+)
+
+type ackEntry struct {
+	number    uint32
+	timestamp uint32
+	nextFlush uint32
+}
+
+// Conn 是 一条 mKCP 连接, 实现 net.Conn.
+//
+// 发送方 把 数据 切成 不大于 mss 的 分段, 在 窗口 允许时 发出, 超时 或 被跳过 时 重传;
+// 接收方 收到 数据分段 后 反复 发送 ack, 直到 发送方 的 sendingNext 越过 该分段 为止.
+// 每个 tti 由 run 调用 一次 flush, 收到 数据 时 也会 立即 flush.
+type Conn struct {
+	netLayer.EasyDeadline
+
+	conv         uint16
+	laddr, raddr net.Addr
+	config       *Config
+	mss          uint32
+
+	wrapper     *packetWrapper
+	writePacket func([]byte) error
+	onClose     func()
+
+	mutex      sync.Mutex
+	state      connState
+	stateBegin uint32
+	start      time.Time
+
+	lastIncoming uint32
+	lastPing     uint32
+
+	//round trip, 与 v2ray 的 RoundTripInfo 相同
+
+	srtt, rttVariation, rto, minRtt uint32
+	rtoUpdated                      uint32
+
+	//sending
+
+	sendNext      uint32 //下一个 新分段 的 序号
+	remoteNext    uint32 //对端 接收窗口 的 上限 (不含)
+	inflight      []*dataSegment
+	sendQueue     [][]byte
+	sendBufSize   uint32
+	controlWindow uint32
+
+	//receiving
+
+	rcvNext    uint32
+	rcvWnd     uint32
+	rcvWindow  map[uint32][]byte
+	rcvCurrent []byte
+	acks       []ackEntry
+	ackDirty   bool
+
+	dataInput  chan struct{}
+	dataOutput chan struct{}
+	wakeup     chan struct{}
+	closeChan  chan struct{}
+}
+
+func newConn(conv uint16, laddr, raddr net.Addr, config *Config, wrapper *packetWrapper, writePacket func([]byte) error, onClose func()) *Conn {
+	c := &Conn{
+		conv:          conv,
+		laddr:         laddr,
+		raddr:         raddr,
+		config:        config,
+		mss:           config.MTU - uint32(wrapper.overhead()) - dataSegmentOverhead,
+		wrapper:       wrapper,
+		writePacket:   writePacket,
+		onClose:       onClose,
+		start:         time.Now(),
+		rto:           initialRTO,
+		minRtt:        config.TTI,
+		remoteNext:    initialRemoteNextLimit,
+		sendBufSize:   config.sendingBufferSize(),
+		controlWindow: config.sendingInFlightSize(),
+		rcvWnd:        config.receivingInFlightSize(),
+		rcvWindow:     make(map[uint32][]byte),
+		dataInput:     make(chan struct{}, 1),
+		dataOutput:    make(chan struct{}, 1),
+		wakeup:        make(chan struct{}, 1),
+		closeChan:     make(chan struct{}),
+	}
+	if rb := config.ReadBufferMB * 1024 * 1024 / config.MTU; rb < c.rcvWnd {
+		c.rcvWnd = rb
+	}
+	c.InitEasyDeadline()
+	go c.run()
+	return c
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// 距离 连接建立 的 毫秒数. 分段 中的 时间戳 都是 这个值, 对端 只会 原样 返回
+func (c *Conn) elapsed() uint32 {
+	return uint32(time.Since(c.start) / time.Millisecond)
+}
+
+func (c *Conn) setState(s connState, current uint32) {
+	c.state = s
+	c.stateBegin = current
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.laddr }
+func (c *Conn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		if len(c.rcvCurrent) == 0 {
+			if bs, ok := c.rcvWindow[c.rcvNext]; ok {
+				delete(c.rcvWindow, c.rcvNext)
+				c.rcvNext++
+				c.rcvCurrent = bs
+				c.ackDirty = true //窗口 变大了, 要 通知 对端
+			}
+		}
+		if len(c.rcvCurrent) > 0 {
+			n := copy(p, c.rcvCurrent)
+			c.rcvCurrent = c.rcvCurrent[n:]
+			c.mutex.Unlock()
+			return n, nil
+		}
+		state := c.state
+		c.mutex.Unlock()
+
+		if state != stateActive {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-c.dataInput:
+		case <-c.closeChan:
+		case <-c.ReadTimeoutChan():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	for {
+		c.mutex.Lock()
+		if c.state != stateActive {
+			c.mutex.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		for len(p) > 0 {
+			//尽量 填满 还没有 发出的 最后一个 分段
+			if ql := len(c.sendQueue); ql > 0 && uint32(len(c.sendQueue[ql-1])) < c.mss {
+				last := c.sendQueue[ql-1]
+				size := int(c.mss) - len(last)
+				if size > len(p) {
+					size = len(p)
+				}
+				c.sendQueue[ql-1] = append(last, p[:size]...)
+				p = p[size:]
+				n += size
+				continue
+			}
+			if uint32(len(c.sendQueue)+len(c.inflight)) >= c.sendBufSize {
+				break
+			}
+			size := int(c.mss)
+			if size > len(p) {
+				size = len(p)
+			}
+			bs := make([]byte, size, c.mss)
+			copy(bs, p)
+			c.sendQueue = append(c.sendQueue, bs)
+			p = p[size:]
+			n += size
+		}
+		c.mutex.Unlock()
+
+		signal(c.wakeup)
+
+		if len(p) == 0 {
+			return
+		}
+
+		select {
+		case <-c.dataOutput:
+		case <-c.closeChan:
+		case <-c.WriteTimeoutChan():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// 不会 立即 断开, 而是 等 已写入的 数据 发送完毕 后 再 通知 对端
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	current := c.elapsed()
+	switch c.state {
+	case stateActive:
+		c.setState(stateReadyToClose, current)
+	case statePeerClosed:
+		c.setState(stateTerminating, current)
+	}
+	c.mutex.Unlock()
+
+	signal(c.wakeup)
+	signal(c.dataInput)
+	signal(c.dataOutput)
+	return nil
+}
+
+// 立即 终止 连接. 须在 持有 mutex 时 调用
+func (c *Conn) terminate(current uint32) {
+	if c.state == stateTerminated {
+		return
+	}
+	c.setState(stateTerminated, current)
+	c.sendQueue = nil
+	c.inflight = nil
+	close(c.closeChan)
+	if c.onClose != nil {
+		go c.onClose()
+	}
+}
+
+// 处理 从 对端 收到的 分段
+func (c *Conn) input(segs []segment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == stateTerminated {
+		return
+	}
+
+	current := c.elapsed()
+	c.lastIncoming = current
+
+	for _, seg := range segs {
+		if seg.conversation() != c.conv {
+			break
+		}
+		switch s := seg.(type) {
+		case *dataSegment:
+			c.processData(s)
+			signal(c.dataInput)
+
+		case *ackSegment:
+			c.processAck(current, s)
+			signal(c.dataOutput)
+
+		case *cmdOnlySegment:
+			if s.cmd == cmdTerminate {
+				switch c.state {
+				case stateActive:
+					c.setState(statePeerClosed, current)
+					c.sendQueue = nil
+					c.inflight = nil
+				case stateReadyToClose:
+					c.setState(stateTerminating, current)
+				case stateTerminating:
+					c.terminate(current)
+					return
+				}
+				signal(c.dataInput)
+				signal(c.dataOutput)
+			}
+			c.processReceivingNext(s.receivingNext)
+			c.processSendingNext(s.sendingNext)
+			c.updatePeerRTO(s.peerRTO, current)
+		}
+	}
+	signal(c.wakeup)
+}
+
+func (c *Conn) processData(s *dataSegment) {
+	idx := s.number - c.rcvNext
+	if idx >= c.rcvWnd {
+		if int32(idx) < 0 {
+			//重复的 旧分段, 说明 对端 没收到 ack, 尽快 告诉 对端 我们的 rcvNext
+			c.ackDirty = true
+		}
+		return
+	}
+	c.processSendingNext(s.sendingNext)
+
+	for i := range c.acks {
+		if c.acks[i].number == s.number {
+			c.acks[i].timestamp = s.timestamp
+			c.acks[i].nextFlush = 0
+			goto store
+		}
+	}
+	c.acks = append(c.acks, ackEntry{number: s.number, timestamp: s.timestamp})
+
+store:
+	if _, has := c.rcvWindow[s.number]; !has && c.state != stateReadyToClose {
+		c.rcvWindow[s.number] = append([]byte(nil), s.payload...)
+	}
+}
+
+// 对端 的 sendingNext 之前的 分段 都已 确认 收到 了 我们的 ack, 不必 再发
+func (c *Conn) processSendingNext(sendingNext uint32) {
+	acks := c.acks[:0]
+	for _, a := range c.acks {
+		if int32(a.number-sendingNext) >= 0 {
+			acks = append(acks, a)
+		}
+	}
+	c.acks = acks
+}
+
+// 对端 已 按序 收到了 receivingNext 之前的 所有 分段
+func (c *Conn) processReceivingNext(receivingNext uint32) {
+	i := 0
+	for ; i < len(c.inflight); i++ {
+		if int32(c.inflight[i].number-receivingNext) >= 0 {
+			break
+		}
+	}
+	if i > 0 {
+		c.inflight = c.inflight[i:]
+	}
+}
+
+func (c *Conn) sendUna() uint32 {
+	if len(c.inflight) > 0 {
+		return c.inflight[0].number
+	}
+	return c.sendNext
+}
+
+func (c *Conn) processAck(current uint32, s *ackSegment) {
+	if int32(s.receivingWindow-c.remoteNext) > 0 {
+		c.remoteNext = s.receivingWindow
+	}
+	c.processReceivingNext(s.receivingNext)
+
+	var maxack uint32
+	var maxackRemoved bool
+	for _, number := range s.numbers {
+		removed := false
+		for i, seg := range c.inflight {
+			if seg.number == number {
+				c.inflight = append(c.inflight[:i], c.inflight[i+1:]...)
+				removed = true
+				break
+			}
+		}
+		if maxack < number {
+			maxack = number
+			maxackRemoved = removed
+		}
+	}
+
+	if maxackRemoved {
+		//比 maxack 小的 分段 还没被确认, 很可能 丢了, 提前 重传
+		for _, seg := range c.inflight {
+			if int32(seg.number-maxack) >= 0 {
+				break
+			}
+			if seg.transmit > 0 && seg.timeout > c.rto/3 {
+				seg.timeout -= c.rto / 3
+			}
+		}
+		if rtt := current - s.timestamp; rtt < 10000 {
+			c.updateRTT(rtt, current)
+		}
+	}
+}
+
+// https://tools.ietf.org/html/rfc6298
+func (c *Conn) updateRTT(rtt, current uint32) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttVariation = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if c.srtt > rtt {
+			delta = c.srtt - rtt
+		}
+		c.rttVariation = (3*c.rttVariation + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+		if c.srtt < c.minRtt {
+			c.srtt = c.minRtt
+		}
+	}
+	var rto uint32
+	if c.minRtt < 4*c.rttVariation {
+		rto = c.srtt + 4*c.rttVariation
+	} else {
+		rto = c.srtt + c.rttVariation
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	c.rto = rto * 5 / 4
+	c.rtoUpdated = current
+}
+
+func (c *Conn) updatePeerRTO(rto, current uint32) {
+	if current-c.rtoUpdated < 3000 || rto == 0 {
+		return
+	}
+	c.rtoUpdated = current
+	c.rto = rto
+}
+
+func (c *Conn) option() byte {
+	if c.state == stateReadyToClose {
+		return optionClose
+	}
+	return 0
+}
+
+func (c *Conn) output(seg segment) {
+	c.writePacket(c.wrapper.wrap(seg))
+}
+
+func (c *Conn) sendCmd(cmd command, current uint32) {
+	c.output(&cmdOnlySegment{
+		conv:          c.conv,
+		cmd:           cmd,
+		option:        c.option(),
+		sendingNext:   c.sendUna(),
+		receivingNext: c.rcvNext,
+		peerRTO:       c.rto,
+	})
+	c.lastPing = current
+}
+
+func (c *Conn) run() {
+	ticker := time.NewTicker(time.Duration(c.config.TTI) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.wakeup:
+		case <-c.closeChan:
+			return
+		}
+		c.flush()
+	}
+}
+
+func (c *Conn) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	current := c.elapsed()
+
+	switch c.state {
+	case stateTerminated:
+		return
+	case stateTerminating:
+		c.sendCmd(cmdTerminate, current)
+		if current-c.stateBegin > terminatingTimeout {
+			c.terminate(current)
+		}
+		return
+	case stateReadyToClose:
+		if (len(c.sendQueue) == 0 && len(c.inflight) == 0) || current-c.stateBegin > readyToCloseTimeout {
+			c.setState(stateTerminating, current)
+			c.sendCmd(cmdTerminate, current)
+			return
+		}
+	}
+
+	if current-c.lastIncoming >= idleTimeout {
+		c.terminate(current)
+		return
+	}
+
+	c.flushAcks(current)
+	c.flushSending(current)
+
+	if current-c.lastPing >= pingInterval {
+		c.sendCmd(cmdPing, current)
+	}
+}
+
+func (c *Conn) newAckSegment() *ackSegment {
+	return &ackSegment{
+		conv:            c.conv,
+		option:          c.option(),
+		receivingNext:   c.rcvNext,
+		receivingWindow: c.rcvNext + c.rcvWnd,
+	}
+}
+
+func (c *Conn) flushAcks(current uint32) {
+	timeout := c.rto / 2
+	if timeout < 20 {
+		timeout = 20
+	}
+
+	seg := c.newAckSegment()
+	for i := range c.acks {
+		a := &c.acks[i]
+		if int32(a.nextFlush-current) > 0 {
+			continue
+		}
+		seg.numbers = append(seg.numbers, a.number)
+		seg.putTimestamp(a.timestamp)
+		a.nextFlush = current + timeout
+
+		if seg.isFull() {
+			c.output(seg)
+			c.ackDirty = false
+			seg = c.newAckSegment()
+		}
+	}
+	if c.ackDirty || len(seg.numbers) > 0 {
+		c.output(seg)
+		c.ackDirty = false
+	}
+}
+
+func (c *Conn) flushSending(current uint32) {
+	una := c.sendUna()
+
+	inFlightSize := c.config.sendingInFlightSize()
+	cwnd := una + inFlightSize
+	if int32(cwnd-c.remoteNext) > 0 {
+		cwnd = c.remoteNext
+	}
+	if c.config.Congestion && int32(cwnd-(una+c.controlWindow)) > 0 {
+		cwnd = una + c.controlWindow
+	}
+
+	var lost uint32
+
+	for _, seg := range c.inflight {
+		if int32(seg.number-cwnd) >= 0 {
+			break
+		}
+		if int32(current-seg.timeout) < 0 {
+			continue
+		}
+		lost++
+		c.sendData(seg, current)
+	}
+
+	for len(c.sendQueue) > 0 && int32(c.sendNext-cwnd) < 0 {
+		seg := &dataSegment{
+			conv:    c.conv,
+			number:  c.sendNext,
+			payload: c.sendQueue[0],
+		}
+		c.sendQueue[0] = nil
+		c.sendQueue = c.sendQueue[1:]
+		c.sendNext++
+		c.inflight = append(c.inflight, seg)
+		c.sendData(seg, current)
+	}
+
+	if c.config.Congestion {
+		lossRate := lost * 100 / inFlightSize
+		if lossRate >= 15 {
+			c.controlWindow = 3 * c.controlWindow / 4
+		} else if lossRate <= 5 {
+			c.controlWindow += c.controlWindow / 4
+		}
+		if c.controlWindow < 16 {
+			c.controlWindow = 16
+		}
+		if c.controlWindow > 2*inFlightSize {
+			c.controlWindow = 2 * inFlightSize
+		}
+	}
+}
+
+func (c *Conn) sendData(seg *dataSegment, current uint32) {
+	seg.timestamp = current
+	seg.sendingNext = c.sendUna()
+	seg.option = c.option()
+	seg.transmit++
+	seg.timeout = current + c.rto
+	c.output(seg)
+}
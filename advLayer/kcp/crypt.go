@@ -0,0 +1,169 @@
+package kcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+var errInvalidAuth = errors.New("kcp invalid auth")
+
+// 没有 seed 时 使用 的 简单 混淆+校验, 与 v2ray 的 SimpleAuthenticator 相同.
+// 它 实现了 cipher.AEAD, 但 没有 任何 安全性.
+type simpleAuthenticator struct{}
+
+func (simpleAuthenticator) NonceSize() int { return 0 }
+
+// 4字节 fnv校验 + 2字节 长度
+func (simpleAuthenticator) Overhead() int { return 6 }
+
+func (simpleAuthenticator) Seal(dst, nonce, plain, extra []byte) []byte {
+	dst = append(dst, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(dst[4:], uint16(len(plain)))
+	dst = append(dst, plain...)
+
+	fnvHash := fnv.New32a()
+	fnvHash.Write(dst[4:])
+	fnvHash.Sum(dst[:0])
+
+	dstLen := len(dst)
+	xtra := 4 - dstLen%4
+	if xtra != 4 {
+		dst = append(dst, make([]byte, xtra)...)
+	}
+	xorfwd(dst)
+	if xtra != 4 {
+		dst = dst[:dstLen]
+	}
+	return dst
+}
+
+func (simpleAuthenticator) Open(dst, nonce, cipherText, extra []byte) ([]byte, error) {
+	dst = append(dst, cipherText...)
+	dstLen := len(dst)
+	xtra := 4 - dstLen%4
+	if xtra != 4 {
+		dst = append(dst, make([]byte, xtra)...)
+	}
+	xorbkd(dst)
+	if xtra != 4 {
+		dst = dst[:dstLen]
+	}
+
+	if len(dst) < 6 {
+		return nil, errInvalidAuth
+	}
+
+	fnvHash := fnv.New32a()
+	fnvHash.Write(dst[4:])
+	if binary.BigEndian.Uint32(dst[:4]) != fnvHash.Sum32() {
+		return nil, errInvalidAuth
+	}
+
+	length := binary.BigEndian.Uint16(dst[4:6])
+	if len(dst)-6 != int(length) {
+		return nil, errInvalidAuth
+	}
+
+	return dst[6:], nil
+}
+
+func xorfwd(x []byte) {
+	for i := 4; i < len(x); i++ {
+		x[i] ^= x[i-4]
+	}
+}
+
+func xorbkd(x []byte) {
+	for i := len(x) - 1; i >= 4; i-- {
+		x[i] ^= x[i-4]
+	}
+}
+
+// 与 v2ray 的 NewAEADAESGCMBasedOnSeed 相同
+func newAEADFromSeed(seed string) cipher.AEAD {
+	hashedSeed := sha256.Sum256([]byte(seed))
+	block, _ := aes.NewCipher(hashedSeed[:16])
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// 为 每个 udp包 加上 伪装头 并 加密, 解包时 则 相反.
+//
+// 包的格式: header | nonce | sealed(segments)
+type packetWrapper struct {
+	header   packetHeader
+	security cipher.AEAD
+
+	buf, plain []byte //wrap 使用 的 缓存
+}
+
+func newPacketWrapper(header packetHeader, security cipher.AEAD, mtu uint32) *packetWrapper {
+	return &packetWrapper{
+		header:   header,
+		security: security,
+		buf:      make([]byte, mtu+8), //简单认证 会在 结尾 临时 补齐 4字节
+		plain:    make([]byte, mtu),
+	}
+}
+
+func (w *packetWrapper) overhead() int {
+	n := w.security.NonceSize() + w.security.Overhead()
+	if w.header != nil {
+		n += w.header.Size()
+	}
+	return n
+}
+
+// 将 seg 打包, 返回 要发送的 数据; 返回值 在 下一次 调用 前 有效.
+// 因为 伪装头 是 有状态的, 且 使用了 内部缓存, 调用者 要 保证 不会 并发 调用.
+func (w *packetWrapper) wrap(seg segment) []byte {
+	hl := 0
+	if w.header != nil {
+		hl = w.header.Size()
+		w.header.Serialize(w.buf)
+	}
+	nonceSize := w.security.NonceSize()
+	nonce := w.buf[hl : hl+nonceSize]
+	if nonceSize > 0 {
+		rand.Read(nonce)
+	}
+
+	plain := w.plain[:seg.byteSize()]
+	seg.serialize(plain)
+
+	out := w.security.Seal(w.buf[hl+nonceSize:hl+nonceSize], nonce, plain, nil)
+	return w.buf[:hl+nonceSize+len(out)]
+}
+
+// 解包, 返回 包中 的 所有 分段
+func (w *packetWrapper) unwrap(b []byte) (segs []segment) {
+	if w.header != nil {
+		hs := w.header.Size()
+		if len(b) <= hs {
+			return nil
+		}
+		b = b[hs:]
+	}
+	nonceSize := w.security.NonceSize()
+	if len(b) <= nonceSize+w.security.Overhead() {
+		return nil
+	}
+	out, err := w.security.Open(b[nonceSize:nonceSize], b[:nonceSize], b[nonceSize:], nil)
+	if err != nil {
+		return nil
+	}
+	for {
+		var seg segment
+		seg, out = readSegment(out)
+		if seg == nil {
+			break
+		}
+		segs = append(segs, seg)
+	}
+	return
+}
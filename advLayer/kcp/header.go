@@ -0,0 +1,126 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// packetHeader 是 加在 每个 udp包 最前面 的 伪装头, 格式 与 v2ray 的 transport/internet/headers 相同.
+// 接收方 不检查 伪装头 的 内容, 直接 跳过 Size() 个字节.
+type packetHeader interface {
+	Size() int
+	Serialize(b []byte)
+}
+
+// 伪装头 名称 为 "" 或 "none" 时 返回 nil
+func newPacketHeader(name string) (packetHeader, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "srtp":
+		return &srtpHeader{header: 0xB5E8, number: uint16(rand.Uint32())}, nil
+	case "utp":
+		return &utpHeader{header: 1, connectionID: uint16(rand.Uint32())}, nil
+	case "wechat-video":
+		return &wechatVideoHeader{sn: uint32(uint16(rand.Uint32()))}, nil
+	case "dtls":
+		return &dtlsHeader{epoch: uint16(rand.Uint32()), length: 17}, nil
+	case "wireguard":
+		return wireguardHeader{}, nil
+	}
+	return nil, utils.ErrInErr{ErrDesc: "kcp header type not supported", Data: name}
+}
+
+// 伪装成 视频通话 (SRTP)
+type srtpHeader struct {
+	header uint16
+	number uint16
+}
+
+func (*srtpHeader) Size() int { return 4 }
+
+func (h *srtpHeader) Serialize(b []byte) {
+	h.number++
+	binary.BigEndian.PutUint16(b, h.header)
+	binary.BigEndian.PutUint16(b[2:], h.number)
+}
+
+// 伪装成 BT下载 (uTP)
+type utpHeader struct {
+	header       byte
+	extension    byte
+	connectionID uint16
+}
+
+func (*utpHeader) Size() int { return 4 }
+
+func (h *utpHeader) Serialize(b []byte) {
+	binary.BigEndian.PutUint16(b, h.connectionID)
+	b[2] = h.header
+	b[3] = h.extension
+}
+
+// 伪装成 微信视频通话
+type wechatVideoHeader struct {
+	sn uint32
+}
+
+func (*wechatVideoHeader) Size() int { return 13 }
+
+func (h *wechatVideoHeader) Serialize(b []byte) {
+	h.sn++
+	b[0] = 0xa1
+	b[1] = 0x08
+	binary.BigEndian.PutUint32(b[2:], h.sn)
+	b[6] = 0x00
+	b[7] = 0x10
+	b[8] = 0x11
+	b[9] = 0x18
+	b[10] = 0x30
+	b[11] = 0x22
+	b[12] = 0x30
+}
+
+// 伪装成 DTLS 1.2 数据包
+type dtlsHeader struct {
+	epoch    uint16
+	length   uint16
+	sequence uint32
+}
+
+func (*dtlsHeader) Size() int { return 1 + 2 + 2 + 6 + 2 }
+
+func (h *dtlsHeader) Serialize(b []byte) {
+	b[0] = 23 // application data
+	b[1] = 254
+	b[2] = 253
+	b[3] = byte(h.epoch >> 8)
+	b[4] = byte(h.epoch)
+	b[5] = 0
+	b[6] = 0
+	b[7] = byte(h.sequence >> 24)
+	b[8] = byte(h.sequence >> 16)
+	b[9] = byte(h.sequence >> 8)
+	b[10] = byte(h.sequence)
+	h.sequence++
+	b[11] = byte(h.length >> 8)
+	b[12] = byte(h.length)
+	h.length += 17
+	if h.length > 100 {
+		h.length -= 50
+	}
+}
+
+// 伪装成 WireGuard 数据包
+type wireguardHeader struct{}
+
+func (wireguardHeader) Size() int { return 4 }
+
+func (wireguardHeader) Serialize(b []byte) {
+	b[0] = 0x04
+	b[1] = 0x00
+	b[2] = 0x00
+	b[3] = 0x00
+}
@@ -0,0 +1,201 @@
+/*
+Package kcp implements mKCP transport as a super advanced layer, like quic.
+
+mKCP 是 v2ray 的 基于udp 的 可靠传输协议, 使用 激进的 ARQ (自动重传) 策略, 在 高丢包 的 线路上 表现较好.
+本包 的 分段格式, 伪装头 与 seed 加密 都 与 v2ray 的 mkcp 相同 (见 v2ray 的 transport/internet/kcp).
+
+与 quic 一样, kcp 是 super 的, 它 自行 监听/拨号 udp; 不过 kcp 本身 没有 多路复用,
+所以 我们 在 一条 kcp 连接 上 使用 smux 来 实现 多路复用. 因此 只能 与 vs 自己 互通.
+
+# Config
+
+通过 extra 配置, 各项 都是 可选的:
+
+	kcp_header: 伪装头, none (默认), srtp, utp, wechat-video, dtls, wireguard
+	kcp_seed: 若给出, 则用 由 seed 生成的 AES-128-GCM 加密 每个 udp包; 否则 只用 简单的 混淆+校验
+	kcp_mtu: 默认 1350, 576 ~ 1460
+	kcp_tti: 发送间隔 (毫秒), 默认 50, 10 ~ 100
+	kcp_uplink: 上行容量 (MB/s), 默认 5
+	kcp_downlink: 下行容量 (MB/s), 默认 20
+	kcp_congestion: 是否 开启 拥塞控制, 默认 false
+	kcp_read_buffer, kcp_write_buffer: 单条连接的 读写缓存 (MB), 默认 2
+
+两端 的 kcp_header 和 kcp_seed 必须 相同.
+*/
+package kcp
+
+import (
+	"crypto/cipher"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func init() {
+	advLayer.ProtocolsMap["kcp"] = Creator{}
+}
+
+const (
+	DefaultMTU          = 1350
+	DefaultTTI          = 50
+	DefaultUplinkMB     = 5
+	DefaultDownlinkMB   = 20
+	DefaultBufferSizeMB = 2
+
+	minMTU = 576
+	maxMTU = 1460
+	minTTI = 10
+	maxTTI = 100
+)
+
+// Config 是 mKCP 的 参数, 含义 与 v2ray 的 kcpSettings 相同
+type Config struct {
+	MTU        uint32
+	TTI        uint32
+	UplinkMB   uint32
+	DownlinkMB uint32
+	Congestion bool
+
+	ReadBufferMB  uint32
+	WriteBufferMB uint32
+
+	HeaderType string
+	Seed       string
+}
+
+func (c *Config) fix() {
+	switch {
+	case c.MTU == 0:
+		c.MTU = DefaultMTU
+	case c.MTU < minMTU:
+		c.MTU = minMTU
+	case c.MTU > maxMTU:
+		c.MTU = maxMTU
+	}
+	switch {
+	case c.TTI == 0:
+		c.TTI = DefaultTTI
+	case c.TTI < minTTI:
+		c.TTI = minTTI
+	case c.TTI > maxTTI:
+		c.TTI = maxTTI
+	}
+	if c.UplinkMB == 0 {
+		c.UplinkMB = DefaultUplinkMB
+	}
+	if c.DownlinkMB == 0 {
+		c.DownlinkMB = DefaultDownlinkMB
+	}
+	if c.ReadBufferMB == 0 {
+		c.ReadBufferMB = DefaultBufferSizeMB
+	}
+	if c.WriteBufferMB == 0 {
+		c.WriteBufferMB = DefaultBufferSizeMB
+	}
+}
+
+// 每个 tti 最多 发出 的 分段数, 与 v2ray 的 GetSendingInFlightSize 相同
+func (c *Config) sendingInFlightSize() uint32 {
+	size := c.UplinkMB * 1024 * 1024 / c.MTU / (1000 / c.TTI)
+	if size < 8 {
+		size = 8
+	}
+	return size
+}
+
+func (c *Config) sendingBufferSize() uint32 {
+	return c.WriteBufferMB * 1024 * 1024 / c.MTU
+}
+
+func (c *Config) receivingInFlightSize() uint32 {
+	size := c.DownlinkMB * 1024 * 1024 / c.MTU / (1000 / c.TTI)
+	if size < 8 {
+		size = 8
+	}
+	return size
+}
+
+// 生成 打包器. 伪装头 有状态 (序号等), 所以 每条连接 要 单独 生成
+func (c *Config) newPacketWrapper() *packetWrapper {
+	header, _ := newPacketHeader(c.HeaderType)
+
+	var security cipher.AEAD
+	if c.Seed != "" {
+		security = newAEADFromSeed(c.Seed)
+	} else {
+		security = simpleAuthenticator{}
+	}
+	return newPacketWrapper(header, security, c.MTU)
+}
+
+func getConfigFromExtra(extra map[string]any) (c Config, err error) {
+	if extra != nil {
+		getUint := func(key string) uint32 {
+			if i, ok := utils.AnyToInt64(extra[key]); ok && i > 0 {
+				return uint32(i)
+			}
+			return 0
+		}
+		c.MTU = getUint("kcp_mtu")
+		c.TTI = getUint("kcp_tti")
+		c.UplinkMB = getUint("kcp_uplink")
+		c.DownlinkMB = getUint("kcp_downlink")
+		c.ReadBufferMB = getUint("kcp_read_buffer")
+		c.WriteBufferMB = getUint("kcp_write_buffer")
+		c.Congestion, _ = utils.AnyToBool(extra["kcp_congestion"])
+
+		if s, ok := extra["kcp_header"].(string); ok {
+			c.HeaderType = s
+		}
+		if s, ok := extra["kcp_seed"].(string); ok {
+			c.Seed = s
+		}
+	}
+	c.fix()
+
+	//检查 伪装头 名称
+	_, err = newPacketHeader(c.HeaderType)
+	return
+}
+
+type Creator struct{}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return
+}
+
+func (Creator) PackageID() string {
+	return "kcp"
+}
+
+func (Creator) ProtocolName() string {
+	return "kcp"
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return false
+}
+
+func (Creator) IsSuper() bool {
+	return true
+}
+
+func (Creator) IsMux() bool {
+	return true
+}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	c, err := getConfigFromExtra(conf.Extra)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conf.Addr.String(), c), nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	c, err := getConfigFromExtra(conf.Extra)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(conf.Addr.String(), c), nil
+}
@@ -0,0 +1,159 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+func TestPacketWrapper(t *testing.T) {
+	for _, header := range []string{"none", "srtp", "utp", "wechat-video", "dtls", "wireguard"} {
+		for _, seed := range []string{"", "verysimple"} {
+			c := Config{HeaderType: header, Seed: seed}
+			c.fix()
+
+			w := c.newPacketWrapper()
+			seg := &dataSegment{conv: 7, number: 3, timestamp: 100, sendingNext: 2, payload: []byte("hello")}
+
+			for i := 0; i < 3; i++ {
+				bs := append([]byte(nil), w.wrap(seg)...)
+
+				segs := c.newPacketWrapper().unwrap(bs)
+				if len(segs) != 1 {
+					t.Fatal(header, seed, "wrong seg count", len(segs))
+				}
+				got := segs[0].(*dataSegment)
+				if got.conv != 7 || got.number != 3 || got.timestamp != 100 || got.sendingNext != 2 || string(got.payload) != "hello" {
+					t.Fatal(header, seed, "wrong seg", got)
+				}
+
+				//篡改后 应无法解包
+				bs[len(bs)-1] ^= 1
+				if segs := c.newPacketWrapper().unwrap(bs); len(segs) != 0 {
+					t.Fatal(header, seed, "tampered packet should fail")
+				}
+			}
+		}
+	}
+
+	if _, err := getConfigFromExtra(map[string]any{"kcp_header": "wrong"}); err == nil {
+		t.Fatal("should fail on wrong header type")
+	}
+}
+
+// 用 丢包 且 乱序 的 内存通道 连接 两个 Conn, 测试 重传
+func TestLossyLink(t *testing.T) {
+	config := Config{TTI: 20}
+	config.fix()
+
+	var a, b *Conn
+	var mu sync.Mutex
+	lossy := func(to **Conn) func([]byte) error {
+		wrapper := config.newPacketWrapper()
+		return func(bs []byte) error {
+			if mrand.Intn(10) == 0 {
+				return nil
+			}
+			segs := wrapper.unwrap(append([]byte(nil), bs...))
+			delay := time.Duration(mrand.Intn(5)) * time.Millisecond
+			time.AfterFunc(delay, func() {
+				mu.Lock()
+				c := *to
+				mu.Unlock()
+				c.input(segs)
+			})
+			return nil
+		}
+	}
+
+	mu.Lock()
+	a = newConn(1, nil, nil, &config, config.newPacketWrapper(), lossy(&b), nil)
+	b = newConn(1, nil, nil, &config, config.newPacketWrapper(), lossy(&a), nil)
+	mu.Unlock()
+
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+
+	b.SetReadDeadline(time.Now().Add(time.Second * 20))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("not equal", len(got))
+	}
+	b.Close()
+}
+
+func TestClientServer(t *testing.T) {
+	addr := netLayer.GetRandLocalAddr(false, true)
+	ad, _ := netLayer.NewAddr(addr)
+
+	conf := &advLayer.Conf{Addr: ad, Extra: map[string]any{"kcp_header": "wechat-video", "kcp_seed": "verysimple"}}
+
+	srv, err := Creator{}.NewServerFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closer := srv.(advLayer.SuperMuxServer).StartListen(func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	if closer == nil {
+		t.Fatal("listen failed")
+	}
+	defer closer.Close()
+
+	cli, err := Creator{}.NewClientFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := cli.(advLayer.MuxClient)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			common, err := mc.GetCommonConn(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c, err := mc.DialSubConn(common)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second * 10))
+
+			msg := bytes.Repeat([]byte{byte(i)}, 100*1024)
+			go c.Write(msg)
+
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(buf, msg) {
+				t.Error("not equal", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,197 @@
+package kcp
+
+import (
+	"encoding/binary"
+)
+
+// 分段的 命令, 与 v2ray 相同
+type command byte
+
+const (
+	cmdACK       command = 0
+	cmdData      command = 1
+	cmdTerminate command = 2
+	cmdPing      command = 3
+)
+
+const optionClose byte = 1
+
+const (
+	dataSegmentOverhead = 18
+	cmdSegmentSize      = 16
+	ackSegmentOverhead  = 17
+
+	ackNumberLimit = 128
+)
+
+// segment 是 一个 mKCP 分段. 一个 udp包 中 可能 有 多个 分段
+type segment interface {
+	conversation() uint16
+	byteSize() int
+	serialize([]byte)
+}
+
+/*
+dataSegment:
+
+conv(2) cmd(1) option(1) timestamp(4) number(4) sendingNext(4) len(2) payload
+*/
+type dataSegment struct {
+	conv        uint16
+	option      byte
+	timestamp   uint32
+	number      uint32
+	sendingNext uint32
+	payload     []byte
+
+	//以下 只在 发送方 使用
+	timeout  uint32
+	transmit uint32
+}
+
+func (s *dataSegment) conversation() uint16 { return s.conv }
+func (s *dataSegment) byteSize() int        { return dataSegmentOverhead + len(s.payload) }
+
+func (s *dataSegment) serialize(b []byte) {
+	binary.BigEndian.PutUint16(b, s.conv)
+	b[2] = byte(cmdData)
+	b[3] = s.option
+	binary.BigEndian.PutUint32(b[4:], s.timestamp)
+	binary.BigEndian.PutUint32(b[8:], s.number)
+	binary.BigEndian.PutUint32(b[12:], s.sendingNext)
+	binary.BigEndian.PutUint16(b[16:], uint16(len(s.payload)))
+	copy(b[18:], s.payload)
+}
+
+/*
+ackSegment:
+
+conv(2) cmd(1) option(1) receivingWindow(4) receivingNext(4) timestamp(4) count(1) numbers(4*count)
+*/
+type ackSegment struct {
+	conv            uint16
+	option          byte
+	receivingWindow uint32
+	receivingNext   uint32
+	timestamp       uint32
+	numbers         []uint32
+}
+
+func (s *ackSegment) conversation() uint16 { return s.conv }
+func (s *ackSegment) byteSize() int        { return ackSegmentOverhead + 4*len(s.numbers) }
+
+func (s *ackSegment) isFull() bool { return len(s.numbers) >= ackNumberLimit }
+
+func (s *ackSegment) putTimestamp(t uint32) {
+	if t-s.timestamp < 0x7FFFFFFF {
+		s.timestamp = t
+	}
+}
+
+func (s *ackSegment) serialize(b []byte) {
+	binary.BigEndian.PutUint16(b, s.conv)
+	b[2] = byte(cmdACK)
+	b[3] = s.option
+	binary.BigEndian.PutUint32(b[4:], s.receivingWindow)
+	binary.BigEndian.PutUint32(b[8:], s.receivingNext)
+	binary.BigEndian.PutUint32(b[12:], s.timestamp)
+	b[16] = byte(len(s.numbers))
+	for i, n := range s.numbers {
+		binary.BigEndian.PutUint32(b[17+4*i:], n)
+	}
+}
+
+/*
+cmdOnlySegment: ping 或 terminate
+
+conv(2) cmd(1) option(1) sendingNext(4) receivingNext(4) peerRTO(4)
+*/
+type cmdOnlySegment struct {
+	conv          uint16
+	cmd           command
+	option        byte
+	sendingNext   uint32
+	receivingNext uint32
+	peerRTO       uint32
+}
+
+func (s *cmdOnlySegment) conversation() uint16 { return s.conv }
+func (s *cmdOnlySegment) byteSize() int        { return cmdSegmentSize }
+
+func (s *cmdOnlySegment) serialize(b []byte) {
+	binary.BigEndian.PutUint16(b, s.conv)
+	b[2] = byte(s.cmd)
+	b[3] = s.option
+	binary.BigEndian.PutUint32(b[4:], s.sendingNext)
+	binary.BigEndian.PutUint32(b[8:], s.receivingNext)
+	binary.BigEndian.PutUint32(b[12:], s.peerRTO)
+}
+
+// 从 buf 中 读出 一个 分段, 返回 剩余的 数据. 数据 不完整 时 返回 nil.
+// dataSegment 的 payload 直接 引用 buf, 调用者 若要 保存 需自行 拷贝.
+func readSegment(buf []byte) (segment, []byte) {
+	if len(buf) < 4 {
+		return nil, nil
+	}
+	conv := binary.BigEndian.Uint16(buf)
+	cmd := command(buf[2])
+	opt := buf[3]
+	buf = buf[4:]
+
+	switch cmd {
+	case cmdData:
+		if len(buf) < 14 {
+			return nil, nil
+		}
+		seg := &dataSegment{
+			conv:        conv,
+			option:      opt,
+			timestamp:   binary.BigEndian.Uint32(buf),
+			number:      binary.BigEndian.Uint32(buf[4:]),
+			sendingNext: binary.BigEndian.Uint32(buf[8:]),
+		}
+		dataLen := int(binary.BigEndian.Uint16(buf[12:]))
+		buf = buf[14:]
+		if len(buf) < dataLen {
+			return nil, nil
+		}
+		seg.payload = buf[:dataLen]
+		return seg, buf[dataLen:]
+
+	case cmdACK:
+		if len(buf) < 13 {
+			return nil, nil
+		}
+		seg := &ackSegment{
+			conv:            conv,
+			option:          opt,
+			receivingWindow: binary.BigEndian.Uint32(buf),
+			receivingNext:   binary.BigEndian.Uint32(buf[4:]),
+			timestamp:       binary.BigEndian.Uint32(buf[8:]),
+		}
+		count := int(buf[12])
+		buf = buf[13:]
+		if len(buf) < count*4 {
+			return nil, nil
+		}
+		seg.numbers = make([]uint32, count)
+		for i := range seg.numbers {
+			seg.numbers[i] = binary.BigEndian.Uint32(buf[4*i:])
+		}
+		return seg, buf[count*4:]
+
+	default:
+		if len(buf) < 12 {
+			return nil, nil
+		}
+		seg := &cmdOnlySegment{
+			conv:          conv,
+			cmd:           cmd,
+			option:        opt,
+			sendingNext:   binary.BigEndian.Uint32(buf),
+			receivingNext: binary.BigEndian.Uint32(buf[4:]),
+			peerRTO:       binary.BigEndian.Uint32(buf[8:]),
+		}
+		return seg, buf[12:]
+	}
+}
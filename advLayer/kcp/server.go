@@ -0,0 +1,210 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/xtaci/smux"
+	"go.uber.org/zap"
+)
+
+// implements advLayer.SuperMuxServer
+type Server struct {
+	Creator
+
+	addr   string
+	config Config
+
+	listener io.Closer
+}
+
+func NewServer(addr string, config Config) *Server {
+	return &Server{addr: addr, config: config}
+}
+
+// kcp 没path配置；return ""
+func (s *Server) GetPath() string {
+	return ""
+}
+
+func (s *Server) Stop() {
+	if s.listener != nil {
+		l := s.listener
+		s.listener = nil
+
+		l.Close()
+	}
+}
+
+// non-blocking
+func (s *Server) StartListen(newSubConnFunc func(net.Conn)) io.Closer {
+	l, err := listen(s.addr, &s.config)
+	if err != nil {
+		if ce := utils.CanLogErr("Failed in KCP listen"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return nil
+	}
+	s.listener = l
+
+	go func() {
+		for conn := range l.acceptChan {
+			go dealNewConn(conn, newSubConnFunc)
+		}
+	}()
+	return l
+}
+
+// 阻塞，不支持回落。
+func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), _ func(httpLayer.FallbackMeta)) {
+	dealNewConn(underlay, newSubConnFunc)
+}
+
+// 阻塞
+func dealNewConn(conn net.Conn, newSubConnFunc func(net.Conn)) {
+	session, err := smux.Server(conn, smux.DefaultConfig())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer session.Close()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if ce := utils.CanLogDebug("Failed in KCP stream accept"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return
+		}
+		go newSubConnFunc(stream)
+	}
+}
+
+type connID struct {
+	addr netip.AddrPort
+	conv uint16
+}
+
+// 在 一个 udp socket 上 按 对端地址 和 conv 区分 各个 kcp 连接
+type listener struct {
+	config *Config
+	conn   *net.UDPConn
+
+	//只用来 解包, 不用 其 有状态的 伪装头
+	wrapper *packetWrapper
+
+	mutex      sync.Mutex
+	sessions   map[connID]*Conn
+	closed     bool
+	acceptChan chan *Conn
+}
+
+func listen(addr string, config *Config) (*listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{
+		config:     config,
+		conn:       conn,
+		wrapper:    config.newPacketWrapper(),
+		sessions:   make(map[connID]*Conn),
+		acceptChan: make(chan *Conn, 64),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *listener) readLoop() {
+	defer close(l.acceptChan)
+
+	buf := utils.GetPacket()
+	defer utils.PutPacket(buf)
+
+	for {
+		n, addr, err := l.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		segs := l.wrapper.unwrap(buf[:n])
+		if len(segs) == 0 {
+			continue
+		}
+		first := segs[0]
+		id := connID{addr: addr, conv: first.conversation()}
+
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			return
+		}
+		conn, found := l.sessions[id]
+		if !found {
+			if cs, ok := first.(*cmdOnlySegment); ok && cs.cmd == cmdTerminate {
+				l.mutex.Unlock()
+				continue
+			}
+			conn = l.newConn(id)
+			select {
+			case l.acceptChan <- conn:
+				l.sessions[id] = conn
+			default:
+				l.mutex.Unlock()
+				conn.mutex.Lock()
+				conn.terminate(0)
+				conn.mutex.Unlock()
+				continue
+			}
+		}
+		l.mutex.Unlock()
+
+		conn.input(segs)
+	}
+}
+
+func (l *listener) newConn(id connID) *Conn {
+	raddr := net.UDPAddrFromAddrPort(id.addr)
+
+	var conn *Conn
+	conn = newConn(id.conv, l.conn.LocalAddr(), raddr, l.config, l.config.newPacketWrapper(), func(b []byte) error {
+		_, err := l.conn.WriteToUDP(b, raddr)
+		return err
+	}, func() {
+		l.mutex.Lock()
+		if l.sessions[id] == conn {
+			delete(l.sessions, id)
+		}
+		l.mutex.Unlock()
+	})
+	return conn
+}
+
+func (l *listener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	conns := make([]*Conn, 0, len(l.sessions))
+	for _, c := range l.sessions {
+		conns = append(conns, c)
+	}
+	l.mutex.Unlock()
+
+	for _, c := range conns {
+		c.mutex.Lock()
+		c.terminate(c.elapsed())
+		c.mutex.Unlock()
+	}
+	return l.conn.Close()
+}
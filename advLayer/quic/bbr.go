@@ -0,0 +1,408 @@
+package quic
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/congestion"
+)
+
+/*
+BBRSender 是 一个 简化的 BBRv1 实现, 见 https://datatracker.ietf.org/doc/html/draft-cardwell-iccrg-bbr-congestion-control-00
+
+它 根据 测得的 瓶颈带宽 (最近10轮 的 最大 交付速率) 与 最小rtt (10秒内) 设置 发送速率 与 窗口, 基本 不理会 丢包,
+所以 在 有 随机丢包 的 长肥管道上 比 cubic 快得多, 又 不像 brutal 那样 需要 手动 指定 速率.
+
+简化之处: 没有 检测 app-limited, 丢包 与 rto 时 不做 窗口 保守处理.
+*/
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+func (m bbrMode) String() string {
+	switch m {
+	case bbrStartup:
+		return "startup"
+	case bbrDrain:
+		return "drain"
+	case bbrProbeBW:
+		return "probe_bw"
+	default:
+		return "probe_rtt"
+	}
+}
+
+const (
+	bbrHighGain  = 2.885
+	bbrDrainGain = 1 / bbrHighGain
+	bbrCwndGain  = 2.0
+
+	bbrFullBwThreshold = 1.25
+	bbrFullBwRounds    = 3
+	bbrBwWindowRounds  = 10
+
+	bbrMinRTTExpiry     = 10 * time.Second
+	bbrProbeRTTDuration = 200 * time.Millisecond
+
+	bbrMinCwndPackets = 4
+)
+
+var bbrPacingGainCycle = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrPacketState struct {
+	delivered     congestion.ByteCount
+	deliveredTime time.Time
+	firstSentTime time.Time
+	sentTime      time.Time
+}
+
+type bwSample struct {
+	round uint64
+	bw    congestion.ByteCount
+}
+
+type BBRSender struct {
+	rttStats        congestion.RTTStatsProvider
+	pacer           *pacer
+	maxDatagramSize congestion.ByteCount
+
+	mode bbrMode
+
+	//交付速率 采样
+	packets       map[congestion.PacketNumber]bbrPacketState
+	delivered     congestion.ByteCount
+	deliveredTime time.Time
+	firstSentTime time.Time
+
+	roundCount         uint64
+	nextRoundDelivered congestion.ByteCount
+	roundStart         bool
+
+	bwSamples []bwSample //每轮 只 保留 最大的 一个
+	maxBw     congestion.ByteCount
+
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	fullBw      congestion.ByteCount
+	fullBwCount int
+	filledPipe  bool
+
+	pacingGain float64
+	cwndGain   float64
+	cycleIndex int
+	cycleStamp time.Time
+
+	probeRTTDoneStamp time.Time
+	probeRTTRoundDone bool
+	priorCwnd         congestion.ByteCount
+
+	cwnd          congestion.ByteCount
+	bytesInFlight congestion.ByteCount
+}
+
+func NewBBRSender() *BBRSender {
+	b := &BBRSender{
+		maxDatagramSize: initMaxDatagramSize,
+		packets:         make(map[congestion.PacketNumber]bbrPacketState),
+		cwnd:            initialCongestionWindowPackets * initMaxDatagramSize,
+	}
+	b.enterStartup()
+	b.pacer = newPacer(b.pacingRate)
+	return b
+}
+
+func (b *BBRSender) pacingRate() congestion.ByteCount {
+	bw := b.maxBw
+	if bw == 0 {
+		//还没有 带宽样本, 按 初始窗口 估计
+		rtt := defaultInitialRTT
+		if b.rttStats != nil && b.rttStats.SmoothedRTT() > 0 {
+			rtt = b.rttStats.SmoothedRTT()
+		}
+		bw = b.cwnd * congestion.ByteCount(time.Second) / congestion.ByteCount(rtt)
+	}
+	rate := congestion.ByteCount(float64(bw) * b.pacingGain)
+	if rate < b.maxDatagramSize {
+		rate = b.maxDatagramSize
+	}
+	return rate
+}
+
+func (b *BBRSender) minCwnd() congestion.ByteCount {
+	return bbrMinCwndPackets * b.maxDatagramSize
+}
+
+// 带宽时延积 乘以 gain
+func (b *BBRSender) inflight(gain float64) congestion.ByteCount {
+	if b.minRTT == 0 || b.maxBw == 0 {
+		return initialCongestionWindowPackets * b.maxDatagramSize
+	}
+	bdp := b.maxBw * congestion.ByteCount(b.minRTT) / congestion.ByteCount(time.Second)
+	return congestion.ByteCount(gain * float64(bdp))
+}
+
+func (b *BBRSender) enterStartup() {
+	b.mode = bbrStartup
+	b.pacingGain = bbrHighGain
+	b.cwndGain = bbrHighGain
+}
+
+func (b *BBRSender) enterProbeBW(now time.Time) {
+	b.mode = bbrProbeBW
+	b.cwndGain = bbrCwndGain
+	//随机 从 一个 不是 0.75 的 阶段 开始
+	b.cycleIndex = rand.Intn(len(bbrPacingGainCycle) - 1)
+	if b.cycleIndex >= 1 {
+		b.cycleIndex++
+	}
+	b.pacingGain = bbrPacingGainCycle[b.cycleIndex]
+	b.cycleStamp = now
+}
+
+func (b *BBRSender) SetRTTStatsProvider(provider congestion.RTTStatsProvider) {
+	b.rttStats = provider
+}
+
+func (b *BBRSender) TimeUntilSend(_ congestion.ByteCount) time.Time {
+	return b.pacer.TimeUntilSend()
+}
+
+func (b *BBRSender) HasPacingBudget() bool {
+	return b.pacer.Budget(time.Now()) >= b.maxDatagramSize
+}
+
+func (b *BBRSender) OnPacketSent(sentTime time.Time, bytesInFlight congestion.ByteCount, packetNumber congestion.PacketNumber, bytes congestion.ByteCount, isRetransmittable bool) {
+	b.pacer.SentPacket(sentTime, bytes)
+	if !isRetransmittable {
+		return
+	}
+	if bytesInFlight == 0 || b.deliveredTime.IsZero() {
+		//从 空闲 开始 发送, 不要 把 空闲时间 算进 交付速率
+		b.deliveredTime = sentTime
+		b.firstSentTime = sentTime
+	}
+	b.packets[packetNumber] = bbrPacketState{
+		delivered:     b.delivered,
+		deliveredTime: b.deliveredTime,
+		firstSentTime: b.firstSentTime,
+		sentTime:      sentTime,
+	}
+	b.bytesInFlight = bytesInFlight + bytes
+}
+
+func (b *BBRSender) CanSend(bytesInFlight congestion.ByteCount) bool {
+	return bytesInFlight < b.cwnd
+}
+
+func (b *BBRSender) MaybeExitSlowStart() {}
+
+func (b *BBRSender) OnPacketAcked(number congestion.PacketNumber, ackedBytes congestion.ByteCount, priorInFlight congestion.ByteCount, eventTime time.Time) {
+	b.delivered += ackedBytes
+	b.deliveredTime = eventTime
+	if priorInFlight > ackedBytes {
+		b.bytesInFlight = priorInFlight - ackedBytes
+	} else {
+		b.bytesInFlight = 0
+	}
+
+	p, ok := b.packets[number]
+	if !ok {
+		return
+	}
+	delete(b.packets, number)
+	b.firstSentTime = p.sentTime
+
+	b.roundStart = false
+	if p.delivered >= b.nextRoundDelivered {
+		b.nextRoundDelivered = b.delivered
+		b.roundCount++
+		b.roundStart = true
+	}
+
+	//交付速率 = 这段时间内 交付的 字节 / max(发送用时, 确认用时)
+	interval := eventTime.Sub(p.deliveredTime)
+	if sendElapsed := p.sentTime.Sub(p.firstSentTime); sendElapsed > interval {
+		interval = sendElapsed
+	}
+	if interval > 0 {
+		bw := (b.delivered - p.delivered) * congestion.ByteCount(time.Second) / congestion.ByteCount(interval)
+		b.updateMaxBw(bw)
+	}
+
+	expired := !b.minRTTStamp.IsZero() && eventTime.After(b.minRTTStamp.Add(bbrMinRTTExpiry))
+	if rtt := eventTime.Sub(p.sentTime); rtt > 0 && (b.minRTT == 0 || rtt <= b.minRTT || expired) {
+		b.minRTT = rtt
+		b.minRTTStamp = eventTime
+	}
+
+	b.checkFullPipe()
+	b.checkDrain(eventTime)
+	b.updateCycle(eventTime)
+	b.checkProbeRTT(eventTime, expired)
+	b.setCwnd(ackedBytes)
+}
+
+func (b *BBRSender) updateMaxBw(bw congestion.ByteCount) {
+	if n := len(b.bwSamples); n > 0 && b.bwSamples[n-1].round == b.roundCount {
+		if bw > b.bwSamples[n-1].bw {
+			b.bwSamples[n-1].bw = bw
+		}
+	} else {
+		b.bwSamples = append(b.bwSamples, bwSample{round: b.roundCount, bw: bw})
+	}
+
+	for len(b.bwSamples) > 0 && b.bwSamples[0].round+bbrBwWindowRounds <= b.roundCount {
+		b.bwSamples = b.bwSamples[1:]
+	}
+
+	b.maxBw = 0
+	for _, s := range b.bwSamples {
+		if s.bw > b.maxBw {
+			b.maxBw = s.bw
+		}
+	}
+}
+
+// 连续 3轮 带宽 增长 不到 25%, 就 认为 管道 已满
+func (b *BBRSender) checkFullPipe() {
+	if b.filledPipe || !b.roundStart {
+		return
+	}
+	if float64(b.maxBw) >= float64(b.fullBw)*bbrFullBwThreshold {
+		b.fullBw = b.maxBw
+		b.fullBwCount = 0
+		return
+	}
+	b.fullBwCount++
+	if b.fullBwCount >= bbrFullBwRounds {
+		b.filledPipe = true
+	}
+}
+
+func (b *BBRSender) checkDrain(now time.Time) {
+	if b.mode == bbrStartup && b.filledPipe {
+		b.mode = bbrDrain
+		b.pacingGain = bbrDrainGain
+		b.cwndGain = bbrHighGain
+	}
+	if b.mode == bbrDrain && b.bytesInFlight <= b.inflight(1) {
+		b.enterProbeBW(now)
+	}
+}
+
+func (b *BBRSender) updateCycle(now time.Time) {
+	if b.mode != bbrProbeBW {
+		return
+	}
+	elapsed := now.Sub(b.cycleStamp) > b.minRTT
+	switch {
+	case b.pacingGain > 1:
+		//探测 阶段 要 真的 把 inflight 推高 才 结束
+		if !elapsed || b.bytesInFlight < b.inflight(b.pacingGain) {
+			return
+		}
+	case b.pacingGain < 1:
+		//排空 阶段, 排空了 就 可以 提前 结束
+		if !elapsed && b.bytesInFlight > b.inflight(1) {
+			return
+		}
+	default:
+		if !elapsed {
+			return
+		}
+	}
+	b.cycleIndex = (b.cycleIndex + 1) % len(bbrPacingGainCycle)
+	b.pacingGain = bbrPacingGainCycle[b.cycleIndex]
+	b.cycleStamp = now
+}
+
+func (b *BBRSender) checkProbeRTT(now time.Time, minRTTExpired bool) {
+	if b.mode != bbrProbeRTT && minRTTExpired {
+		b.mode = bbrProbeRTT
+		b.pacingGain = 1
+		b.cwndGain = 1
+		b.priorCwnd = b.cwnd
+		b.probeRTTDoneStamp = time.Time{}
+	}
+	if b.mode != bbrProbeRTT {
+		return
+	}
+	if b.probeRTTDoneStamp.IsZero() {
+		if b.bytesInFlight <= b.minCwnd() {
+			b.probeRTTDoneStamp = now.Add(bbrProbeRTTDuration)
+			b.probeRTTRoundDone = false
+			b.nextRoundDelivered = b.delivered
+		}
+		return
+	}
+	if b.roundStart {
+		b.probeRTTRoundDone = true
+	}
+	if b.probeRTTRoundDone && now.After(b.probeRTTDoneStamp) {
+		b.minRTTStamp = now
+		if b.cwnd < b.priorCwnd {
+			b.cwnd = b.priorCwnd
+		}
+		if b.filledPipe {
+			b.enterProbeBW(now)
+		} else {
+			b.enterStartup()
+		}
+	}
+}
+
+func (b *BBRSender) setCwnd(ackedBytes congestion.ByteCount) {
+	target := b.inflight(b.cwndGain) + 3*b.maxDatagramSize
+	if b.filledPipe {
+		b.cwnd = minByteCount(b.cwnd+ackedBytes, target)
+	} else if b.cwnd < target || b.delivered < initialCongestionWindowPackets*b.maxDatagramSize {
+		b.cwnd += ackedBytes
+	}
+	if maxCwnd := maxCongestionWindowPackets * b.maxDatagramSize; b.cwnd > maxCwnd {
+		b.cwnd = maxCwnd
+	}
+	if minCwnd := b.minCwnd(); b.cwnd < minCwnd {
+		b.cwnd = minCwnd
+	}
+	if b.mode == bbrProbeRTT {
+		b.cwnd = minByteCount(b.cwnd, b.minCwnd())
+	}
+}
+
+func (b *BBRSender) OnPacketLost(number congestion.PacketNumber, lostBytes congestion.ByteCount, priorInFlight congestion.ByteCount) {
+	delete(b.packets, number)
+	if priorInFlight > lostBytes {
+		b.bytesInFlight = priorInFlight - lostBytes
+	} else {
+		b.bytesInFlight = 0
+	}
+}
+
+func (b *BBRSender) OnRetransmissionTimeout(packetsRetransmitted bool) {}
+
+func (b *BBRSender) SetMaxDatagramSize(s congestion.ByteCount) {
+	if s < b.maxDatagramSize {
+		return
+	}
+	b.maxDatagramSize = s
+	b.pacer.SetMaxDatagramSize(s)
+}
+
+func (b *BBRSender) InSlowStart() bool {
+	return b.mode == bbrStartup
+}
+
+func (b *BBRSender) InRecovery() bool {
+	return false
+}
+
+func (b *BBRSender) GetCongestionWindow() congestion.ByteCount {
+	return b.cwnd
+}
@@ -12,7 +12,6 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/congestion"
 	"go.uber.org/zap"
 )
 
@@ -26,7 +25,8 @@ type Client struct {
 
 	serverAddrStr string
 
-	tlsConf tls.Config
+	tlsConf  tls.Config
+	dialConf quic.Config
 
 	clientconns  map[[16]byte]*connState
 	connMapMutex sync.RWMutex
@@ -34,17 +34,43 @@ type Client struct {
 
 func NewClient(addr *netLayer.Addr, tConf tls.Config, args arguments) *Client {
 
-	if args.hysteriaMaxByteCount <= 0 {
-		args.hysteriaMaxByteCount = Default_hysteriaMaxByteCount
+	dialConf := common_DialConfig
+
+	if args.early {
+		//缓存 session ticket 和 token, 这样 重连时 就能 0-RTT
+		if tConf.ClientSessionCache == nil {
+			tConf.ClientSessionCache = tls.NewLRUClientSessionCache(sessionCacheSize)
+		}
+		dialConf.TokenStore = quic.NewLRUTokenStore(sessionCacheSize, 4)
 	}
 
 	return &Client{
 		serverAddrStr: addr.String(),
 		tlsConf:       tConf,
+		dialConf:      dialConf,
 		arguments:     args,
 	}
 }
 
+const sessionCacheSize = 16
+
+// 握手完成后 记录 是否 恢复了 会话 以及 是否 用上了 0-RTT
+func logResumption(conn quic.EarlyConnection) {
+	select {
+	case <-conn.HandshakeComplete().Done():
+	case <-conn.Context().Done():
+		return
+	}
+	if ce := utils.CanLogInfo("QUIC early handshake complete"); ce != nil {
+		state := conn.ConnectionState()
+		ce.Write(
+			zap.Bool("resumed", state.TLS.DidResume),
+			zap.Bool("used0RTT", state.TLS.Used0RTT),
+			zap.String("local", conn.LocalAddr().String()),
+		)
+	}
+}
+
 //trimBadConns removes non-Active sessions, and try to pick and return the best session for a new stream
 func (c *Client) trimBadConns() (bestConn *connState) {
 
@@ -129,7 +155,14 @@ func (c *Client) getCommonConn(_ net.Conn) (*connState, error) {
 	if err != nil {
 		return nil, err
 	}
-	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+
+	//只在 配置了 hop_ports 时 使用 hopPacketConn; 否则 直接 用 *net.UDPConn, 以 保留 quic-go 的 批量 收发 等 优化
+	var pConn net.PacketConn
+	if len(c.hopPorts) > 1 {
+		pConn, err = newHopPacketConn(rudpAddr, c.hopPorts, c.hopInterval)
+	} else {
+		pConn, err = net.ListenUDP("udp", nil)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -137,31 +170,38 @@ func (c *Client) getCommonConn(_ net.Conn) (*connState, error) {
 	if c.early {
 		utils.Debug("quic Dialing Early")
 		//conn, err = quic.DialAddrEarly(c.serverAddrStr, &c.tlsConf, &common_DialConfig)
-		conn, err = quic.DialEarly(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &common_DialConfig)
+		var econn quic.EarlyConnection
+		econn, err = quic.DialEarly(pConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &c.dialConf)
+		if err == nil {
+			conn = econn
+			go logResumption(econn)
+		}
 
 	} else {
 
 		utils.Debug("quic Dialing Connection")
 		//conn, err = quic.DialAddr(c.serverAddrStr, &c.tlsConf, &common_DialConfig)
-		conn, err = quic.Dial(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &common_DialConfig)
+		conn, err = quic.Dial(pConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &c.dialConf)
 
 	}
 
 	if err != nil {
-
+		pConn.Close()
 		return nil, err
 	}
 
-	if c.useHysteria {
+	go func() {
+		<-conn.Context().Done()
+		pConn.Close()
+	}()
 
-		if c.hysteria_manual {
-			bs := NewBrutalSender_M(congestion.ByteCount(c.hysteriaMaxByteCount))
-			conn.SetCongestionControl(bs)
-
-		} else {
-			bs := NewBrutalSender(congestion.ByteCount(c.hysteriaMaxByteCount))
-			conn.SetCongestionControl(bs)
+	setCongestion(conn, c.congestion, false, getConnAddrs(conn))
 
+	if c.serverCongestion.name != "" {
+		if err := sendCongestionRequest(conn, c.serverCongestion); err != nil {
+			if ce := utils.CanLogWarn("QUIC send congestion request failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
 		}
 	}
 
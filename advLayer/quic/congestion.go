@@ -0,0 +1,194 @@
+package quic
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/congestion"
+	"go.uber.org/zap"
+)
+
+/*
+Pluggable Congestion Control
+
+extra.congestion_control 可选:
+
+	bbr, cubic, newreno, brutal (也可写 hy, 速率 由 mbps 指定)
+
+不写 则 使用 quic-go 内置的 阻控 (cubic). 注意 只有 我们 自己设置的 阻控 才有 统计信息 (见 stats.go).
+
+阻控 只 影响 本端的 发送. 客户端 可以 用 server_congestion_control 与 server_mbps 请求 服务端
+对 本连接 使用 指定的 阻控, 服务端 要 开启 allow_client_congestion_control 才会 接受, 而且 brutal 的 速率 不会 超过 max_client_mbps.
+
+请求 是 在 连接上 打开的 第一个 单向流 中 发送的:
+
+	version(1) nameLen(1) name mbps(4, big endian)
+
+服务端 在 接受 流 之前 确定 阻控: 在 negotiateTimeout 内 没有 收到 请求, 或 先 收到了 双向流, 就 使用 自己的 配置.
+不支持 请求的 一方 (如 v2ray) 不会 发, 所以 不影响 互通.
+*/
+
+const (
+	CongestionBBR     = "bbr"
+	CongestionCubic   = "cubic"
+	CongestionNewReno = "newreno"
+	CongestionBrutal  = "brutal"
+
+	negotiateVersion = 0
+	negotiateTimeout = time.Second * 3
+)
+
+type congestionConf struct {
+	name   string //为空 表示 使用 quic-go 内置的 阻控
+	manual bool   //brutal 手动挡
+	bps    int    //brutal 的 发送速率 (字节每秒)
+}
+
+// 返回 标准名称, 不认识 则 返回 false
+func parseCongestionName(s string) (string, bool) {
+	switch s = strings.ToLower(s); s {
+	case "", "default":
+		return "", true
+	case "hy", "hysteria", CongestionBrutal:
+		return CongestionBrutal, true
+	case CongestionBBR, CongestionCubic, CongestionNewReno:
+		return s, true
+	case "reno":
+		return CongestionNewReno, true
+	}
+	return "", false
+}
+
+// 返回 nil 表示 使用 quic-go 内置的 阻控
+func (cc congestionConf) newSender() congestion.CongestionControl {
+	switch cc.name {
+	case CongestionBBR:
+		return NewBBRSender()
+	case CongestionCubic:
+		return NewCubicSender(false)
+	case CongestionNewReno:
+		return NewCubicSender(true)
+	case CongestionBrutal:
+		bps := cc.bps
+		if bps <= 0 {
+			bps = Default_hysteriaMaxByteCount
+		}
+		if cc.manual {
+			return NewBrutalSender_M(congestion.ByteCount(bps))
+		}
+		return NewBrutalSender(congestion.ByteCount(bps))
+	}
+	return nil
+}
+
+// 为 conn 设置 阻控 并 登记 统计信息
+func setCongestion(conn quic.Connection, cc congestionConf, isServer bool, addrs connAddrs) {
+	sender := cc.newSender()
+	if sender == nil {
+		return
+	}
+	conn.SetCongestionControl(newStatsSender(conn, sender, cc, isServer, addrs))
+}
+
+// 客户端 请求 服务端 对 本连接 使用 cc
+func sendCongestionRequest(conn quic.Connection, cc congestionConf) error {
+	stream, err := conn.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, 2+len(cc.name)+4)
+	buf = append(buf, negotiateVersion, byte(len(cc.name)))
+	buf = append(buf, cc.name...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(cc.bps*8/1024/1024))
+
+	_, err = stream.Write(buf)
+	stream.Close()
+	return err
+}
+
+// 服务端 读取 客户端的 请求, 直到 ctx 结束
+func readCongestionRequest(ctx context.Context, conn quic.Connection) (cc congestionConf, err error) {
+	stream, err := conn.AcceptUniStream(ctx)
+	if err != nil {
+		//ctx 结束 时 请求 可能 已经 到了; AcceptUniStream 会 先 检查 已 收到 的 流, 再 看 ctx
+		if stream, err = conn.AcceptUniStream(ctx); err != nil {
+			return
+		}
+	}
+	defer stream.CancelRead(0)
+
+	stream.SetReadDeadline(time.Now().Add(negotiateTimeout))
+
+	var head [2]byte
+	if _, err = io.ReadFull(stream, head[:]); err != nil {
+		return
+	}
+	if head[0] != negotiateVersion {
+		err = utils.ErrInErr{ErrDesc: "QUIC congestion request version not supported", Data: head[0]}
+		return
+	}
+	buf := make([]byte, int(head[1])+4)
+	if _, err = io.ReadFull(stream, buf); err != nil {
+		return
+	}
+	name, ok := parseCongestionName(string(buf[:head[1]]))
+	if !ok {
+		err = utils.ErrInErr{ErrDesc: "QUIC congestion request with unknown congestion control", Data: string(buf[:head[1]])}
+		return
+	}
+	cc.name = name
+	cc.bps = int(binary.BigEndian.Uint32(buf[head[1]:])) * 1024 * 1024 / 8
+	return
+}
+
+// 服务端 为 新连接 设置 阻控, 要在 接受 流 之前 调用, 这样 阻控 不会 在 连接 已经 传输 数据 后 才 更换.
+//
+// 允许 客户端 请求 时 会 等待 请求, 最多 negotiateTimeout; 若 先 收到了 双向流, 说明 客户端 不会 发 请求 (如 v2ray),
+// 就 不再 等待, 使用 服务端 自己的 配置, 并 返回 该流, 由 调用者 处理.
+func (arg *arguments) setServerCongestion(conn quic.Connection, addrs connAddrs) (firstStream quic.Stream) {
+	if !arg.allowClientCongestion {
+		setCongestion(conn, arg.congestion, true, addrs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(conn.Context(), negotiateTimeout)
+	defer cancel()
+
+	streamDone := make(chan struct{})
+	go func() {
+		defer close(streamDone)
+		if stream, err := conn.AcceptStream(ctx); err == nil {
+			firstStream = stream
+			cancel()
+		}
+	}()
+
+	cc, err := readCongestionRequest(ctx, conn)
+	cancel()
+	<-streamDone
+
+	if err != nil {
+		if ce := utils.CanLogDebug("QUIC no congestion request from client, use server's"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		setCongestion(conn, arg.congestion, true, addrs)
+		return
+	}
+	if cc.name == CongestionBrutal && arg.maxClientBps > 0 && (cc.bps <= 0 || cc.bps > arg.maxClientBps) {
+		cc.bps = arg.maxClientBps
+	}
+	if ce := utils.CanLogInfo("QUIC use congestion control requested by client"); ce != nil {
+		ce.Write(
+			zap.String("client", addrs.remote),
+			zap.String("congestion", cc.name),
+			zap.Int("mbps", cc.bps*8/1024/1024),
+		)
+	}
+	setCongestion(conn, cc, true, addrs)
+	return
+}
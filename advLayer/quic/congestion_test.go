@@ -0,0 +1,145 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestParseCongestionName(t *testing.T) {
+	for in, want := range map[string]string{"": "", "hy": CongestionBrutal, "BBR": CongestionBBR, "reno": CongestionNewReno, "cubic": CongestionCubic} {
+		got, ok := parseCongestionName(in)
+		if !ok || got != want {
+			t.Fatal(in, got, ok)
+		}
+	}
+	if _, ok := parseCongestionName("vegas"); ok {
+		t.Fatal("vegas should be unknown")
+	}
+}
+
+var initTestLogOnce sync.Once
+
+// 日志 只 初始化 一次, 以免 与 之前 测试 还 没 退出 的 goroutine 竞争 读写 utils.LogLevel
+func initTestLog() {
+	initTestLogOnce.Do(func() {
+		utils.LogLevel = utils.Log_warning
+		utils.InitLog("")
+	})
+}
+
+func startEchoServer(t *testing.T, args arguments) (addr string, closer io.Closer) {
+	addr = "127.0.0.1:" + strconv.Itoa(netLayer.RandPort(true, true, 0))
+	serverTls := &tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert(), NextProtos: DefaultAlpnList}
+
+	closer = ListenInitialLayers(addr, *serverTls.Clone(), args, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	if closer == nil {
+		t.Fatal("listen failed")
+	}
+	return
+}
+
+func echoBigData(t *testing.T, client *Client) *connState {
+	state, err := client.getCommonConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.DialSubConn(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+
+	go stream.Write(data)
+
+	got := make([]byte, len(data))
+	stream.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("not equal")
+	}
+	return state
+}
+
+func TestCongestionControls(t *testing.T) {
+	initTestLog()
+
+	for _, name := range []string{CongestionBBR, CongestionCubic, CongestionNewReno, CongestionBrutal} {
+		t.Run(name, func(t *testing.T) {
+			cc := congestionConf{name: name, bps: 100 * 1024 * 1024 / 8}
+
+			addr, closer := startEchoServer(t, arguments{congestion: cc})
+			defer closer.Close()
+
+			na, _ := netLayer.NewAddr(addr)
+			client := NewClient(&na, tls.Config{InsecureSkipVerify: true, NextProtos: DefaultAlpnList}, arguments{congestion: cc})
+
+			state := echoBigData(t, client)
+			state.CloseWithError(0, "")
+		})
+	}
+}
+
+// 客户端 请求 服务端 使用 brutal, 服务端 限速; api 应能 看到 两端 的 统计
+func TestCongestionNegotiation(t *testing.T) {
+	initTestLog()
+
+	addr, closer := startEchoServer(t, arguments{
+		allowClientCongestion: true,
+		maxClientBps:          200 * 1024 * 1024 / 8,
+	})
+	defer closer.Close()
+
+	na, _ := netLayer.NewAddr(addr)
+	client := NewClient(&na, tls.Config{InsecureSkipVerify: true, NextProtos: DefaultAlpnList}, arguments{
+		congestion:       congestionConf{name: CongestionBBR},
+		serverCongestion: congestionConf{name: CongestionBrutal, bps: 1000 * 1024 * 1024 / 8},
+	})
+
+	state := echoBigData(t, client)
+	defer state.CloseWithError(0, "")
+
+	_, localPort, _ := net.SplitHostPort(state.LocalAddr().String())
+
+	var clientStats, serverStats *ConnStats
+	for i := 0; i < 50 && (clientStats == nil || serverStats == nil); i++ {
+		for _, s := range GetConnStats() {
+			s := s
+			if s.Local == state.LocalAddr().String() && !s.IsServer {
+				clientStats = &s
+			}
+			if _, port, _ := net.SplitHostPort(s.Remote); port == localPort && s.IsServer {
+				serverStats = &s
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if clientStats == nil || serverStats == nil {
+		t.Fatal("stats not found", GetConnStats())
+	}
+
+	if clientStats.Congestion != CongestionBBR || clientStats.SentPackets == 0 || clientStats.SmoothedRTTMs <= 0 || clientStats.Cwnd <= 0 {
+		t.Fatal("wrong client stats", *clientStats)
+	}
+	if serverStats.Congestion != CongestionBrutal || serverStats.Mbps != 200 {
+		t.Fatal("wrong server stats", *serverStats)
+	}
+}
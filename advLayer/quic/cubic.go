@@ -0,0 +1,379 @@
+package quic
+
+import (
+	"math"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/congestion"
+)
+
+/*
+CubicSender 是 quic-go 内部 的 cubic_sender (来自 chromium) 的 移植, 同时 支持 cubic 和 newreno.
+
+quic-go 的 internal/congestion 包 无法 从外部 引用, 而 SetCongestionControl 会 替换掉 它 默认的 阻控,
+所以 为了 能 统计 cubic 连接的 数据, 我们 需要 自己的 实现.
+*/
+
+const (
+	invalidPacketNumber congestion.PacketNumber = -1
+
+	initialCongestionWindowPackets = 32
+	maxCongestionWindowPackets     = 10000
+	minCongestionWindowPackets     = 2
+	cwndLimitedBurstPackets        = 3
+
+	renoBeta = 0.7
+
+	defaultInitialRTT = 100 * time.Millisecond
+)
+
+type CubicSender struct {
+	hybridSlowStart hybridSlowStart
+	rttStats        congestion.RTTStatsProvider
+	cubic           cubic
+	pacer           *pacer
+
+	reno bool
+
+	largestSentPacketNumber  congestion.PacketNumber
+	largestAckedPacketNumber congestion.PacketNumber
+	largestSentAtLastCutback congestion.PacketNumber
+
+	congestionWindow   congestion.ByteCount
+	slowStartThreshold congestion.ByteCount
+	numAckedPackets    uint64
+
+	maxDatagramSize congestion.ByteCount
+}
+
+// reno 为 true 时 使用 newreno, 否则 使用 cubic
+func NewCubicSender(reno bool) *CubicSender {
+	c := &CubicSender{
+		reno:                     reno,
+		largestSentPacketNumber:  invalidPacketNumber,
+		largestAckedPacketNumber: invalidPacketNumber,
+		largestSentAtLastCutback: invalidPacketNumber,
+		maxDatagramSize:          initMaxDatagramSize,
+		congestionWindow:         initialCongestionWindowPackets * initMaxDatagramSize,
+		slowStartThreshold:       math.MaxInt64,
+	}
+	c.cubic.maxDatagramSize = initMaxDatagramSize
+	c.cubic.Reset()
+	c.pacer = newPacer(func() congestion.ByteCount {
+		//与 quic-go 一样, 按 1.25 倍 估计带宽 发送
+		return c.bandwidthEstimate() * 5 / 4
+	})
+	return c
+}
+
+func (c *CubicSender) bandwidthEstimate() congestion.ByteCount {
+	srtt := defaultInitialRTT
+	if c.rttStats != nil && c.rttStats.SmoothedRTT() > 0 {
+		srtt = c.rttStats.SmoothedRTT()
+	}
+	return c.congestionWindow * congestion.ByteCount(time.Second) / congestion.ByteCount(srtt)
+}
+
+func (c *CubicSender) maxCongestionWindow() congestion.ByteCount {
+	return c.maxDatagramSize * maxCongestionWindowPackets
+}
+
+func (c *CubicSender) minCongestionWindow() congestion.ByteCount {
+	return c.maxDatagramSize * minCongestionWindowPackets
+}
+
+func (c *CubicSender) SetRTTStatsProvider(provider congestion.RTTStatsProvider) {
+	c.rttStats = provider
+}
+
+func (c *CubicSender) TimeUntilSend(_ congestion.ByteCount) time.Time {
+	return c.pacer.TimeUntilSend()
+}
+
+func (c *CubicSender) HasPacingBudget() bool {
+	return c.pacer.Budget(time.Now()) >= c.maxDatagramSize
+}
+
+func (c *CubicSender) OnPacketSent(sentTime time.Time, _ congestion.ByteCount, packetNumber congestion.PacketNumber, bytes congestion.ByteCount, isRetransmittable bool) {
+	c.pacer.SentPacket(sentTime, bytes)
+	if !isRetransmittable {
+		return
+	}
+	c.largestSentPacketNumber = packetNumber
+	c.hybridSlowStart.OnPacketSent(packetNumber)
+}
+
+func (c *CubicSender) CanSend(bytesInFlight congestion.ByteCount) bool {
+	return bytesInFlight < c.congestionWindow
+}
+
+func (c *CubicSender) InRecovery() bool {
+	return c.largestAckedPacketNumber != invalidPacketNumber && c.largestAckedPacketNumber <= c.largestSentAtLastCutback
+}
+
+func (c *CubicSender) InSlowStart() bool {
+	return c.congestionWindow < c.slowStartThreshold
+}
+
+func (c *CubicSender) GetCongestionWindow() congestion.ByteCount {
+	return c.congestionWindow
+}
+
+func (c *CubicSender) MaybeExitSlowStart() {
+	if c.InSlowStart() && c.rttStats != nil &&
+		c.hybridSlowStart.ShouldExitSlowStart(c.rttStats.LatestRTT(), c.rttStats.MinRTT(), c.congestionWindow/c.maxDatagramSize) {
+		c.slowStartThreshold = c.congestionWindow
+	}
+}
+
+func (c *CubicSender) OnPacketAcked(ackedPacketNumber congestion.PacketNumber, ackedBytes congestion.ByteCount, priorInFlight congestion.ByteCount, eventTime time.Time) {
+	if ackedPacketNumber > c.largestAckedPacketNumber {
+		c.largestAckedPacketNumber = ackedPacketNumber
+	}
+	if c.InRecovery() {
+		return
+	}
+	c.maybeIncreaseCwnd(ackedBytes, priorInFlight, eventTime)
+	if c.InSlowStart() {
+		c.hybridSlowStart.OnPacketAcked(ackedPacketNumber)
+	}
+}
+
+func (c *CubicSender) OnPacketLost(packetNumber congestion.PacketNumber, _ congestion.ByteCount, _ congestion.ByteCount) {
+	//同一个 窗口 内 的 多次丢包 只 减一次 窗口
+	if packetNumber <= c.largestSentAtLastCutback {
+		return
+	}
+	if c.reno {
+		c.congestionWindow = congestion.ByteCount(float64(c.congestionWindow) * renoBeta)
+	} else {
+		c.congestionWindow = c.cubic.CongestionWindowAfterPacketLoss(c.congestionWindow)
+	}
+	if minCwnd := c.minCongestionWindow(); c.congestionWindow < minCwnd {
+		c.congestionWindow = minCwnd
+	}
+	c.slowStartThreshold = c.congestionWindow
+	c.largestSentAtLastCutback = c.largestSentPacketNumber
+	c.numAckedPackets = 0
+}
+
+func (c *CubicSender) maybeIncreaseCwnd(ackedBytes congestion.ByteCount, priorInFlight congestion.ByteCount, eventTime time.Time) {
+	if !c.isCwndLimited(priorInFlight) {
+		c.cubic.OnApplicationLimited()
+		return
+	}
+	if c.congestionWindow >= c.maxCongestionWindow() {
+		return
+	}
+	if c.InSlowStart() {
+		c.congestionWindow += c.maxDatagramSize
+		return
+	}
+	if c.reno {
+		c.numAckedPackets++
+		if c.numAckedPackets >= uint64(c.congestionWindow/c.maxDatagramSize) {
+			c.congestionWindow += c.maxDatagramSize
+			c.numAckedPackets = 0
+		}
+	} else {
+		var minRTT time.Duration
+		if c.rttStats != nil {
+			minRTT = c.rttStats.MinRTT()
+		}
+		c.congestionWindow = minByteCount(c.maxCongestionWindow(), c.cubic.CongestionWindowAfterAck(ackedBytes, c.congestionWindow, minRTT, eventTime))
+	}
+}
+
+func (c *CubicSender) isCwndLimited(bytesInFlight congestion.ByteCount) bool {
+	if bytesInFlight >= c.congestionWindow {
+		return true
+	}
+	availableBytes := c.congestionWindow - bytesInFlight
+	slowStartLimited := c.InSlowStart() && bytesInFlight > c.congestionWindow/2
+	return slowStartLimited || availableBytes <= cwndLimitedBurstPackets*c.maxDatagramSize
+}
+
+func (c *CubicSender) OnRetransmissionTimeout(packetsRetransmitted bool) {
+	c.largestSentAtLastCutback = invalidPacketNumber
+	if !packetsRetransmitted {
+		return
+	}
+	c.hybridSlowStart.Restart()
+	c.cubic.Reset()
+	c.slowStartThreshold = c.congestionWindow / 2
+	c.congestionWindow = c.minCongestionWindow()
+}
+
+func (c *CubicSender) SetMaxDatagramSize(s congestion.ByteCount) {
+	if s < c.maxDatagramSize {
+		return
+	}
+	cwndIsMin := c.congestionWindow == c.minCongestionWindow()
+	c.maxDatagramSize = s
+	c.cubic.maxDatagramSize = s
+	if cwndIsMin {
+		c.congestionWindow = c.minCongestionWindow()
+	}
+	c.pacer.SetMaxDatagramSize(s)
+}
+
+const (
+	cubeScale                 = 40
+	cubeCongestionWindowScale = 410
+
+	cubicBeta        float32 = 0.7
+	cubicBetaLastMax float32 = 0.85
+	cubicAlpha               = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// cubic 窗口增长函数, 见 rfc 8312
+type cubic struct {
+	maxDatagramSize congestion.ByteCount
+
+	epoch time.Time
+
+	lastMaxCongestionWindow      congestion.ByteCount
+	ackedBytesCount              congestion.ByteCount
+	estimatedTCPcongestionWindow congestion.ByteCount
+	originPointCongestionWindow  congestion.ByteCount
+	timeToOriginPoint            uint32
+}
+
+func (c *cubic) cubeFactor() congestion.ByteCount {
+	return 1 << cubeScale / cubeCongestionWindowScale / c.maxDatagramSize
+}
+
+func (c *cubic) Reset() {
+	c.epoch = time.Time{}
+	c.lastMaxCongestionWindow = 0
+	c.ackedBytesCount = 0
+	c.estimatedTCPcongestionWindow = 0
+	c.originPointCongestionWindow = 0
+	c.timeToOriginPoint = 0
+}
+
+// 应用 没有 用满 窗口 时 调用, 这段时间 不应 计入 窗口增长
+func (c *cubic) OnApplicationLimited() {
+	c.epoch = time.Time{}
+}
+
+func (c *cubic) CongestionWindowAfterPacketLoss(cwnd congestion.ByteCount) congestion.ByteCount {
+	if cwnd+c.maxDatagramSize < c.lastMaxCongestionWindow {
+		//还没 恢复到 上次的 最大值 就 又丢包了, 说明 可用带宽 下降, 再 让出 一些
+		c.lastMaxCongestionWindow = congestion.ByteCount(cubicBetaLastMax * float32(cwnd))
+	} else {
+		c.lastMaxCongestionWindow = cwnd
+	}
+	c.epoch = time.Time{}
+	return congestion.ByteCount(float32(cwnd) * cubicBeta)
+}
+
+func (c *cubic) CongestionWindowAfterAck(ackedBytes congestion.ByteCount, cwnd congestion.ByteCount, delayMin time.Duration, eventTime time.Time) congestion.ByteCount {
+	c.ackedBytesCount += ackedBytes
+
+	if c.epoch.IsZero() {
+		c.epoch = eventTime
+		c.ackedBytesCount = ackedBytes
+		c.estimatedTCPcongestionWindow = cwnd
+		if c.lastMaxCongestionWindow <= cwnd {
+			c.timeToOriginPoint = 0
+			c.originPointCongestionWindow = cwnd
+		} else {
+			c.timeToOriginPoint = uint32(math.Cbrt(float64(c.cubeFactor() * (c.lastMaxCongestionWindow - cwnd))))
+			c.originPointCongestionWindow = c.lastMaxCongestionWindow
+		}
+	}
+
+	//单位 是 1/1024 秒
+	elapsedTime := int64(eventTime.Add(delayMin).Sub(c.epoch)/time.Microsecond) << 10 / (1000 * 1000)
+
+	offset := int64(c.timeToOriginPoint) - elapsedTime
+	if offset < 0 {
+		offset = -offset
+	}
+	deltaCongestionWindow := congestion.ByteCount(cubeCongestionWindowScale*offset*offset*offset) * c.maxDatagramSize >> cubeScale
+
+	var target congestion.ByteCount
+	if elapsedTime > int64(c.timeToOriginPoint) {
+		target = c.originPointCongestionWindow + deltaCongestionWindow
+	} else {
+		target = c.originPointCongestionWindow - deltaCongestionWindow
+	}
+	target = minByteCount(target, cwnd+c.ackedBytesCount/2)
+
+	//tcp友好 区域: 不比 同样条件下的 reno 慢
+	c.estimatedTCPcongestionWindow += congestion.ByteCount(float32(c.ackedBytesCount) * cubicAlpha * float32(c.maxDatagramSize) / float32(c.estimatedTCPcongestionWindow))
+	c.ackedBytesCount = 0
+
+	if target < c.estimatedTCPcongestionWindow {
+		target = c.estimatedTCPcongestionWindow
+	}
+	return target
+}
+
+const (
+	hybridStartLowWindow      = 16
+	hybridStartMinSamples     = 8
+	hybridStartDelayFactorExp = 3
+	hybridStartDelayMinThres  = 4 * time.Millisecond
+	hybridStartDelayMaxThres  = 16 * time.Millisecond
+)
+
+// HyStart: 慢启动 阶段 rtt 明显增大 时 提前 退出 慢启动
+type hybridSlowStart struct {
+	endPacketNumber      congestion.PacketNumber
+	lastSentPacketNumber congestion.PacketNumber
+	started              bool
+	currentMinRTT        time.Duration
+	rttSampleCount       uint32
+	hystartFound         bool
+}
+
+func (s *hybridSlowStart) StartReceiveRound(lastSent congestion.PacketNumber) {
+	s.endPacketNumber = lastSent
+	s.currentMinRTT = 0
+	s.rttSampleCount = 0
+	s.started = true
+}
+
+func (s *hybridSlowStart) ShouldExitSlowStart(latestRTT time.Duration, minRTT time.Duration, cwndPackets congestion.ByteCount) bool {
+	if !s.started {
+		s.StartReceiveRound(s.lastSentPacketNumber)
+	}
+	if s.hystartFound {
+		return true
+	}
+	s.rttSampleCount++
+	if s.rttSampleCount <= hybridStartMinSamples {
+		if s.currentMinRTT == 0 || s.currentMinRTT > latestRTT {
+			s.currentMinRTT = latestRTT
+		}
+	}
+	if s.rttSampleCount == hybridStartMinSamples {
+		threshold := minRTT >> hybridStartDelayFactorExp
+		if threshold < hybridStartDelayMinThres {
+			threshold = hybridStartDelayMinThres
+		} else if threshold > hybridStartDelayMaxThres {
+			threshold = hybridStartDelayMaxThres
+		}
+		if s.currentMinRTT > minRTT+threshold {
+			s.hystartFound = true
+		}
+	}
+	return cwndPackets >= hybridStartLowWindow && s.hystartFound
+}
+
+func (s *hybridSlowStart) OnPacketSent(packetNumber congestion.PacketNumber) {
+	s.lastSentPacketNumber = packetNumber
+}
+
+func (s *hybridSlowStart) OnPacketAcked(ackedPacketNumber congestion.PacketNumber) {
+	if s.started && s.endPacketNumber < ackedPacketNumber {
+		s.started = false
+	}
+}
+
+func (s *hybridSlowStart) Restart() {
+	s.started = false
+	s.hystartFound = false
+}
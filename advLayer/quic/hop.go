@@ -0,0 +1,406 @@
+package quic
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+/*
+Port Hopping
+
+长时间 对 单个 udp端口 的 大流量 容易 被 qos. 配置 extra.hop_ports 后,
+服务端 会 同时 监听 主端口 和 hop_ports 中的 所有端口;
+客户端 每隔 hop_interval 秒 换一个 端口 发送, 同时 换一个 新的 本地 udp socket.
+
+因为 我们用的 apernet/quic-go 服务端 会 把 连接的 对端地址 更新为 最后收到的 包的 来源地址 (简易的 连接迁移),
+所以 客户端 换了 本地端口 后 连接 依然 可用.
+
+配置了 hop_ports 时, 客户端 写入 出错 (比如 手机 切换了 网络) 也会 立即 换一个 新的 本地 socket, 从而 让 连接 迁移到 新的 网络上.
+没 配置 时 客户端 直接 使用 *net.UDPConn, 不会 迁移.
+
+注意 apernet/quic-go 服务端 更新 对端地址 (sconn.SetRemoteAddr) 时 没有 加锁, 与 发送 goroutine 之间 有 data race,
+go test -race 会 报告; 这 需要 上游 修复, 所以 客户端 的 迁移 默认 不 开启.
+*/
+
+const (
+	DefaultHopInterval = time.Second * 30
+	minHopInterval     = time.Second * 5
+)
+
+// 从 extra 中 读取 hop_ports 与 hop_interval. mainPort 总是 包含 在 返回的 ports 中.
+// 若 没有 配置 hop_ports, 返回的 ports 为 nil
+func getHopFromExtra(extra map[string]any, mainPort int) (ports []int, interval time.Duration, err error) {
+	if extra == nil {
+		return
+	}
+	str, _ := extra["hop_ports"].(string)
+	if str == "" {
+		return
+	}
+	hopPorts, err := netLayer.ParsePortList(str)
+	if err != nil {
+		return
+	}
+	ports = append(ports, mainPort)
+	for _, p := range hopPorts {
+		if p != mainPort {
+			ports = append(ports, p)
+		}
+	}
+
+	interval = DefaultHopInterval
+	if sec, ok := utils.AnyToInt64(extra["hop_interval"]); ok && sec > 0 {
+		interval = time.Duration(sec) * time.Second
+		if interval < minHopInterval {
+			interval = minHopInterval
+		}
+	}
+	return
+}
+
+type recvPacket struct {
+	buf  []byte
+	n    int
+	addr *net.UDPAddr
+	from *net.UDPConn
+}
+
+// 从 多个 udp socket 中 读取, 读到的包 统一 送到 recvChan
+type multiSocketReader struct {
+	recvChan  chan recvPacket
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiSocketReader() multiSocketReader {
+	return multiSocketReader{
+		recvChan:  make(chan recvPacket, 64),
+		closeChan: make(chan struct{}),
+	}
+}
+
+// 阻塞, 直到 conn 被关闭
+func (r *multiSocketReader) readLoop(conn *net.UDPConn) {
+	for {
+		buf := utils.GetPacket()
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			utils.PutPacket(buf)
+			return
+		}
+		select {
+		case r.recvChan <- recvPacket{buf: buf, n: n, addr: addr, from: conn}:
+		case <-r.closeChan:
+			utils.PutPacket(buf)
+			return
+		}
+	}
+}
+
+func (r *multiSocketReader) read(b []byte) (n int, p recvPacket, err error) {
+	select {
+	case p = <-r.recvChan:
+		n = copy(b, p.buf[:p.n])
+		utils.PutPacket(p.buf)
+		return
+	case <-r.closeChan:
+		err = net.ErrClosed
+		return
+	}
+}
+
+// 不支持 deadline, quic-go 不会 用到
+func (*multiSocketReader) SetDeadline(t time.Time) error      { return nil }
+func (*multiSocketReader) SetReadDeadline(t time.Time) error  { return nil }
+func (*multiSocketReader) SetWriteDeadline(t time.Time) error { return nil }
+
+// 客户端 使用的 net.PacketConn, 会 定时 换 服务端端口 和 本地socket, 写入出错时 也会 换 本地socket.
+type hopPacketConn struct {
+	multiSocketReader
+
+	serverIP net.IP
+	ports    []int
+	interval time.Duration
+
+	//ReadFrom 总是 返回 这个地址, 这样 quic-go 看到的 对端地址 就是 固定的
+	fixedRemote *net.UDPAddr
+
+	mutex         sync.Mutex
+	current, prev *net.UDPConn
+	currentAddr   *net.UDPAddr
+}
+
+func newHopPacketConn(serverAddr *net.UDPAddr, ports []int, interval time.Duration) (*hopPacketConn, error) {
+	if len(ports) == 0 {
+		ports = []int{serverAddr.Port}
+	}
+	c := &hopPacketConn{
+		multiSocketReader: newMultiSocketReader(),
+		serverIP:          serverAddr.IP,
+		ports:             ports,
+		interval:          interval,
+		fixedRemote:       serverAddr,
+		currentAddr:       serverAddr,
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	c.current = conn
+	go c.readLoop(conn)
+
+	if len(ports) > 1 && interval > 0 {
+		go c.hopLoop()
+	}
+	return c, nil
+}
+
+func (c *hopPacketConn) hopLoop() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-ticker.C:
+			port := c.ports[rand.Intn(len(c.ports))]
+			c.rebind(&net.UDPAddr{IP: c.serverIP, Port: port}, "QUIC port hopping")
+		}
+	}
+}
+
+// 换一个 新的 本地socket. 旧的 socket 保留到 下一次 rebind, 以便 接收 路上 还没到的 包.
+func (c *hopPacketConn) rebind(newRemote *net.UDPAddr, reason string) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		if ce := utils.CanLogErr("QUIC rebind udp failed"); ce != nil {
+			ce.Write(zap.String("reason", reason), zap.Error(err))
+		}
+		return
+	}
+
+	c.mutex.Lock()
+	select {
+	case <-c.closeChan:
+		c.mutex.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	oldPrev := c.prev
+	oldAddr := c.currentAddr
+	c.prev = c.current
+	c.current = conn
+	c.currentAddr = newRemote
+	c.mutex.Unlock()
+
+	if oldPrev != nil {
+		oldPrev.Close()
+	}
+	go c.readLoop(conn)
+
+	if ce := utils.CanLogInfo(reason); ce != nil {
+		ce.Write(
+			zap.String("from", oldAddr.String()),
+			zap.String("to", newRemote.String()),
+			zap.String("newLocal", conn.LocalAddr().String()),
+		)
+	}
+}
+
+func (c *hopPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := c.read(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, c.fixedRemote, nil
+}
+
+// 忽略 addr, 总是 发往 当前端口
+func (c *hopPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.mutex.Lock()
+	conn, addr := c.current, c.currentAddr
+	c.mutex.Unlock()
+
+	_, err := conn.WriteToUDP(b, addr)
+	if err != nil {
+		select {
+		case <-c.closeChan:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		//网络 可能 变了, 换个 socket 再试一次; 再失败 就 当作 丢包, 不返回错误, 否则 quic-go 会 关闭 连接
+		if ce := utils.CanLogDebug("QUIC udp write failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		c.mutex.Lock()
+		changed := c.current != conn
+		c.mutex.Unlock()
+		if !changed {
+			c.rebind(addr, "QUIC connection migration")
+		}
+
+		c.mutex.Lock()
+		conn, addr = c.current, c.currentAddr
+		c.mutex.Unlock()
+		conn.WriteToUDP(b, addr)
+	}
+	return len(b), nil
+}
+
+func (c *hopPacketConn) LocalAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current.LocalAddr()
+}
+
+func (c *hopPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		close(c.closeChan)
+		c.current.Close()
+		if c.prev != nil {
+			c.prev.Close()
+		}
+		c.mutex.Unlock()
+	})
+	return nil
+}
+
+// 服务端 使用的 net.PacketConn, 同时 监听 多个端口 或 多个 ip.
+// 回包 时 从 最后一次 收到 该地址 的包 的 那个 socket 发出.
+type multiPortPacketConn struct {
+	multiSocketReader
+
+	conns []*net.UDPConn
+
+	mutex  sync.Mutex
+	routes map[netip.AddrPort]routeEntry
+	swept  time.Time
+}
+
+type routeEntry struct {
+	conn     *net.UDPConn
+	lastSeen time.Time
+}
+
+const routeExpire = time.Minute * 5
+
+// 监听 addrs 中 的 所有 udp 地址, 只有 一个 时 直接 返回 *net.UDPConn;
+// 多个 时 返回 的 PacketConn 从 所有 socket 读取, 回包 时 从 收到 对方 包 的 那个 socket 发出.
+// 也用于 tuic 和 hysteria2 等 自己 监听 quic 的 协议.
+func ListenUDP(addrs []string) (net.PacketConn, error) {
+	var uaddrs []*net.UDPAddr
+	seen := make(map[string]bool)
+	for _, a := range addrs {
+		ua, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[ua.String()] {
+			seen[ua.String()] = true
+			uaddrs = append(uaddrs, ua)
+		}
+	}
+	switch len(uaddrs) {
+	case 0:
+		return nil, utils.ErrInErr{ErrDesc: "QUIC ListenUDP, no addr", ErrDetail: utils.ErrInvalidData}
+	case 1:
+		return net.ListenUDP("udp", uaddrs[0])
+	}
+	return listenMultiAddr(uaddrs)
+}
+
+func listenMultiAddr(addrs []*net.UDPAddr) (*multiPortPacketConn, error) {
+	c := &multiPortPacketConn{
+		multiSocketReader: newMultiSocketReader(),
+		routes:            make(map[netip.AddrPort]routeEntry),
+		swept:             time.Now(),
+	}
+	for _, a := range addrs {
+		conn, err := net.ListenUDP("udp", a)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns = append(c.conns, conn)
+	}
+	for _, conn := range c.conns {
+		go c.readLoop(conn)
+	}
+	return c, nil
+}
+
+func (c *multiPortPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, p, err := c.read(b)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	key := p.addr.AddrPort()
+	now := time.Now()
+
+	c.mutex.Lock()
+	old, has := c.routes[key]
+	c.routes[key] = routeEntry{conn: p.from, lastSeen: now}
+
+	if now.Sub(c.swept) > routeExpire {
+		c.swept = now
+		for k, v := range c.routes {
+			if now.Sub(v.lastSeen) > routeExpire {
+				delete(c.routes, k)
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	if has && old.conn != p.from {
+		if ce := utils.CanLogDebug("QUIC client hopped to another port"); ce != nil {
+			ce.Write(zap.String("client", p.addr.String()), zap.String("port", p.from.LocalAddr().String()))
+		}
+	} else if !has {
+		if ce := utils.CanLogDebug("QUIC got packet from new addr"); ce != nil {
+			ce.Write(zap.String("client", p.addr.String()), zap.String("port", p.from.LocalAddr().String()))
+		}
+	}
+
+	return n, p.addr, nil
+}
+
+func (c *multiPortPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, utils.ErrInErr{ErrDesc: "QUIC multiPortPacketConn WriteTo got wrong addr type", Data: addr}
+	}
+	c.mutex.Lock()
+	e, has := c.routes[ua.AddrPort()]
+	c.mutex.Unlock()
+
+	conn := c.conns[0]
+	if has {
+		conn = e.conn
+	}
+	return conn.WriteToUDP(b, ua)
+}
+
+func (c *multiPortPacketConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+func (c *multiPortPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		for _, conn := range c.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,184 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+)
+
+func TestGetHopFromExtra(t *testing.T) {
+	ports, interval, err := getHopFromExtra(map[string]any{"hop_ports": "2000-2002,443", "hop_interval": 1}, 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 4 || ports[0] != 443 || ports[3] != 2002 {
+		t.Fatal("wrong ports", ports)
+	}
+	if interval != minHopInterval {
+		t.Fatal("wrong interval", interval)
+	}
+
+	ports, _, err = getHopFromExtra(map[string]any{}, 443)
+	if err != nil || ports != nil {
+		t.Fatal("should not hop", ports, err)
+	}
+
+	_, _, err = getHopFromExtra(map[string]any{"hop_ports": "abc"}, 443)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+// 服务端 监听 多个端口, 客户端 快速 跳跃, 连接 应 一直可用
+func TestPortHopping(t *testing.T) {
+	initTestLog()
+
+	var ports []int
+	for len(ports) < 3 {
+		p := netLayer.RandPort(true, true, 0)
+		if len(ports) == 0 || p != ports[len(ports)-1] {
+			ports = append(ports, p)
+		}
+	}
+
+	serverTls := &tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert(), NextProtos: DefaultAlpnList}
+
+	addr := "127.0.0.1:" + strconv.Itoa(ports[0])
+	closer := ListenInitialLayers(addr, *serverTls.Clone(), arguments{early: true, hopPorts: ports}, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	if closer == nil {
+		t.Fatal("listen failed")
+	}
+	defer closer.Close()
+
+	na, _ := netLayer.NewAddr(addr)
+	client := NewClient(&na, tls.Config{InsecureSkipVerify: true, NextProtos: DefaultAlpnList}, arguments{
+		early:       true,
+		hopPorts:    ports,
+		hopInterval: time.Millisecond * 100,
+	})
+
+	state, err := client.getCommonConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.DialSubConn(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	payload := make([]byte, 1000)
+	for i := 0; i < 15; i++ {
+		payload[0] = byte(i)
+		if _, err := stream.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(payload))
+		stream.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(stream, got); err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("not equal", i)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// 服务端 同时 监听 多个 ip 和 端口, 客户端 连 任一 地址 都 可用
+func TestListenMultiAddr(t *testing.T) {
+	initTestLog()
+
+	p1, p2 := netLayer.RandPort(true, true, 0), netLayer.RandPort(true, true, 0)
+	for p2 == p1 {
+		p2 = netLayer.RandPort(true, true, 0)
+	}
+	addrs := []string{"127.0.0.1:" + strconv.Itoa(p1), "127.0.0.2:" + strconv.Itoa(p2)}
+
+	serverTls := &tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert(), NextProtos: DefaultAlpnList}
+	closer := ListenInitialLayers(addrs[0], *serverTls.Clone(), arguments{listenAddrs: addrs}, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	if closer == nil {
+		t.Fatal("listen failed")
+	}
+	defer closer.Close()
+
+	for _, addr := range addrs {
+		na, _ := netLayer.NewAddr(addr)
+		client := NewClient(&na, tls.Config{InsecureSkipVerify: true, NextProtos: DefaultAlpnList}, arguments{})
+		state, err := client.getCommonConn(nil)
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		stream, err := client.DialSubConn(state)
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		stream.Write([]byte(addr))
+		got := make([]byte, len(addr))
+		stream.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(stream, got); err != nil || string(got) != addr {
+			t.Fatal(addr, string(got), err)
+		}
+		stream.Close()
+		state.CloseWithError(0, "")
+	}
+}
+
+// 开启 early 后, 重连时 应 恢复会话 并 使用 0-RTT
+func TestEarlyResumption(t *testing.T) {
+	initTestLog()
+
+	port := netLayer.RandPort(true, true, 0)
+	serverTls := &tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert(), NextProtos: DefaultAlpnList}
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	closer := ListenInitialLayers(addr, *serverTls.Clone(), arguments{early: true}, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	if closer == nil {
+		t.Fatal("listen failed")
+	}
+	defer closer.Close()
+
+	na, _ := netLayer.NewAddr(addr)
+	client := NewClient(&na, tls.Config{InsecureSkipVerify: true, NextProtos: DefaultAlpnList}, arguments{early: true})
+
+	for i := 0; i < 2; i++ {
+		state, err := client.getCommonConn(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := client.DialSubConn(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello := []byte("hello")
+		stream.Write(hello)
+		got := make([]byte, len(hello))
+		stream.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(stream, got); err != nil {
+			t.Fatal(err)
+		}
+
+		tlsState := state.ConnectionState().TLS
+		if i == 1 && (!tlsState.DidResume || !tlsState.Used0RTT) {
+			t.Fatal("second dial should resume with 0-RTT", tlsState.DidResume, tlsState.Used0RTT)
+		}
+		stream.Close()
+		state.CloseWithError(0, "")
+	}
+}
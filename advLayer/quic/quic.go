@@ -9,6 +9,10 @@ Hysteria Brutal Congestion Control
 
 我们这里利用其阻控，但是没有使用hysteria的通知速率和 auth的 数据头，也就是说我们这里是纯quic协议的情况下使用了hysteria的优点。
 
+若要 与 hysteria2 互通 (包括 通知速率 与 认证), 见 proxy/hysteria2, 它 复用了 这里的 BrutalSender.
+
+除了 brutal, 还可以 选择 bbr, cubic, newreno, 并且 客户端 可以 请求 服务端 使用的 阻控, 详见 congestion.go.
+
 我们要是以后不使用hysteria的话，只需删掉 useHysteria 里的代码, 删掉 pacer.go/brutal.go, 并删掉 go.mod中的replace部分.
 然后proxy.go里的 相关配置部分也要删掉 在 prepareTLS_for* 函数中 的相关配置 即可.
 
@@ -21,6 +25,13 @@ Imperfect Package
 
 实际上就是因为quic-go包占用cpu太猛了，导致cpu占用率达到100%瓶颈，所以速度无法进一步提高。
 
+Port Hopping, Migration and 0-RTT
+
+extra 中 配置 hop_ports (如 "20000-20010,443") 后, 服务端 会 同时监听 这些端口, 客户端 每隔 hop_interval 秒 (默认30) 换一个端口.
+配置了 hop_ports 时, 客户端 写udp 出错 也会 换一个 本地socket 迁移 连接. 详见 hop.go.
+
+客户端 开启 early 时, 会 缓存 tls session ticket 与 quic token, 重连时 即可 使用 0-RTT.
+
 */
 package quic
 
@@ -93,9 +104,22 @@ func CloseConn(conn any) {
 }
 
 type arguments struct {
-	useHysteria, hysteria_manual, early bool
-	customMaxStreamsInOneConn           int64
-	hysteriaMaxByteCount                int
+	early                     bool
+	customMaxStreamsInOneConn int64
+
+	congestion congestionConf
+
+	//客户端: 请求 服务端 使用的 阻控, name 为空 则 不请求
+	serverCongestion congestionConf
+
+	//服务端: 是否 接受 客户端 请求的 阻控, 以及 brutal 速率 的 上限
+	allowClientCongestion bool
+	maxClientBps          int
+
+	hopPorts    []int //包含主端口; 为空 表示 不使用 port hopping
+	hopInterval time.Duration
+
+	listenAddrs []string //服务端 监听 多个 地址 时 给出, 见 advLayer.Conf.ListenAddrs
 }
 
 type Creator struct{}
@@ -133,11 +157,16 @@ func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
 		alpn = DefaultAlpnList
 	}
 
-	var useHysteria, hysteria_manual bool
-	var maxbyteCount int
+	var args arguments
 
 	if conf.Extra != nil {
-		useHysteria, hysteria_manual, maxbyteCount, _ = getExtra(conf.Extra)
+		args.congestion, _ = getExtra(conf.Extra)
+		args.serverCongestion = getServerCongestionFromExtra(conf.Extra)
+	}
+
+	hopPorts, hopInterval, err := getHopFromExtra(conf.Extra, conf.Addr.Port)
+	if err != nil {
+		return nil, err
 	}
 
 	var tConf tls.Config
@@ -147,19 +176,16 @@ func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
 	}
 	tConf.NextProtos = alpn
 
-	return NewClient(&conf.Addr, tConf, arguments{
-		early:                conf.IsEarly,
-		useHysteria:          useHysteria,
-		hysteria_manual:      hysteria_manual,
-		hysteriaMaxByteCount: maxbyteCount,
-	}), nil
+	args.early = conf.IsEarly
+	args.hopPorts = hopPorts
+	args.hopInterval = hopInterval
+
+	return NewClient(&conf.Addr, tConf, args), nil
 }
 
 func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
 
-	var useHysteria, hysteria_manual bool
-	var maxbyteCount int
-	var maxStreamCountInOneConn int64
+	var args arguments
 
 	tlsConf := *conf.TlsConf
 	if len(tlsConf.NextProtos) == 0 {
@@ -168,27 +194,52 @@ func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
 
 	if conf.Extra != nil {
 
-		useHysteria, hysteria_manual, maxbyteCount, maxStreamCountInOneConn = getExtra(conf.Extra)
+		args.congestion, args.customMaxStreamsInOneConn = getExtra(conf.Extra)
 
+		args.allowClientCongestion, _ = utils.AnyToBool(conf.Extra["allow_client_congestion_control"])
+		if mbps, ok := utils.AnyToInt64(conf.Extra["max_client_mbps"]); ok && mbps > 0 {
+			args.maxClientBps = int(mbps) * 1024 * 1024 / 8
+		}
+	}
+
+	hopPorts, _, err := getHopFromExtra(conf.Extra, conf.Addr.Port)
+	if err != nil {
+		return nil, err
 	}
 
+	args.early = conf.IsEarly
+	args.hopPorts = hopPorts
+	args.listenAddrs = conf.ListenAddrs
+
 	return &Server{
 		addr:    conf.Addr.String(),
 		tlsConf: tlsConf,
-		args: arguments{
-			useHysteria:               useHysteria,
-			hysteria_manual:           hysteria_manual,
-			hysteriaMaxByteCount:      maxbyteCount,
-			customMaxStreamsInOneConn: maxStreamCountInOneConn,
-			early:                     conf.IsEarly,
-		},
+		args:    args,
 	}, nil
 }
 
+// 客户端 请求 服务端 使用的 阻控: server_congestion_control, server_mbps
+func getServerCongestionFromExtra(extra map[string]any) (cc congestionConf) {
+	str, _ := extra["server_congestion_control"].(string)
+	if str == "" {
+		return
+	}
+	name, ok := parseCongestionName(str)
+	if !ok || name == "" {
+		if ce := utils.CanLogErr("Unknown QUIC server_congestion_control, ignored"); ce != nil {
+			ce.Write(zap.String("value", str))
+		}
+		return
+	}
+	cc.name = name
+	if mbps, ok := utils.AnyToInt64(extra["server_mbps"]); ok && mbps > 0 {
+		cc.bps = int(mbps) * 1024 * 1024 / 8
+	}
+	return
+}
+
 //从配置map中读取更多配置信息。一般在程序刚运行时调用。为了保证信息绝对能输出，就是用了 log包来以防万一。
-func getExtra(extra map[string]any) (useHysteria, hysteria_manual bool,
-	maxbyteCount int,
-	maxStreamsInOneConn int64) {
+func getExtra(extra map[string]any) (cc congestionConf, maxStreamsInOneConn int64) {
 
 	if thing := extra["maxStreamsInOneConn"]; thing != nil {
 		if count, ok := utils.AnyToInt64(thing); ok && count > 0 {
@@ -205,63 +256,109 @@ func getExtra(extra map[string]any) (useHysteria, hysteria_manual bool,
 	}
 
 	if thing := extra["congestion_control"]; thing != nil {
-		if use, ok := thing.(string); ok && use == "hy" {
-			useHysteria = true
-
-			if thing := extra["mbps"]; thing != nil {
-				if mbps, ok := utils.AnyToInt64(thing); ok && mbps > 1 {
-					maxbyteCount = int(mbps) * 1024 * 1024 / 8
-				}
+		if str, ok := thing.(string); ok {
+			if name, ok := parseCongestionName(str); ok {
+				cc.name = name
 			} else {
-				maxbyteCount = Default_hysteriaMaxByteCount
+				if ce := utils.CanLogErr("Unknown QUIC congestion_control, use default"); ce != nil {
+					ce.Write(zap.String("value", str))
+				} else {
+					log.Println("Unknown QUIC congestion_control, use default", str)
+				}
 			}
+		}
+	}
 
-			if ce := utils.CanLogInfo("Using Hysteria Congestion Control"); ce != nil {
-				ce.Write(zap.Int("max upload mbps,", int(maxbyteCount)))
-			} else {
-				log.Println("Using Hysteria Congestion Control, max upload mbps: ", maxbyteCount)
-
+	switch cc.name {
+	case "":
+	case CongestionBrutal:
+		if thing := extra["mbps"]; thing != nil {
+			if mbps, ok := utils.AnyToInt64(thing); ok && mbps > 1 {
+				cc.bps = int(mbps) * 1024 * 1024 / 8
 			}
+		} else {
+			cc.bps = Default_hysteriaMaxByteCount
+		}
 
-			if thing := extra["hy_manual"]; thing != nil {
-				if ismanual, ok := utils.AnyToBool(thing); ok {
-					hysteria_manual = ismanual
-					if ismanual {
-
-						if ce := utils.CanLogInfo("Using Hysteria Manual Control Mode"); ce != nil {
-							ce.Write()
-						} else {
-							log.Println("Using Hysteria Manual Control Mode")
-						}
-
-						if thing := extra["hy_manual_initial_rate"]; thing != nil {
-							if initRate, ok := utils.AnyToFloat64(thing); ok {
+		if ce := utils.CanLogInfo("Using Hysteria Congestion Control"); ce != nil {
+			ce.Write(zap.Int("max upload mbps,", int(cc.bps)))
+		} else {
+			log.Println("Using Hysteria Congestion Control, max upload mbps: ", cc.bps)
 
-								if rateOk(initRate) == 0 {
-									TheCustomRate = initRate
-									if ce := utils.CanLogInfo("Hysteria Manual Control Initial Rate"); ce != nil {
-										ce.Write(zap.Float64("rate", initRate))
-									} else {
-										log.Println("Hysteria Manual Control Initial Rate", initRate)
-									}
+		}
 
+		if thing := extra["hy_manual"]; thing != nil {
+			if ismanual, ok := utils.AnyToBool(thing); ok {
+				cc.manual = ismanual
+				if ismanual {
+					if ce := utils.CanLogInfo("Using Hysteria Manual Control Mode"); ce != nil {
+						ce.Write()
+					} else {
+						log.Println("Using Hysteria Manual Control Mode")
+					}
+
+					if thing := extra["hy_manual_initial_rate"]; thing != nil {
+						if initRate, ok := utils.AnyToFloat64(thing); ok {
+
+							if rateOk(initRate) == 0 {
+								TheCustomRate = initRate
+								if ce := utils.CanLogInfo("Hysteria Manual Control Initial Rate"); ce != nil {
+									ce.Write(zap.Float64("rate", initRate))
 								} else {
-									if ce := utils.CanLogErr("hy_manual_initial_rate not within threshold"); ce != nil {
-										ce.Write(zap.Float64("wrongValue", initRate))
-									} else {
-										log.Println("hy_manual_initial_rate not within threshold", initRate)
-									}
+									log.Println("Hysteria Manual Control Initial Rate", initRate)
+								}
 
+							} else {
+								if ce := utils.CanLogErr("hy_manual_initial_rate not within threshold"); ce != nil {
+									ce.Write(zap.Float64("wrongValue", initRate))
+								} else {
+									log.Println("hy_manual_initial_rate not within threshold", initRate)
 								}
 
 							}
+
 						}
+					}
 
-					} // ismanual
-				} // ismanual, ok
-			} // hy_manual
-		} // use hysteria
+				} // ismanual
+			} // ismanual, ok
+		} // hy_manual
+	default:
+		if ce := utils.CanLogInfo("Using QUIC Congestion Control"); ce != nil {
+			ce.Write(zap.String("name", cc.name))
+		} else {
+			log.Println("Using QUIC Congestion Control", cc.name)
+		}
 	} //congestion control
 
 	return
 }
+
+// 返回 common_ListenConfig 或 common_DialConfig 的副本.
+// 供 直接使用 quic.Connection 而不使用 advLayer 的 代理协议 (如 proxy/tuic) 使用.
+func GetCommonConfig(isServer bool) quic.Config {
+	if isServer {
+		return common_ListenConfig
+	}
+	return common_DialConfig
+}
+
+// 按 extra 中的 congestion_control, mbps, hy_manual 等配置 (与 advLayer quic 的 extra 格式相同) 返回 一个 设置阻控的函数;
+// 若没有配置 阻控, 返回 nil. 与 GetCommonConfig 一样, 供 直接使用 quic.Connection 的 代理协议 使用.
+func NewCongestionSetterFromExtra(extra map[string]any, isServer bool) func(quic.Connection) {
+	if extra == nil {
+		return nil
+	}
+	cc, _ := getExtra(extra)
+	if cc.name == "" {
+		return nil
+	}
+	return func(conn quic.Connection) {
+		setCongestion(conn, cc, isServer, getConnAddrs(conn))
+	}
+}
+
+// 为 conn 设置 brutal阻控, bps 为 发送速率(字节每秒). 供 在连接建立后 才能确定速率 的 代理协议 (如 proxy/hysteria2) 使用.
+func SetBrutalForConn(conn quic.Connection, manual bool, bps int, isServer bool) {
+	setCongestion(conn, congestionConf{name: CongestionBrutal, manual: manual, bps: bps}, isServer, getConnAddrs(conn))
+}
@@ -5,11 +5,11 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"strconv"
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/congestion"
 	"go.uber.org/zap"
 )
 
@@ -50,7 +50,7 @@ func (s *Server) StartListen(newSubConnFunc func(net.Conn)) (baseConn io.Closer)
 
 // 阻塞，不支持回落。
 func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), _ func(httpLayer.FallbackMeta)) {
-	dealNewConn(underlay.(quic.Connection), newSubConnFunc)
+	dealNewConn(underlay.(quic.Connection), nil, newSubConnFunc)
 }
 
 // non-blocking
@@ -60,6 +60,10 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 	if arg.customMaxStreamsInOneConn > 0 {
 		thisConfig.MaxIncomingStreams = arg.customMaxStreamsInOneConn
 	}
+	if arg.allowClientCongestion {
+		//客户端 用 单向流 发送 阻控请求
+		thisConfig.MaxIncomingUniStreams = 1
+	}
 
 	var listener quic.Listener
 	var elistener quic.EarlyListener
@@ -67,20 +71,40 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 
 	//自己listen，而不是调用 quic.ListenAddr, 这样可以为以后支持 udp的 proxy protocol v2 作准备。
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		if ce := utils.CanLogErr("Failed in QUIC ResolveUDPAddr"); ce != nil {
-			ce.Write(zap.Error(err))
+	addrs := arg.listenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{addr}
+	}
+	if len(arg.hopPorts) > 1 {
+		//每个 监听 ip 上 都 监听 所有 hop_ports
+		var hopAddrs []string
+		for _, a := range addrs {
+			host, _, err := net.SplitHostPort(a)
+			if err != nil {
+				if ce := utils.CanLogErr("Failed in QUIC parse listen addr"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+				return
+			}
+			for _, p := range arg.hopPorts {
+				hopAddrs = append(hopAddrs, net.JoinHostPort(host, strconv.Itoa(p)))
+			}
 		}
-		return
+		addrs = hopAddrs
 	}
-	conn, err := net.ListenUDP("udp", udpAddr)
+
+	conn, err := ListenUDP(addrs)
 	if err != nil {
 		if ce := utils.CanLogErr("Failed in QUIC listen udp"); ce != nil {
 			ce.Write(zap.Error(err))
 		}
 		return
 	}
+	if len(addrs) > 1 {
+		if ce := utils.CanLogInfo("QUIC listening on multiple addresses"); ce != nil {
+			ce.Write(zap.Strings("addrs", addrs))
+		}
+	}
 
 	if arg.early {
 		utils.Info("quic Listen Early")
@@ -95,29 +119,27 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 		if ce := utils.CanLogErr("Failed in QUIC listen"); ce != nil {
 			ce.Write(zap.Error(err))
 		}
+		conn.Close()
 		return
 	}
 
-	if arg.useHysteria {
-		if arg.hysteriaMaxByteCount <= 0 {
-			arg.hysteriaMaxByteCount = Default_hysteriaMaxByteCount
-		}
-	}
-
 	if arg.early {
-		go loopAcceptEarly(elistener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
+		go loopAcceptEarly(elistener, newSubConnFunc, &arg)
 		returnCloser = elistener
 	} else {
-		go loopAccept(listener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
+		go loopAccept(listener, newSubConnFunc, &arg)
 
 		returnCloser = listener
 	}
 
+	//quic.Listen 不会 关闭 我们传入的 conn
+	returnCloser = &utils.MultiCloser{Closers: []io.Closer{returnCloser, conn}}
+
 	return
 }
 
 // 阻塞
-func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
+func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), arg *arguments) {
 	for {
 
 		conn, err := l.Accept(context.Background())
@@ -129,17 +151,17 @@ func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), useHysteria bool
 			return
 		}
 
-		if useHysteria {
-			configHyForConn(conn, hysteria_manual, hysteriaMaxByteCount)
-		}
-
-		go dealNewConn(conn, newSubConnFunc)
+		addrs := getConnAddrs(conn)
+		go func() {
+			firstStream := arg.setServerCongestion(conn, addrs)
+			dealNewConn(conn, firstStream, newSubConnFunc)
+		}()
 
 	}
 }
 
 // 阻塞
-func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
+func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), arg *arguments) {
 
 	for {
 
@@ -151,29 +173,20 @@ func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), useHy
 			return
 		}
 
-		if useHysteria {
-			configHyForConn(conn, hysteria_manual, hysteriaMaxByteCount)
-		}
-
-		go dealNewConn(conn, newSubConnFunc)
+		addrs := getConnAddrs(conn)
+		go func() {
+			firstStream := arg.setServerCongestion(conn, addrs)
+			dealNewConn(conn, firstStream, newSubConnFunc)
+		}()
 
 	}
 }
 
-func configHyForConn(conn quic.Connection, hysteria_manual bool, hysteriaMaxByteCount int) {
-	if hysteria_manual {
-		bs := NewBrutalSender_M(congestion.ByteCount(hysteriaMaxByteCount))
-
-		conn.SetCongestionControl(bs)
-	} else {
-		bs := NewBrutalSender(congestion.ByteCount(hysteriaMaxByteCount))
-
-		conn.SetCongestionControl(bs)
+// 阻塞. firstStream 不为 nil 时 先 处理 它, 见 setServerCongestion
+func dealNewConn(conn quic.Connection, firstStream quic.Stream, newSubConnFunc func(net.Conn)) {
+	if firstStream != nil {
+		go newSubConnFunc(&StreamConn{firstStream, conn.LocalAddr(), conn.RemoteAddr(), nil, false})
 	}
-}
-
-// 阻塞
-func dealNewConn(conn quic.Connection, newSubConnFunc func(net.Conn)) {
 
 	for {
 		stream, err := conn.AcceptStream(context.Background())
@@ -0,0 +1,167 @@
+package quic
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/congestion"
+)
+
+// ConnStats 是 一条 quic连接 的 阻控 统计信息, api server 的 quicStats 会 输出 所有 活跃连接的 ConnStats.
+// 只有 设置了 阻控 (congestion_control 不为空) 的 连接 才有 统计.
+type ConnStats struct {
+	ID         uint64 `json:"id"`
+	IsServer   bool   `json:"isServer"`
+	Local      string `json:"local"`
+	Remote     string `json:"remote"`
+	Congestion string `json:"congestion"`
+	Mbps       int    `json:"mbps,omitempty"` //brutal 的 发送速率
+	Uptime     string `json:"uptime"`
+
+	SmoothedRTTMs float64 `json:"smoothedRttMs"`
+	MinRTTMs      float64 `json:"minRttMs"`
+	LatestRTTMs   float64 `json:"latestRttMs"`
+
+	Cwnd        int64   `json:"cwnd"`
+	SentPackets uint64  `json:"sentPackets"`
+	SentBytes   uint64  `json:"sentBytes"`
+	LostPackets uint64  `json:"lostPackets"`
+	LostBytes   uint64  `json:"lostBytes"`
+	LossRate    float64 `json:"lossRate"`
+}
+
+// 包装 一个 阻控, 记录 统计信息. 阻控的 方法 都在 quic-go 的 连接 goroutine 中 调用,
+// 而 统计 会被 api server 读取, 所以 用 原子操作 保存 快照.
+type statsSender struct {
+	congestion.CongestionControl
+
+	rttStats congestion.RTTStatsProvider
+
+	sentPackets, sentBytes, lostPackets, lostBytes uint64
+
+	smoothedRTT, minRTT, latestRTT, cwnd int64
+
+	info ConnStats //只读 部分
+}
+
+func (s *statsSender) SetRTTStatsProvider(provider congestion.RTTStatsProvider) {
+	s.rttStats = provider
+	s.CongestionControl.SetRTTStatsProvider(provider)
+}
+
+func (s *statsSender) OnPacketSent(sentTime time.Time, bytesInFlight congestion.ByteCount, packetNumber congestion.PacketNumber, bytes congestion.ByteCount, isRetransmittable bool) {
+	atomic.AddUint64(&s.sentPackets, 1)
+	atomic.AddUint64(&s.sentBytes, uint64(bytes))
+	s.CongestionControl.OnPacketSent(sentTime, bytesInFlight, packetNumber, bytes, isRetransmittable)
+}
+
+func (s *statsSender) OnPacketAcked(number congestion.PacketNumber, ackedBytes congestion.ByteCount, priorInFlight congestion.ByteCount, eventTime time.Time) {
+	s.CongestionControl.OnPacketAcked(number, ackedBytes, priorInFlight, eventTime)
+
+	if s.rttStats != nil {
+		atomic.StoreInt64(&s.smoothedRTT, int64(s.rttStats.SmoothedRTT()))
+		atomic.StoreInt64(&s.minRTT, int64(s.rttStats.MinRTT()))
+		atomic.StoreInt64(&s.latestRTT, int64(s.rttStats.LatestRTT()))
+	}
+	atomic.StoreInt64(&s.cwnd, int64(s.CongestionControl.GetCongestionWindow()))
+}
+
+func (s *statsSender) OnPacketLost(number congestion.PacketNumber, lostBytes congestion.ByteCount, priorInFlight congestion.ByteCount) {
+	atomic.AddUint64(&s.lostPackets, 1)
+	atomic.AddUint64(&s.lostBytes, uint64(lostBytes))
+	s.CongestionControl.OnPacketLost(number, lostBytes, priorInFlight)
+	atomic.StoreInt64(&s.cwnd, int64(s.CongestionControl.GetCongestionWindow()))
+}
+
+func (s *statsSender) snapshot(now time.Time, start time.Time) ConnStats {
+	cs := s.info
+	cs.Uptime = now.Sub(start).Round(time.Second).String()
+
+	toMs := func(p *int64) float64 {
+		return float64(atomic.LoadInt64(p)) / float64(time.Millisecond)
+	}
+	cs.SmoothedRTTMs = toMs(&s.smoothedRTT)
+	cs.MinRTTMs = toMs(&s.minRTT)
+	cs.LatestRTTMs = toMs(&s.latestRTT)
+	cs.Cwnd = atomic.LoadInt64(&s.cwnd)
+	cs.SentPackets = atomic.LoadUint64(&s.sentPackets)
+	cs.SentBytes = atomic.LoadUint64(&s.sentBytes)
+	cs.LostPackets = atomic.LoadUint64(&s.lostPackets)
+	cs.LostBytes = atomic.LoadUint64(&s.lostBytes)
+	if cs.SentPackets > 0 {
+		cs.LossRate = float64(cs.LostPackets) / float64(cs.SentPackets)
+	}
+	return cs
+}
+
+type statsEntry struct {
+	sender *statsSender
+	start  time.Time
+}
+
+var (
+	statsMutex   sync.Mutex
+	statsMap     = make(map[uint64]statsEntry)
+	statsCounter uint64
+)
+
+// 连接 建立 时 记下 的 地址. quic-go 服务端 会 在 连接 goroutine 中 不加锁 地 更新 对端地址,
+// 所以 应在 accept 时 读取 一次, 而 不是 之后 在 其它 goroutine 中 读取.
+type connAddrs struct {
+	local, remote string
+}
+
+func getConnAddrs(conn quic.Connection) connAddrs {
+	return connAddrs{local: conn.LocalAddr().String(), remote: conn.RemoteAddr().String()}
+}
+
+// 包装 sender 并 登记, 连接 关闭 后 自动 注销
+func newStatsSender(conn quic.Connection, sender congestion.CongestionControl, cc congestionConf, isServer bool, addrs connAddrs) *statsSender {
+	s := &statsSender{
+		CongestionControl: sender,
+		info: ConnStats{
+			IsServer:   isServer,
+			Local:      addrs.local,
+			Remote:     addrs.remote,
+			Congestion: cc.name,
+		},
+	}
+	if cc.name == CongestionBrutal {
+		s.info.Mbps = cc.bps * 8 / 1024 / 1024
+	}
+
+	statsMutex.Lock()
+	statsCounter++
+	id := statsCounter
+	s.info.ID = id
+	statsMap[id] = statsEntry{sender: s, start: time.Now()}
+	statsMutex.Unlock()
+
+	go func() {
+		<-conn.Context().Done()
+		statsMutex.Lock()
+		delete(statsMap, id)
+		statsMutex.Unlock()
+	}()
+	return s
+}
+
+// 返回 所有 活跃的 设置了 阻控 的 quic连接 的 统计信息, 按 建立顺序 排列
+func GetConnStats() []ConnStats {
+	now := time.Now()
+
+	statsMutex.Lock()
+	result := make([]ConnStats, 0, len(statsMap))
+	for _, e := range statsMap {
+		result = append(result, e.sender.snapshot(now, e.start))
+	}
+	statsMutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
@@ -0,0 +1,303 @@
+package splithttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// implements advLayer.MuxClient
+type Client struct {
+	Creator
+
+	host string
+	path string
+
+	requestHeader  http.Header
+	responseHeader map[string][]string
+
+	cachedTransport *http2.Transport //与 grpcSimple 一样, 一个 transport 对应 一个 dial好的 tls 连接
+}
+
+func NewClient(host, path string, headers *httpLayer.HeaderPreset) *Client {
+	c := &Client{
+		host: host,
+		path: normalizePath(path),
+	}
+	if headers != nil && headers.Request != nil && len(headers.Request.Headers) > 0 {
+		c.requestHeader = http.Header(headers.Request.Headers).Clone()
+	}
+	if headers != nil && headers.Response != nil && len(headers.Response.Headers) > 0 {
+		c.responseHeader = headers.Response.Headers
+	}
+	return c
+}
+
+func (c *Client) GetPath() string {
+	return c.path
+}
+
+func (c *Client) IsEarly() bool {
+	return false
+}
+
+func (c *Client) dealErr(err error) {
+	if errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed") {
+		c.cachedTransport = nil
+	}
+}
+
+func (c *Client) GetCommonConn(underlay net.Conn) (any, error) {
+	if underlay == nil {
+		if c.cachedTransport != nil {
+			return c.cachedTransport, nil
+		} else {
+			return nil, errors.New("splithttp.GetCommonConn: underlay==nil and no cachedTranspot")
+		}
+	} else {
+		return underlay, nil
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body []byte) *http.Request {
+	rq := &http.Request{
+		Method: method,
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   c.host,
+			Path:   path,
+		},
+		Proto:      "HTTP/2",
+		ProtoMajor: 2,
+		ProtoMinor: 0,
+		Header:     make(http.Header),
+	}
+	for k, vs := range c.requestHeader {
+		rq.Header[k] = vs
+	}
+	if body != nil {
+		rq.Body = io.NopCloser(bytes.NewReader(body))
+		rq.ContentLength = int64(len(body))
+	}
+	return rq.WithContext(ctx)
+}
+
+func (c *Client) DialSubConn(underlay any) (net.Conn, error) {
+	if underlay == nil {
+		return nil, utils.ErrNilParameter
+	}
+
+	var transport *http2.Transport
+
+	if t, ok := underlay.(*http2.Transport); ok && t != nil {
+		transport = t
+	} else {
+		transport = &http2.Transport{
+			DialTLS: func(_, _ string, cfg *tls.Config) (net.Conn, error) {
+				return underlay.(net.Conn), nil
+			},
+			AllowHTTP:          false,
+			DisableCompression: true,
+		}
+		c.cachedTransport = transport
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn := &ClientConn{
+		client:      c,
+		transport:   transport,
+		sessionPath: c.path + utils.GenerateUUIDStr(),
+		ctx:         ctx,
+		cancel:      cancel,
+		writeChan:   make(chan []byte),
+		closeChan:   make(chan struct{}),
+		uploadErr:   atomic.NewError(nil),
+	}
+	conn.InitEasyDeadline()
+
+	go conn.downloadOnce.Do(conn.download)
+	go conn.uploadLoop()
+
+	return conn, nil
+}
+
+// implements net.Conn. 读 来自 GET 的 响应, 写 则 通过 POST 发送
+type ClientConn struct {
+	netLayer.EasyDeadline
+
+	client    *Client
+	transport *http2.Transport
+
+	sessionPath string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	downloadOnce sync.Once
+	response     *http.Response
+	err          error
+
+	writeChan chan []byte
+	closeChan chan struct{}
+	closeOnce sync.Once
+	uploadErr *atomic.Error
+}
+
+func (c *ClientConn) download() {
+	response, err := c.transport.RoundTrip(c.client.newRequest(c.ctx, http.MethodGet, c.sessionPath, nil))
+	if err != nil {
+		c.err = err
+		c.client.dealErr(err)
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		c.err = utils.ErrInErr{ErrDesc: "splithttp download got wrong status", ErrDetail: utils.ErrInvalidData, Data: response.Status}
+		response.Body.Close()
+		return
+	}
+
+	if len(c.client.responseHeader) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.client.responseHeader, response.Header); !ok {
+
+			if ce := utils.CanLogWarn("splithttp Client configured custom header, but the server response doesn't have all of them"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", firstNotMatchKey))
+			}
+			c.err = utils.ErrInErr{ErrDesc: "splithttp response header not match", ErrDetail: utils.ErrInvalidData, Data: firstNotMatchKey}
+			response.Body.Close()
+			return
+		}
+	}
+
+	c.response = response
+}
+
+func (c *ClientConn) Read(b []byte) (n int, err error) {
+	c.downloadOnce.Do(c.download)
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	select {
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return c.response.Body.Read(b)
+	}
+}
+
+func (c *ClientConn) Write(b []byte) (n int, err error) {
+	if err = c.uploadErr.Load(); err != nil {
+		return 0, err
+	}
+
+	bs := make([]byte, len(b))
+	copy(bs, b)
+
+	select {
+	case <-c.closeChan:
+		return 0, net.ErrClosed
+	case <-c.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	case c.writeChan <- bs:
+		return len(b), nil
+	}
+}
+
+// 将 Write 的 数据 合并 后 用 POST 发送, 同时 最多 有 MaxConcurrentUploads 个 POST 在 进行中
+func (c *ClientConn) uploadLoop() {
+	sem := make(chan struct{}, MaxConcurrentUploads)
+	var seq uint64
+
+	for {
+		var bs []byte
+		select {
+		case <-c.closeChan:
+			return
+		case bs = <-c.writeChan:
+		}
+
+	drain:
+		for len(bs) < MaxUploadSize {
+			select {
+			case more := <-c.writeChan:
+				bs = append(bs, more...)
+			default:
+				break drain
+			}
+		}
+
+		for len(bs) > 0 {
+			chunk := bs
+			if len(chunk) > MaxUploadSize {
+				chunk = bs[:MaxUploadSize]
+			}
+			bs = bs[len(chunk):]
+
+			select {
+			case <-c.closeChan:
+				return
+			case sem <- struct{}{}:
+			}
+
+			go func(seq uint64, chunk []byte) {
+				defer func() { <-sem }()
+
+				if err := c.upload(seq, chunk); err != nil {
+					if ce := utils.CanLogDebug("splithttp upload failed"); ce != nil {
+						ce.Write(zap.Uint64("seq", seq), zap.Error(err))
+					}
+					c.uploadErr.Store(err)
+					c.Close()
+				}
+			}(seq, chunk)
+
+			seq++
+		}
+	}
+}
+
+func (c *ClientConn) upload(seq uint64, bs []byte) error {
+	path := c.sessionPath + "/" + strconv.FormatUint(seq, 10)
+
+	response, err := c.transport.RoundTrip(c.client.newRequest(context.Background(), http.MethodPost, path, bs))
+	if err != nil {
+		c.client.dealErr(err)
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return utils.ErrInErr{ErrDesc: "splithttp upload got wrong status", ErrDetail: utils.ErrInvalidData, Data: response.Status}
+	}
+	return nil
+}
+
+func (c *ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *ClientConn) LocalAddr() net.Addr  { return nil }
+func (c *ClientConn) RemoteAddr() net.Addr { return nil }
@@ -0,0 +1,169 @@
+package splithttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+var errWrongSeq = errors.New("splithttp got wrong upload seq")
+
+// implements net.Conn. 读 来自 多个 POST 的 重新排序后的 数据, 写 则 写入 GET 的 响应
+type ServerConn struct {
+	netLayer.EasyDeadline
+
+	mux  sync.Mutex
+	cond *sync.Cond
+
+	pending map[uint64][]byte //乱序到达的 上行数据
+	nextSeq uint64
+	current []byte
+
+	rw          http.ResponseWriter
+	flusher     http.Flusher
+	downloadSet bool
+
+	closed    bool
+	closeOnce sync.Once
+	closeChan chan struct{}
+
+	ra net.Addr
+}
+
+func newServerConn() *ServerConn {
+	sc := &ServerConn{
+		pending:   make(map[uint64][]byte),
+		closeChan: make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mux)
+	sc.InitEasyDeadline()
+	return sc
+}
+
+func (sc *ServerConn) setDownload(rw http.ResponseWriter, flusher http.Flusher) bool {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+
+	if sc.downloadSet || sc.closed {
+		return false
+	}
+	sc.downloadSet = true
+	sc.rw = rw
+	sc.flusher = flusher
+	return true
+}
+
+func (sc *ServerConn) hasDownload() bool {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	return sc.downloadSet
+}
+
+// 与 grpcSimple 一样, 如果是 从 nginx 反代过来的, 可以 读一下 X-Forwarded-For
+func (sc *ServerConn) setRemoteAddr(rq *http.Request) {
+	if xff := rq.Header.Get(httpLayer.XForwardStr); xff != "" {
+		if ta, e := net.ResolveIPAddr("ip", strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])); e == nil {
+			sc.ra = ta
+			return
+		}
+	}
+	if ta, e := net.ResolveTCPAddr("tcp", rq.RemoteAddr); e == nil {
+		sc.ra = ta
+	}
+}
+
+// 存入 一个 POST 的 数据. 缓存的 乱序数据 过多 时 阻塞, 直到 有 空位 或 轮到 seq 为止
+func (sc *ServerConn) push(seq uint64, bs []byte) error {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+
+	for !sc.closed && seq != sc.nextSeq && len(sc.pending) >= MaxBufferedUploads {
+		sc.cond.Wait()
+	}
+	if sc.closed {
+		return net.ErrClosed
+	}
+	if seq < sc.nextSeq {
+		return errWrongSeq
+	}
+	if _, has := sc.pending[seq]; has {
+		return errWrongSeq
+	}
+	sc.pending[seq] = bs
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *ServerConn) Read(p []byte) (int, error) {
+	select {
+	case <-sc.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+
+	for len(sc.current) == 0 {
+		if bs, ok := sc.pending[sc.nextSeq]; ok {
+			delete(sc.pending, sc.nextSeq)
+			sc.nextSeq++
+			sc.current = bs
+			sc.cond.Broadcast()
+			continue
+		}
+		if sc.closed {
+			return 0, io.EOF
+		}
+		sc.cond.Wait()
+	}
+
+	n := copy(p, sc.current)
+	sc.current = sc.current[n:]
+	return n, nil
+}
+
+func (sc *ServerConn) Write(p []byte) (int, error) {
+	select {
+	case <-sc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+
+	if sc.closed || sc.rw == nil {
+		return 0, net.ErrClosed
+	}
+
+	n, err := sc.rw.Write(p)
+	if err == nil && sc.flusher != nil {
+		sc.flusher.Flush()
+	}
+	return n, err
+}
+
+// 关闭后 handleDownload 会 返回, 从而 结束 GET 的 响应
+func (sc *ServerConn) Close() error {
+	sc.closeOnce.Do(func() {
+		sc.mux.Lock()
+		sc.closed = true
+		sc.rw = nil
+		sc.cond.Broadcast()
+		sc.mux.Unlock()
+
+		close(sc.closeChan)
+	})
+	return nil
+}
+
+func (sc *ServerConn) LocalAddr() net.Addr  { return nil }
+func (sc *ServerConn) RemoteAddr() net.Addr { return sc.ra }
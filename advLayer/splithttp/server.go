@@ -0,0 +1,373 @@
+package splithttp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// implements advLayer.MuxServer
+type Server struct {
+	Creator
+	http2.Server
+	netLayer.ConnList
+
+	Headers *httpLayer.HeaderPreset
+
+	path string
+
+	sessionsMux sync.Mutex
+	sessions    map[string]*ServerConn
+
+	closed *atomic.Bool
+}
+
+func NewServer(path string, headers *httpLayer.HeaderPreset) *Server {
+	return &Server{
+		path:     normalizePath(path),
+		Headers:  headers,
+		sessions: make(map[string]*ServerConn),
+		closed:   atomic.NewBool(false),
+	}
+}
+
+func (s *Server) GetPath() string {
+	return s.path
+}
+
+func (s *Server) Stop() {
+	if s.closed.Swap(true) {
+		return
+	}
+
+	s.CloseDeleteAll()
+
+	s.sessionsMux.Lock()
+	for _, sc := range s.sessions {
+		sc.Close()
+	}
+	s.sessions = make(map[string]*ServerConn)
+	s.sessionsMux.Unlock()
+}
+
+var clientPreface = []byte(http2.ClientPreface)
+
+// 阻塞. h2c 的 连接 用 http2 处理, 其它的 当作 http1.1 处理.
+func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	s.closed.Store(false)
+
+	oldUnderlay := underlay
+	s.Insert(oldUnderlay)
+
+	bs := utils.GetPacket()
+	netLayer.SetCommonReadTimeout(underlay)
+
+	n, err := underlay.Read(bs)
+	if err != nil {
+		if ce := utils.CanLogDebug("splithttp try read first packet failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		s.CloseDelete(oldUnderlay)
+		return
+	}
+	netLayer.PersistConn(underlay)
+
+	firstBuf := bytes.NewBuffer(bs[:n])
+
+	isH2c := n >= len(clientPreface) && bytes.Equal(bs[:len(clientPreface)], clientPreface)
+
+	if !isH2c {
+		_, method, path, _, failreason := httpLayer.ParseH1Request(bs[:n], false)
+		if failreason != 0 || !strings.HasPrefix(path, s.path) {
+			if ce := utils.CanLogInfo("splithttp got not matched h1 request"); ce != nil {
+				ce.Write(zap.Int("failreason", failreason), zap.String("path", path))
+			}
+
+			if fallbackFunc != nil {
+				s.Delete(oldUnderlay)
+
+				go fallbackFunc(httpLayer.FallbackMeta{
+					Path:         path,
+					Method:       method,
+					Conn:         underlay,
+					H1RequestBuf: firstBuf,
+				})
+			} else {
+				underlay.Write([]byte(httpLayer.Err403response))
+				s.CloseDelete(oldUnderlay)
+			}
+			return
+		}
+	}
+
+	underlay = &netLayer.ReadWrapper{
+		Conn:              underlay,
+		OptionalReader:    io.MultiReader(firstBuf, underlay),
+		RemainFirstBufLen: n,
+	}
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		s.handle(rw, rq, isH2c, newSubConnFunc, fallbackFunc)
+	})
+
+	if isH2c {
+		s.Server.ServeConn(underlay, &http2.ServeConnOpts{
+			Handler: handler,
+		})
+	} else {
+		l := newSingleConnListener(underlay)
+		hs := &http.Server{
+			Handler: handler,
+			ConnState: func(c net.Conn, cs http.ConnState) {
+				if cs == http.StateClosed || cs == http.StateHijacked {
+					l.Close()
+				}
+			},
+		}
+		hs.Serve(l)
+	}
+
+	s.CloseDelete(oldUnderlay)
+}
+
+func (s *Server) handle(rw http.ResponseWriter, rq *http.Request, isH2 bool, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	if s.closed.Load() {
+		return
+	}
+
+	p := rq.URL.Path
+
+	var parts []string
+
+	shouldFallback := false
+
+	if !strings.HasPrefix(p, s.path) {
+		if ce := utils.CanLogWarn("splithttp Server got wrong path"); ce != nil {
+			ce.Write(zap.String("path", p))
+		}
+		shouldFallback = true
+
+	} else {
+		parts = strings.Split(p[len(s.path):], "/")
+
+		if !(rq.Method == http.MethodGet && len(parts) == 1 || rq.Method == http.MethodPost && len(parts) == 2) || parts[0] == "" {
+			if ce := utils.CanLogWarn("splithttp Server got right path but wrong method or sub path"); ce != nil {
+				ce.Write(zap.String("path", p), zap.String("method", rq.Method))
+			}
+			shouldFallback = true
+
+		} else if s.Headers != nil && s.Headers.Request != nil && len(s.Headers.Request.Headers) > 0 {
+
+			if ok, fnmk := httpLayer.AllHeadersIn(s.Headers.Request.Headers, rq.Header); !ok {
+
+				if ce := utils.CanLogWarn("splithttp Server has custom header configured, but the client request have notMatched Header(s)"); ce != nil {
+					ce.Write(zap.String("firstNotMatchKey", fnmk))
+				}
+				shouldFallback = true
+			}
+		}
+	}
+
+	if shouldFallback {
+		//h1 的 回落 在 StartHandle 中 根据 第一个 请求 进行; 同一连接 后续的 不符合的 请求 直接 返回 404
+		if !isH2 || fallbackFunc == nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if ce := utils.CanLogInfo("splithttp will fallback"); ce != nil {
+			ce.Write(
+				zap.String("path", p),
+				zap.String("method", rq.Method),
+				zap.String("raddr", rq.RemoteAddr))
+		}
+
+		ra := httpLayer.GetRequestRemoteAddr(rq)
+		fallbackFunc(httpLayer.FallbackMeta{
+			Path: p,
+			Conn: &netLayer.IOWrapper{
+				EasyNetAddresser: netLayer.EasyNetAddresser{RA: ra},
+				Reader:           rq.Body,
+				Writer:           rw,
+				Rejecter:         httpLayer.RejectConn{ResponseWriter: rw},
+			},
+			IsH2:      true,
+			H2Request: rq,
+			H2RW:      rw,
+			XFF:       ra,
+		})
+		return
+	}
+
+	if rq.Method == http.MethodGet {
+		s.handleDownload(rw, rq, parts[0], newSubConnFunc)
+	} else {
+		s.handleUpload(rw, rq, parts[0], parts[1])
+	}
+}
+
+// 下行. 阻塞 直到 newSubConnFunc 返回
+func (s *Server) handleDownload(rw http.ResponseWriter, rq *http.Request, id string, newSubConnFunc func(net.Conn)) {
+	sc := s.getSession(id)
+	if sc == nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer s.deleteSession(id, sc)
+
+	flusher, _ := rw.(http.Flusher)
+	if !sc.setDownload(rw, flusher) {
+		if ce := utils.CanLogWarn("splithttp Server got duplicated download request"); ce != nil {
+			ce.Write(zap.String("id", id))
+		}
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer sc.Close()
+
+	headerMap := rw.Header()
+
+	//避免 nginx 与 cdn 缓存 响应
+	headerMap.Set("X-Accel-Buffering", "no")
+	headerMap.Set("Cache-Control", "no-store")
+	headerMap.Set("Content-Type", "text/event-stream")
+
+	if s.Headers != nil && s.Headers.Response != nil && len(s.Headers.Response.Headers) > 0 {
+		for k, vs := range httpLayer.TrimHeaders(s.Headers.Response.Headers) {
+			if len(vs) > 0 {
+				headerMap.Add(k, vs[0])
+			}
+		}
+	}
+	rw.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	sc.setRemoteAddr(rq)
+
+	go func() {
+		select {
+		case <-rq.Context().Done():
+			sc.Close()
+		case <-sc.closeChan:
+		}
+	}()
+
+	if s.closed.Load() {
+		return
+	}
+	newSubConnFunc(sc)
+}
+
+// 上行
+func (s *Server) handleUpload(rw http.ResponseWriter, rq *http.Request, id, seqStr string) {
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sc := s.getSession(id)
+	if sc == nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	bs, err := io.ReadAll(io.LimitReader(rq.Body, MaxUploadSize+1))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(bs) > MaxUploadSize {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err = sc.push(seq, bs); err != nil {
+		if ce := utils.CanLogDebug("splithttp Server push upload failed"); ce != nil {
+			ce.Write(zap.String("id", id), zap.Uint64("seq", seq), zap.Error(err))
+		}
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// 获取 或 新建 session. 新建的 session 若 在 SessionTimeout 内 没有 收到 GET, 则被 删除
+func (s *Server) getSession(id string) *ServerConn {
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	if s.closed.Load() {
+		return nil
+	}
+
+	sc := s.sessions[id]
+	if sc == nil {
+		sc = newServerConn()
+		s.sessions[id] = sc
+
+		time.AfterFunc(SessionTimeout, func() {
+			if !sc.hasDownload() {
+				sc.Close()
+				s.deleteSession(id, sc)
+			}
+		})
+	}
+	return sc
+}
+
+func (s *Server) deleteSession(id string, sc *ServerConn) {
+	s.sessionsMux.Lock()
+	if s.sessions[id] == sc {
+		delete(s.sessions, id)
+	}
+	s.sessionsMux.Unlock()
+}
+
+// 让 http.Server 只 服务 一个 连接. 第二次 Accept 会 阻塞 到 该连接 关闭 为止
+type singleConnListener struct {
+	conn      net.Conn
+	once      sync.Once
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+func newSingleConnListener(c net.Conn) *singleConnListener {
+	return &singleConnListener{conn: c, closeChan: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (c net.Conn, err error) {
+	l.once.Do(func() {
+		c = l.conn
+	})
+	if c != nil {
+		return
+	}
+	<-l.closeChan
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+	})
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,92 @@
+/*
+Package splithttp implements split http transport for advLayer.
+
+splithttp 把 一条 双向的 连接 拆成 多个 普通的 http 请求, 这样 只允许 标准 请求/响应 的 代理 与 cdn 也能通过:
+
+下行 是 一个 长时间 保持的 流式 GET 响应:
+
+	GET /path/{sessionId}
+
+上行 是 一系列 带有 序号 的 POST, 每个 POST 的 body 为 一段 上行数据, 服务端 按 序号 重新排序:
+
+	POST /path/{sessionId}/{seq}
+
+seq 从 0 开始 递增. 客户端 可以 同时 发送 多个 POST, 所以 到达 服务端 时 可能是 乱序的.
+
+客户端 使用 h2, 所有 请求 都在 同一个 tls连接 的 不同 stream 中; 服务端 同时 支持 h2c 和 http1.1
+(cdn 回源 时 常用 http1.1, 每个 请求 可能 在 不同的 连接 上 到达, 服务端 用 sessionId 将它们 关联起来).
+
+path 不在 配置的 前缀 下 的 请求 会 回落.
+*/
+package splithttp
+
+import (
+	"strings"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+)
+
+const (
+	// 一个 POST 的 body 的 最大长度
+	MaxUploadSize = 1024 * 1024
+
+	// 客户端 同时 进行中的 POST 的 最大数量
+	MaxConcurrentUploads = 10
+
+	// 服务端 为 一个 session 缓存的 乱序 POST 的 最大数量. 必须大于 MaxConcurrentUploads, 否则 可能 卡住
+	MaxBufferedUploads = 30
+
+	// 服务端 收到 POST 后 若 一直没有 对应的 GET, 则 超时 后 删除 该 session
+	SessionTimeout = time.Second * 30
+)
+
+func init() {
+	advLayer.ProtocolsMap["splithttp"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) PackageID() string {
+	return "splithttp"
+}
+
+func (Creator) ProtocolName() string {
+	return "splithttp"
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	//客户端 只使用 h2
+	return "h2", true
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+func (Creator) IsMux() bool {
+	return true
+}
+
+// 返回 以 "/" 开头 和 结尾 的 path
+func normalizePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	return NewClient(conf.Host, conf.Path, conf.Headers), nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(conf.Path, conf.Headers), nil
+}
@@ -0,0 +1,185 @@
+package splithttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+)
+
+// 启动 一个 splithttp 服务端, 每个 子连接 都 回显 收到的 数据
+func startEchoServer(t *testing.T, fallbackPaths chan string) (*Server, net.Listener) {
+	server := NewServer("/sh", nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			lc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.StartHandle(lc, func(sc net.Conn) {
+				io.Copy(sc, sc)
+			}, func(fm httpLayer.FallbackMeta) {
+				fallbackPaths <- fm.Path
+				if fm.IsH2 {
+					fm.H2RW.WriteHeader(http.StatusNotFound)
+				} else {
+					fm.Conn.Close()
+				}
+			})
+		}
+	}()
+	return server, listener
+}
+
+func TestSplitHttpH2(t *testing.T) {
+	fallbackPaths := make(chan string, 1)
+	server, listener := startEchoServer(t, fallbackPaths)
+	defer listener.Close()
+	defer server.Stop()
+
+	rc, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	client := NewClient("example.com", "sh", nil)
+
+	for i := 0; i < 2; i++ {
+		var underlay any = rc
+		if i > 0 {
+			underlay = client.cachedTransport
+		}
+		cc, err := client.DialSubConn(underlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc.SetDeadline(time.Now().Add(time.Second * 5))
+
+		for j := 0; j < 5; j++ {
+			msg := bytes.Repeat([]byte{byte(j)}, 1000*(j+1)+i)
+			if _, err := cc.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(cc, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, msg) {
+				t.Fatal("not equal", i, j)
+			}
+		}
+		cc.Close()
+	}
+
+	//其它path 回落
+	wrongClient := NewClient("example.com", "other", nil)
+	wc, _ := wrongClient.DialSubConn(client.cachedTransport)
+	wc.Read(make([]byte, 1))
+	wc.Close()
+
+	select {
+	case p := <-fallbackPaths:
+		if !strings.HasPrefix(p, "/other/") {
+			t.Fatal("wrong fallback path", p)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no fallback")
+	}
+}
+
+// 服务端 的 http1.1 支持: 下行 和 上行 分别 在 不同的 连接 上, 且 上行 乱序 到达
+func TestSplitHttpH1(t *testing.T) {
+	fallbackPaths := make(chan string, 1)
+	server, listener := startEchoServer(t, fallbackPaths)
+	defer listener.Close()
+	defer server.Stop()
+
+	addr := listener.Addr().String()
+
+	post := func(seq int, data string) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "POST /sh/abc/%d HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n%s", seq, len(data), data)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Error("post failed", seq, err)
+		}
+	}
+
+	dc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	dc.SetDeadline(time.Now().Add(time.Second * 5))
+
+	post(1, "world")
+	fmt.Fprintf(dc, "GET /sh/abc HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(dc), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("get failed", err)
+	}
+	post(0, "hello")
+
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "helloworld" {
+		t.Fatal("got", string(buf))
+	}
+
+	fc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Close()
+	fmt.Fprintf(fc, "GET /other HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	select {
+	case p := <-fallbackPaths:
+		if p != "/other" {
+			t.Fatal("wrong fallback path", p)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no fallback")
+	}
+}
+
+func TestServerConnReorder(t *testing.T) {
+	sc := newServerConn()
+	for _, seq := range []uint64{2, 0, 1} {
+		if err := sc.push(seq, []byte{byte('a' + seq)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sc.push(0, []byte("x")); err != errWrongSeq {
+		t.Fatal("duplicated seq should fail", err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "abc" {
+		t.Fatal(string(buf), err)
+	}
+	sc.Close()
+	if _, err := sc.Read(buf); err != io.EOF {
+		t.Fatal("should be EOF", err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
@@ -24,10 +25,16 @@ type Client struct {
 	path         string
 	UseEarlyData bool
 
+	maxEarlyDataLen int
+
+	UseDeflate bool //是否 尝试 协商 permessage-deflate
+
 	headers *httpLayer.HeaderPreset
 }
 
 // 这里默认，传入的path必须 以 "/" 为前缀. 若path为空，本函数 将自动使用 "/"
+//
+// 与 xray/v2ray 一样, path 中 可以带有 ?ed=2048 这种 参数 来 开启 early data 并 指定 其 最大长度, 该参数 不会 被 发送 给 服务端.
 func NewClient(hostAddr, path string, headers *httpLayer.HeaderPreset, isEarly bool) (*Client, error) {
 	if path == "" {
 		path = "/"
@@ -36,11 +43,23 @@ func NewClient(hostAddr, path string, headers *httpLayer.HeaderPreset, isEarly b
 	if err != nil {
 		return nil, err
 	}
+
+	maxEarlyDataLen := MaxEarlyDataLen
+
+	if ed := parseEdQuery(u); ed > 0 {
+		isEarly = true
+		if ed < maxEarlyDataLen {
+			maxEarlyDataLen = ed
+		}
+		path = u.RequestURI()
+	}
+
 	return &Client{
-		requestURL:   u,
-		path:         path,
-		headers:      headers,
-		UseEarlyData: isEarly,
+		requestURL:      u,
+		path:            path,
+		headers:         headers,
+		UseEarlyData:    isEarly,
+		maxEarlyDataLen: maxEarlyDataLen,
 	}, nil
 }
 
@@ -59,9 +78,9 @@ func (c *Client) IsEarly() bool {
 // 与服务端进行 websocket握手，并返回可直接用于读写 websocket 二进制数据的 net.Conn
 func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, error) {
 
-	if c.IsEarly() && firstPayloadLen > 0 && firstPayloadLen <= MaxEarlyDataLen {
+	if c.IsEarly() && firstPayloadLen > 0 && firstPayloadLen <= c.maxEarlyDataLen {
 		// 我们要先返回一个 Conn, 然后读取到内层的 vless等协议的握手后，再进行实际的 ws握手
-		return &EarlyDataConn{
+		edc := &EarlyDataConn{
 			Conn: underlay,
 
 			requestURL:           c.requestURL,
@@ -71,7 +90,9 @@ func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, er
 					return underlay, nil
 				},
 			},
-		}, nil
+		}
+		c.setDialer(edc.dialer)
+		return edc, nil
 	}
 
 	//实测默认的4096过小,因为 实测 tls握手的serverHello 就有可能超过了4096,
@@ -85,14 +106,9 @@ func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, er
 		// 默认不给出Protocols的话, gobwas就不会发送这个header, 另一端也收不到此header
 
 	}
+	c.setDialer(&d)
 
-	if c.headers != nil && c.headers.Request != nil && len(c.headers.Request.Headers) > 0 {
-		d.Header = ws.HandshakeHeaderHTTP(c.headers.Request.Headers)
-
-		//实测Header里的Connection会被用到。
-	}
-
-	br, _, err := d.Upgrade(underlay, c.requestURL)
+	br, hs, err := d.Upgrade(underlay, c.requestURL)
 	if err != nil {
 		return nil, err
 	}
@@ -115,6 +131,7 @@ func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, er
 		theConn.r.OnIntermediate = wsutil.ControlFrameHandler(underlay, ws.StateClientSide)
 		// OnIntermediate 会在 r.NextFrame 里被调用. 如果我们不在这里提供，就要每次都在Read里操作，多此一举
 
+		theConn.initDeflate(deflateAccepted(hs.Extensions))
 		return theConn, nil
 	}
 
@@ -128,9 +145,22 @@ func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, er
 	theConn.r = wsutil.NewClientSideReader(wholeR)
 	theConn.r.OnIntermediate = wsutil.ControlFrameHandler(underlay, ws.StateClientSide)
 
+	theConn.initDeflate(deflateAccepted(hs.Extensions))
 	return theConn, nil
 }
 
+// 设置 自定义 header 和 permessage-deflate
+func (c *Client) setDialer(d *ws.Dialer) {
+	if c.headers != nil && c.headers.Request != nil && len(c.headers.Request.Headers) > 0 {
+		d.Header = ws.HandshakeHeaderHTTP(c.headers.Request.Headers)
+
+		//实测Header里的Connection会被用到。
+	}
+	if c.UseDeflate {
+		d.Extensions = []httphead.Option{deflateParameters.Option()}
+	}
+}
+
 type EarlyDataConn struct {
 	net.Conn
 	dialer     *ws.Dialer
@@ -165,7 +195,7 @@ func (edc *EarlyDataConn) Write(p []byte) (int, error) {
 
 		edc.dialer.Protocols = []string{outBuf.String()}
 
-		br, _, err := edc.dialer.Upgrade(edc.Conn, edc.requestURL)
+		br, hs, err := edc.dialer.Upgrade(edc.Conn, edc.requestURL)
 		if err != nil {
 			utils.PutBuf(outBuf)
 
@@ -201,6 +231,8 @@ func (edc *EarlyDataConn) Write(p []byte) (int, error) {
 
 		}
 
+		theConn.initDeflate(deflateAccepted(hs.Extensions))
+
 		edc.realWsConn = theConn
 		edc.firstHandshakeOkChan <- 1
 		return len(p), nil
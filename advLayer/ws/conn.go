@@ -1,12 +1,14 @@
 package ws
 
 import (
+	"compress/flate"
 	"io"
 	"net"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
 )
 
@@ -30,6 +32,25 @@ type Conn struct {
 	bigHeaderEverUsed bool
 
 	realRaddr net.Addr //可从 X-Forwarded-For 读取用户真实ip，用于反代等情况
+
+	//permessage-deflate 协商成功后 才会 被设置
+
+	deflate   bool
+	msgState  wsflate.MessageState
+	inMessage bool
+	msgReader io.Reader
+	flateR    *wsflate.Reader
+	flateW    *wsflate.Writer
+}
+
+// 握手 完成后 调用. ok 表示 是否 协商 成功了 permessage-deflate
+func (c *Conn) initDeflate(ok bool) {
+	if !ok {
+		return
+	}
+	c.deflate = true
+	c.r.State = c.r.State.Set(ws.StateExtended)
+	c.r.Extensions = []wsutil.RecvExtension{&c.msgState}
 }
 
 // Read websocket binary frames
@@ -41,6 +62,10 @@ func (c *Conn) Read(p []byte) (int, error) {
 		return n, nil
 	}
 
+	if c.deflate {
+		return c.readMessage(p)
+	}
+
 	//websocket 协议中帧长度上限为2^64，超大，考虑到我们vs的标准Packet缓存是64k，也就是2^16,
 	// https://www.rfc-editor.org/rfc/rfc6455#section-5.2
 	// (使用了 Extended payload length 字段)
@@ -112,8 +137,87 @@ func (c *Conn) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// 开启 deflate 后 按 消息 读取, 因为 一条 压缩消息 只有 第一帧 带有 压缩标志,
+// 而且 只有 整条消息 读完 才能 解压 出 结尾.
+// wsutil.Reader.Read 会 自动 处理 分片, 并在 消息结尾 返回 EOF
+func (c *Conn) readMessage(p []byte) (int, error) {
+	for {
+		if !c.inMessage {
+			h, e := c.r.NextFrame()
+			if e != nil {
+				return 0, e
+			}
+			if h.OpCode.IsControl() {
+				continue
+			}
+			if h.OpCode != ws.OpBinary {
+				return 0, utils.ErrInErr{ErrDesc: "ws OpCode not OpBinary", Data: h.OpCode}
+			}
+			c.inMessage = true
+
+			if c.msgState.IsCompressed() {
+				if c.flateR == nil {
+					c.flateR = wsflate.NewReader(c.r, func(r io.Reader) wsflate.Decompressor {
+						return flate.NewReader(r)
+					})
+				} else {
+					c.flateR.Reset(c.r)
+				}
+				c.msgReader = c.flateR
+			} else {
+				c.msgReader = c.r
+			}
+		}
+
+		n, e := c.msgReader.Read(p)
+		if e == io.EOF {
+			c.inMessage = false
+			e = nil
+		}
+		if n > 0 || e != nil {
+			return n, e
+		}
+	}
+}
+
+// 压缩 为 一个 单独的 消息 写出
+func (c *Conn) writeDeflate(p []byte) (n int, e error) {
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	if c.flateW == nil {
+		c.flateW = wsflate.NewWriter(buf, func(w io.Writer) wsflate.Compressor {
+			fw, _ := flate.NewWriter(w, flate.BestSpeed)
+			return fw
+		})
+	} else {
+		c.flateW.Reset(buf)
+	}
+
+	if _, e = c.flateW.Write(p); e != nil {
+		return
+	}
+	if e = c.flateW.Flush(); e != nil {
+		return
+	}
+
+	frame := ws.NewFrame(ws.OpBinary, true, buf.Bytes())
+	frame.Header, e = wsflate.SetBit(frame.Header)
+	if e != nil {
+		return
+	}
+	if c.state == ws.StateClientSide {
+		frame = ws.MaskFrameInPlace(frame)
+	}
+	e = ws.WriteFrame(c.Conn, frame)
+	if e == nil {
+		n = len(p)
+	}
+	return
+}
+
 func (c *Conn) EverPossibleToSpliceWrite() bool {
-	return c.underlayIsTCP && c.state == ws.StateServerSide
+	return c.underlayIsTCP && c.state == ws.StateServerSide && !c.deflate
 }
 
 // 采用 “超长包” 的办法 试图进行splice
@@ -154,7 +258,7 @@ func (c *Conn) CanSpliceWrite() (r bool, conn *net.TCPConn) {
 }
 
 func (c *Conn) ReadFrom(r io.Reader) (written int64, err error) {
-	if c.state == ws.StateClientSide {
+	if c.state == ws.StateClientSide || c.deflate {
 		return utils.ClassicCopy(c, r)
 	}
 
@@ -184,7 +288,7 @@ func (c *Conn) ReadFrom(r io.Reader) (written int64, err error) {
 // 若底层是tls，那我们也合并再发出，这样能少些很多头部,也能减少Write次数
 func (c *Conn) WriteBuffers(buffers [][]byte) (int64, error) {
 
-	if c.underlayIsBasic {
+	if c.underlayIsBasic && !c.deflate {
 		allLen := utils.BuffersLen(buffers)
 
 		if c.state == ws.StateClientSide {
@@ -255,6 +359,10 @@ func (c *Conn) Write(p []byte) (n int, e error) {
 	//查看了代码，wsutil.WriteClientBinary 等类似函数会直接调用 ws.WriteFrame， 是不分片的.
 	// 不分片的效率更高,因为无需缓存,zero copy
 
+	if c.deflate {
+		return c.writeDeflate(p)
+	}
+
 	if c.state == ws.StateClientSide {
 		e = wsutil.WriteClientBinary(c.Conn, p) //实际我查看它的代码，发现Client端 最终调用到的 writeFrame 函数 还是多了一次拷贝; 它是为了防止篡改客户数据；但是我们代理的话不会使用数据，只是转发而已
 	} else {
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/advLayer"
@@ -14,6 +15,7 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
 	"go.uber.org/zap"
 )
@@ -33,13 +35,23 @@ type Server struct {
 	requestHeaderCheckCount     int
 	noNeedToCheckRequestHeaders bool
 	responseHeader              ws.HandshakeHeader
+
+	UseDeflate bool //是否 接受 permessage-deflate
 }
 
 // 这里默认: 传入的path必须 以 "/" 为前缀. 若path为空，本函数 将自动使用 "/"
+//
+// path 中 的 查询参数 (比如 xray 的 ?ed=2048) 会被 去掉, 匹配时 只比较 path 部分.
 func NewServer(path string, headers *httpLayer.HeaderPreset, UseEarlyData bool) *Server {
 	if path == "" {
 		path = "/"
 	}
+	if u, err := url.Parse(path); err == nil && u.RawQuery != "" {
+		if parseEdQuery(u) > 0 {
+			UseEarlyData = true
+		}
+		path = u.Path
+	}
 
 	noNeedToCheckRequestHeaders := headers == nil || headers.Request == nil || len(headers.Request.Headers) == 0
 
@@ -133,7 +145,12 @@ func (s *Server) Handshake(underlay net.Conn) (net.Conn, error) {
 	//header 我们只过滤一个 connection 就行. 要是怕攻击者用 “对的path,method 和错误的header” 进行探测,
 	// 那你设一个复杂的path就ok了。
 
-	if rp.Method != "GET" || s.Thepath != rp.Path || len(rp.Headers) == 0 {
+	requestPath := rp.Path
+	if i := strings.IndexByte(requestPath, '?'); i >= 0 {
+		requestPath = requestPath[:i]
+	}
+
+	if rp.Method != "GET" || s.Thepath != requestPath || len(rp.Headers) == 0 {
 		notWsRequest = true
 		notReason = `rp.Method != "GET" || s.Thepath != rp.Path || len(rp.Headers) == 0`
 
@@ -247,6 +264,9 @@ func (s *Server) Handshake(underlay net.Conn) (net.Conn, error) {
 		//xray和v2ray中，使用了 header中的
 		// Sec-WebSocket-Protocol 字段 来传输 earlydata，来实现 0-rtt;我们为了兼容,同样用此字段
 		// (websocket标准是没有定义 0-rtt的方法的，但是ws的握手包头部是可以自定义header的)
+		//
+		// 服务端 需要 用 early = true 或 path?ed=2048 开启, 否则 Sec-WebSocket-Protocol 会被 当作 普通的 子协议,
+		// 因为 chat 这种 普通的 子协议 也 可以被 base64 解码, 不能 总是 当作 early data.
 
 		// gobwas 的 Upgrader 用 ProtocolCustom 这个函数来检查 protocol的内容
 		// 它会遍历客户端给出的所有 protocol，然后选择一个来返回
@@ -267,18 +287,27 @@ func (s *Server) Handshake(underlay net.Conn) (net.Conn, error) {
 
 				return "", true
 			}
+			//xray 只 使用 RawURLEncoding
 			bs, err := base64.RawURLEncoding.DecodeString(string(b))
 			if err != nil {
-				// 传来的并不是base64数据，可能是其它访问我们网站websocket的情况，但是一般我们path复杂都会过滤掉，所以直接认为这是非法的
-				return "", false
+				// 传来的并不是base64数据，可能是 真的 子协议, 不选择 即可
+				return "", true
 			}
 
 			thePotentialEarlyData = bs
-			return "", true
+
+			//与 xray 一样 原样返回, 有些 客户端 (比如 浏览器) 要求 服务端 选择 一个 它 给出的 子协议
+			return string(b), true
 		}
 
 	}
 
+	var deflateExt *wsflate.Extension
+	if s.UseDeflate {
+		deflateExt = &wsflate.Extension{Parameters: deflateParameters}
+		theUpgrader.Negotiate = deflateExt.Negotiate
+	}
+
 	var theReader io.Reader
 	if optionalFirstBuffer != nil {
 		theReader = io.MultiReader(optionalFirstBuffer, underlay)
@@ -316,5 +345,10 @@ func (s *Server) Handshake(underlay net.Conn) (net.Conn, error) {
 		theConn.serverEndGotEarlyData = thePotentialEarlyData
 	}
 
+	if deflateExt != nil {
+		_, accepted := deflateExt.Accepted()
+		theConn.initDeflate(accepted)
+	}
+
 	return theConn, nil
 }
@@ -35,11 +35,31 @@ https://tonybai.com/2019/09/28/how-to-build-websockets-in-go/
 All in all gobwas/ws is the best package. We use gobwas/ws.
 
 gobwas包只支持http1.1, 所以如果使用nginx前置，确保 proxy_http_version 1.1;
+
+# Early Data
+
+与 xray/v2ray 兼容, early data 以 base64 编码 放在 Sec-WebSocket-Protocol 中.
+两端 都 可以用 early = true 开启, 也可以 像 xray 那样 在 path 后 加上 ?ed=2048, 两种 写法 能 互通.
+服务端 只有 开启后 才会 从 Sec-WebSocket-Protocol 读取 early data (只接受 xray 使用的 RawURLEncoding),
+未开启 时 Sec-WebSocket-Protocol 被 当作 普通的 子协议 忽略.
+
+# permessage-deflate
+
+extra.ws_deflate = true 时 协商 permessage-deflate (rfc7692), 只有 两端 都开启 时 才会 压缩.
+为了 简单 和 节省内存, 我们 总是 使用 no_context_takeover, 即 每个 消息 单独 压缩.
+开启后 无法 splice.
 */
 package ws
 
 import (
+	"bytes"
+	"net/url"
+	"strconv"
+
 	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws/wsflate"
 )
 
 // 2048 /3 = 682.6666...  (682 又 三分之二),
@@ -58,11 +78,53 @@ func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
 	if conf.Addr.Network == "unix" {
 		hn = ""
 	}
-	return NewClient(hn, conf.Path, conf.Headers, conf.IsEarly)
+	c, err := NewClient(hn, conf.Path, conf.Headers, conf.IsEarly)
+	if err != nil {
+		return nil, err
+	}
+	c.UseDeflate = getDeflateFromConf(conf)
+	return c, nil
 }
 
 func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
-	return NewServer(conf.Path, conf.Headers, conf.IsEarly), nil
+	s := NewServer(conf.Path, conf.Headers, conf.IsEarly)
+	s.UseDeflate = getDeflateFromConf(conf)
+	return s, nil
+}
+
+func getDeflateFromConf(conf *advLayer.Conf) (b bool) {
+	if conf.Extra != nil {
+		b, _ = utils.AnyToBool(conf.Extra["ws_deflate"])
+	}
+	return
+}
+
+// 读取 并 删除 url 中的 ed 参数, 没有 则 返回 0
+func parseEdQuery(u *url.URL) int {
+	q := u.Query()
+	edStr := q.Get("ed")
+	if edStr == "" {
+		return 0
+	}
+	q.Del("ed")
+	u.RawQuery = q.Encode()
+
+	ed, _ := strconv.Atoi(edStr)
+	return ed
+}
+
+var deflateParameters = wsflate.Parameters{
+	ServerNoContextTakeover: true,
+	ClientNoContextTakeover: true,
+}
+
+func deflateAccepted(extensions []httphead.Option) bool {
+	for _, e := range extensions {
+		if bytes.Equal(e.Name, wsflate.ExtensionNameBytes) {
+			return true
+		}
+	}
+	return false
 }
 func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
 	return
@@ -0,0 +1,174 @@
+package ws_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer/ws"
+	gobwasws "github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// 启动一个 ws 回声服务器, 并用给定的 客户端 进行 一次握手 与 读写
+func testEcho(t *testing.T, s *ws.Server, cli *ws.Client, firstPayload []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	gotEarlyData := make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		wsConn, err := s.Handshake(conn)
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		bs := make([]byte, len(firstPayload))
+		if _, err = io.ReadFull(wsConn, bs); err != nil {
+			t.Log(err)
+			return
+		}
+		gotEarlyData <- bs
+		io.Copy(wsConn, wsConn)
+	}()
+
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	wsConn, err := cli.Handshake(tcpConn, len(firstPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wsConn.Write(firstPayload); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case bs := <-gotEarlyData:
+		if !bytes.Equal(bs, firstPayload) {
+			t.Fatal("first payload not equal")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("server didn't get first payload")
+	}
+
+	for _, l := range []int{5, 10240, 70000} {
+		msg := bytes.Repeat([]byte("verysimple"), l/10)
+		if _, err = wsConn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		bs := make([]byte, len(msg))
+		if _, err = io.ReadFull(wsConn, bs); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, msg) {
+			t.Fatal("not equal", l)
+		}
+	}
+}
+
+// xray 风格的 path?ed=2048 与 early = true 可以 互通
+func TestEarlyDataByPath(t *testing.T) {
+	cli, err := ws.NewClient("127.0.0.1", "/thepath?ed=2048", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cli.UseEarlyData {
+		t.Fatal("ed param not detected")
+	}
+
+	testEcho(t, ws.NewServer("/thepath", nil, true), cli, []byte("hello early data"))
+
+	//服务端 path 中 带 ed 参数 时 同样 开启 early data, 且 能 匹配
+	s := ws.NewServer("/thepath?ed=2048", nil, false)
+	if !s.UseEarlyData {
+		t.Fatal("ed param not detected")
+	}
+	cli, _ = ws.NewClient("127.0.0.1", "/thepath", nil, true)
+	testEcho(t, s, cli, []byte("hello"))
+}
+
+// 服务端 未 开启 early 时, 普通的 子协议 (比如 chat, 它 也是 合法的 base64) 不能 被 当作 early data
+func TestSubprotocolNotEarlyData(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		wsConn, err := ws.NewServer("/thepath", nil, false).Handshake(conn)
+		if err != nil {
+			got <- nil
+			return
+		}
+		bs := make([]byte, 5)
+		io.ReadFull(wsConn, bs)
+		got <- bs
+	}()
+
+	conn, _, hs, err := gobwasws.Dialer{
+		Protocols: []string{"chat"},
+		Timeout:   time.Second * 5,
+	}.Dial(context.Background(), "ws://"+listener.Addr().String()+"/thepath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if hs.Protocol != "" {
+		t.Fatal("subprotocol selected", hs.Protocol)
+	}
+
+	wsutil.WriteClientBinary(conn, []byte("hello"))
+
+	select {
+	case bs := <-got:
+		if string(bs) != "hello" {
+			t.Fatal("got", bs)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestDeflate(t *testing.T) {
+	cli, err := ws.NewClient("127.0.0.1", "/thepath", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.UseDeflate = true
+
+	s := ws.NewServer("/thepath", nil, false)
+	s.UseDeflate = true
+
+	testEcho(t, s, cli, []byte("hello deflate"))
+
+	//只有一端 开启 时 不压缩, 也能 正常通信
+	testEcho(t, ws.NewServer("/thepath", nil, false), cli, []byte("hello"))
+
+	cli.UseDeflate = false
+	testEcho(t, s, cli, []byte("hello"))
+}
@@ -2,6 +2,21 @@
 
 package main
 
-import _ "github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	"github.com/e1732a364fed/v2ray_simple/machine"
+)
 
 // 如果不引用 quic，go build 编译出的可执行文件 的大小 可以减小 2MB 。
+
+func init() {
+	//输出 各 quic连接 的 rtt, 丢包 与 拥塞窗口, 用于 调节 congestion_control.
+	//curl -k https://127.0.0.1:48345/api/quicStats
+	machine.ExtraApiHandlers["quicStats"] = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quic.GetConnStats())
+	}
+}
@@ -49,6 +49,8 @@ var cliCmdList = []*CliCmd{
 		"生成随机ssl证书", generateRandomSSlCert,
 	}, {
 		"生成一个随机的uuid供你参考", generateAndPrintUUID,
+	}, {
+		"生成 reality 所用的 x25519 密钥对", generateAndPrintRealityKeyPair,
 	}, {
 		"下载geosite文件夹", tryDownloadGeositeSource,
 	}, {
@@ -219,7 +219,7 @@ func interactively_generateConf(confClient, confServer *proxy.StandardConf) {
 
 	fmt.Printf("你输入了 %d\n", theInt)
 
-	clientlisten.Port = int(theInt)
+	clientlisten.Port = proxy.ListenPort{int(theInt)}
 	clientlisten.IP = "127.0.0.1"
 
 	select3 := promptui.Select{
@@ -376,6 +376,7 @@ func interactively_generateConf(confClient, confServer *proxy.StandardConf) {
 
 	var serverListenStruct proxy.ListenConf
 	serverListenStruct.CommonConf = clientDial.CommonConf
+	serverListenStruct.Port = proxy.ListenPort{clientDial.Port}
 	serverListenStruct.IP = "0.0.0.0"
 
 	confServer.Listen = append(confServer.Listen, &serverListenStruct)
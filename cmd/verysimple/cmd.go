@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
@@ -108,6 +109,46 @@ func generateAndPrintUUID() {
 	utils.PrintStr("\n")
 }
 
+func generateAndPrintRealityKeyPair() {
+	privateKey, publicKey, err := tlsLayer.GenerateRealityKeyPair()
+	if err != nil {
+		utils.PrintStr("生成失败,")
+		utils.PrintStr(err.Error())
+		utils.PrintStr("\n")
+		return
+	}
+	utils.PrintStr("Private key (reality_private_key, for server) : ")
+	utils.PrintStr(privateKey)
+	utils.PrintStr("\nPublic key (reality_public_key, for client) : ")
+	utils.PrintStr(publicKey)
+	utils.PrintStr("\n")
+}
+
+// 生成 ech.pem 给 服务端 的 ech_key_files 使用, 并 打印 客户端 ech_config 所用 的 ECHConfigList
+func generateECHKey(publicName string) {
+	const keyFn = "ech.pem"
+	if utils.FileExist(keyFn) {
+		utils.PrintStr(keyFn)
+		utils.PrintStr(" 已存在！\n")
+		return
+	}
+	keyPem, configList, err := tlsLayer.GenerateECHKey(publicName)
+	if err == nil {
+		err = os.WriteFile(keyFn, keyPem, 0600)
+	}
+	if err != nil {
+		utils.PrintStr("生成失败,")
+		utils.PrintStr(err.Error())
+		utils.PrintStr("\n")
+		return
+	}
+	utils.PrintStr("ECH key (ech_key_files, for server) : ")
+	utils.PrintStr(keyFn)
+	utils.PrintStr("\nECHConfigList (ech_config, for client, or the ech param of HTTPS dns record) : ")
+	utils.PrintStr(base64.StdEncoding.EncodeToString(configList))
+	utils.PrintStr("\n")
+}
+
 func generateRandomSSlCert() {
 	const certFn = "cert.pem"
 	const keyFn = "cert.key"
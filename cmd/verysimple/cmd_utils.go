@@ -20,6 +20,8 @@ func init() {
 	extraExitCmds := []exitCmd{
 		{name: "gu", desc: "automatically generate a uuid for you", f: generateAndPrintUUID},
 		{name: "gc", desc: "automatically generate random certificate for you", f: generateRandomSSlCert},
+		{name: "grk", desc: "automatically generate a x25519 key pair for reality", f: generateAndPrintRealityKeyPair},
+		{name: "gech", isStr: true, desc: "if given public name, generate an ECH key file (ech.pem) for server and print the ECHConfigList for client", fs: generateECHKey},
 
 		{name: "cvqxtvs", isStr: true, desc: "if given, convert qx server config string to vs toml config", fs: convertQxToVs},
 		{name: "eqxrs", isStr: true, desc: "if given, automatically extract remote servers from quantumultX config for you", fs: extractQxRemoteServers},
@@ -371,7 +371,7 @@ func addConfControls(sc proxy.StandardConf, vb *ui.Box, isDial bool) {
 			if isDial {
 				sc.Dial[curSelectedTagIdx].Port = portE.Value()
 			} else {
-				sc.Listen[curSelectedTagIdx].Port = portE.Value()
+				sc.Listen[curSelectedTagIdx].Port = proxy.ListenPort{portE.Value()}
 			}
 		})
 
@@ -545,6 +545,7 @@ func addConfControls(sc proxy.StandardConf, vb *ui.Box, isDial bool) {
 				if curSelectedTagIdx >= 0 {
 					curL := sc.Listen[curSelectedTagIdx]
 					cc = curL.CommonConf
+					cc.Port = curL.FirstPort()
 
 					keyE.SetText(curL.TLSKey)
 					certE.SetText(curL.TLSCert)
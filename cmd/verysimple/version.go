@@ -28,15 +28,23 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 
 	_ "github.com/e1732a364fed/v2ray_simple/advLayer/grpcSimple"
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/h2"
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/httpupgrade"
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/kcp"
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/splithttp"
 	_ "github.com/e1732a364fed/v2ray_simple/advLayer/ws"
 
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/dokodemo"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/hysteria2"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/reverse"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/shadowsocks"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/simplesocks"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/socks5http" //该包自动引用 socks5 和 http
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/trojan"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/tuic"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/vless"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/vmess"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/wireguard"
 )
 
 const (
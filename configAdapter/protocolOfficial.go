@@ -57,10 +57,14 @@ func ToSS(cc *proxy.CommonConf, lc *proxy.ListenConf, plain_userinfo bool, sip i
 		}
 	}
 
+	port := cc.Port
+	if lc != nil {
+		port = lc.FirstPort()
+	}
 	if cc.IP != "" {
-		u.Host = cc.IP + ":" + strconv.Itoa(cc.Port)
+		u.Host = cc.IP + ":" + strconv.Itoa(port)
 	} else {
-		u.Host = cc.Host + ":" + strconv.Itoa(cc.Port)
+		u.Host = cc.Host + ":" + strconv.Itoa(port)
 
 	}
 
@@ -187,11 +191,18 @@ func ToXray(dc *proxy.DialConf) string {
 
 		//}
 	}
+	if flow, ok := dc.Extra["flow"].(string); ok && flow != "" {
+		q.Add("flow", flow)
+	}
 	if dc.AdvancedLayer != "" {
-		q.Add("type", dc.AdvancedLayer)
+		if dc.AdvancedLayer == "h2" {
+			q.Add("type", "http") //v2ray/xray 把 h2 传输 叫做 http
+		} else {
+			q.Add("type", dc.AdvancedLayer)
+		}
 
 		switch dc.AdvancedLayer {
-		case "ws":
+		case "ws", "httpupgrade", "splithttp", "h2":
 			if dc.Path != "" {
 				q.Add("path", dc.Path)
 			}
@@ -199,6 +210,13 @@ func ToXray(dc *proxy.DialConf) string {
 				q.Add("host", dc.Host)
 
 			}
+		case "kcp":
+			if ht, ok := dc.Extra["kcp_header"].(string); ok && ht != "" {
+				q.Add("headerType", ht)
+			}
+			if seed, ok := dc.Extra["kcp_seed"].(string); ok && seed != "" {
+				q.Add("seed", seed)
+			}
 		case "grpc":
 			if dc.Path != "" {
 				q.Add("serviceName", dc.Path)
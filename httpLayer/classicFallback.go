@@ -1,47 +1,109 @@
 package httpLayer
 
 import (
+	"math/bits"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
 )
 
-/*实现 Fallback,支持 path, alpn, sni 分流。
- 内部 map 我们使用通用的集合办法, 而不是多层map嵌套;
-虽然目前就三个fallback类型，但是谁知道以后会加几个？所以这样更通用.
- 目前3种fallback性能是没问题的，不过如果 fallback继续增加的话，
- 最差情况下集合的子集总数会急剧上升,导致最差情况下性能不如多重 map;不过一般没人会给出那种配置.
+/*
+实现 Fallback,支持 path, alpn, sni, tls指纹, Host, User-Agent, 任意头, http方法 和 客户端地址 分流。
+
+内部 map 我们使用通用的集合办法, 而不是多层map嵌套, 这样 增加 fallback类型 很方便.
+
+条件类型 多了 以后, 一个请求 的 子集 总数 会 急剧上升, 所以 我们 在 插入时 就 预先 计算好 subsetTable:
+对 每种 ftype, 只 列出 map 中 真正 出现过的 子集, 条件 多的 在前. 匹配 时 依次 查 map 即可, 不用 每次 都 枚举 子集.
 
- TODO: 预先计算所有的子集，这样就不用每次匹配都算一遍
+tls指纹, User-Agent, header 和 客户端地址 不是 精确 匹配的, 一个 请求 可能 同时 匹配上 多个 条件,
+此时 会 把 所有 匹配上 的 条件 的 组合 都 试一遍, 所以 条件 多的 规则 总是 优先, 与 配置 顺序 无关;
+只有 条件类型 相同 的 规则 之间 才 按 配置 顺序 (tls指纹 则 按 参数 中 的 顺序) 选择.
 */
 type ClassicFallback struct {
 	Default *FallbackResult
 
-	supportedTypeMask byte
+	supportedTypeMask uint16
+
+	tlsFps map[string]bool //所有 配置了的 tls 指纹
+
+	uaRegexps   []*regexp.Regexp //所有 配置了的 User-Agent 正则
+	headerConds []headerCond     //所有 配置了的 header 条件
+	sources     []netip.Prefix   //所有 配置了的 客户端 地址
 
 	Map map[string]map[FallbackConditionSet]*FallbackResult //第一层key为 inTag，若为 "" 则表示 来自所有inServer 的 都会被匹配
+
+	subsetTable map[string][][]uint16 //key 与 Map 相同; subsetTable[tag][ftype] 为 Map[tag] 中 出现过 的 ftype 的 子集
 }
 
 func NewClassicFallback() *ClassicFallback {
 	cf := &ClassicFallback{
-		Map: make(map[string]map[FallbackConditionSet]*FallbackResult),
+		Map:         make(map[string]map[FallbackConditionSet]*FallbackResult),
+		tlsFps:      make(map[string]bool),
+		subsetTable: make(map[string][][]uint16),
 	}
 	cf.Map[""] = make(map[FallbackConditionSet]*FallbackResult)
 
 	return cf
 }
 
+// Fallback_header 的 条件, "Name" 或 "Name: value"
+type headerCond struct {
+	str         string //规范化 后的 条件, 用作 FallbackConditionSet.Header
+	name, value string
+	hasValue    bool
+}
+
+func parseHeaderCond(s string) (hc headerCond) {
+	name, value, hasValue := strings.Cut(s, ":")
+	hc.name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	hc.str = hc.name
+	if hasValue {
+		hc.hasValue = true
+		hc.value = strings.TrimSpace(value)
+		hc.str += ": " + hc.value
+	}
+	return
+}
+
+// 去掉 端口, 转为 小写
+func normalizeFallbackHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
 func NewClassicFallbackFromConfList(fcl []*FallbackConf) *ClassicFallback {
 	cfb := NewClassicFallback()
 	for _, fc := range fcl {
-		addr, err := netLayer.NewAddrFromAny(fc.Dest)
+		handler, err := NewFallbackHandler(fc.Dest)
 		if err != nil {
 			if ce := utils.CanLogErr("NewClassicFallbackFromConfList failed"); ce != nil {
-				ce.Write(zap.String("netLayer.NewAddrFromAny err", err.Error()))
+				ce.Write(zap.Error(err))
 			}
 
 			return nil
+		}
+		result := FallbackResult{Xver: fc.Xver, Handler: handler}
+
+		if handler == nil {
+			result.Addr, err = netLayer.NewAddrFromAny(fc.Dest)
+			if err != nil {
+				if ce := utils.CanLogErr("NewClassicFallbackFromConfList failed"); ce != nil {
+					ce.Write(zap.String("netLayer.NewAddrFromAny err", err.Error()))
+				}
 
+				return nil
+
+			}
 		}
 		var aMask byte
 		if len(fc.Alpn) > 2 {
@@ -58,56 +120,220 @@ func NewClassicFallbackFromConfList(fcl []*FallbackConf) *ClassicFallback {
 		}
 
 		condition := FallbackConditionSet{
-			Path:     fc.Path,
-			Sni:      fc.Sni,
-			AlpnMask: aMask,
+			Path:      fc.Path,
+			Sni:       fc.Sni,
+			AlpnMask:  aMask,
+			TlsFp:     fc.TlsFp,
+			Host:      fc.Host,
+			UserAgent: fc.UserAgent,
+			Header:    fc.Header,
+			Method:    fc.Method,
+			Source:    fc.Source,
 		}
 
-		cfb.InsertFallbackConditionSet(condition, fc.FromTag, addr, fc.Xver)
+		if err := cfb.InsertFallbackConditionSet(condition, fc.FromTag, result); err != nil {
+			if ce := utils.CanLogErr("NewClassicFallbackFromConfList failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+
+			return nil
+		}
 
 	}
 	return cfb
 }
 
-func (cfb *ClassicFallback) InsertFallbackConditionSet(condition FallbackConditionSet, forServerTags []string, addr netLayer.Addr, xver int) {
+// 若 condition 中 的 正则 或 CIDR 不合法, 则 不插入 并 返回 错误
+func (cfb *ClassicFallback) InsertFallbackConditionSet(condition FallbackConditionSet, forServerTags []string, result FallbackResult) error {
 
 	ftype := condition.GetType()
 
 	if ftype == FallBack_default && len(forServerTags) == 0 {
-		cfb.Default = &FallbackResult{Addr: addr, Xver: xver}
-		return
+		cfb.Default = &result
+		return nil
+	}
+
+	if err := cfb.addMatchers(&condition); err != nil {
+		return err
 	}
 
 	cfb.supportedTypeMask |= ftype
 
 	if len(forServerTags) == 0 {
-		realMap := cfb.Map[""]
-		realMap[condition] = &FallbackResult{Addr: addr, Xver: xver}
+		forServerTags = []string{""}
+	}
+	for _, forServerTag := range forServerTags {
 
-	} else {
-		for _, forServerTag := range forServerTags {
+		realMap := cfb.Map[forServerTag]
+		if realMap == nil {
+			realMap = make(map[FallbackConditionSet]*FallbackResult)
+			cfb.Map[forServerTag] = realMap
+		}
+
+		r := result
+		realMap[condition] = &r
+
+		cfb.updateSubsetTable(forServerTag)
+	}
+	return nil
+}
 
-			realMap := cfb.Map[forServerTag]
-			if realMap == nil {
-				realMap = make(map[FallbackConditionSet]*FallbackResult)
-				cfb.Map[forServerTag] = realMap
+// 记录 非精确匹配 的 条件, 并 把 condition 中 的 Host, Header, Method, Source 规范化, 以便 与 GetFallback 中 得到的 一致
+func (cfb *ClassicFallback) addMatchers(condition *FallbackConditionSet) error {
+	if condition.UserAgent != "" {
+		re, err := regexp.Compile(condition.UserAgent)
+		if err != nil {
+			return utils.ErrInErr{ErrDesc: "fallback user_agent is not a valid regexp", ErrDetail: err, Data: condition.UserAgent}
+		}
+		if !slices.ContainsFunc(cfb.uaRegexps, func(r *regexp.Regexp) bool { return r.String() == condition.UserAgent }) {
+			cfb.uaRegexps = append(cfb.uaRegexps, re)
+		}
+	}
+	if condition.Source != "" {
+		p, err := netLayer.ParseIPOrCIDR(condition.Source)
+		if err != nil {
+			return utils.ErrInErr{ErrDesc: "fallback source is neither ip nor CIDR", ErrDetail: err, Data: condition.Source}
+		}
+		condition.Source = p.String()
+		if !slices.Contains(cfb.sources, p) {
+			cfb.sources = append(cfb.sources, p)
+		}
+	}
+	if condition.Header != "" {
+		hc := parseHeaderCond(condition.Header)
+		if hc.name == "" {
+			return utils.ErrInErr{ErrDesc: "fallback header has no name", ErrDetail: utils.ErrInvalidData, Data: condition.Header}
+		}
+		condition.Header = hc.str
+		if !slices.Contains(cfb.headerConds, hc) {
+			cfb.headerConds = append(cfb.headerConds, hc)
+		}
+	}
+	if condition.TlsFp != "" {
+		cfb.tlsFps[condition.TlsFp] = true
+	}
+	if condition.Host != "" {
+		condition.Host = normalizeFallbackHost(condition.Host)
+	}
+	condition.Method = strings.ToUpper(condition.Method)
+	return nil
+}
+
+// 条件 数量, 无条件 的 FallBack_default 算 0 个
+func fallbackConditionCount(ftype uint16) int {
+	return bits.OnesCount16(ftype &^ FallBack_default)
+}
+
+// 重新计算 tag 的 subsetTable. 子集 中 条件 多的 在前, 数量 相同 时 含有 靠前类型 (如 path) 的 在前.
+// 无条件 的 (FallBack_default, 即 只 给出了 from 的) 是 所有 ftype 的 子集, 放在 最后.
+func (cfb *ClassicFallback) updateSubsetTable(tag string) {
+	var masks []uint16
+	for condition := range cfb.Map[tag] {
+		if m := condition.GetType(); !slices.Contains(masks, m) {
+			masks = append(masks, m)
+		}
+	}
+	sort.Slice(masks, func(i, j int) bool {
+		a, b := masks[i], masks[j]
+		if ca, cb := fallbackConditionCount(a), fallbackConditionCount(b); ca != cb {
+			return ca > cb
+		}
+		diff := a ^ b
+		return a&(diff&-diff) != 0
+	})
+
+	table := make([][]uint16, fallback_end)
+	for ftype := range table {
+		for _, m := range masks {
+			if m == FallBack_default || m&^uint16(ftype) == 0 {
+				table[ftype] = append(table[ftype], m)
 			}
+		}
+	}
+	cfb.subsetTable[tag] = table
+}
 
-			realMap[condition] = &FallbackResult{Addr: addr, Xver: xver}
+// 参数 为 http.Header.Write 的 格式, 每行 一个 "Name: value". 按 配置 顺序 返回 所有 匹配上 的 条件
+func (cfb *ClassicFallback) matchHeaders(param string) (rs []string) {
+	var lines []string
+	for _, line := range strings.Split(param, "\r\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for _, hc := range cfb.headerConds {
+		for _, line := range lines {
+			name, value, ok := strings.Cut(line, ":")
+			if !ok || http.CanonicalHeaderKey(strings.TrimSpace(name)) != hc.name {
+				continue
+			}
+			if !hc.hasValue || strings.TrimSpace(value) == hc.value {
+				rs = append(rs, hc.str)
+				break
+			}
 		}
 	}
+	return
+}
 
+// 参数 为 ip 或 ip:port. 按 配置 顺序 返回 所有 包含 它 的 CIDR
+func (cfb *ClassicFallback) matchSources(param string) (rs []string) {
+	addr, ok := netLayer.StrToNetIP(param)
+	if !ok {
+		return
+	}
+	for _, p := range cfb.sources {
+		if p.Contains(addr) {
+			rs = append(rs, p.String())
+		}
+	}
+	return
 }
 
-func (cfb *ClassicFallback) SupportType() byte {
+// 按 配置 顺序 返回 所有 匹配上 的 User-Agent 正则
+func (cfb *ClassicFallback) matchUserAgents(param string) (rs []string) {
+	for _, re := range cfb.uaRegexps {
+		if re.MatchString(param) {
+			rs = append(rs, re.String())
+		}
+	}
+	return
+}
+
+// 一种 非精确 条件 匹配上 的 所有 候选
+type fallbackCandidates struct {
+	ftype uint16
+	strs  []string
+}
+
+// 在 realMap 中 查找 cd 的 subType 子集, 其中 非精确 条件 会 依次 使用 cands 中 的 每个 候选 组合
+func lookupFallbackCandidates(realMap map[FallbackConditionSet]*FallbackResult, cd FallbackConditionSet, subType uint16, cands []fallbackCandidates) *FallbackResult {
+	if len(cands) == 0 {
+		return realMap[cd.GetSub(subType)]
+	}
+	c := cands[0]
+	if !HasFallbackType(subType, c.ftype) {
+		return lookupFallbackCandidates(realMap, cd, subType, cands[1:])
+	}
+	for _, str := range c.strs {
+		cd.setSingle(c.ftype, str, 0)
+		if r := lookupFallbackCandidates(realMap, cd, subType, cands[1:]); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func (cfb *ClassicFallback) SupportType() uint16 {
 
 	return cfb.supportedTypeMask
 }
 
 // GetFallback 使用给出的 ftype mask 和 对应参数 来试图匹配到 回落地址.
-// ss 必须按 FallBack_* 类型 从小到大顺序排列
-//
-func (cfb *ClassicFallback) GetFallback(fromServerTag string, ftype byte, ss ...string) *FallbackResult {
+// ss 必须按 FallBack_* 类型 从小到大顺序排列.
+// Fallback_tlsfp 的 参数 为 空格 分隔的 多个 指纹 (如 ja4 和 ja3 的 md5), 其中 配置过 的 都会 被 尝试.
+// Fallback_host, Fallback_ua, Fallback_header 和 Fallback_method 的 参数 见 GetHttpFallbackParams, Fallback_source 的 参数 为 ip 或 ip:port.
+func (cfb *ClassicFallback) GetFallback(fromServerTag string, ftype uint16, ss ...string) *FallbackResult {
 
 	if ftype == FallBack_default && fromServerTag == "" {
 		return cfb.Default
@@ -121,9 +347,18 @@ func (cfb *ClassicFallback) GetFallback(fromServerTag string, ftype byte, ss ...
 
 	cd := FallbackConditionSet{}
 
+	//非精确 条件 的 所有 候选; cd 中 只 放 第一个, 用于 确定 类型
+	var cands []fallbackCandidates
+	addCands := func(t uint16, strs []string) {
+		if len(strs) > 0 {
+			cd.setSingle(t, strs[0], 0)
+			cands = append(cands, fallbackCandidates{ftype: t, strs: strs})
+		}
+	}
+
 	ss_cursor := 0
 
-	for thisType := byte(Fallback_path); thisType < fallback_end; thisType <<= 1 {
+	for thisType := Fallback_path; thisType < fallback_end; thisType <<= 1 {
 		if len(ss) <= ss_cursor {
 			break
 		}
@@ -152,25 +387,45 @@ func (cfb *ClassicFallback) GetFallback(fromServerTag string, ftype byte, ss ...
 			cd.Path = param
 		case Fallback_sni:
 			cd.Sni = param
+		case Fallback_tlsfp:
+			var fps []string
+			for _, fp := range strings.Fields(param) {
+				if cfb.tlsFps[fp] {
+					fps = append(fps, fp)
+				}
+			}
+			addCands(thisType, fps)
+		case Fallback_host:
+			cd.Host = normalizeFallbackHost(param)
+		case Fallback_ua:
+			addCands(thisType, cfb.matchUserAgents(param))
+		case Fallback_header:
+			addCands(thisType, cfb.matchHeaders(param))
+		case Fallback_method:
+			cd.Method = strings.ToUpper(param)
+		case Fallback_source:
+			addCands(thisType, cfb.matchSources(param))
 		}
 	}
 
 	var result *FallbackResult
 
-	realMap := cfb.Map[fromServerTag]
+	realMap, table := cfb.Map[fromServerTag], cfb.subsetTable[fromServerTag]
 	if realMap == nil {
-		realMap = cfb.Map[""]
+		realMap, table = cfb.Map[""], cfb.subsetTable[""]
 	}
 
 	if len(realMap) != 0 {
-		result = cd.TestAllSubSets(cfb.supportedTypeMask, realMap)
-
+		for _, subType := range table[cd.GetType()] {
+			if result = lookupFallbackCandidates(realMap, cd, subType, cands); result != nil {
+				break
+			}
+		}
 	}
 
+	//iics 会 给 每个 请求 都 加上 已 配置 的 条件 的 参数, 所以 不能 只在 ftype 为 Fallback_path 时 才 回落 到 默认 回落
 	if result == nil {
-		if ftype == Fallback_path {
-			return cfb.Default
-		}
+		return cfb.Default
 	}
 
 	return result
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 )
@@ -13,7 +14,7 @@ const (
 	Fallback_none = 0
 )
 const (
-	FallBack_default byte = 1 << iota //default 其实也是path，只不过path是通配符。
+	FallBack_default uint16 = 1 << iota //default 其实也是path，只不过path是通配符。
 
 	//这里剩余fallback按该固定顺序排列. 这是为了方便代码的书写(alpn和sni都是tls的)
 
@@ -22,6 +23,15 @@ const (
 	Fallback_path
 	Fallback_alpn
 	Fallback_sni
+	Fallback_tlsfp //客户端 tls 指纹, 见 tlsLayer.HelloFingerprint
+
+	//下面 几个 来自 http 请求 或 客户端 地址, 见 GetHttpFallbackParams
+
+	Fallback_host   //Host 头, 不含 端口
+	Fallback_ua     //User-Agent, 按 正则 匹配
+	Fallback_header //任意 头 的 存在 或 值, 参数 为 所有 头, 每行 一个 "Name: value"
+	Fallback_method //http 方法
+	Fallback_source //客户端 地址, 按 CIDR 匹配
 
 	fallback_end
 
@@ -51,31 +61,29 @@ type FallbackMeta struct {
 	XFF       net.Addr
 }
 
-func getfallbacktype_byindex(i int) byte {
-	return 1 << (i + 1)
-}
-
 // 判断 Fallback.SupportType 返回的 数值 是否具有特定的Fallback类型
-func HasFallbackType(ftype, b byte) bool {
+func HasFallbackType(ftype, b uint16) bool {
 	return ftype&b > 0
 }
 
-// 实现 Fallback. 这里的fallback只与http协议有关，所以只能按path,alpn 和 sni 进行分类
+// 实现 Fallback. 这里的fallback只与http协议有关，所以只能按 path, alpn, sni, tls指纹, http头 和 客户端地址 进行分类
 type Fallback interface {
-	GetFallback(ftype byte, params ...string) *FallbackResult
-	SupportType() byte //参考Fallback_开头的常量。如果支持多个，则返回它们 按位与 的结果
+	GetFallback(ftype uint16, params ...string) *FallbackResult
+	SupportType() uint16 //参考Fallback_开头的常量。如果支持多个，则返回它们 按位与 的结果
 }
 
 type FallbackResult struct {
 	Addr netLayer.Addr
 	Xver int
+
+	Handler *FallbackHandler //不为 nil 时 使用 内置 的 回落 目标, 而不是 Addr
 }
 
-func (r *FallbackResult) GetFallback(ftype byte, _ ...string) *FallbackResult {
+func (r *FallbackResult) GetFallback(ftype uint16, _ ...string) *FallbackResult {
 	return r
 }
 
-func (FallbackResult) SupportType() byte {
+func (FallbackResult) SupportType() uint16 {
 	return FallBack_default
 }
 
@@ -89,6 +97,8 @@ type FallbackConf struct {
 	//see netLayer.NewAddrFromAny for details about "any" addr.
 	//
 	// 约定，如果该项是字符串 且 开头为@，则我们认为它给出的是 tag 名称，要将其替换为 实际 该tag的 listen  的地址。
+	//
+	// 以 file:// , http:// 或 https:// 开头 时 为 内置 的 静态文件 或 反向代理, 见 FallbackHandler
 	Dest any `toml:"dest" json:"dest"`
 
 	//几种匹配方式，可选
@@ -96,4 +106,38 @@ type FallbackConf struct {
 	Path string   `toml:"path" json:"path"`
 	Sni  string   `toml:"sni" json:"sni"`
 	Alpn []string `toml:"alpn" json:"alpn"`
+
+	TlsFp string `toml:"tls_fp" json:"tls_fp"` //客户端 tls 指纹, ja4 或 ja3 的 md5, 可用于 把 扫描器 回落到 别处
+
+	Host      string `toml:"host" json:"host"`             //Host 头, 不区分 大小写, 忽略 端口
+	UserAgent string `toml:"user_agent" json:"user_agent"` //User-Agent 的 正则表达式, 如 "(?i)curl|python|go-http-client"
+	Header    string `toml:"header" json:"header"`         //"Name" 表示 有 该头 即可, "Name: value" 表示 该头 的 值 要 等于 value
+	Method    string `toml:"method" json:"method"`         //http 方法, 如 "GET"
+	Source    string `toml:"source" json:"source"`         //客户端 地址, CIDR 或 单个 ip
+}
+
+// GetHttpFallbackParams 返回 Fallback_host, Fallback_ua, Fallback_header 和 Fallback_method 所用 的 参数.
+// h2 时 给出 h2Request, 否则 从 h1 的 首包 中 解析; 解析 失败 时 均为 空.
+func GetHttpFallbackParams(h1FirstBuffer []byte, h2Request *http.Request) (host, ua, header, method string) {
+	var h http.Header
+	if h2Request != nil {
+		method, host, h = h2Request.Method, h2Request.Host, h2Request.Header
+	} else {
+		_, m, _, rawHeaders, failreason := ParseH1Request(h1FirstBuffer, false)
+		if failreason != 0 {
+			return
+		}
+		method = m
+		h = make(http.Header, len(rawHeaders))
+		for _, rh := range rawHeaders {
+			h.Add(string(rh.Head), string(bytes.TrimSpace(rh.Value)))
+		}
+		host = h.Get("Host")
+	}
+	ua = h.Get("User-Agent")
+
+	var sb strings.Builder
+	h.Write(&sb)
+	header = sb.String()
+	return
 }
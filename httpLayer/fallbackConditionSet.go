@@ -8,9 +8,12 @@ import (
 type FallbackConditionSet struct {
 	Path, Sni string
 	AlpnMask  byte
+	TlsFp     string
+
+	Host, UserAgent, Header, Method, Source string //UserAgent 为 正则, Source 为 CIDR, 均为 配置中 的 原 字符串
 }
 
-func (fcs *FallbackConditionSet) GetType() (r byte) {
+func (fcs *FallbackConditionSet) GetType() (r uint16) {
 	if fcs.Path != "" {
 		r |= (Fallback_path)
 	}
@@ -20,32 +23,43 @@ func (fcs *FallbackConditionSet) GetType() (r byte) {
 	if fcs.AlpnMask > 0 {
 		r |= Fallback_alpn
 	}
+	if fcs.TlsFp != "" {
+		r |= Fallback_tlsfp
+	}
+	if fcs.Host != "" {
+		r |= Fallback_host
+	}
+	if fcs.UserAgent != "" {
+		r |= Fallback_ua
+	}
+	if fcs.Header != "" {
+		r |= Fallback_header
+	}
+	if fcs.Method != "" {
+		r |= Fallback_method
+	}
+	if fcs.Source != "" {
+		r |= Fallback_source
+	}
 	if r == 0 {
 		r = FallBack_default
 	}
 	return r
 }
 
-func (fcs *FallbackConditionSet) GetSub(subType byte) (r FallbackConditionSet) {
+func (fcs *FallbackConditionSet) GetSub(subType uint16) (r FallbackConditionSet) {
 
-	for thisType := byte(Fallback_path); thisType < fallback_end; thisType++ {
+	for thisType := Fallback_path; thisType < fallback_end; thisType <<= 1 {
 		if !HasFallbackType(subType, thisType) {
 			continue
 		}
-		switch thisType {
-		case Fallback_alpn:
-			r.AlpnMask = fcs.AlpnMask
-
-		case Fallback_path:
-			r.Path = fcs.Path
-		case Fallback_sni:
-			r.Sni = fcs.Sni
-		}
+		s, b := fcs.getSingle(thisType)
+		r.setSingle(thisType, s, b)
 	}
 	return
 }
 
-func (fcs *FallbackConditionSet) getSingle(t byte) (s string, b byte) {
+func (fcs *FallbackConditionSet) getSingle(t uint16) (s string, b byte) {
 	switch t {
 	case Fallback_path:
 		s = fcs.Path
@@ -53,24 +67,23 @@ func (fcs *FallbackConditionSet) getSingle(t byte) (s string, b byte) {
 		s = fcs.Sni
 	case Fallback_alpn:
 		b = fcs.AlpnMask
+	case Fallback_tlsfp:
+		s = fcs.TlsFp
+	case Fallback_host:
+		s = fcs.Host
+	case Fallback_ua:
+		s = fcs.UserAgent
+	case Fallback_header:
+		s = fcs.Header
+	case Fallback_method:
+		s = fcs.Method
+	case Fallback_source:
+		s = fcs.Source
 	}
 	return
 }
 
-func (fcs *FallbackConditionSet) getSingleByInt(t int) (s string, b byte) {
-	switch t {
-	case 0:
-		s = fcs.Path
-	case 1:
-		b = fcs.AlpnMask
-	case 2:
-		s = fcs.Sni
-
-	}
-	return
-}
-
-func (fcs *FallbackConditionSet) setSingle(t byte, s string, b byte) {
+func (fcs *FallbackConditionSet) setSingle(t uint16, s string, b byte) {
 	switch t {
 	case Fallback_sni:
 		fcs.Sni = s
@@ -78,23 +91,22 @@ func (fcs *FallbackConditionSet) setSingle(t byte, s string, b byte) {
 		fcs.Path = s
 	case Fallback_alpn:
 		fcs.AlpnMask = b
+	case Fallback_tlsfp:
+		fcs.TlsFp = s
+	case Fallback_host:
+		fcs.Host = s
+	case Fallback_ua:
+		fcs.UserAgent = s
+	case Fallback_header:
+		fcs.Header = s
+	case Fallback_method:
+		fcs.Method = s
+	case Fallback_source:
+		fcs.Source = s
 	}
 }
 
-func (fcs *FallbackConditionSet) setSingleByInt(t int, s string, b byte) {
-	switch t {
-	case 0:
-		fcs.Path = s
-	case 1:
-		fcs.AlpnMask = b
-
-	case 2:
-		fcs.Sni = s
-
-	}
-}
-
-func (fcs *FallbackConditionSet) extractSingle(t byte) (r FallbackConditionSet) {
+func (fcs *FallbackConditionSet) extractSingle(t uint16) (r FallbackConditionSet) {
 	s, b := fcs.getSingle(t)
 	r.setSingle(t, s, b)
 	return
@@ -103,9 +115,9 @@ func (fcs *FallbackConditionSet) extractSingle(t byte) (r FallbackConditionSet)
 //返回不包括自己的所有子集
 func (fcs *FallbackConditionSet) GetAllSubSets() (rs []FallbackConditionSet) {
 
-	alltypes := make([]byte, 0, all_non_default_fallbacktype_count)
+	alltypes := make([]uint16, 0, all_non_default_fallbacktype_count)
 	ftype := fcs.GetType()
-	for thisType := byte(Fallback_path); thisType < fallback_end; thisType <<= 1 {
+	for thisType := Fallback_path; thisType < fallback_end; thisType <<= 1 {
 		if !HasFallbackType(ftype, thisType) {
 			continue
 		}
@@ -140,7 +152,7 @@ func (fcs *FallbackConditionSet) GetAllSubSets() (rs []FallbackConditionSet) {
 
 // TestAllSubSets 传入一个map, 对fcs自己以及其所有子集依次测试, 看是否有匹配的。
 // 对比 GetAllSubSets 内存占用较大, 而本方法开销则小很多, 因为1是复用内存, 2是匹配到就会返回，一般不会到遍历全部子集.
-func (fcs FallbackConditionSet) TestAllSubSets(allsupportedTypeMask byte, theMap map[FallbackConditionSet]*FallbackResult) *FallbackResult {
+func (fcs FallbackConditionSet) TestAllSubSets(allsupportedTypeMask uint16, theMap map[FallbackConditionSet]*FallbackResult) *FallbackResult {
 
 	if addr := theMap[fcs]; addr != nil {
 		return addr
@@ -149,8 +161,8 @@ func (fcs FallbackConditionSet) TestAllSubSets(allsupportedTypeMask byte, theMap
 	ftype := fcs.GetType()
 
 	// 该 FallbackConditionSet 所支持的所有类型
-	alltypes := make([]byte, 0, all_non_default_fallbacktype_count)
-	for thisType := byte(Fallback_path); thisType < fallback_end; thisType <<= 1 {
+	alltypes := make([]uint16, 0, all_non_default_fallbacktype_count)
+	for thisType := Fallback_path; thisType < fallback_end; thisType <<= 1 {
 		if !HasFallbackType(ftype, thisType) {
 			continue
 		}
@@ -184,14 +196,15 @@ func (fcs FallbackConditionSet) TestAllSubSets(allsupportedTypeMask byte, theMap
 				curSet := FallbackConditionSet{}
 
 				for _, typeIndex := range indexList { //按得到的type索引生成本curSet
+					thisType := alltypes[typeIndex]
 
 					//有的单个元素种类不可能在map中出现过
-					if !HasFallbackType(allsupportedTypeMask, getfallbacktype_byindex(typeIndex)) {
+					if !HasFallbackType(allsupportedTypeMask, thisType) {
 						continue nextCombination
 					}
 
-					s, b := fcs.getSingleByInt(typeIndex)
-					curSet.setSingleByInt(typeIndex, s, b)
+					s, b := fcs.getSingle(thisType)
+					curSet.setSingle(thisType, s, b)
 				}
 
 				if addr := theMap[curSet]; addr != nil {
@@ -0,0 +1,193 @@
+package httpLayer
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+/*
+FallbackHandler 是 内置 的 回落 目标, 直接 在 本进程 中 响应 回落 的 http 请求, 这样 就 不需要 再 单独 开 一个 nginx 作为 伪装网站.
+
+FallbackConf.Dest 为 下面 两种 url 时 使用:
+
+	dest = "file:///var/www/html"   # 静态 文件, 目录 中的 index.html 作为 首页, 支持 MIME 类型 和 Range 请求; 相对路径 也可以, 如 "file://www"
+	dest = "https://example.com"    # 反向代理 到 该 url, Host 头 会被 改写 为 该 url 的 host
+
+h1 的 回落 直接 在 原连接 上 运行 一个 http.Server (首包 为 h2c 的 preface 时 运行 http2.Server); h2 的 回落 直接 使用 H2Request 和 H2RW.
+
+内置 dest 不使用 xver.
+*/
+type FallbackHandler struct {
+	http.Handler
+	Dest string //配置 中 给出 的 dest, 用于 日志
+}
+
+const (
+	fallbackHandlerReadHeaderTimeout = time.Second * 30
+	fallbackHandlerIdleTimeout       = time.Second * 75 //与 nginx 的 keepalive_timeout 默认值 相同
+)
+
+// 若 dest 不是 内置 dest 的 格式, 返回 nil, nil
+func NewFallbackHandler(dest any) (*FallbackHandler, error) {
+	deststr, ok := dest.(string)
+	if !ok {
+		return nil, nil
+	}
+	switch {
+	case strings.HasPrefix(deststr, "file://"):
+		dir := utils.GetFilePath(strings.TrimPrefix(deststr, "file://"))
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "fallback file dest not exist", ErrDetail: err, Data: dir}
+		}
+		if !fi.IsDir() {
+			return nil, utils.ErrInErr{ErrDesc: "fallback file dest is not a directory", ErrDetail: utils.ErrInvalidData, Data: dir}
+		}
+		return &FallbackHandler{
+			Handler: http.FileServer(noListingDir{http.Dir(dir)}),
+			Dest:    deststr,
+		}, nil
+
+	case strings.HasPrefix(deststr, "http://") || strings.HasPrefix(deststr, "https://"):
+		u, err := url.Parse(deststr)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "fallback reverse proxy dest is not a valid url", ErrDetail: err, Data: deststr}
+		}
+		if u.Host == "" {
+			return nil, utils.ErrInErr{ErrDesc: "fallback reverse proxy dest has no host", ErrDetail: utils.ErrInvalidData, Data: deststr}
+		}
+		return &FallbackHandler{
+			Handler: newReverseProxy(u),
+			Dest:    deststr,
+		}, nil
+	}
+	return nil, nil
+}
+
+func newReverseProxy(u *url.URL) *httputil.ReverseProxy {
+	rp := httputil.NewSingleHostReverseProxy(u)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+	}
+	rp.ErrorLog = log.New(io.Discard, "", 0)
+	rp.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		if ce := utils.CanLogErr("Failed in fallback reverse proxy"); ce != nil {
+			ce.Write(
+				zap.String("upstream", u.String()),
+				zap.String("path", r.URL.Path),
+				zap.Error(err),
+			)
+		}
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+	return rp
+}
+
+// 没有 index.html 的 目录 返回 404, 而不是 列出 目录 内容, 这样 更像 一个 普通 网站
+type noListingDir struct {
+	http.Dir
+}
+
+func (d noListingDir) Open(name string) (http.File, error) {
+	f, err := d.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		index, err := d.Dir.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// 响应 回落 的 请求, 直到 连接 关闭 才 返回. fm.Conn 会被 关闭.
+func (fh *FallbackHandler) Serve(fm FallbackMeta) {
+	if fm.IsH2 {
+		defer fm.Conn.Close()
+
+		fh.ServeHTTP(fm.H2RW, fm.H2Request)
+		return
+	}
+
+	conn := fm.Conn
+	conn.SetDeadline(time.Time{})
+
+	isH2c := false
+	if buf := fm.H1RequestBuf; buf != nil && buf.Len() > 0 {
+		isH2c = bytes.HasPrefix(buf.Bytes(), []byte(http2.ClientPreface))
+
+		conn = &netLayer.ReadWrapper{
+			Conn:              conn,
+			OptionalReader:    buf,
+			RemainFirstBufLen: buf.Len(),
+		}
+	}
+
+	if isH2c {
+		defer conn.Close()
+
+		(&http2.Server{IdleTimeout: fallbackHandlerIdleTimeout}).ServeConn(conn, &http2.ServeConnOpts{Handler: fh})
+		return
+	}
+
+	l := &oneConnListener{conn: conn, done: make(chan struct{})}
+	s := &http.Server{
+		Handler:           fh,
+		ReadHeaderTimeout: fallbackHandlerReadHeaderTimeout,
+		IdleTimeout:       fallbackHandlerIdleTimeout,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ConnState: func(c net.Conn, cs http.ConnState) {
+			if cs == http.StateClosed || cs == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	s.Serve(l)
+}
+
+// 只 Accept 一次 的 Listener, 用于 在 一个 已有 的 连接 上 运行 http.Server. 连接 关闭 后 Accept 返回 net.ErrClosed.
+type oneConnListener struct {
+	conn      net.Conn
+	accepted  bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,140 @@
+package httpLayer_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"golang.org/x/net/http2"
+)
+
+func TestFallbackHandlerStatic(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>cover</html>"), 0644)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("0123456789"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	cfb := httpLayer.NewClassicFallbackFromConfList([]*httpLayer.FallbackConf{{Dest: "file://" + dir, Path: "/"}})
+	if cfb == nil {
+		t.Fatal("NewClassicFallbackFromConfList failed")
+	}
+	r := cfb.GetFallback("", httpLayer.Fallback_path, "/")
+	if r == nil || r.Handler == nil {
+		t.Fatal("no handler", r)
+	}
+
+	//首个 请求 已被 读入 H1RequestBuf
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		r.Handler.Serve(httpLayer.FallbackMeta{
+			Conn:         c2,
+			H1RequestBuf: bytes.NewBufferString("GET /a.txt HTTP/1.1\r\nHost: cover.example\r\nRange: bytes=2-4\r\n\r\n"),
+		})
+		close(done)
+	}()
+
+	br := bufio.NewReader(c1)
+	read := func(method string) (*http.Response, string) {
+		rsp, err := http.ReadResponse(br, &http.Request{Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp, string(body)
+	}
+
+	rsp, body := read("GET")
+	if rsp.StatusCode != http.StatusPartialContent || body != "234" || rsp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatal("range", rsp.StatusCode, body, rsp.Header)
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "<html>cover</html>"},
+		{"/sub/", http.StatusNotFound, ""},
+		{"/no", http.StatusNotFound, ""},
+	} {
+		io.WriteString(c1, "GET "+c.path+" HTTP/1.1\r\nHost: cover.example\r\n\r\n")
+		rsp, body = read("GET")
+		if rsp.StatusCode != c.status || (c.body != "" && body != c.body) {
+			t.Fatal(c.path, rsp.StatusCode, body)
+		}
+	}
+
+	c1.Close()
+	<-done
+
+	if _, err := httpLayer.NewFallbackHandler("file://" + filepath.Join(dir, "a.txt")); err == nil {
+		t.Fatal("file dest should be a directory")
+	}
+}
+
+func TestFallbackHandlerReverseProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, r.Host+" "+r.URL.RequestURI())
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	fh, err := httpLayer.NewFallbackHandler(upstream.URL)
+	if err != nil || fh == nil {
+		t.Fatal(fh, err)
+	}
+	want := u.Host + " /x?y=1"
+
+	//h2 回落 直接 使用 H2Request 和 H2RW
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	rec := httptest.NewRecorder()
+	fh.Serve(httpLayer.FallbackMeta{
+		Conn:      c2,
+		IsH2:      true,
+		H2Request: httptest.NewRequest("GET", "https://cover.example/x?y=1", nil),
+		H2RW:      rec,
+	})
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Fatal("h2", rec.Code, rec.Body.String())
+	}
+
+	//h2c, 首包 为 preface
+	c1, c2 = net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		preface := make([]byte, len(http2.ClientPreface))
+		io.ReadFull(c2, preface)
+		fh.Serve(httpLayer.FallbackMeta{Conn: c2, H1RequestBuf: bytes.NewBuffer(preface)})
+		close(done)
+	}()
+
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://cover.example/x?y=1", nil)
+	rsp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(rsp.Body)
+	if string(body) != want {
+		t.Fatal("h2c", string(body))
+	}
+	cc.Close()
+	<-done
+
+	if fh, _ := httpLayer.NewFallbackHandler("127.0.0.1:80"); fh != nil {
+		t.Fatal("addr dest should not be a handler")
+	}
+}
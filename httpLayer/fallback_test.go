@@ -54,6 +54,207 @@ func TestTestAllSubSets(t *testing.T) {
 	t.Log(testf.TestAllSubSets(map2Mask, testMap2))
 }
 
+func TestClassicFallbackTlsFp(t *testing.T) {
+	cfb := httpLayer.NewClassicFallbackFromConfList([]*httpLayer.FallbackConf{
+		{Dest: 80},
+		{Dest: 8080, TlsFp: "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{Dest: 8081, TlsFp: "e7d705a3286e19ea42f587b344ee6865", Path: "/a"},
+	})
+
+	//参数 为 空格 分隔 的 ja4 和 ja3 的 md5
+	for _, c := range []struct {
+		ftype  uint16
+		params []string
+		port   int
+	}{
+		{httpLayer.Fallback_path, []string{"/"}, 80},
+		{httpLayer.Fallback_path | httpLayer.Fallback_tlsfp, []string{"/", "t13d1516h2_8daaf6152771_e5627efa2ab1 cd08e31494f9531f560d64c695473da9"}, 8080},
+		{httpLayer.Fallback_path | httpLayer.Fallback_tlsfp, []string{"/a", "t13d1715h2_5b57614c22b0_3d5424432f57 e7d705a3286e19ea42f587b344ee6865"}, 8081},
+		{httpLayer.Fallback_path | httpLayer.Fallback_tlsfp, []string{"/", "t13d1715h2_5b57614c22b0_3d5424432f57 e7d705a3286e19ea42f587b344ee6865"}, 80},
+	} {
+		r := cfb.GetFallback("", c.ftype, c.params...)
+		if r == nil {
+			r = cfb.Default
+		}
+		if r == nil || r.Addr.Port != c.port {
+			t.Fatal("wrong fallback", c.params, r)
+		}
+	}
+}
+
+func TestClassicFallbackHttpConditions(t *testing.T) {
+	cfb := httpLayer.NewClassicFallbackFromConfList([]*httpLayer.FallbackConf{
+		{Dest: 80},
+		{Dest: 8001, UserAgent: "(?i)curl|python"},
+		{Dest: 8002, Host: "www.Example.com"},
+		{Dest: 8003, Host: "www.example.com", Method: "post"},
+		{Dest: 8004, Header: "x-scanner"},
+		{Dest: 8005, Header: "Accept: */*", Path: "/api"},
+		{Dest: 8006, Source: "10.0.0.0/8"},
+		{Dest: 8007, Source: "192.168.1.2", UserAgent: "(?i)curl|python"},
+		{Dest: 8008, FromTag: []string{"mytag"}},
+	})
+	if cfb == nil {
+		t.Fatal("nil fallback")
+	}
+
+	get := func(tag, request, raddr string) int {
+		host, ua, header, method := httpLayer.GetHttpFallbackParams([]byte(request), nil)
+		_, _, path, _, _ := httpLayer.ParseH1Request([]byte(request), false)
+
+		//与 iics.checkfallback 一样 按 类型 顺序 给出 参数
+		ftype := httpLayer.Fallback_path
+		params := []string{path}
+		for _, p := range []struct {
+			t     uint16
+			param string
+		}{
+			{httpLayer.Fallback_host, host},
+			{httpLayer.Fallback_ua, ua},
+			{httpLayer.Fallback_header, header},
+			{httpLayer.Fallback_method, method},
+			{httpLayer.Fallback_source, raddr},
+		} {
+			if p.param != "" {
+				ftype |= p.t
+				params = append(params, p.param)
+			}
+		}
+		r := cfb.GetFallback(tag, ftype, params...)
+		if r == nil && tag != "" {
+			r = cfb.GetFallback("", ftype, params...)
+		}
+		if r == nil {
+			r = cfb.Default
+		}
+		return r.Addr.Port
+	}
+
+	const browser = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36"
+	for i, c := range []struct {
+		tag, request, raddr string
+		port                int
+	}{
+		{"", "GET / HTTP/1.1\r\nHost: other.com\r\nUser-Agent: " + browser + "\r\n\r\n", "1.1.1.1:1234", 80},
+		{"", "GET / HTTP/1.1\r\nHost: other.com\r\nUser-Agent: curl/8.0\r\n\r\n", "1.1.1.1:1234", 8001},
+		{"", "GET / HTTP/1.1\r\nHost: WWW.example.com:443\r\nUser-Agent: " + browser + "\r\n\r\n", "1.1.1.1:1234", 8002},
+		{"", "POST / HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: " + browser + "\r\n\r\n", "1.1.1.1:1234", 8003},
+		{"", "GET / HTTP/1.1\r\nHost: other.com\r\nX-Scanner: 1\r\n\r\n", "1.1.1.1:1234", 8004},
+		{"", "GET /api HTTP/1.1\r\nHost: other.com\r\nAccept: */*\r\n\r\n", "1.1.1.1:1234", 8005},
+		{"", "GET / HTTP/1.1\r\nHost: other.com\r\nAccept: */*\r\n\r\n", "1.1.1.1:1234", 80},
+		{"", "GET / HTTP/1.1\r\nHost: other.com\r\n\r\n", "10.1.2.3:1234", 8006},
+		{"", "GET / HTTP/1.1\r\nHost: other.com\r\nUser-Agent: python-requests\r\n\r\n", "[::ffff:192.168.1.2]:1234", 8007},
+		{"", "GET / HTTP/1.1\r\nHost: other.com\r\nUser-Agent: python-requests\r\n\r\n", "192.168.1.3:1234", 8001},
+		{"mytag", "GET / HTTP/1.1\r\nHost: other.com\r\n\r\n", "1.1.1.1:1234", 8008},
+	} {
+		if got := get(c.tag, c.request, c.raddr); got != c.port {
+			t.Fatal("wrong fallback", i, got, "want", c.port)
+		}
+	}
+
+	if httpLayer.NewClassicFallbackFromConfList([]*httpLayer.FallbackConf{{Dest: 80, UserAgent: "("}}) != nil {
+		t.Fatal("should fail with invalid regexp")
+	}
+	if httpLayer.NewClassicFallbackFromConfList([]*httpLayer.FallbackConf{{Dest: 80, Source: "1.2.3.4/33"}}) != nil {
+		t.Fatal("should fail with invalid CIDR")
+	}
+}
+
+// 配置了 与 请求 无关 的 条件 时, 不 匹配 的 请求 仍 应 回落 到 默认 回落, 而 不是 nil
+func TestClassicFallbackUnmatchedCondition(t *testing.T) {
+	cfb := httpLayer.NewClassicFallbackFromConfList([]*httpLayer.FallbackConf{
+		{Dest: 80},
+		{Dest: 81, Method: "POST"},
+		{Dest: 82, UserAgent: "curl"},
+		{Dest: 83, Source: "10.0.0.0/8"},
+	})
+	if cfb == nil {
+		t.Fatal("nil fallback")
+	}
+
+	for i, c := range []struct {
+		ftype  uint16
+		params []string
+		port   int
+	}{
+		{httpLayer.Fallback_path | httpLayer.Fallback_method, []string{"/", "GET"}, 80},
+		{httpLayer.Fallback_path | httpLayer.Fallback_method, []string{"/", "POST"}, 81},
+		{httpLayer.Fallback_path | httpLayer.Fallback_ua | httpLayer.Fallback_method, []string{"/", "Mozilla/5.0", "GET"}, 80},
+		{httpLayer.Fallback_path | httpLayer.Fallback_method | httpLayer.Fallback_source, []string{"/", "GET", "1.1.1.1:1234"}, 80},
+		{httpLayer.Fallback_method | httpLayer.Fallback_source, []string{"GET", "1.1.1.1:1234"}, 80},
+	} {
+		r := cfb.GetFallback("", c.ftype, c.params...)
+		if r == nil || r.Addr.Port != c.port {
+			t.Fatal("wrong fallback", i, r, "want", c.port)
+		}
+	}
+}
+
+// 参数 中 有 多个 配置过 的 指纹 时, 条件 多的 规则 优先, 与 配置 顺序 无关
+func TestClassicFallbackTlsFpOverlapping(t *testing.T) {
+	for _, fcl := range [][]*httpLayer.FallbackConf{
+		{{Dest: 80}, {Dest: 8007, TlsFp: "fp_a"}, {Dest: 8008, TlsFp: "fp_b", Path: "/x"}},
+		{{Dest: 80}, {Dest: 8008, TlsFp: "fp_b", Path: "/x"}, {Dest: 8007, TlsFp: "fp_a"}},
+	} {
+		cfb := httpLayer.NewClassicFallbackFromConfList(fcl)
+		for _, c := range []struct {
+			path string
+			port int
+		}{{"/x", 8008}, {"/y", 8007}} {
+			r := cfb.GetFallback("", httpLayer.Fallback_path|httpLayer.Fallback_tlsfp, c.path, "fp_a fp_b")
+			if r == nil || r.Addr.Port != c.port {
+				t.Fatal("wrong fallback", c.path, r, "want", c.port)
+			}
+		}
+	}
+}
+
+// 多个 非精确 条件 同时 匹配 时, 条件 多的 规则 优先, 与 配置 顺序 无关
+func TestClassicFallbackOverlapping(t *testing.T) {
+	rules := []*httpLayer.FallbackConf{
+		{Dest: 8001, UserAgent: ".*curl.*"},
+		{Dest: 8002, UserAgent: "curl/8.*", Path: "/x"},
+		{Dest: 8003, Header: "Accept"},
+		{Dest: 8004, Header: "X-A", Source: "10.0.0.0/8"},
+		{Dest: 8005, Source: "10.0.0.0/8"},
+		{Dest: 8006, Source: "10.1.0.0/16", Path: "/x"},
+	}
+
+	for _, reverse := range []bool{false, true} {
+		fcl := append([]*httpLayer.FallbackConf{{Dest: 80}}, rules...)
+		if reverse {
+			for i, j := 1, len(fcl)-1; i < j; i, j = i+1, j-1 {
+				fcl[i], fcl[j] = fcl[j], fcl[i]
+			}
+		}
+		cfb := httpLayer.NewClassicFallbackFromConfList(fcl)
+		if cfb == nil {
+			t.Fatal("nil fallback")
+		}
+
+		for i, c := range []struct {
+			ftype  uint16
+			params []string
+			port   int
+		}{
+			{httpLayer.Fallback_path | httpLayer.Fallback_ua, []string{"/x", "curl/8.0"}, 8002},
+			{httpLayer.Fallback_path | httpLayer.Fallback_ua, []string{"/y", "curl/8.0"}, 8001},
+			{httpLayer.Fallback_path | httpLayer.Fallback_ua, []string{"/x", "libcurl/7"}, 8001},
+			{httpLayer.Fallback_path | httpLayer.Fallback_header | httpLayer.Fallback_source, []string{"/", "Accept: */*\r\nX-A: 1\r\n", "10.2.3.4:1234"}, 8004},
+			{httpLayer.Fallback_path | httpLayer.Fallback_source, []string{"/x", "10.1.2.3:1234"}, 8006},
+			{httpLayer.Fallback_path | httpLayer.Fallback_source, []string{"/y", "10.1.2.3:1234"}, 8005},
+		} {
+			r := cfb.GetFallback("", c.ftype, c.params...)
+			if r == nil {
+				r = cfb.Default
+			}
+			if r == nil || r.Addr.Port != c.port {
+				t.Fatal("wrong fallback", reverse, i, r, "want", c.port)
+			}
+		}
+	}
+}
+
 /*
 goos: darwin
 goarch: arm64
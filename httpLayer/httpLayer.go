@@ -105,6 +105,21 @@ func (e *RequestErr) Error() string {
 	return sb.String()
 }
 
+// GetRequestRemoteAddr 返回 h2 请求 的 客户端 地址. 监听 使用了 PROXY protocol 时 rq.RemoteAddr 已经 是 真实 地址;
+// 如果是 从 nginx 通过 unix domain socket 回落 过来的, rq.RemoteAddr 可能 无法 解析 (如 "@"), 此时 读一下 X-Forwarded-For.
+// 都 无法 解析 时 返回 nil
+func GetRequestRemoteAddr(rq *http.Request) net.Addr {
+	if ta, e := net.ResolveTCPAddr("tcp", rq.RemoteAddr); e == nil {
+		return ta
+	}
+	if xffs := rq.Header.Values(XForwardStr); len(xffs) > 0 {
+		if ta, e := net.ResolveIPAddr("ip", strings.TrimSpace(strings.SplitN(xffs[0], ",", 2)[0])); e == nil {
+			return ta
+		}
+	}
+	return nil
+}
+
 // H1RequestParser被用于 预读一个链接，判断该连接是否是有效的http请求,
 // 并将Version，Path，Method 记录在结构中.
 //
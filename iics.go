@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
@@ -73,7 +74,11 @@ type incomingInserverConnState struct {
 
 	cachedRemoteAddr string
 
+	proxyProtocolInfo *netLayer.PROXYprotocolInfo //监听 使用了 PROXY protocol 时 读到的 头, 此时 cachedRemoteAddr 为 其中 的 客户端 真实 地址
+
 	inServerTlsConn            tlsLayer.Conn
+	inServerTlsUser            utils.User                 //双向tls 时 由 客户端证书 得到的 用户
+	inServerTlsFingerprint     *tlsLayer.HelloFingerprint //inServer 的 tls 握手时 客户端 ClientHello 的 ja3/ja4 指纹
 	inServerTlsRawReadRecorder *tlsLayer.Recorder
 
 	isFallbackH2        bool
@@ -93,6 +98,8 @@ type incomingInserverConnState struct {
 
 	routedToDirect bool
 
+	releaseHandshake func() //见 proxy.Base.AcquireHandshake; 在 passToOutClient 开始时 调用, 可为 nil
+
 	routingEnv *proxy.RoutingEnv //used in passToOutClient
 
 	heapObj *heapObj
@@ -104,6 +111,17 @@ type heapObj struct {
 }
 
 // 每个iics使用之前，必须调用 genID
+// 返回 代理协议 所认证的 用户; 若 代理协议 没有 用户, 则 返回 客户端证书 对应的 用户
+func (iics *incomingInserverConnState) getUser(wlc net.Conn, udp_wlc netLayer.MsgConn) utils.User {
+	if u, ok := wlc.(utils.User); ok {
+		return u
+	}
+	if u, ok := udp_wlc.(utils.User); ok {
+		return u
+	}
+	return iics.inServerTlsUser
+}
+
 func (iics *incomingInserverConnState) genID() {
 	const low = 100000
 	const hi = low*10 - 1
@@ -164,11 +182,24 @@ func (iics *incomingInserverConnState) extractFirstBufFromErr(err error) bool {
 	return true
 }
 
+// 分流 或 回落 配置了 tls 指纹 时 才 需要 预读 ClientHello 计算 指纹
+func (iics *incomingInserverConnState) shouldSniffTlsFingerprint() bool {
+	re := iics.routingEnv
+	if re == nil {
+		return false
+	}
+	if re.RoutePolicy != nil && !iics.inServer.CantRoute() && re.RoutePolicy.HasTlsFingerprints() {
+		return true
+	}
+	return re.Fallback != nil && httpLayer.HasFallbackType(re.Fallback.SupportType(), httpLayer.Fallback_tlsfp)
+}
+
 // 查看当前配置 是否支持fallback, 并获得回落地址。
 // 被 passToOutClient 调用. 若 无fallback则 result < 0, 否则返回所使用的 PROXY protocol 版本, 0 表示 回落但是不用 PROXY protocol.
 //
 // 本方法不会修改 iics的任何内容.
-func (iics *incomingInserverConnState) checkfallback() (targetAddr netLayer.Addr, result int) {
+// handler 不为 nil 时 表示 使用 内置 的 回落 目标, 此时 targetAddr 为 空值
+func (iics *incomingInserverConnState) checkfallback() (targetAddr netLayer.Addr, result int, handler *httpLayer.FallbackHandler) {
 	//先检查 mainFallback，如果mainFallback中各项都不满足 or根本没有 mainFallback 再检查 defaultFallback
 
 	//一般情况下 iics.RoutingEnv 都会给出，但是 如果是 热加载、tproxy、go test、单独自定义 调用 ListenSer 不给出env 等情况的话， iics.RoutingEnv 都是空值
@@ -176,7 +207,7 @@ func (iics *incomingInserverConnState) checkfallback() (targetAddr netLayer.Addr
 
 		if mf := iics.routingEnv.Fallback; mf != nil {
 
-			var thisFallbackType byte
+			var thisFallbackType uint16
 
 			theRequestPath := iics.fallbackRequestPath
 
@@ -191,7 +222,7 @@ func (iics *incomingInserverConnState) checkfallback() (targetAddr netLayer.Addr
 
 			}
 
-			fallback_params := make([]string, 0, 4)
+			fallback_params := make([]string, 0, 9)
 
 			if theRequestPath != "" {
 				fallback_params = append(fallback_params, theRequestPath)
@@ -213,6 +244,53 @@ func (iics *incomingInserverConnState) checkfallback() (targetAddr netLayer.Addr
 					fallback_params = append(fallback_params, sni)
 					thisFallbackType |= httpLayer.Fallback_sni
 				}
+			} else if ppi := iics.proxyProtocolInfo; ppi != nil {
+				//tls 由 前置 的 haproxy 等 解开 时, 使用 PROXY 头 中 的 alpn 和 sni
+				if ppi.ALPN != "" {
+					fallback_params = append(fallback_params, ppi.ALPN)
+					thisFallbackType |= httpLayer.Fallback_alpn
+				}
+				if ppi.Authority != "" {
+					fallback_params = append(fallback_params, ppi.Authority)
+					thisFallbackType |= httpLayer.Fallback_sni
+				}
+			}
+
+			//只在 配置了 tls 指纹 回落 时 才 加入, 以免 影响 其它 回落 的 默认 行为
+			if fp := iics.inServerTlsFingerprint; fp != nil && httpLayer.HasFallbackType(mf.SupportType(), httpLayer.Fallback_tlsfp) {
+				fallback_params = append(fallback_params, strings.Join(fp.Strings(), " "))
+				thisFallbackType |= httpLayer.Fallback_tlsfp
+			}
+
+			//与 tls 指纹 一样, 下面 几项 也 只在 配置了 时 才 加入
+			supportedType := mf.SupportType()
+			if supportedType&(httpLayer.Fallback_host|httpLayer.Fallback_ua|httpLayer.Fallback_header|httpLayer.Fallback_method) != 0 {
+				var firstBuffer []byte
+				if iics.fallbackFirstBuffer != nil {
+					firstBuffer = iics.fallbackFirstBuffer.Bytes()
+				}
+				host, ua, header, method := httpLayer.GetHttpFallbackParams(firstBuffer, iics.fallbackH2Request)
+
+				for _, p := range []struct {
+					t     uint16
+					param string
+				}{
+					{httpLayer.Fallback_host, host},
+					{httpLayer.Fallback_ua, ua},
+					{httpLayer.Fallback_header, header},
+					{httpLayer.Fallback_method, method},
+				} {
+					if p.param != "" && httpLayer.HasFallbackType(supportedType, p.t) {
+						fallback_params = append(fallback_params, p.param)
+						thisFallbackType |= p.t
+					}
+				}
+			}
+			if httpLayer.HasFallbackType(supportedType, httpLayer.Fallback_source) {
+				if raddr := iics.getRealRAddr(); raddr != "" {
+					fallback_params = append(fallback_params, raddr)
+					thisFallbackType |= httpLayer.Fallback_source
+				}
 			}
 
 			{
@@ -225,8 +303,12 @@ func (iics *incomingInserverConnState) checkfallback() (targetAddr netLayer.Addr
 
 				if ce := utils.CanLogDebug("Fallback to"); ce != nil {
 					if fbResult != nil {
+						dest := fbResult.Addr.String()
+						if fbResult.Handler != nil {
+							dest = fbResult.Handler.Dest
+						}
 						ce.Write(
-							zap.String("addr", fbResult.Addr.String()),
+							zap.String("addr", dest),
 							zap.Any("params", fallback_params),
 						)
 					}
@@ -234,6 +316,7 @@ func (iics *incomingInserverConnState) checkfallback() (targetAddr netLayer.Addr
 				if fbResult != nil {
 					targetAddr = fbResult.Addr
 					result = fbResult.Xver
+					handler = fbResult.Handler
 					return
 				}
 			}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
@@ -20,8 +21,12 @@ import (
 
 const eIllegalParameter = "illegal parameter"
 
+// 其它包 可在 init 中 注册 额外的 api, key 为 不含 prefix 的 路径名. 如 quic 的 quicStats
+var ExtraApiHandlers = make(map[string]http.HandlerFunc)
+
 /*
 curl -k https://127.0.0.1:48345/api/allstate
+curl -k https://127.0.0.1:48345/api/certs
 */
 
 type ApiServerConf struct {
@@ -300,6 +305,16 @@ func (m *M) runApiServer() {
 
 	})
 
+	//所有 监听 所加载的 证书文件 及其 过期时间
+	ser.addServerHandle(mux, "certs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tlsLayer.GetCertInfos())
+	})
+
+	for name, f := range ExtraApiHandlers {
+		ser.addServerHandle(mux, name, f)
+	}
+
 	tlsConf := &tls.Config{}
 
 	if m.PlainHttp {
@@ -138,6 +138,7 @@ func (m *M) HotDeleteServer(index int) {
 	}
 
 	m.allServers[index].Stop()
+	m.allServers[index].ReleaseCerts()
 	m.allServers = utils.TrimSlice(m.allServers, index)
 
 	if running {
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -177,26 +178,51 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 		}
 	}
 
-	closer, err = netLayer.ListenAndAccept(
-		network,
-		inServer.AddrStr(),
-		inServer.GetSockopt(),
-		inServer.GetXver(),
-		func(conn net.Conn) {
-			handleNewIncomeConnection(inServer, defaultOutClient, conn, env, gi)
-		},
-	)
-
+	//给出 多个 监听地址 时 (ListenConf.Port, ListenConf.IPs), 所有 地址 共用 同一个 inServer; 任一 地址 监听 失败 则 全部 关闭
+	listenAddrs := inServer.GetBase().GetListenAddrs()
+	var closers []io.Closer
+	var failedAddr string
+	for _, addr := range listenAddrs {
+		var c io.Closer
+		c, err = netLayer.ListenAndAccept(
+			network,
+			addr,
+			inServer.GetSockopt(),
+			inServer.GetXver(),
+			inServer.GetBase().XverFrom,
+			func(conn net.Conn) {
+				handleNewIncomeConnection(inServer, defaultOutClient, conn, env, gi)
+			},
+		)
+		if err != nil {
+			failedAddr = addr
+			for _, cl := range closers {
+				cl.Close()
+			}
+			break
+		}
+		closers = append(closers, c)
+	}
 	if err == nil {
+		if len(closers) == 1 {
+			closer = closers[0]
+		} else {
+			closer = &utils.MultiCloser{Closers: closers}
+		}
+
 		if ce := utils.CanLogInfo("Listening"); ce != nil {
 
-			ce.Write(
+			fields := []zap.Field{
 				zap.String("tag", inServer.GetTag()),
 				zap.String("protocol", proxy.GetFullName(inServer)),
 				zap.String("listen_addr", inServer.AddrStr()),
 				zap.String("defaultClient", proxy.GetFullName(defaultOutClient)),
 				zap.String("dial_addr", defaultOutClient.AddrStr()),
-			)
+			}
+			if len(listenAddrs) > 1 {
+				fields = append(fields, zap.Strings("listen_addrs", listenAddrs))
+			}
+			ce.Write(fields...)
 		}
 
 		if extraCloser != nil {
@@ -206,7 +232,7 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 		if err != nil {
 			if ce := utils.CanLogErr("ListenSer failed"); ce != nil {
 				ce.Write(
-					zap.String("addr", inServer.AddrStr()),
+					zap.String("addr", failedAddr),
 					zap.Error(err),
 				)
 			}
@@ -237,22 +263,42 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 
 	wrappedConn := thisLocalConnectionInstance
 
-	if ce := iics.CanLogInfo("New Accepted Conn"); ce != nil {
-		var addrstr string
+	//限制 同时 握手 的 连接 数, 见 ListenConf.MaxHandshakes
+	release, ok := inServer.GetBase().AcquireHandshake(thisLocalConnectionInstance)
+	if !ok {
+		if ce := iics.CanLogWarn("Too many handshakes, waiting timeout, will close"); ce != nil {
+			ce.Write(zap.String("from", thisLocalConnectionInstance.RemoteAddr().String()))
+		}
+		thisLocalConnectionInstance.Close()
+		return
+	}
+	defer release()
+	iics.releaseHandshake = release
 
-		if inServer.Network() == "unix" {
-			addrstr = inServer.AddrStr()
+	//使用 PROXY protocol 时, RemoteAddr 为 PROXY 头 中 的 客户端 真实 地址, 即使 是 unix domain socket
+	iics.proxyProtocolInfo = netLayer.GetPROXYprotocolInfo(thisLocalConnectionInstance)
 
-		} else {
-			addrstr = wrappedConn.RemoteAddr().String()
+	if inServer.Network() == "unix" && iics.proxyProtocolInfo == nil {
+		iics.cachedRemoteAddr = inServer.AddrStr()
+	} else {
+		iics.cachedRemoteAddr = wrappedConn.RemoteAddr().String()
+	}
 
-		}
-		ce.Write(
-			zap.String("from", addrstr),
+	if ce := iics.CanLogInfo("New Accepted Conn"); ce != nil {
+		fields := []zap.Field{
+			zap.String("from", iics.cachedRemoteAddr),
 			zap.String("handler", proxy.GetVSI_url(inServer, "")),
-		)
-
-		iics.cachedRemoteAddr = addrstr
+		}
+		if ppi := iics.proxyProtocolInfo; ppi != nil {
+			fields = append(fields, zap.String("via", ppi.Upstream.String()))
+			if ppi.Authority != "" {
+				fields = append(fields, zap.String("authority", ppi.Authority))
+			}
+			if ppi.ALPN != "" {
+				fields = append(fields, zap.String("alpn", ppi.ALPN))
+			}
+		}
+		ce.Write(fields...)
 	}
 
 	////////////////////////////// tls层 /////////////////////////////////////
@@ -278,9 +324,10 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 
 		tConf := inServer.GetBase().TlsConf
 
-		if tConf.RejectUnknownSni {
+		//预读 ClientHello, 用于 rejectUnknownSni, 以及 在 分流 或 回落 配置了 tls 指纹 时 计算 ja3/ja4 指纹
+		if tConf.RejectUnknownSni || iics.shouldSniffTlsFingerprint() {
 			bs := utils.GetPacket()
-			n, e := wrappedConn.Read(bs)
+			n, e := tlsLayer.ReadHelloRecord(wrappedConn, bs)
 			if e != nil {
 				if ce := iics.CanLogWarn("tls preread failed"); ce != nil {
 					ce.Write(zap.Error(e))
@@ -290,9 +337,18 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 				return
 			}
 			firstpayload := bs[:n]
-			tlsSniff := new(tlsLayer.ComSniff)
+			tlsSniff := &tlsLayer.ComSniff{ShouldSniffFingerprint: true}
 			tlsSniff.CommonDetect(firstpayload, true, true)
-			if tlsSniff.SniffedServerName == "" {
+
+			if fp := tlsSniff.SniffedFingerprint; fp != nil {
+				iics.inServerTlsFingerprint = fp
+
+				if ce := iics.CanLogDebug("tls client fingerprint"); ce != nil {
+					ce.Write(zap.String("ja4", fp.JA4), zap.String("ja3", fp.JA3Hash))
+				}
+			}
+
+			if tConf.RejectUnknownSni && tlsSniff.SniffedServerName == "" {
 				if ce := iics.CanLogWarn("tls rejectUnknownSni, client didn't provide sni"); ce != nil {
 					ce.Write()
 				}
@@ -302,7 +358,7 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 			}
 
 			//shadowTls自己没有防御功能，完全靠我们包外过滤
-			if tConf.IsShadowTls() {
+			if tConf.RejectUnknownSni && tConf.IsShadowTls() {
 				if tlsSniff.SniffedServerName != tConf.Host {
 					if ce := iics.CanLogWarn("tls rejectUnknownSni, client sni not match"); ce != nil {
 						ce.Write(zap.String("sni", tlsSniff.SniffedServerName), zap.String("shouldBe", tConf.Host))
@@ -323,10 +379,14 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 		if err != nil {
 
 			if ce := iics.CanLogErr("Failed in TLS handshake"); ce != nil {
-				ce.Write(
+				fields := []zap.Field{
 					zap.String("inServer", inServer.AddrStr()),
 					zap.Error(err),
-				)
+				}
+				if fp := iics.inServerTlsFingerprint; fp != nil {
+					fields = append(fields, zap.String("ja4", fp.JA4), zap.String("ja3", fp.JA3Hash))
+				}
+				ce.Write(fields...)
 
 			}
 			//see #241
@@ -347,6 +407,15 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 			iics.inServerTlsConn = realtlsConn
 
 		}
+		if uc, ok := tlsConn.(tlsLayer.UserConn); ok {
+			if u := uc.GetClientUser(); u != nil {
+				iics.inServerTlsUser = u
+
+				if ce := iics.CanLogDebug("tls client cert user"); ce != nil {
+					ce.Write(zap.String("user", u.IdentityStr()))
+				}
+			}
+		}
 
 		wrappedConn = tlsConn
 
@@ -412,6 +481,9 @@ func handleNewIncomeConnection(inServer proxy.Server, defaultClientForThis proxy
 				newiics.isFallbackH2 = fallbackMeta.IsH2
 				newiics.fallbackH2Request = fallbackMeta.H2Request
 				newiics.fallbackRW = fallbackMeta.H2RW
+				if fallbackMeta.XFF != nil {
+					newiics.cachedRemoteAddr = fallbackMeta.XFF.String()
+				}
 
 				passToOutClient(newiics, true, nil, nil, netLayer.Addr{})
 			})
@@ -601,24 +673,14 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 						newiics.isInner = true
 
 						//试图将user赋值给simplesocks, 使其在内部的对user的分流依旧可用
-						if wlc != nil {
-							if u, ok := wlc.(utils.User); ok {
-								if wlc1 != nil {
-									if us, ok := wlc1.(utils.UserAssigner); ok {
-										us.SetUser(u)
-									}
-								} else if udp_wlc1 != nil {
-									if us, ok := udp_wlc1.(utils.UserAssigner); ok {
-										us.SetUser(u)
-									}
+						if u := iics.getUser(wlc, udp_wlc); u != nil {
+							if wlc1 != nil {
+								if us, ok := wlc1.(utils.UserAssigner); ok {
+									us.SetUser(u)
 								}
-							}
-						} else if udp_wlc != nil {
-							if u, ok := udp_wlc.(utils.User); ok {
-								if udp_wlc1 != nil {
-									if us, ok := udp_wlc1.(utils.UserAssigner); ok {
-										us.SetUser(u)
-									}
+							} else if udp_wlc1 != nil {
+								if us, ok := udp_wlc1.(utils.UserAssigner); ok {
+									us.SetUser(u)
 								}
 							}
 						}
@@ -686,13 +748,38 @@ func handshakeInserver_and_passToOutClient(iics incomingInserverConnState) {
 // 最终会调用 dialClient_andRelay. 若isfallback为true，传入的 wlc 和 udp_wlc 必须为nil，targetAddr必须为空值。
 func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Conn, udp_wlc netLayer.MsgConn, targetAddr netLayer.Addr) {
 
+	//握手 已 完成, 释放 握手 名额
+	if iics.releaseHandshake != nil {
+		iics.releaseHandshake()
+	}
+
 	//这里的 iics.inServer 是可能为nil的，所以一定要判断一下，否则会空指针闪退
 
 	////////////////////////////// 回落阶段 /////////////////////////////////////
 
 	if isfallback {
 
-		fallbackTargetAddr, fbResult := iics.checkfallback()
+		//acme 的 http-01 验证 通过 回落 路径 回答
+		if ffb := iics.fallbackFirstBuffer; ffb != nil && iics.wrappedConn != nil && !iics.isFallbackH2 {
+			if tlsLayer.ServeAcmeHttp01(iics.wrappedConn, ffb.Bytes()) {
+				iics.wrappedConn.Close()
+				return
+			}
+		}
+
+		fallbackTargetAddr, fbResult, fbHandler := iics.checkfallback()
+
+		if fbHandler != nil && iics.wrappedConn != nil {
+			fbHandler.Serve(httpLayer.FallbackMeta{
+				Conn:         iics.wrappedConn,
+				H1RequestBuf: iics.fallbackFirstBuffer,
+				IsH2:         iics.isFallbackH2,
+				H2Request:    iics.fallbackH2Request,
+				H2RW:         iics.fallbackRW,
+			})
+			return
+		}
+
 		if fbResult >= 0 {
 			targetAddr = fallbackTargetAddr
 			wlc = iics.wrappedConn
@@ -715,6 +802,14 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 				}
 
+				//与 nginx 的 proxy_add_x_forwarded_for 一样, 把 客户端 真实 地址 加到 X-Forwarded-For 后面
+				if host, _, err := net.SplitHostPort(iics.getRealRAddr()); err == nil {
+					if prior := rq.Header.Values(httpLayer.XForwardStr); len(prior) > 0 {
+						host = strings.Join(prior, ", ") + ", " + host
+					}
+					rq.Header.Set(httpLayer.XForwardStr, host)
+				}
+
 				var transport *http2.Transport
 
 				newUdsTransport := func(doAfterDial func(conn net.Conn)) *http2.Transport {
@@ -1005,8 +1100,8 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 	////////////////////////////// DNS解析阶段 /////////////////////////////////////
 
 	//dns解析会试图解析域名并将ip放入 targetAddr中
-	// 因为在direct时，netLayer.Addr 拨号时，会优先选用ip拨号，而且我们下面的分流阶段 如果使用ip的话，
-	// 可以利用geoip文件,  可以做到国别分流.
+	// 我们下面的分流阶段 如果使用ip的话， 可以利用geoip文件,  可以做到国别分流.
+	// direct 拨号 时 因为 Name 仍在, 会 用 Happy Eyeballs 同时 解析 ipv4 和 ipv6 并 拨号, 而 不是 只用 这里 的 ip.
 
 	if iics.routingEnv != nil && iics.routingEnv.DnsMachine != nil && (targetAddr.Name != "" && len(targetAddr.IP) == 0) && targetAddr.Network != "unix" {
 
@@ -1043,11 +1138,13 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 		} else {
 			desc.InTag = iics.inTag
 		}
-		if uc, ok := wlc.(utils.User); ok {
-			desc.UserIdentityStr = uc.IdentityStr()
-		} else if uc, ok := udp_wlc.(utils.User); ok {
+		if uc := iics.getUser(wlc, udp_wlc); uc != nil {
 			desc.UserIdentityStr = uc.IdentityStr()
 		}
+		if fp := iics.inServerTlsFingerprint; fp != nil {
+			desc.TlsFingerprints = fp.Strings()
+		}
+		desc.SourceIP, _ = netLayer.StrToNetIP(iics.getRealRAddr())
 
 		if ce := iics.CanLogDebug("Try routing"); ce != nil {
 			ce.Write(zap.Any("source", desc))
@@ -1307,7 +1404,12 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 		realTargetAddr.Network = targetAddr.Network
 	}
 
-	dialhere := !(client.Name() == proxy.DirectName)
+	var isSelfDial bool
+	if sdc, ok := client.(proxy.SelfDialClient); ok {
+		isSelfDial = sdc.IsSelfDial()
+	}
+
+	dialhere := !(client.Name() == proxy.DirectName || isSelfDial)
 
 	/*
 		direct的udp是自己拨号的，因为它用到了udp的fullcone
@@ -1704,6 +1806,19 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 		}
 	}
 
+	//反向代理 的 隧道请求, 直接交给 TunnelClient, 而不进行拨号
+	if tc, ok := client.(proxy.TunnelClient); ok && wlc != nil && tc.IsTunnelTarget(targetAddr) {
+		if ce := iics.CanLogInfo("Tunnel Request"); ce != nil {
+			ce.Write(
+				zap.String("From", iics.cachedRemoteAddr),
+				zap.String("Target", targetAddr.UrlString()),
+				zap.String("through", proxy.GetVSI_url(client, targetAddr.Network)),
+			)
+		}
+		tc.ServeTunnel(wlc, iics.firstPayload)
+		return
+	}
+
 	wrc, udp_wrc, realTargetAddr, clientEndRemoteClientTlsRawReadRecorder, result := dialClient(iics, targetAddr, client, wlc, udp_wlc, isTlsLazy_clientEnd)
 	if result != 0 {
 		return
@@ -143,6 +143,86 @@ func RandPort_andStr(mustValid, isudp bool) (int, string) {
 	return pt, strconv.Itoa(pt)
 }
 
+// 解析 "443,20000-20010" 这种 以逗号分隔的 端口 或 端口范围 列表, 返回 去重后 的 端口, 顺序 与 给出的 相同
+func ParsePortList(s string) (ports []int, err error) {
+	seen := make(map[int]bool)
+	add := func(p int) {
+		if !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if i := strings.IndexByte(part, '-'); i > 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		start, e1 := strconv.Atoi(strings.TrimSpace(from))
+		end, e2 := strconv.Atoi(strings.TrimSpace(to))
+		if e1 != nil || e2 != nil || start <= 0 || end > 65535 || start > end {
+			return nil, utils.ErrInErr{ErrDesc: "invalid port range", Data: part}
+		}
+		for p := start; p <= end; p++ {
+			add(p)
+		}
+	}
+	if len(ports) == 0 {
+		err = utils.ErrInErr{ErrDesc: "empty port list", Data: s}
+	}
+	return
+}
+
+// 解析 单个 ip 或 CIDR, 单个 ip 视为 只含 该 ip 的 CIDR. ipv4 映射 的 ipv6 地址 会被 转为 ipv4
+func ParseIPOrCIDR(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return p, err
+	}
+	if p.Addr().Is4In6() {
+		if p.Bits() < 96 {
+			return p, utils.ErrInErr{ErrDesc: "ipv4-mapped CIDR prefix too short", ErrDetail: utils.ErrInvalidData, Data: s}
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// 从 net.Addr 中 取出 ip, 如 *net.TCPAddr 或 "ip:port" 形式 的 地址; 不含 ip 时 (如 unix domain socket) 返回 false
+func NetAddrToNetIP(a net.Addr) (netip.Addr, bool) {
+	if a == nil {
+		return netip.Addr{}, false
+	}
+	switch v := a.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(v.IP)
+		return ip.Unmap(), ok
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(v.IP)
+		return ip.Unmap(), ok
+	}
+	return StrToNetIP(a.String())
+}
+
+// 与 NetAddrToNetIP 相同, 但 参数 为 ip 或 ip:port 字符串
+func StrToNetIP(s string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
 func GetRandLocalAddr(mustValid, isudp bool) string {
 	return "0.0.0.0:" + RandPortStr(mustValid, isudp)
 }
@@ -40,3 +40,36 @@ func TestUrl(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParsePortList(t *testing.T) {
+	ports, err := netLayer.ParsePortList("443, 20000-20003,20001")
+	if err != nil || len(ports) != 5 || ports[0] != 443 || ports[4] != 20003 {
+		t.Fatal(ports, err)
+	}
+
+	for _, wrong := range []string{"", "a-b", "20-10", "0", "70000", "1-70000"} {
+		if _, err := netLayer.ParsePortList(wrong); err == nil {
+			t.Fatal("should fail", wrong)
+		}
+	}
+}
+
+func TestParseIPOrCIDR(t *testing.T) {
+	for s, want := range map[string]string{
+		"1.2.3.4":             "1.2.3.4/32",
+		"10.1.2.3/8":          "10.0.0.0/8",
+		"::ffff:10.0.0.1":     "10.0.0.1/32",
+		"::ffff:10.0.0.0/104": "10.0.0.0/8",
+		"2001:db8::/32":       "2001:db8::/32",
+	} {
+		p, err := netLayer.ParseIPOrCIDR(s)
+		if err != nil || p.String() != want {
+			t.Fatal(s, p, err)
+		}
+	}
+	for _, wrong := range []string{"", "1.2.3.4/33", "::ffff:0:0/90", "example.com"} {
+		if _, err := netLayer.ParseIPOrCIDR(wrong); err == nil {
+			t.Fatal("should fail", wrong)
+		}
+	}
+}
@@ -25,7 +25,14 @@ const (
 // 如果找不到，则会使用net包的方法进行拨号（其会返回错误）。
 //
 // localAddr可为nil，如果不为nil，则其为 为 拨号 所指定的 本地地址。
+//
+// 拨号 域名 时 使用 Happy Eyeballs, 见 SetDialDnsMachine.
 func (a *Addr) Dial(sockopt *Sockopt, localAddr net.Addr) (net.Conn, error) {
+	return a.dial(sockopt, localAddr, dialDnsMachine.Load())
+}
+
+// dm 用于 Happy Eyeballs 的 解析, 可为 nil
+func (a *Addr) dial(sockopt *Sockopt, localAddr net.Addr, dm *DNSMachine) (net.Conn, error) {
 	var istls bool
 	var resultConn net.Conn
 	var err error
@@ -71,6 +78,16 @@ func (a *Addr) Dial(sockopt *Sockopt, localAddr net.Addr) (net.Conn, error) {
 
 tcp:
 
+	if a.IP == nil && a.Name != "" && HappyEyeballsEnabled {
+		var tcpConn *net.TCPConn
+		tcpConn, err = a.dialHappyEyeballs(sockopt, localAddr, dm)
+		if err == nil {
+			tcpConn.SetWriteBuffer(utils.MaxPacketLen)
+			resultConn = tcpConn
+		}
+		goto dialedPart
+	}
+
 	if a.IP != nil {
 
 		var tcpConn *net.TCPConn
@@ -144,6 +161,16 @@ dialedPart:
 // 比Dial更低级的方法，专用于使用sockopt的情况。
 // a的Network只能为golang支持的那几种。
 func (a Addr) DialWithOpt(sockopt *Sockopt, localAddr net.Addr) (net.Conn, error) {
+	switch a.Network {
+	case "", "tcp", "tcp4", "tcp6":
+		if a.IP == nil && a.Name != "" && HappyEyeballsEnabled {
+			tcpConn, err := a.dialHappyEyeballs(sockopt, localAddr, dialDnsMachine.Load())
+			if err != nil {
+				return nil, err
+			}
+			return tcpConn, nil
+		}
+	}
 
 	dialer := &net.Dialer{
 		Timeout: DialTimeout,
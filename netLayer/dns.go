@@ -55,6 +55,16 @@ func Is_DNSQuery_returnType_ReadFatalErr(err error) bool {
 // 如果从conn中Read后成功返回, 则可能返回如下几种错误 os.ErrNotExist (表示查无此记录), dns.ErrRcode (表示dns返回的 Rcode 不是 dns.RcodeSuccess), ErrRecursion,
 // 如果不是这三个error, 那就是 从 该 conn 读取数据时出错了.
 func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex, recursionCount int) (ip net.IP, ttl uint32, err error) {
+	var ips []net.IP
+	ips, ttl, err = DNSQueryAll(domain, dns_type, conn, theMux, recursionCount)
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	return
+}
+
+// 与 DNSQuery 相同, 但 返回 所有 A 或 AAAA 记录, ttl 为 第一个 记录 的 ttl.
+func DNSQueryAll(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex, recursionCount int) (ips []net.IP, ttl uint32, err error) {
 	m := new(dns.Msg)
 	m.SetQuestion((domain), dns_type) //为了更快，不使用 dns.Fqdn, 请调用之前先确保ok
 	c := new(dns.Client)
@@ -86,24 +96,26 @@ func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex
 		return
 	}
 
-	switch dns_type {
-	case dns.TypeA:
-		for _, a := range r.Answer {
-			if aa, ok := a.(*dns.A); ok {
-				ip = aa.A
-				ttl = aa.Hdr.Ttl
-				return
+	for _, a := range r.Answer {
+		switch aa := a.(type) {
+		case *dns.A:
+			if dns_type == dns.TypeA {
+				ips = append(ips, aa.A)
 			}
-		}
-	case dns.TypeAAAA:
-		for _, a := range r.Answer {
-			if aa, ok := a.(*dns.AAAA); ok {
-				ip = aa.AAAA
-				ttl = aa.Hdr.Ttl
-				return
+		case *dns.AAAA:
+			if dns_type == dns.TypeAAAA {
+				ips = append(ips, aa.AAAA)
 			}
+		default:
+			continue
+		}
+		if len(ips) == 1 {
+			ttl = a.Header().Ttl
 		}
 	}
+	if len(ips) > 0 {
+		return
+	}
 
 	//没A和4A那就查cname在不在
 
@@ -121,7 +133,7 @@ func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex
 				err = ErrRecursion
 				return
 			}
-			return DNSQuery(dns.Fqdn(aa.Target), dns_type, conn, theMux, recursionCount+1)
+			return DNSQueryAll(dns.Fqdn(aa.Target), dns_type, conn, theMux, recursionCount+1)
 		}
 	}
 
@@ -143,10 +155,18 @@ type DnsConn struct {
 
 type IPRecord struct {
 	IP         net.IP
-	TTL        uint32 //seconds
+	IPs        []net.IP //所有 地址, IP 为 其中 第一个
+	TTL        uint32   //seconds
 	RecordTime time.Time
 }
 
+// A 和 AAAA 记录 分开 缓存, 否则 先查到的 ipv4 会被 当作 AAAA 的 结果 返回.
+// domain 统一为 未经 Fqdn包装过的域名. 即尾部没有点号
+type dnsCacheKey struct {
+	domain string
+	qtype  uint16
+}
+
 // dns machine维持与多个dns服务器的连接(最好是udp这种无状态的)，并可以发起dns请求。
 // 会缓存dns记录; 该设施是一个状态机, 所以叫 DNSMachine。
 // SpecialIPPollicy 用于指定特殊的 域名-ip 映射，这样遇到这种域名时，不经过dns查询，直接返回预设ip。
@@ -157,7 +177,7 @@ type DNSMachine struct {
 
 	defaultConn DnsConn
 	conns       map[string]*DnsConn
-	cache       map[string]IPRecord //cache的key统一为 未经 Fqdn包装过的域名. 即尾部没有点号
+	cache       map[dnsCacheKey]IPRecord
 
 	SpecialIPPollicy map[string][]netip.Addr
 
@@ -208,7 +228,7 @@ func DialDnsAddr(addr *Addr) (conn net.Conn, err error) {
 	if addr.IsUDP() {
 		conn, err = net.DialUDP("udp", nil, addr.ToUDPAddr())
 	} else {
-		conn, err = addr.Dial(nil, nil)
+		conn, err = addr.dial(nil, nil, nil) //dns服务器 的 域名 不能 再 用 DNSMachine 解析
 
 	}
 	//todo: 以后支持DoH的话，要分离出https这个Network然后单独使用独特方法进行dial
@@ -273,6 +293,16 @@ func (dm *DNSMachine) Query(domain string) (ip net.IP) {
 
 // 传入的domain必须是不带尾缀点号的domain, 即没有包过 Fqdn
 func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl uint32) {
+	var ips []net.IP
+	ips, ttl = dm.QueryTypeAll(domain, dns_type)
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	return
+}
+
+// 与 QueryType 相同, 但 返回 所有 A 或 AAAA 记录, 用于 Happy Eyeballs 依次 拨号.
+func (dm *DNSMachine) QueryTypeAll(domain string, dns_type uint16) (ips []net.IP, ttl uint32) {
 	var generalCacheHit bool // 若读到了 cache 或 SpecialIPPollicy 的项, 则 generalCacheHit 为 true
 
 	var theDNSServerConn *DnsConn
@@ -305,24 +335,24 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 		if generalCacheHit {
 
 			if ce := utils.CanLogDebug("[DNSMachine] hit cache"); ce != nil {
-				ce.Write(zap.String("domain", domain), zap.String("ip", ip.String()))
+				ce.Write(zap.String("domain", domain), zap.Any("ips", ips))
 			}
 			return
 		}
 
-		if len(ip) > 0 {
+		if len(ips) > 0 {
 			domain = strings.TrimSuffix(domain, ".")
 			if ce := utils.CanLogDebug("[DNSMachine] will add to cache"); ce != nil {
-				ce.Write(zap.String("domain", domain), zap.String("ip", ip.String()))
+				ce.Write(zap.String("domain", domain), zap.Any("ips", ips))
 			}
 
 			dm.mutex.Lock()
 			if dm.cache == nil {
 
-				dm.cache = make(map[string]IPRecord)
+				dm.cache = make(map[dnsCacheKey]IPRecord)
 			}
 
-			dm.cache[domain] = IPRecord{IP: ip, TTL: ttl, RecordTime: time.Now()}
+			dm.cache[dnsCacheKey{domain, dns_type}] = IPRecord{IP: ips[0], IPs: ips, TTL: ttl, RecordTime: time.Now()}
 			dm.mutex.Unlock()
 		}
 	}()
@@ -338,7 +368,7 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 	if dm.cache != nil {
 
 		dm.mutex.RLock()
-		ipRecord, ok := dm.cache[domain]
+		ipRecord, ok := dm.cache[dnsCacheKey{domain, dns_type}]
 		dm.mutex.RUnlock()
 
 		if ok {
@@ -360,14 +390,17 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 			}
 
 			if ok {
-				ip = ipRecord.IP
+				ips = ipRecord.IPs
+				if len(ips) == 0 {
+					ips = []net.IP{ipRecord.IP}
+				}
 				generalCacheHit = true
 
 				return
 
 			} else {
 				dm.mutex.Lock()
-				delete(dm.cache, domain)
+				delete(dm.cache, dnsCacheKey{domain, dns_type})
 				dm.mutex.Unlock()
 			}
 		}
@@ -385,19 +418,21 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 
 					if a.Is4() || a.Is4In6() {
 						aa := a.As4()
-						generalCacheHit = true
-						return aa[:], uint32(dm.TTLStrategy)
+						ips = append(ips, aa[:])
 					}
 				}
 			case dns.TypeAAAA:
 				for _, a := range na {
 					if a.Is6() {
 						aa := a.As16()
-						generalCacheHit = true
-						return aa[:], uint32(dm.TTLStrategy)
+						ips = append(ips, aa[:])
 					}
 				}
 			}
+			if len(ips) > 0 {
+				generalCacheHit = true
+				return ips, uint32(dm.TTLStrategy)
+			}
 
 		}
 	}
@@ -428,7 +463,7 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 	}
 	var err error
 
-	ip, ttl, err = DNSQuery(domain, dns_type, theDNSServerConn.Conn, &theDNSServerConn.mutex, 0)
+	ips, ttl, err = DNSQueryAll(domain, dns_type, theDNSServerConn.Conn, &theDNSServerConn.mutex, 0)
 
 	if Is_DNSQuery_returnType_ReadFatalErr(err) {
 		//如果是读取的、非timeout的错误，那么我们直接认为底层连接出故障了, 我们需要重新dial
@@ -451,6 +486,65 @@ func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl
 	return
 }
 
+// QueryECHConfig 查询 domain 的 HTTPS 记录, 返回 其 ech 参数 的 值, 即 ECHConfigList.
+// 有多个 记录 时, 使用 带有 ech 参数 的 优先级 最高 (SvcPriority 最小) 的 那个. 结果 不缓存, 由 调用者 按 ttl 缓存.
+//
+// 与 QueryType 一样, 传入的domain必须是不带尾缀点号的domain, 会遵循 SpecialServerPolicy.
+func (dm *DNSMachine) QueryECHConfig(domain string) (configList []byte, ttl uint32, err error) {
+	dm.mutex.RLock()
+	theDNSServerConn := &dm.defaultConn
+	if dnsServerName := dm.SpecialServerPolicy[domain]; dnsServerName != "" {
+		if serConn := dm.conns[dnsServerName]; serConn != nil {
+			theDNSServerConn = serConn
+		}
+	}
+	dm.mutex.RUnlock()
+
+	if theDNSServerConn.Conn == nil {
+		err = utils.ErrInErr{ErrDesc: "[DNSMachine] no server configured", ErrDetail: os.ErrNotExist, Data: domain}
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeHTTPS)
+	c := new(dns.Client)
+
+	theDNSServerConn.mutex.Lock()
+	r, _, err := c.ExchangeWithConn(m, theDNSServerConn.Conn)
+	theDNSServerConn.mutex.Unlock()
+
+	if err != nil {
+		return
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		err = dns.ErrRcode
+		return
+	}
+
+	var bestPriority uint16
+	for _, a := range r.Answer {
+		h, ok := a.(*dns.HTTPS)
+		if !ok || h.Priority == 0 { //AliasMode 不带 参数
+			continue
+		}
+		if configList != nil && h.Priority >= bestPriority {
+			continue
+		}
+		for _, kv := range h.Value {
+			if e, ok := kv.(*dns.SVCBECHConfig); ok && len(e.ECH) > 0 {
+				configList = e.ECH
+				ttl = h.Hdr.Ttl
+				bestPriority = h.Priority
+				break
+			}
+		}
+	}
+	if configList == nil {
+		err = os.ErrNotExist
+	}
+	return
+}
+
 // 使用通过配置设置好的监听地址进行监听
 func (dm *DNSMachine) StartListen() {
 	if dm.listenUrl == "" {
@@ -0,0 +1,309 @@
+package netLayer
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+/*
+Happy Eyeballs (RFC 8305)
+
+拨号 只有 域名 的 地址 时, 同时 查询 A 和 AAAA 记录, 将 两种 地址 交替 排列, 每隔 HappyEyeballsAttemptDelay 发起 一次 新的 拨号,
+前一次 拨号 失败 时 立即 发起 下一次; 最先 成功 的 连接 被 使用, 其它 的 拨号 被 取消.
+这样 在 ipv6 不通 的 网络 中 不会 卡在 ipv6 的 拨号 上 直到 超时.
+已经 有 ip 的 地址 (比如 嗅探, 路由 中 的 dns 解析 或 hosts 给出的) 直接 拨号 该 ip, 不会 重新 解析.
+
+优先 的 地址族 由 dns 的 strategy 决定: 6 和 60 优先 ipv6, 0 和 4 优先 ipv4; 40 和 60 只 使用 一种 地址族.
+没有 配置 dns 时 使用 系统 的 解析, 按 RFC 8305 优先 ipv6.
+*/
+
+const (
+	HappyEyeballsResolutionDelay = time.Millisecond * 50 //先 查到 非优先 的 地址族 时, 等待 优先 的 地址族 的 时间
+	HappyEyeballsAttemptDelay    = time.Millisecond * 250
+)
+
+var (
+	//为 false 时 拨号 域名 使用 net包 的 默认 行为
+	HappyEyeballsEnabled = true
+
+	happyEyeballsAttemptDelay    = HappyEyeballsAttemptDelay
+	happyEyeballsResolutionDelay = HappyEyeballsResolutionDelay
+
+	dialDnsMachine atomic.Pointer[DNSMachine]
+)
+
+// 设置 拨号 域名 时 用于 解析 的 DNSMachine, 为 nil 时 使用 系统 的 解析.
+func SetDialDnsMachine(dm *DNSMachine) {
+	dialDnsMachine.Store(dm)
+}
+
+// 用 Happy Eyeballs 拨号 a.Name, 只用于 tcp, 且 a.IP 为 nil 时. a.Network 为 tcp4/tcp6 或 localAddr 给出时 只 使用 对应 的 地址族.
+func (a *Addr) dialHappyEyeballs(sockopt *Sockopt, localAddr net.Addr, dm *DNSMachine) (*net.TCPConn, error) {
+	useV4, useV6 := true, true
+	preferV6 := true
+
+	if dm != nil {
+		switch dm.TypeStrategy {
+		case 6:
+		case 40:
+			useV6 = false
+			preferV6 = false
+		case 60:
+			useV4 = false
+		default:
+			preferV6 = false
+		}
+	}
+
+	switch a.Network {
+	case "tcp4":
+		useV6 = false
+	case "tcp6":
+		useV4 = false
+	}
+	if ta, ok := localAddr.(*net.TCPAddr); ok && ta != nil {
+		if ta.IP.To4() == nil {
+			useV4 = false
+		} else {
+			useV6 = false
+		}
+	}
+
+	var families []bool
+	if useV4 {
+		families = append(families, false)
+	}
+	if useV6 {
+		families = append(families, true)
+	}
+
+	dialer := &net.Dialer{}
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+	if sockopt != nil {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				SetSockOpt(int(fd), sockopt, false, network == "tcp6")
+			})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+
+	c, err := happyEyeballs(ctx, families, preferV6, func(ctx context.Context, isV6 bool) ([]net.IP, error) {
+		return lookupIPFamily(ctx, dm, a.Name, isV6)
+	}, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(a.Port)))
+	})
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "happy eyeballs dial failed", ErrDetail: err, Data: a.String()}
+	}
+	return c.(*net.TCPConn), nil
+}
+
+// 用 dm 查询 domain 的 所有 A 或 AAAA 记录, dm 为 nil 或 查不到 时 使用 系统 的 解析.
+func lookupIPFamily(ctx context.Context, dm *DNSMachine, domain string, isV6 bool) ([]net.IP, error) {
+	if dm != nil {
+		qtype := dns.TypeA
+		if isV6 {
+			qtype = dns.TypeAAAA
+		}
+		ips, _ := dm.QueryTypeAll(domain, qtype)
+		var result []net.IP
+		for _, ip := range ips {
+			if (ip.To4() == nil) == isV6 {
+				result = append(result, ip)
+			}
+		}
+		if len(result) > 0 {
+			return result, nil
+		}
+	}
+	network := "ip4"
+	if isV6 {
+		network = "ip6"
+	}
+	return net.DefaultResolver.LookupIP(ctx, network, domain)
+}
+
+/*
+happyEyeballs 对 families 中 的 每个 地址族 (true 表示 ipv6) 并行 调用 lookup, 并 用 dial 按 RFC 8305 的 顺序 拨号 查到的 ip,
+返回 最先 成功 的 连接. 返回 时 还在 进行 的 拨号 会被 取消, 之后 才 成功 的 连接 会被 关闭.
+*/
+func happyEyeballs(ctx context.Context, families []bool, preferV6 bool,
+	lookup func(ctx context.Context, isV6 bool) ([]net.IP, error),
+	dial func(ctx context.Context, ip net.IP) (net.Conn, error)) (net.Conn, error) {
+
+	if len(families) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "happy eyeballs, no address family allowed", ErrDetail: utils.ErrInvalidData}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	returned := make(chan struct{})
+	defer close(returned)
+
+	type lookupResult struct {
+		isV6 bool
+		ips  []net.IP
+		err  error
+	}
+	type dialResult struct {
+		ip   net.IP
+		conn net.Conn
+		err  error
+	}
+
+	lookupCh := make(chan lookupResult, len(families))
+	for _, isV6 := range families {
+		go func(isV6 bool) {
+			ips, err := lookup(ctx, isV6)
+			lookupCh <- lookupResult{isV6: isV6, ips: ips, err: err}
+		}(isV6)
+	}
+	pendingLookups := len(families)
+
+	dialCh := make(chan dialResult)
+
+	var queues [2][]net.IP //0 为 ipv4, 1 为 ipv6
+	nextV6 := preferV6
+
+	pop := func() net.IP {
+		i, j := 0, 1
+		if nextV6 {
+			i, j = 1, 0
+		}
+		if len(queues[i]) == 0 {
+			i = j
+		}
+		if len(queues[i]) == 0 {
+			return nil
+		}
+		ip := queues[i][0]
+		queues[i] = queues[i][1:]
+		nextV6 = i == 0 //交替 地址族
+		return ip
+	}
+
+	var (
+		started        bool //是否 已经 可以 开始 拨号
+		inflight       int
+		attemptTimer   *time.Timer
+		attemptC       <-chan time.Time
+		resolutionC    <-chan time.Time
+		firstErr       error
+		firstLookupErr error
+	)
+	defer func() {
+		if attemptTimer != nil {
+			attemptTimer.Stop()
+		}
+	}()
+
+	startNext := func() {
+		ip := pop()
+		if ip == nil {
+			attemptC = nil
+			return
+		}
+		inflight++
+		go func() {
+			c, err := dial(ctx, ip)
+			select {
+			case dialCh <- dialResult{ip: ip, conn: c, err: err}:
+			case <-returned:
+				if c != nil {
+					c.Close()
+				}
+			}
+		}()
+
+		if attemptTimer != nil {
+			attemptTimer.Stop()
+		}
+		attemptTimer = time.NewTimer(happyEyeballsAttemptDelay)
+		attemptC = attemptTimer.C
+	}
+
+	for {
+		select {
+		case lr := <-lookupCh:
+			pendingLookups--
+			if lr.err != nil && firstLookupErr == nil {
+				firstLookupErr = lr.err
+			}
+			for _, ip := range lr.ips {
+				if (ip.To4() == nil) != lr.isV6 {
+					continue
+				}
+				if lr.isV6 {
+					queues[1] = append(queues[1], ip)
+				} else {
+					queues[0] = append(queues[0], ip)
+				}
+			}
+
+			if !started {
+				if lr.isV6 == preferV6 || pendingLookups == 0 {
+					started = true
+					startNext()
+				} else if len(lr.ips) > 0 && resolutionC == nil {
+					resolutionC = time.After(happyEyeballsResolutionDelay)
+				}
+			} else if attemptC == nil {
+				startNext()
+			}
+
+		case <-resolutionC:
+			resolutionC = nil
+			if !started {
+				started = true
+				startNext()
+			}
+
+		case <-attemptC:
+			attemptC = nil
+			startNext()
+
+		case r := <-dialCh:
+			inflight--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if ce := utils.CanLogDebug("happy eyeballs attempt failed"); ce != nil {
+				ce.Write(zap.String("ip", r.ip.String()), zap.Error(r.err))
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			startNext()
+
+		case <-ctx.Done():
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			return nil, ctx.Err()
+		}
+
+		if started && inflight == 0 && pendingLookups == 0 && len(queues[0]) == 0 && len(queues[1]) == 0 {
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			if firstLookupErr != nil {
+				return nil, firstLookupErr
+			}
+			return nil, utils.ErrInErr{ErrDesc: "happy eyeballs, no address found", ErrDetail: utils.ErrInvalidData}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package netLayer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHappyEyeballsOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+
+	lookup := func(ctx context.Context, isV6 bool) ([]net.IP, error) {
+		if isV6 {
+			time.Sleep(time.Millisecond * 20) //在 ResolutionDelay 内 到达, 仍 优先 ipv6
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, nil
+		}
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}, nil
+	}
+	dial := func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		mu.Lock()
+		order = append(order, ip.String())
+		mu.Unlock()
+		return nil, errors.New("refused")
+	}
+
+	start := time.Now()
+	_, err := happyEyeballs(context.Background(), []bool{false, true}, true, lookup, dial)
+	if err == nil || err.Error() != "refused" {
+		t.Fatal(err)
+	}
+	//拨号 失败 时 立即 开始 下一次, 不需要 等待 AttemptDelay
+	if time.Since(start) > happyEyeballsAttemptDelay {
+		t.Fatal("should not wait attempt delay on failure", time.Since(start))
+	}
+
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	if len(order) != len(want) {
+		t.Fatal(order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatal(order)
+		}
+	}
+}
+
+func TestHappyEyeballsFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	//ipv6 黑洞: 拨号 直到 被 取消 才 返回
+	v6Canceled := make(chan struct{}, 2)
+	lookup := func(ctx context.Context, isV6 bool) ([]net.IP, error) {
+		if isV6 {
+			return []net.IP{net.ParseIP("2001:db8::1")}, nil
+		}
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+	dial := func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		if ip.To4() == nil {
+			<-ctx.Done()
+			v6Canceled <- struct{}{}
+			return nil, ctx.Err()
+		}
+		return net.Dial("tcp", ln.Addr().String())
+	}
+
+	start := time.Now()
+	c, err := happyEyeballs(context.Background(), []bool{false, true}, true, lookup, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if d := time.Since(start); d < happyEyeballsAttemptDelay || d > DialTimeout/2 {
+		t.Fatal("ipv4 should start after attempt delay", d)
+	}
+	select {
+	case <-v6Canceled:
+	case <-time.After(time.Second):
+		t.Fatal("ipv6 attempt not canceled")
+	}
+
+	//只 允许 ipv6 时 不会 拨号 ipv4
+	ctx, cancel := context.WithTimeout(context.Background(), happyEyeballsAttemptDelay*2)
+	defer cancel()
+	if _, err := happyEyeballs(ctx, []bool{true}, true, lookup, dial); err == nil {
+		t.Fatal("ipv6 only should fail")
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("ok"))
+			c.Close()
+		}
+	}()
+
+	dm := &DNSMachine{SpecialIPPollicy: map[string][]netip.Addr{
+		"dual.test": {netip.MustParseAddr("::1"), netip.MustParseAddr("127.0.0.1")},
+	}}
+	if ip, _ := dm.QueryType("dual.test", dns.TypeAAAA); ip.To4() != nil {
+		t.Fatal("AAAA query returns ipv4", ip)
+	}
+
+	SetDialDnsMachine(dm)
+	defer SetDialDnsMachine(nil)
+
+	//::1 上 没有 监听, 拨号 被 拒绝 后 立即 使用 127.0.0.1
+	a := &Addr{Name: "dual.test", Port: ln.Addr().(*net.TCPAddr).Port, Network: "tcp"}
+	c, err := a.Dial(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	n, _ := c.Read(buf)
+	c.Close()
+	if string(buf[:n]) != "ok" {
+		t.Fatal(string(buf[:n]))
+	}
+
+	dm.TypeStrategy = 60
+	if c, err = a.Dial(nil, nil); err == nil {
+		c.Close()
+		t.Fatal("strategy 60 should only dial ipv6")
+	}
+
+	//已经 有 ip 时 直接 拨号, 不 重新 解析
+	dm.TypeStrategy = 0
+	dm.SpecialIPPollicy["pinned.test"] = []netip.Addr{netip.MustParseAddr("127.0.0.2")}
+	pinned := &Addr{Name: "pinned.test", IP: net.IPv4(127, 0, 0, 1), Port: a.Port, Network: "tcp"}
+	if c, err = pinned.Dial(nil, nil); err != nil {
+		t.Fatal("should dial the given ip", err)
+	}
+	c.Close()
+
+	//dns 返回的 所有 地址 都会 被 尝试
+	dm.TypeStrategy = 40
+	dm.SpecialIPPollicy["multi.test"] = []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")}
+	if ips, _ := dm.QueryTypeAll("multi.test", dns.TypeA); len(ips) != 2 {
+		t.Fatal("QueryTypeAll should return all addresses", ips)
+	}
+	multi := &Addr{Name: "multi.test", Port: a.Port, Network: "tcp"}
+	if c, err = multi.Dial(nil, nil); err != nil {
+		t.Fatal("should fall back to the second address", err)
+	}
+	c.Close()
+}
@@ -3,8 +3,10 @@ package netLayer
 import (
 	"context"
 	"net"
+	"net/netip"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,14 +20,30 @@ var (
 	CustomListenerMap = make(map[string]func(address string) (net.Listener, error))
 )
 
-func loopAccept(listener net.Listener, xver int, acceptFunc func(net.Conn)) {
+func loopAccept(listener net.Listener, xver int, xverFrom []netip.Prefix, acceptFunc func(net.Conn)) {
 	if xver > 0 {
 
 		if ce := utils.CanLogDebug("Listening PROXY protocol"); ce != nil {
-			ce.Write(zap.Int("preferred version", xver))
+			ce.Write(zap.Int("preferred version", xver), zap.Any("from", xverFrom))
 		}
 
-		listener = &proxyproto.Listener{Listener: listener, Policy: proxyProtocolListenPolicyFunc}
+		listener = &proxyproto.Listener{Listener: listener, Policy: proxyProtocolPolicy(xverFrom)}
+
+		realAcceptFunc := acceptFunc
+		acceptFunc = func(c net.Conn) {
+			//先 读取 PROXY 头, 这样 之后 各层 得到的 RemoteAddr 都是 客户端 真实 地址.
+			// 读取 失败 (没有 PROXY 头, 或 不允许 的 上游 发送了 PROXY 头) 时 proxyproto 只有 第一次 Read 会 返回 错误, 所以 要在 这里 关闭.
+			if pc, ok := c.(*proxyproto.Conn); ok {
+				if _, err := pc.Read(nil); err != nil {
+					if ce := utils.CanLogWarn("Failed in reading PROXY protocol header"); ce != nil {
+						ce.Write(zap.String("upstream", pc.Raw().RemoteAddr().String()), zap.Error(err))
+					}
+					c.Close()
+					return
+				}
+			}
+			realAcceptFunc(c)
+		}
 	}
 
 	var tooManyRetryCount time.Duration = 1
@@ -66,8 +84,10 @@ func loopAccept(listener net.Listener, xver int, acceptFunc func(net.Conn)) {
 
 // ListenAndAccept 试图监听 tcp, udp 和 unix domain socket 这三种传输层协议.
 //
+// xver 大于0 时 读取 PROXY protocol 头, xverFrom 为 允许 发送 PROXY 头 的 上游, 见 proxyProtocolPolicy.
+//
 // 非阻塞，在自己的goroutine中监听.
-func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFunc func(net.Conn)) (listener net.Listener, err error) {
+func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, xverFrom []netip.Prefix, acceptFunc func(net.Conn)) (listener net.Listener, err error) {
 	if addr == "" || acceptFunc == nil {
 		return nil, utils.ErrNilParameter
 	}
@@ -86,6 +106,15 @@ func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFun
 			return
 		}
 
+		if sockopt != nil && sockopt.ReusePort > 1 {
+			if reusePortSupported {
+				return listenReusePort(network, ta, sockopt, xver, xverFrom, acceptFunc)
+			}
+			if ce := utils.CanLogWarn("reuse_port is only supported on linux, will use a single listener"); ce != nil {
+				ce.Write(zap.String("addr", addr))
+			}
+		}
+
 		tcplistener, err = net.ListenTCP(network, ta)
 		if err != nil {
 			return
@@ -95,7 +124,7 @@ func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFun
 			SetSockOptForListener(tcplistener, sockopt, false, ta.IP.To4() == nil)
 		}
 
-		go loopAccept(tcplistener, xver, acceptFunc)
+		go loopAccept(tcplistener, xver, xverFrom, acceptFunc)
 
 		listener = tcplistener
 
@@ -113,7 +142,7 @@ func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFun
 		if err != nil {
 			return
 		}
-		go loopAccept(listener, xver, acceptFunc)
+		go loopAccept(listener, xver, xverFrom, acceptFunc)
 
 	case UNIX:
 		// 参考 https://eli.thegreenplace.net/2019/unix-domain-sockets-in-go/
@@ -167,12 +196,80 @@ func ListenAndAccept(network, addr string, sockopt *Sockopt, xver int, acceptFun
 
 		}
 
-		go loopAccept(listener, xver, acceptFunc)
+		go loopAccept(listener, xver, xverFrom, acceptFunc)
 
 	}
 	return
 }
 
+// 用 SO_REUSEPORT 在 ta 上 打开 sockopt.ReusePort 个 tcp 监听, 每个 都 有 自己的 loopAccept.
+// sockopt 在 bind 之前 设置. 任一 监听 失败 则 全部 关闭.
+func listenReusePort(network string, ta *net.TCPAddr, sockopt *Sockopt, xver int, xverFrom []netip.Prefix, acceptFunc func(net.Conn)) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			if err := setReusePort(c); err != nil {
+				return err
+			}
+			return c.Control(func(fd uintptr) {
+				SetSockOpt(int(fd), sockopt, false, ta.IP.To4() == nil)
+			})
+		},
+	}
+
+	ml := &multiListener{}
+	addr := ta.String()
+	for i := 0; i < sockopt.ReusePort; i++ {
+		l, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			ml.Close()
+			return nil, utils.ErrInErr{ErrDesc: "Failed in listening with SO_REUSEPORT", ErrDetail: err, Data: addr}
+		}
+		if i == 0 {
+			//端口 为 0 时, 之后的 监听 要用 第一个 监听 得到的 端口
+			addr = l.Addr().String()
+		}
+		ml.listeners = append(ml.listeners, l)
+	}
+
+	if ce := utils.CanLogInfo("Listening with SO_REUSEPORT"); ce != nil {
+		ce.Write(zap.String("addr", addr), zap.Int("acceptors", len(ml.listeners)))
+	}
+
+	ml.loops.Add(len(ml.listeners))
+	for _, l := range ml.listeners {
+		go func(l net.Listener) {
+			defer ml.loops.Done()
+			loopAccept(l, xver, xverFrom, acceptFunc)
+		}(l)
+	}
+	return ml, nil
+}
+
+// 多个 监听 同一 地址 的 Listener, 各自 的 accept 循环 在 内部 运行, 所以 Accept 不可用; 用于 Close 和 Addr.
+type multiListener struct {
+	listeners []net.Listener
+	loops     sync.WaitGroup
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	return nil, utils.ErrInErr{ErrDesc: "multiListener Accept is called in its own loops", ErrDetail: utils.ErrUnImplemented}
+}
+
+// 关闭 所有 监听, 并 等待 所有 accept 循环 退出
+func (ml *multiListener) Close() (err error) {
+	for _, l := range ml.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	ml.loops.Wait()
+	return
+}
+
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
 func (a Addr) ListenUDP_withOpt(sockopt *Sockopt) (net.PacketConn, error) {
 	var lc net.ListenConfig
 	lc.Control = func(network, address string, c syscall.RawConn) error {
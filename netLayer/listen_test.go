@@ -0,0 +1,45 @@
+package netLayer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is only used on linux")
+	}
+
+	accepted := make(chan net.Conn, 16)
+	l, err := ListenAndAccept("tcp", "127.0.0.1:0", &Sockopt{ReusePort: 4}, 0, nil, func(c net.Conn) {
+		accepted <- c
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml, ok := l.(*multiListener)
+	if !ok || len(ml.listeners) != 4 {
+		t.Fatal("should have 4 listeners", l)
+	}
+	for _, sub := range ml.listeners {
+		if sub.Addr().String() != l.Addr().String() {
+			t.Fatal("listeners not on the same addr", sub.Addr(), l.Addr())
+		}
+	}
+
+	for i := 0; i < 16; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		(<-accepted).Close()
+	}
+
+	//Close 会 等待 所有 accept 循环 退出, 以免 它们 在 测试 结束 后 还在 打 日志
+	l.Close()
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("all listeners should be closed")
+	}
+}
@@ -3,14 +3,91 @@ package netLayer
 import (
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
 )
 
 var proxyProtocolListenPolicyFunc = func(upstream net.Addr) (proxyproto.Policy, error) { return proxyproto.REQUIRE, nil }
 
+// allowedUpstreams 为 允许 发送 PROXY 头 的 上游 地址. 为空 时 所有 连接 都 必须 发送 PROXY 头;
+// 否则 只有 这些 上游 必须 发送, 其它 连接 视为 客户端 直连, 若 发送了 PROXY 头 则 被 拒绝, 以防 伪造 地址.
+// unix domain socket 的 上游 只能是 本机 进程, 总是 允许.
+func proxyProtocolPolicy(allowedUpstreams []netip.Prefix) proxyproto.PolicyFunc {
+	if len(allowedUpstreams) == 0 {
+		return proxyProtocolListenPolicyFunc
+	}
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		ip, ok := NetAddrToNetIP(upstream)
+		if !ok {
+			return proxyproto.REQUIRE, nil
+		}
+		for _, p := range allowedUpstreams {
+			if p.Contains(ip) {
+				return proxyproto.REQUIRE, nil
+			}
+		}
+		return proxyproto.REJECT, nil
+	}
+}
+
+// PROXYprotocolInfo 为 监听时 读到的 PROXY protocol 头 的 内容. 客户端 真实 地址 会 作为 连接 的 RemoteAddr.
+type PROXYprotocolInfo struct {
+	Upstream net.Addr //发送 PROXY 头 的 上游 (如 haproxy, nginx) 的 地址
+	Source   net.Addr //客户端 真实 地址
+	Dest     net.Addr
+
+	//下面 几项 来自 v2 的 TLV, 一般 在 上游 解开了 tls 时 给出
+
+	ALPN      string
+	Authority string //一般 为 客户端 tls 握手 中 的 sni
+
+	SSL         bool //客户端 与 上游 之间 使用 了 tls
+	SSLVersion  string
+	SSLCN       string //客户端 证书 的 Common Name
+	SSLVerified bool   //客户端 给出 了 证书 且 通过 了 验证
+}
+
+// 若 c 是 监听 时 读取了 PROXY 头 的 连接, 返回 其 内容, 否则 返回 nil. c 须为 ListenAndAccept 传给 acceptFunc 的 原始 连接.
+func GetPROXYprotocolInfo(c net.Conn) *PROXYprotocolInfo {
+	pc, ok := c.(*proxyproto.Conn)
+	if !ok {
+		return nil
+	}
+	h := pc.ProxyHeader()
+	if h == nil || h.Command.IsLocal() {
+		return nil
+	}
+	info := &PROXYprotocolInfo{
+		Upstream: pc.Raw().RemoteAddr(),
+		Source:   h.SourceAddr,
+		Dest:     h.DestinationAddr,
+	}
+
+	tlvs, err := h.TLVs()
+	if err != nil {
+		return info
+	}
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case proxyproto.PP2_TYPE_ALPN:
+			info.ALPN = string(tlv.Value)
+		case proxyproto.PP2_TYPE_AUTHORITY:
+			info.Authority = string(tlv.Value)
+		}
+	}
+	if ssl, ok := tlvparse.FindSSL(tlvs); ok {
+		info.SSL = ssl.ClientSSL()
+		info.SSLVersion, _ = ssl.SSLVersion()
+		info.SSLCN, _ = ssl.ClientCN()
+		info.SSLVerified = (ssl.ClientCertConn() || ssl.ClientCertSess()) && ssl.Verified()
+	}
+	return info
+}
+
 //PROXY protocol。
 //Reference： http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
 //
@@ -0,0 +1,140 @@
+package netLayer
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+)
+
+func listenPROXYprotocol(t *testing.T, xverFrom []netip.Prefix) (net.Listener, chan net.Conn) {
+	conns := make(chan net.Conn, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//不 直接 用 ListenAndAccept, 因为 它 启动 的 accept 循环 在 Close 后 还会 打日志, 会与 之后 测试 中 对 日志等级 的 修改 发生 竞态
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loopAccept(l, 2, xverFrom, func(c net.Conn) {
+			conns <- c
+		})
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	return l, conns
+}
+
+func writePROXYv2Header(t *testing.T, c net.Conn, src string, tlvs []proxyproto.TLV) {
+	h := proxyproto.HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP(src), Port: 4444}, c.RemoteAddr())
+	if err := h.SetTLVs(tlvs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteTo(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPROXYprotocolListen(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	ssl, err := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+		TLV:    []proxyproto.TLV{{Type: proxyproto.PP2_SUBTYPE_SSL_VERSION, Value: []byte("TLSv1.3")}},
+	}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlvs := []proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte("h2")},
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("www.example.com")},
+		ssl,
+	}
+
+	//允许 的 上游
+	l, conns := listenPROXYprotocol(t, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writePROXYv2Header(t, c, "203.0.113.5", tlvs)
+	c.Write([]byte("hello"))
+
+	sc := <-conns
+	defer sc.Close()
+	if ra := sc.RemoteAddr().String(); ra != "203.0.113.5:4444" {
+		t.Fatal("RemoteAddr", ra)
+	}
+	info := GetPROXYprotocolInfo(sc)
+	if info == nil || info.Upstream.String() != c.LocalAddr().String() || info.ALPN != "h2" || info.Authority != "www.example.com" || !info.SSL || info.SSLVersion != "TLSv1.3" || info.SSLVerified {
+		t.Fatalf("info %+v", info)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+		t.Fatal(string(buf), err)
+	}
+
+	//不在 允许 列表 中 的 上游 发送 PROXY 头 会被 关闭; 不发送 则 视为 客户端 直连
+	l2, conns2 := listenPROXYprotocol(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	defer l2.Close()
+
+	c2, err := net.Dial("tcp", l2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	writePROXYv2Header(t, c2, "203.0.113.5", nil)
+	c2.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := c2.Read(buf); err != io.EOF {
+		t.Fatal("should be closed", err)
+	}
+	select {
+	case <-conns2:
+		t.Fatal("should not be accepted")
+	default:
+	}
+
+	c3, err := net.Dial("tcp", l2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	c3.Write([]byte("hello"))
+	sc3 := <-conns2
+	defer sc3.Close()
+	if sc3.RemoteAddr().String() != c3.LocalAddr().String() || GetPROXYprotocolInfo(sc3) != nil {
+		t.Fatal("direct conn", sc3.RemoteAddr())
+	}
+	if _, err := io.ReadFull(sc3, buf); err != nil || string(buf) != "hello" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+func TestRouteSetSources(t *testing.T) {
+	rs := NewFullRouteSet()
+	rs.Sources = []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+
+	target := Addr{Name: "www.example.com", Port: 443}
+	if !rs.IsIn(&TargetDescription{Addr: target, SourceIP: netip.MustParseAddr("203.0.113.5")}) {
+		t.Fatal("should match source")
+	}
+	if rs.IsIn(&TargetDescription{Addr: target, SourceIP: netip.MustParseAddr("198.51.100.1")}) {
+		t.Fatal("should not match other source")
+	}
+	if rs.IsIn(&TargetDescription{Addr: target}) {
+		t.Fatal("should not match unknown source")
+	}
+}
@@ -49,7 +49,9 @@ func TestReadVCopy(t *testing.T) {
 
 	transmitCount := 10
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		conn, err := listener.Accept()
 		if err != nil {
 			//t.Log(err)
@@ -88,6 +90,9 @@ func TestReadVCopy(t *testing.T) {
 		}
 	}
 	tcpConn.Close()
+
+	//等 读取 的 goroutine 退出, 以免 它 与 之后 的 测试 竞争 日志 配置
+	<-done
 }
 
 func BenchmarkReadVCopy(b *testing.B) {
@@ -0,0 +1,19 @@
+package netLayer
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+func setReusePort(c syscall.RawConn) (err error) {
+	ce := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if ce != nil {
+		return ce
+	}
+	return
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package netLayer
+
+import "syscall"
+
+const reusePortSupported = false
+
+func setReusePort(c syscall.RawConn) error {
+	return nil
+}
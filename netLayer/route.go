@@ -50,6 +50,10 @@ type TargetDescription struct {
 	InTag string
 
 	UserIdentityStr string
+
+	TlsFingerprints []string //客户端 tls ClientHello 的 指纹, 如 ja4 和 ja3 的 md5
+
+	SourceIP netip.Addr //客户端 地址; 监听 使用了 PROXY protocol 时 为 PROXY 头 中 的 真实 地址
 }
 
 /*
@@ -60,7 +64,7 @@ Set 是 “集合” 的意思, 是一组相同类型的数据放到一起。
 	这里的相同点，就是它们同属于 将发往一个方向, 即同属一个路由策略。
 
 任意一个网络参数匹配后，都将发往相同的方向，由该方向OutTag 指定。
-若还给出了 InTags, Users 或 传输层, 则这些条件都通过后, 才进行网络层判断.
+若还给出了 InTags, Users, TlsFingerprints, Sources 或 传输层, 则这些条件都通过后, 才进行网络层判断.
 */
 type RouteSet struct {
 	//网络层
@@ -80,6 +84,12 @@ type RouteSet struct {
 	//Users 包含所有可匹配的 用户的 identityStr
 	Users map[string]bool
 
+	//TlsFingerprints 包含所有可匹配的 客户端 tls 指纹 (ja4 或 ja3 的 md5)
+	TlsFingerprints map[string]bool
+
+	//Sources 包含所有可匹配的 客户端 地址 范围
+	Sources []netip.Prefix
+
 	//Regex是正则匹配域名.
 	Regex []*regexp.Regexp
 
@@ -119,6 +129,7 @@ func NewFullRouteSet() *RouteSet {
 		Domains:                        make(map[string]bool),
 		Full:                           make(map[string]bool),
 		Users:                          make(map[string]bool),
+		TlsFingerprints:                make(map[string]bool),
 		Geosites:                       make([]string, 0),
 		InTags:                         make(map[string]bool),
 		Countries:                      make(map[string]bool),
@@ -153,6 +164,35 @@ func (rs *RouteSet) IsIn(td *TargetDescription) bool {
 		return false
 	}
 
+	if len(rs.TlsFingerprints) > 0 {
+		fpOk := false
+		for _, fp := range td.TlsFingerprints {
+			if rs.TlsFingerprints[fp] {
+				fpOk = true
+				break
+			}
+		}
+		if !fpOk {
+			return false
+		}
+	}
+
+	if len(rs.Sources) > 0 {
+		if !td.SourceIP.IsValid() {
+			return false
+		}
+		sourceOk := false
+		for _, p := range rs.Sources {
+			if p.Contains(td.SourceIP) {
+				sourceOk = true
+				break
+			}
+		}
+		if !sourceOk {
+			return false
+		}
+	}
+
 	return rs.IsAddrIn(td.Addr)
 
 }
@@ -285,6 +325,8 @@ func (rs *RouteSet) Clone() (newOne *RouteSet) {
 		Domains:                        maps.Clone(rs.Domains),
 		Full:                           maps.Clone(rs.Full),
 		Users:                          maps.Clone(rs.Users),
+		TlsFingerprints:                maps.Clone(rs.TlsFingerprints),
+		Sources:                        slices.Clone(rs.Sources),
 		Geosites:                       slices.Clone(rs.Geosites),
 		InTags:                         maps.Clone(rs.InTags),
 		OutTags:                        slices.Clone(rs.OutTags),
@@ -324,6 +366,16 @@ func (rp *RoutePolicy) AddRouteSet(rs *RouteSet) {
 	}
 }
 
+// 是否 有 RouteSet 配置了 TlsFingerprints
+func (rp *RoutePolicy) HasTlsFingerprints() bool {
+	for _, rs := range rp.List {
+		if len(rs.TlsFingerprints) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (rp *RoutePolicy) Clone() (newOne RoutePolicy) {
 	for _, v := range rp.List {
 		newOne.List = append(newOne.List, v.Clone())
@@ -18,6 +18,9 @@ type RuleConf struct {
 	InTags []string `toml:"fromTag" json:"fromTag"`
 	Users  []string `toml:"user" json:"user"`
 
+	TlsFingerprints []string `toml:"tls_fp" json:"tls_fp"` //客户端 tls 指纹, ja4 或 ja3 的 md5
+	Sources         []string `toml:"source" json:"source"` //客户端 地址, ip 或 CIDR
+
 	Countries []string `toml:"country" json:"country"` // 如果类似 !CN, 则意味着专门匹配不为CN 的国家（目前还未实现）
 	IPs       []string `toml:"ip" json:"ip"`
 	Domains   []string `toml:"domain" json:"domain"`
@@ -110,6 +113,21 @@ func LoadRuleForRouteSet(rule *RuleConf) (rs *RouteSet) {
 		rs.Users[u] = true
 	}
 
+	for _, fp := range rule.TlsFingerprints {
+		rs.TlsFingerprints[fp] = true
+	}
+
+	for _, src := range rule.Sources {
+		p, err := ParseIPOrCIDR(src)
+		if err != nil {
+			if ce := utils.CanLogErr("LoadRuleForRouteSet, parse source failed"); ce != nil {
+				ce.Write(zap.String("source", src), zap.Error(err))
+			}
+			continue
+		}
+		rs.Sources = append(rs.Sources, p)
+	}
+
 	//ip 过滤 需要 分辨 "private", cidr 和普通ip
 
 	for _, ipStr := range rule.IPs {
@@ -12,6 +12,10 @@ type Sockopt struct {
 	BBR    bool   `toml:"bbr"`    //only linux
 	Device string `toml:"device"`
 
+	//only linux, 只用于 tcp 监听. 大于1 时 用 SO_REUSEPORT 在 同一 地址 上 打开 这么多个 监听, 每个 都有 自己的 accept 循环,
+	// 由 内核 把 新连接 分配 到 各个 监听 上, 适合 多核 服务器. 一般 设为 cpu 核数 即可.
+	ReusePort int `toml:"reuse_port"`
+
 	//fastopen 不予支持, 因为自己客户端在重重网关之下，不可能让层层网关都支持tcp fast open；
 	// 而自己的远程节点的话因为本来网速就很快, 也不需要fastopen，总之 因为木桶原理，慢的地方在我们层层网关, 所以fastopen 意义不大.
 
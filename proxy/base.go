@@ -4,8 +4,10 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/advLayer"
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
@@ -92,8 +94,13 @@ type Base struct {
 	Tag            string //可用于路由, 见 netLayer.route.go
 	TransportLayer string
 
-	Sockopt *netLayer.Sockopt
-	Xver    int
+	Sockopt  *netLayer.Sockopt
+	Xver     int
+	XverFrom []netip.Prefix //for inServer, 允许 发送 PROXY 头 的 上游, 见 ListenConf.XverFrom
+
+	ListenAddrs []string //for inServer, 监听 多个 地址 时 给出, 第一个 与 Addr 相同; 见 ListenConf.Port
+
+	handshakeSem chan struct{} //for inServer, 见 ListenConf.MaxHandshakes
 
 	IsFullcone bool
 
@@ -110,6 +117,8 @@ type Base struct {
 	AdvC advLayer.Client
 	AdvS advLayer.Server
 
+	advTlsConf *tls.Config //super 的 高级层 服务端 所使用的 tls 配置
+
 	FallbackAddr *netLayer.Addr
 
 	Innermux *smux.Session //用于存储 client的已拨号的mux连接
@@ -125,6 +134,46 @@ func (b *Base) GetBase() *Base {
 	return b
 }
 
+// 见 ListenConf.MaxHandshakes
+var HandshakeLimitTimeout = time.Second * 10
+
+// 配置了 max_handshakes 时, 等待 一个 握手 名额, 并 给 c 设置 HandshakeLimitTimeout 的 deadline.
+// 握手 完成 后 调用 release 释放 名额 并 清除 deadline, release 可以 调用 多次.
+// 等待 超时 时 ok 为 false, 此时 应 关闭 c.
+func (b *Base) AcquireHandshake(c net.Conn) (release func(), ok bool) {
+	sem := b.handshakeSem
+	if sem == nil {
+		return func() {}, true
+	}
+	deadline := time.Now().Add(HandshakeLimitTimeout)
+
+	timer := time.NewTimer(HandshakeLimitTimeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+	case <-timer.C:
+		return nil, false
+	}
+
+	c.SetDeadline(deadline)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.SetDeadline(time.Time{})
+			<-sem
+		})
+	}, true
+}
+
+// 返回 所有 要 监听 的 地址; 只有 一个 时 即为 Addr
+func (b *Base) GetListenAddrs() []string {
+	if len(b.ListenAddrs) > 0 {
+		return b.ListenAddrs
+	}
+	return []string{b.Addr}
+}
+
 func (b *Base) LocalTCPAddr() *net.TCPAddr {
 	return b.LTA
 }
@@ -170,7 +219,9 @@ func (b *Base) MiddleName() string {
 	}
 	advL := b.AdvancedL
 	if b.Header != nil {
-		if advL != "ws" && advL != "grpc" {
+		switch advL {
+		case "ws", "grpc", "httpupgrade", "splithttp", "h2":
+		default:
 			sb.WriteString("+http")
 		}
 	}
@@ -280,6 +331,15 @@ func (b *Base) Stop() {
 	}
 }
 
+// 释放 tls层 和 高级层 的 证书
+func (b *Base) ReleaseCerts() {
+	if b.Tls_s != nil {
+		b.Tls_s.ReleaseCerts()
+	}
+	tlsLayer.ReleaseTlsConfig(b.advTlsConf)
+	b.advTlsConf = nil
+}
+
 // return false. As a placeholder.
 func (b *Base) CanFallback() bool {
 	return false
@@ -345,7 +405,7 @@ func (b *Base) InitAdvLayer() {
 	switch b.AdvancedL {
 	case "":
 		return
-	case "quic":
+	case "quic", "kcp":
 		b.setNetwork("udp")
 	}
 
@@ -442,21 +502,22 @@ func (b *Base) InitAdvLayer() {
 			Addr:    ad,
 			Headers: Headers,
 			Extra:   lc.Extra,
+
+			ListenAddrs: b.ListenAddrs,
 		}
 
 		if creator.IsSuper() {
 
 			aConf.TlsConf = tlsLayer.GetTlsConfig(true, tlsLayer.Conf{
-				Insecure: lc.Insecure,
-				AlpnList: lc.Alpn,
-				Host:     lc.Host,
-				CertConf: &tlsLayer.CertConf{
-					CertFile: lc.TLSCert, KeyFile: lc.TLSKey, CA: lc.CA,
-				},
+				Insecure:     lc.Insecure,
+				AlpnList:     lc.Alpn,
+				Host:         lc.Host,
+				CertConf:     lc.GetCertConf(),
 				Minver:       getTlsMinVerFromExtra(lc.Extra),
 				Maxver:       getTlsMaxVerFromExtra(lc.Extra),
 				CipherSuites: getTlsCipherSuitesFromExtra(lc.Extra),
 			})
+			b.advTlsConf = aConf.TlsConf
 		}
 
 		advSer, err := creator.NewServerFromConf(aConf)
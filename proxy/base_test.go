@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAcquireHandshake(t *testing.T) {
+	old := HandshakeLimitTimeout
+	HandshakeLimitTimeout = time.Millisecond * 100
+	defer func() { HandshakeLimitTimeout = old }()
+
+	//不限制
+	b := &Base{}
+	if release, ok := b.AcquireHandshake(nil); !ok {
+		t.Fatal("no limit should not block")
+	} else {
+		release()
+	}
+
+	b.handshakeSem = make(chan struct{}, 1)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	release, ok := b.AcquireHandshake(c1)
+	if !ok {
+		t.Fatal("first acquire failed")
+	}
+
+	//握手 超时 前 没有 完成, 读取 应 超时
+	if _, err := c1.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("handshake deadline not set", err)
+	}
+
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	if _, ok := b.AcquireHandshake(c3); ok {
+		t.Fatal("second acquire should time out")
+	}
+
+	release()
+	release()
+
+	go c2.Write([]byte{1})
+	if _, err := c1.Read(make([]byte, 1)); err != nil {
+		t.Fatal("deadline should be cleared after release", err)
+	}
+
+	release3, ok := b.AcquireHandshake(c3)
+	if !ok {
+		t.Fatal("acquire after release failed")
+	}
+	release3()
+}
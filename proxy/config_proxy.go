@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"net"
 	"strconv"
+	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
@@ -117,10 +120,30 @@ type ListenConf struct {
 
 	CA string `toml:"ca"` //可选,用于 验证"客户端证书"
 
+	//可选, 在 cert/key 之外 再 给出 多个 证书, 或 一个 证书目录; 服务端 会根据 sni 选择(支持通配符证书).
+	// 证书文件 变动后 会 自动 重新加载, 无需 重启.
+	Certs   []tlsLayer.CertPair `toml:"certs"`
+	CertDir string              `toml:"cert_dir"`
+
 	SniffConf *SniffConf `toml:"sniffing"` //用于嗅探出 host 来帮助 分流。
 
 	Fallback any `toml:"fallback"` //可选，默认回落的地址，一般可为 ip:port,数字port or unix socket的文件名
 
+	//可选, 给出 xver 时 允许 发送 PROXY protocol 头 的 上游 (如 haproxy) 的 ip 或 CIDR.
+	// 不给出 则 所有 连接 都 必须 发送 PROXY 头; 给出 后 其它 地址 的 连接 视为 客户端 直连, 且 不能 发送 PROXY 头.
+	XverFrom []string `toml:"xver_from"`
+
+	//监听 的 端口, 覆盖 CommonConf.Port. 除了 数字 外, 也可以 写作 端口 列表 或 范围, 如 port = "20000-20100,443",
+	// 或 数组, 如 port = [443, "20000-20100"]. 所有 端口 共用 同一个 inServer, 所以 用户, 流量统计 和 回落 都是 共享 的.
+	Port ListenPort `toml:"port"`
+
+	//可选, 在 ip/host 之外 再 监听 多个 ip, 如 ["0.0.0.0", "::"]; 与 port 组合, 每个 ip 的 每个 端口 都会 监听.
+	IPs []string `toml:"ips"`
+
+	//可选, 同时 进行 握手 (tls层, 高级层 和 代理层 握手) 的 连接 数 的 上限, 0 为 不限制.
+	// 超过 时 新连接 会 等待, 等待 和 握手 总共 超过 HandshakeLimitTimeout 则 断开, 以防 大量 tls 握手 占满 cpu, 影响 已建立 的 连接.
+	MaxHandshakes int `toml:"max_handshakes"`
+
 	//noroute 意味着 传入的数据 不会被分流，一定会被转发到默认的 dial
 	// 这一项是针对 分流功能的. 如果不设noroute, 则所有listen 得到的流量都会被 试图 进行分流
 	NoRoute bool `toml:"noroute"`
@@ -129,6 +152,120 @@ type ListenConf struct {
 
 }
 
+// 返回 所有 监听 端口. 没有 给出 lc.Port 时 (如 用 代码 构造 的 ListenConf) 使用 CommonConf.Port
+func (lc *ListenConf) GetPorts() []int {
+	if len(lc.Port) > 0 {
+		return lc.Port
+	}
+	return []int{lc.CommonConf.Port}
+}
+
+// 返回 第一个 监听 端口, 见 GetPorts
+func (lc *ListenConf) FirstPort() int {
+	return lc.GetPorts()[0]
+}
+
+// 返回 所有 要 监听 的 地址, 第一个 为 ip(或host) 与 第一个 端口 组成 的 地址.
+// unix domain socket 不支持 多地址.
+func (lc *ListenConf) GetListenAddrStrs() ([]string, error) {
+	ports := lc.GetPorts()
+	if lc.Network == "unix" || (len(ports) == 1 && len(lc.IPs) == 0) {
+		cc := lc.CommonConf
+		cc.Port = ports[0]
+		return []string{cc.GetAddrStrForListenOrDial()}, nil
+	}
+
+	var hosts []string
+	if h := lc.IP; h != "" {
+		hosts = append(hosts, h)
+	} else if lc.Host != "" || len(lc.IPs) == 0 {
+		hosts = append(hosts, lc.Host)
+	}
+	hosts = append(hosts, lc.IPs...)
+
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, h := range hosts {
+		for _, p := range ports {
+			a := net.JoinHostPort(h, strconv.Itoa(p))
+			if !seen[a] {
+				seen[a] = true
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// ListenConf 的 端口. toml 中 可以 是 数字, 端口 列表/范围 字符串 (见 netLayer.ParsePortList), 或 二者 组成 的 数组.
+type ListenPort []int
+
+func (lp *ListenPort) UnmarshalTOML(data any) error {
+	var ports []int
+	add := func(v any) error {
+		switch x := v.(type) {
+		case int64:
+			if x < 0 || x > 65535 {
+				return utils.ErrInErr{ErrDesc: "invalid listen port", ErrDetail: utils.ErrInvalidData, Data: x}
+			}
+			ports = append(ports, int(x))
+		case string:
+			pl, err := netLayer.ParsePortList(x)
+			if err != nil {
+				return err
+			}
+			ports = append(ports, pl...)
+		default:
+			return utils.ErrInErr{ErrDesc: "listen port must be an integer, a port list string or an array of them", ErrDetail: utils.ErrInvalidData, Data: v}
+		}
+		return nil
+	}
+
+	if arr, ok := data.([]any); ok {
+		for _, v := range arr {
+			if err := add(v); err != nil {
+				return err
+			}
+		}
+	} else if err := add(data); err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		return utils.ErrInErr{ErrDesc: "empty listen port", ErrDetail: utils.ErrInvalidData}
+	}
+	*lp = ports
+	return nil
+}
+
+// 单个 端口 写作 数字, 多个 端口 写作 列表 字符串, 以便 再次 解码.
+func (lp ListenPort) MarshalTOML() ([]byte, error) {
+	if len(lp) == 1 {
+		return []byte(strconv.Itoa(lp[0])), nil
+	}
+	return []byte(strconv.Quote(lp.String())), nil
+}
+
+// 连续 的 端口 写作 范围, 如 "443,20000-20100"
+func (lp ListenPort) String() string {
+	var sb strings.Builder
+	for i := 0; i < len(lp); i++ {
+		j := i
+		for j+1 < len(lp) && lp[j+1] == lp[j]+1 {
+			j++
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.Itoa(lp[i]))
+		if j > i {
+			sb.WriteByte('-')
+			sb.WriteString(strconv.Itoa(lp[j]))
+		}
+		i = j
+	}
+	return sb.String()
+}
+
 // config for dialing, user can be called dialer or outClient.
 //
 //	CommonConf.Host , CommonConf.IP, CommonConf.Port  are the addr and port for dialing.
@@ -1,5 +1,65 @@
 package proxy_test
 
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestListenPort(t *testing.T) {
+	for str, want := range map[string]string{
+		`port = 443`:                        "[443]",
+		`port = "443,20000-20002"`:          "[443 20000 20001 20002]",
+		`port = [443, "20000-20001", 8080]`: "[443 20000 20001 8080]",
+	} {
+		conf, err := proxy.LoadStandardConfFromTomlStr("[[listen]]\n" + str + "\n")
+		if err != nil {
+			t.Fatal(str, err)
+		}
+		lc := conf.Listen[0]
+		if got := fmt.Sprint(lc.GetPorts()); got != want {
+			t.Fatal(str, got)
+		}
+
+		//编码 后 再 解码 应 得到 相同 的 端口
+		bs, err := utils.GetPurgedTomlBytes(proxy.StandardConf{Listen: conf.Listen})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf2, err := proxy.LoadStandardConfFromTomlStr(string(bs))
+		if err != nil {
+			t.Fatal(string(bs), err)
+		}
+		if got := fmt.Sprint(conf2.Listen[0].GetPorts()); got != want {
+			t.Fatal(string(bs), got)
+		}
+	}
+
+	for _, str := range []string{`port = "443-80"`, `port = 70000`, `port = [true]`} {
+		if _, err := proxy.LoadStandardConfFromTomlStr("[[listen]]\n" + str + "\n"); err == nil {
+			t.Fatal(str, "should fail")
+		}
+	}
+
+	//代码 构造 的 ListenConf 只 给出 CommonConf.Port
+	lc := proxy.ListenConf{CommonConf: proxy.CommonConf{IP: "127.0.0.1", Port: 1080}}
+	if addrs, err := lc.GetListenAddrStrs(); err != nil || fmt.Sprint(addrs) != "[127.0.0.1:1080]" {
+		t.Fatal(addrs, err)
+	}
+
+	//dial 的 port 只能 是 数字, 其它 字段 中 的 字符串 也 不应 被 改写
+	if _, err := proxy.LoadStandardConfFromTomlStr("[[dial]]\nport = \"443\"\n"); err == nil {
+		t.Fatal("dial port string should fail")
+	}
+	conf, err := proxy.LoadStandardConfFromTomlStr("[[dial]]\nport = 443\nextra = { hop_ports = \"20000-20010\" }\n")
+	if err != nil || conf.Dial[0].Port != 443 || !strings.Contains(fmt.Sprint(conf.Dial[0].Extra), "20000-20010") {
+		t.Fatal(conf.Dial, err)
+	}
+}
+
 /*
 func TestClientSimpleConfig(t *testing.T) {
 	confstr1 := `{
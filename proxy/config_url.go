@@ -261,6 +261,9 @@ func URLToListenConf(u *url.URL, conf *ListenConf) error {
 	if e != nil {
 		return e
 	}
+	if conf.CommonConf.Port != 0 {
+		conf.Port = ListenPort{conf.CommonConf.Port}
+	}
 
 	q := u.Query()
 
@@ -321,10 +324,14 @@ func ToStandardUrl(cc *CommonConf, dc *DialConf, lc *ListenConf) string {
 	}
 
 	u.User = url.User(cc.UUID)
+	port := cc.Port
+	if lc != nil {
+		port = lc.FirstPort()
+	}
 	if cc.IP != "" {
-		u.Host = cc.IP + ":" + strconv.Itoa(cc.Port)
+		u.Host = cc.IP + ":" + strconv.Itoa(port)
 	} else {
-		u.Host = cc.Host + ":" + strconv.Itoa(cc.Port)
+		u.Host = cc.Host + ":" + strconv.Itoa(port)
 
 	}
 	if cc.Path != "" {
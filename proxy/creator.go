@@ -215,11 +215,21 @@ func newServer(creator ServerCreator, lc *ListenConf, knownTls bool) (Server, er
 
 // SetAddrStr, setCantRoute,setFallback, ConfigCommon
 func configCommonForServer(ser BaseInterface, lc *ListenConf) error {
-	ser.SetAddrStr(lc.GetAddrStrForListenOrDial())
+	addrs, err := lc.GetListenAddrStrs()
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "Failed, invalid listen ports", ErrDetail: err, Data: lc.Port}
+	}
+	ser.SetAddrStr(addrs[0])
 	serc := ser.GetBase()
 	if serc == nil {
 		return nil
 	}
+	if len(addrs) > 1 {
+		serc.ListenAddrs = addrs
+	}
+	if lc.MaxHandshakes > 0 {
+		serc.handshakeSem = make(chan struct{}, lc.MaxHandshakes)
+	}
 	serc.ListenConf = lc
 	serc.IsCantRoute = lc.NoRoute
 
@@ -236,5 +246,13 @@ func configCommonForServer(ser BaseInterface, lc *ListenConf) error {
 		serc.FallbackAddr = &fa
 	}
 
+	for _, s := range lc.XverFrom {
+		p, err := netLayer.ParseIPOrCIDR(s)
+		if err != nil {
+			return utils.ErrInErr{ErrDesc: "Failed, xver_from is neither ip nor CIDR", ErrDetail: err, Data: s}
+		}
+		serc.XverFrom = append(serc.XverFrom, p)
+	}
+
 	return nil
 }
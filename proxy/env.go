@@ -5,6 +5,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 )
 
 // used in real relay progress. See source code of v2ray_simple for details.
@@ -48,6 +49,8 @@ func LoadEnvFromStandardConf(standardConf *StandardConf, myCountryISO_3166 strin
 	if dnsConf := standardConf.DnsConf; dnsConf != nil {
 		routingEnv.DnsMachine = netLayer.LoadDnsMachine(dnsConf)
 	}
+	tlsLayer.SetECHDnsMachine(routingEnv.DnsMachine)
+	netLayer.SetDialDnsMachine(routingEnv.DnsMachine)
 
 	if standardConf.Route != nil || myCountryISO_3166 != "" {
 
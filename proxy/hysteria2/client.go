@@ -0,0 +1,336 @@
+package hysteria2
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	quicgo "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+func init() {
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+// true
+func (ClientCreator) MultiTransportLayer() bool {
+	return true
+}
+
+// hysteria2://password@host:port?obfs=salamander&obfs-password=xxx&sni=example.com&insecure=1
+func (ClientCreator) URLToDialConf(u *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	if format != proxy.UrlStandardFormat {
+		return nil, utils.ErrUnImplemented
+	}
+	if dc == nil {
+		dc = &proxy.DialConf{}
+	}
+	dc.UUID = u.User.Username()
+	if p, ok := u.User.Password(); ok {
+		dc.UUID += ":" + p
+	}
+
+	q := u.Query()
+	if dc.Extra == nil {
+		dc.Extra = make(map[string]any)
+	}
+	if v := q.Get("obfs"); v != "" {
+		dc.Extra["obfs"] = v
+		dc.Extra["obfs_password"] = q.Get("obfs-password")
+	}
+	if v := q.Get("sni"); v != "" {
+		dc.Host = v
+	}
+	if v := q.Get("insecure"); v != "" {
+		dc.Insecure, _ = strconv.ParseBool(v)
+	}
+	return dc, nil
+}
+
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	if dc.UUID == "" {
+		return nil, utils.ErrInErr{ErrDesc: "hysteria2 requires password in uuid field", ErrDetail: utils.ErrInvalidData}
+	}
+
+	c := &Client{
+		auth:       dc.UUID,
+		serverAddr: dc.GetAddrStr(),
+		serverName: dc.Host,
+		tlsConf: tlsLayer.GetTlsConfig(false, tlsLayer.Conf{
+			Insecure: dc.Insecure,
+			AlpnList: quic.DefaultAlpnList,
+			Host:     dc.Host,
+		}),
+	}
+	if dc.Extra != nil {
+		c.maxTx = getBandwidth(dc.Extra, "up_mbps")
+		c.maxRx = getBandwidth(dc.Extra, "down_mbps")
+		c.hyManual, _ = utils.AnyToBool(dc.Extra["hy_manual"])
+	}
+
+	var err error
+	if _, c.obfsPassword, err = getObfs(dc.Extra); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// implements proxy.SelfDialClient. 所有请求 共用 一个 quic连接, 若其 断开, 则 在下一个请求时 重新拨号并认证.
+type Client struct {
+	proxy.Base
+
+	auth string
+
+	serverAddr string
+	serverName string
+	tlsConf    *tls.Config
+
+	maxTx, maxRx uint64 //字节每秒, 0表示 未配置
+	hyManual     bool
+
+	obfsPassword string
+
+	mutex   sync.Mutex
+	session *clientSession
+}
+
+type clientSession struct {
+	conn quicgo.Connection
+	rt   *http3.RoundTripper
+	udp  *udpRelay //服务端 不支持udp 时 为 nil
+}
+
+func (*Client) Name() string { return Name }
+
+func (*Client) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+// true
+func (*Client) IsSelfDial() bool { return true }
+
+// 获取 现有的 quic连接, 若没有 或 已断开 则 重新拨号并认证.
+func (c *Client) getSession() (*clientSession, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if s := c.session; s != nil {
+		select {
+		case <-s.conn.Context().Done():
+		default:
+			return s, nil
+		}
+	}
+
+	s, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.session = s
+	return s, nil
+}
+
+func (c *Client) dial() (*clientSession, error) {
+	raddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	var pc net.PacketConn = udpConn
+	if c.obfsPassword != "" {
+		pc = newSalamanderConn(udpConn, c.obfsPassword)
+	}
+
+	qConf := quic.GetCommonConfig(false)
+	qConf.EnableDatagrams = true
+
+	var conn quicgo.EarlyConnection
+
+	rt := &http3.RoundTripper{
+		TLSClientConfig: c.tlsConf,
+		QuicConfig:      &qConf,
+		EnableDatagrams: true,
+		Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quicgo.Config) (quicgo.EarlyConnection, error) {
+			qc, err := quicgo.DialEarlyContext(ctx, pc, raddr, c.serverName, tlsCfg, cfg)
+			if err != nil {
+				return nil, err
+			}
+			conn = qc
+			return qc, nil
+		},
+	}
+
+	req := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: "https", Host: authURLHost, Path: authURLPath},
+		Header: http.Header{
+			headerAuth:    []string{c.auth},
+			headerCCRX:    []string{formatRx(c.maxRx)},
+			headerPadding: []string{authRequestPadding.String()},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), netLayer.DialTimeout)
+	defer cancel()
+
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		rt.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != statusAuthOK {
+		rt.Close()
+		udpConn.Close()
+		return nil, utils.ErrInErr{ErrDesc: "hysteria2 auth", ErrDetail: ErrAuth, Data: resp.StatusCode}
+	}
+
+	s := &clientSession{conn: conn, rt: rt}
+
+	if udp, _ := strconv.ParseBool(resp.Header.Get(headerUDP)); udp {
+		s.udp = newUDPRelay(conn, true, c.IsFullcone)
+		go s.udp.loopReadDatagram()
+	}
+
+	c.setCongestion(conn, resp.Header.Get(headerCCRX))
+
+	go func() {
+		<-conn.Context().Done()
+		if s.udp != nil {
+			s.udp.closeAll()
+		}
+		udpConn.Close()
+	}()
+
+	return s, nil
+}
+
+// 服务端 的 接收速率 为 auto 时, 使用 默认阻控; 否则 以 min(up_mbps, 服务端接收速率) 使用 brutal.
+func (c *Client) setCongestion(conn quicgo.Connection, serverRx string) {
+	if serverRx == ccRXAuto {
+		return
+	}
+	rx, _ := strconv.ParseUint(serverRx, 10, 64)
+	tx := actualTx(c.maxTx, rx)
+	if tx == 0 {
+		return
+	}
+	if ce := utils.CanLogDebug("hysteria2 using brutal congestion control"); ce != nil {
+		ce.Write(zap.Uint64("tx", tx))
+	}
+	quic.SetBrutalForConn(conn, c.hyManual, int(tx), false)
+}
+
+// underlay 不会被使用, 一般为nil
+func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	s, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), netLayer.DialTimeout)
+	defer cancel()
+
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := appendTCPRequest(make([]byte, 0, 1024), target.String())
+	if len(firstPayload) > 0 {
+		buf = append(buf, firstPayload...)
+		utils.PutBytes(firstPayload)
+	}
+	if _, err = stream.Write(buf); err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, err
+	}
+
+	return &clientStreamConn{
+		streamConn: streamConn{Stream: stream, laddr: s.conn.LocalAddr(), raddr: s.conn.RemoteAddr()},
+	}, nil
+}
+
+// underlay 不会被使用, 一般为nil
+func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	s, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	if s.udp == nil {
+		return nil, ErrUDP
+	}
+
+	us := s.udp.newClientSession()
+
+	if len(firstPayload) > 0 {
+		if err = us.WriteMsg(firstPayload, target); err != nil {
+			us.Close()
+			return nil, err
+		}
+	}
+	return us, nil
+}
+
+func (c *Client) Stop() {
+	c.mutex.Lock()
+	if s := c.session; s != nil {
+		s.rt.Close()
+		c.session = nil
+	}
+	c.mutex.Unlock()
+	c.Base.Stop()
+}
+
+// implements net.Conn
+type streamConn struct {
+	quicgo.Stream
+	laddr, raddr net.Addr
+}
+
+func (sc *streamConn) LocalAddr() net.Addr  { return sc.laddr }
+func (sc *streamConn) RemoteAddr() net.Addr { return sc.raddr }
+
+// quic.Stream 的 Close 只会 关闭 写端, 所以还要 CancelRead
+func (sc *streamConn) Close() error {
+	sc.CancelRead(0)
+	return sc.Stream.Close()
+}
+
+// 客户端 发送 tcp请求 后 不等待 服务端的回复, 而是 在 第一次 Read 时 读取 回复.
+type clientStreamConn struct {
+	streamConn
+
+	respOnce sync.Once
+	respErr  error
+}
+
+func (cc *clientStreamConn) Read(p []byte) (int, error) {
+	cc.respOnce.Do(func() {
+		cc.respErr = readTCPResponse(cc.Stream)
+	})
+	if cc.respErr != nil {
+		return 0, cc.respErr
+	}
+	return cc.Stream.Read(p)
+}
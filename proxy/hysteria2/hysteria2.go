@@ -0,0 +1,363 @@
+/*
+Package hysteria2 implements hysteria2 for proxy.Client and proxy.Server.
+
+hysteria2 是一个 基于 quic 的代理协议. 与 proxy/tuic 一样, 它直接使用 quic.Connection, 自己 拨号/监听 quic, 不走 vs 的 advLayer.
+
+# Protocol
+
+见 https://v2.hysteria.network/docs/developers/Protocol/
+
+认证 使用 http/3: 客户端 发送 POST https://hysteria/auth, 头部 含有
+
+	Hysteria-Auth: 密码
+	Hysteria-CC-RX: 客户端的 最大接收速率 (字节每秒), 0 表示 未知
+	Hysteria-Padding: 随机填充
+
+服务端 认证成功 则 返回 状态码 233, 头部 含有
+
+	Hysteria-UDP: true/false
+	Hysteria-CC-RX: 服务端的 最大接收速率, 或 "auto"
+	Hysteria-Padding: 随机填充
+
+认证失败 或 不是 认证请求 的, 服务端 将 表现得 和 普通的 http/3 服务器 一样 (返回 404).
+
+之后 每个 tcp请求 使用 一个 双向流, 其 开头 被 伪装成 一个 类型为 0x401 的 http/3 帧:
+
+	请求: [varint]0x401 [varint]地址长度 地址(host:port) [varint]填充长度 填充
+	回复: [uint8]状态(0为成功) [varint]消息长度 消息 [varint]填充长度 填充
+
+udp 使用 quic datagram 传输, 每个 datagram 为:
+
+	[uint32]会话id [uint16]包id [uint8]分片id [uint8]分片数 [varint]地址长度 地址(host:port) 数据
+
+超过 datagram 最大长度 的包 会被 分片, 每个分片 都含有 完整的头部.
+
+# Congestion Control
+
+认证时 双方 交换 各自的 最大接收速率. 客户端 以 min(up_mbps, 服务端接收速率) 作为 发送速率, 服务端 以 min(up_mbps, 客户端接收速率) 作为 发送速率,
+若 得到的 速率 大于0, 就使用 advLayer/quic 中的 hysteria brutal 阻控 (extra.hy_manual 同样有效); 否则 使用 quic-go 默认的阻控.
+
+# Obfuscation
+
+extra.obfs = "salamander" 时, 所有 udp包 都会 使用 salamander 混淆, 见 obfs.go.
+
+# Config
+
+客户端:
+
+	[[dial]]
+	protocol = "hysteria2"
+	uuid = "mypassword"
+	host = "example.com"
+	port = 443
+	extra = { up_mbps = 50, down_mbps = 200, obfs = "salamander", obfs_password = "myobfspassword" }
+
+服务端:
+
+	[[listen]]
+	protocol = "hysteria2"
+	uuid = "mypassword"
+	host = "0.0.0.0"
+	port = 443
+	cert = "cert.pem"
+	key = "cert.key"
+	users = [ {user = "password2"}, {user = "alice", pass = "password3"} ]	# 有 pass 的, 认证字符串 为 user:pass
+	extra = { up_mbps = 1000, down_mbps = 1000, ignore_client_bandwidth = false, obfs = "salamander", obfs_password = "myobfspassword" }
+*/
+package hysteria2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"strconv"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+const Name = "hysteria2"
+
+const (
+	authURLHost = "hysteria"
+	authURLPath = "/auth"
+
+	statusAuthOK = 233
+
+	headerAuth    = "Hysteria-Auth"
+	headerUDP     = "Hysteria-UDP"
+	headerCCRX    = "Hysteria-CC-RX"
+	headerPadding = "Hysteria-Padding"
+
+	ccRXAuto = "auto"
+
+	frameTypeTCPRequest = 0x401
+
+	tcpStatusOK    byte = 0x00
+	tcpStatusError byte = 0x01
+
+	maxAddressLen = 2048
+	maxMessageLen = 2048
+	maxPaddingLen = 4096
+
+	//会话id, 包id, 分片id, 分片数
+	udpFixedHeaderLen = 4 + 2 + 1 + 1
+)
+
+var (
+	ErrAuth = errors.New("hysteria2 authentication failed")
+	ErrUDP  = errors.New("hysteria2 server does not support udp")
+)
+
+// 各种 填充 的 长度范围, 与 官方实现 相同
+type paddingRange struct{ min, max int }
+
+var (
+	authRequestPadding  = paddingRange{256, 2048}
+	authResponsePadding = paddingRange{256, 2048}
+	tcpRequestPadding   = paddingRange{64, 512}
+	tcpResponsePadding  = paddingRange{128, 1024}
+)
+
+const paddingChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// 返回 随机长度的 填充字符串, 只含字母与数字, 因此也可用于 http头部.
+func (p paddingRange) String() string {
+	bs := make([]byte, p.min+rand.Intn(p.max-p.min))
+	for i := range bs {
+		bs[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+	return string(bs)
+}
+
+// 写入 tcp请求, 包括 帧类型 0x401
+func appendTCPRequest(buf []byte, addr string) []byte {
+	padding := tcpRequestPadding.String()
+
+	buf = quicvarint.Append(buf, frameTypeTCPRequest)
+	buf = quicvarint.Append(buf, uint64(len(addr)))
+	buf = append(buf, addr...)
+	buf = quicvarint.Append(buf, uint64(len(padding)))
+	return append(buf, padding...)
+}
+
+// 读取 tcp请求 帧类型 之后的部分
+func readTCPRequest(r io.Reader) (addr string, err error) {
+	qr := quicvarint.NewReader(r)
+
+	bs, err := readVarintBytes(qr, maxAddressLen)
+	if err != nil {
+		return
+	}
+	if len(bs) == 0 {
+		err = utils.ErrInErr{ErrDesc: "hysteria2 got empty address", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+	addr = string(bs)
+
+	_, err = readVarintBytes(qr, maxPaddingLen)
+	return
+}
+
+func appendTCPResponse(buf []byte, ok bool, msg string) []byte {
+	padding := tcpResponsePadding.String()
+
+	if ok {
+		buf = append(buf, tcpStatusOK)
+	} else {
+		buf = append(buf, tcpStatusError)
+	}
+	buf = quicvarint.Append(buf, uint64(len(msg)))
+	buf = append(buf, msg...)
+	buf = quicvarint.Append(buf, uint64(len(padding)))
+	return append(buf, padding...)
+}
+
+// 读取 tcp回复; 若 服务端 返回 错误, 则 err 中 含有 服务端的 消息.
+func readTCPResponse(r io.Reader) error {
+	qr := quicvarint.NewReader(r)
+
+	status, err := qr.ReadByte()
+	if err != nil {
+		return err
+	}
+	msg, err := readVarintBytes(qr, maxMessageLen)
+	if err != nil {
+		return err
+	}
+	if _, err = readVarintBytes(qr, maxPaddingLen); err != nil {
+		return err
+	}
+	if status != tcpStatusOK {
+		return utils.ErrInErr{ErrDesc: "hysteria2 server refused tcp request", ErrDetail: utils.ErrFailed, Data: string(msg)}
+	}
+	return nil
+}
+
+// 读取 [varint]长度 与 其后的数据
+func readVarintBytes(qr quicvarint.Reader, maxLen uint64) ([]byte, error) {
+	l, err := quicvarint.Read(qr)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxLen {
+		return nil, utils.ErrInErr{ErrDesc: "hysteria2 length too large", ErrDetail: utils.ErrInvalidData, Data: l}
+	}
+	bs := make([]byte, l)
+	_, err = io.ReadFull(qr, bs)
+	return bs, err
+}
+
+// 一个 udp datagram (或其 一个分片)
+type udpMessage struct {
+	sessionID uint32
+	packetID  uint16
+	fragID    uint8
+	fragCount uint8
+	addr      string
+	data      []byte
+}
+
+func (m *udpMessage) headerLen() int {
+	return udpFixedHeaderLen + int(quicvarint.Len(uint64(len(m.addr)))) + len(m.addr)
+}
+
+func (m *udpMessage) appendTo(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, m.sessionID)
+	buf = binary.BigEndian.AppendUint16(buf, m.packetID)
+	buf = append(buf, m.fragID, m.fragCount)
+	buf = quicvarint.Append(buf, uint64(len(m.addr)))
+	buf = append(buf, m.addr...)
+	return append(buf, m.data...)
+}
+
+func parseUDPMessage(bs []byte) (m udpMessage, err error) {
+	if len(bs) < udpFixedHeaderLen {
+		err = utils.ErrInErr{ErrDesc: "hysteria2 udp message too short", ErrDetail: utils.ErrInvalidData, Data: len(bs)}
+		return
+	}
+	m.sessionID = binary.BigEndian.Uint32(bs)
+	m.packetID = binary.BigEndian.Uint16(bs[4:])
+	m.fragID = bs[6]
+	m.fragCount = bs[7]
+
+	if m.fragCount == 0 || m.fragID >= m.fragCount {
+		err = utils.ErrInErr{ErrDesc: "hysteria2 udp fragment invalid", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+
+	r := bytes.NewReader(bs[udpFixedHeaderLen:])
+	addr, err := readVarintBytes(quicvarint.NewReader(r), maxAddressLen)
+	if err != nil {
+		return
+	}
+	m.addr = string(addr)
+	m.data = bs[len(bs)-r.Len():]
+	return
+}
+
+// 将 m 按 maxLen 分片, 每个分片 都含有 完整的头部. m.packetID 应该 已经设置好.
+func fragment(m udpMessage, maxLen int) []udpMessage {
+	maxData := maxLen - m.headerLen()
+	if maxData <= 0 || len(m.data) <= maxData {
+		return []udpMessage{m}
+	}
+
+	count := (len(m.data) + maxData - 1) / maxData
+	ms := make([]udpMessage, 0, count)
+	data := m.data
+	for i := 0; i < count; i++ {
+		fm := m
+		fm.fragID = uint8(i)
+		fm.fragCount = uint8(count)
+		n := maxData
+		if n > len(data) {
+			n = len(data)
+		}
+		fm.data = data[:n]
+		data = data[n:]
+		ms = append(ms, fm)
+	}
+	return ms
+}
+
+// 重组 一个会话中的 分片. 和 官方实现 一样, 同一时间 只重组 一个包, 收到 新的包id 时 丢弃 旧的.
+type defragger struct {
+	packetID uint16
+	frags    [][]byte
+	count    int
+}
+
+// 返回 完整的数据; 若 还没有 收齐, 返回 nil
+func (d *defragger) feed(m udpMessage) []byte {
+	if m.fragCount <= 1 {
+		return m.data
+	}
+	if m.packetID != d.packetID || len(d.frags) != int(m.fragCount) {
+		d.packetID = m.packetID
+		d.frags = make([][]byte, m.fragCount)
+		d.count = 0
+	}
+	if d.frags[m.fragID] != nil {
+		return nil
+	}
+	d.frags[m.fragID] = m.data
+	d.count++
+	if d.count < len(d.frags) {
+		return nil
+	}
+	data := bytes.Join(d.frags, nil)
+	d.frags = nil
+	return data
+}
+
+func parseAddr(addrStr, network string) (netLayer.Addr, error) {
+	addr, err := netLayer.NewAddrByHostPort(addrStr)
+	if err != nil {
+		return addr, utils.ErrInErr{ErrDesc: "hysteria2 address invalid", ErrDetail: err, Data: addrStr}
+	}
+	addr.Network = network
+	return addr, nil
+}
+
+// 从 extra 中 读取 以 mbps 为单位的 速率, 返回 字节每秒
+func getBandwidth(extra map[string]any, key string) uint64 {
+	if thing := extra[key]; thing != nil {
+		if mbps, ok := utils.AnyToInt64(thing); ok && mbps > 0 {
+			return uint64(mbps) * 1024 * 1024 / 8
+		}
+	}
+	return 0
+}
+
+// 按 本地的 最大发送速率 与 对端的 最大接收速率 决定 实际发送速率; 0 表示 不使用 brutal.
+func actualTx(localMaxTx, peerRx uint64) uint64 {
+	if peerRx == 0 || (localMaxTx > 0 && peerRx > localMaxTx) {
+		return localMaxTx
+	}
+	return peerRx
+}
+
+func formatRx(rx uint64) string {
+	return strconv.FormatUint(rx, 10)
+}
+
+// implements utils.User. 认证字符串 为 password, 或 user:pass.
+type User struct {
+	id, auth string
+}
+
+func NewUser(uc utils.UserConf) User {
+	if uc.Pass == "" {
+		return User{id: uc.User, auth: uc.User}
+	}
+	return User{id: uc.User, auth: uc.User + ":" + uc.Pass}
+}
+
+func (u User) IdentityStr() string   { return u.id }
+func (u User) IdentityBytes() []byte { return []byte(u.id) }
+func (u User) AuthStr() string       { return u.auth }
+func (u User) AuthBytes() []byte     { return []byte(u.auth) }
@@ -0,0 +1,178 @@
+package hysteria2_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/hysteria2"
+)
+
+const testPassword = "hy2_password"
+
+func startServer(t *testing.T, extra map[string]any) (port int, closer io.Closer) {
+	port = netLayer.RandPort(true, true, 0)
+
+	s, err := proxy.NewServer(&proxy.ListenConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: hysteria2.Name,
+			Host:     "127.0.0.1",
+			Port:     port,
+			UUID:     testPassword,
+			Extra:    extra,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closer = s.(proxy.ListenerServer).StartListen(func(info netLayer.TCPRequestInfo) {
+		if info.Target.Name != "example.com" || info.Target.Port != 80 {
+			t.Log("wrong target", info.Target.String())
+			info.Conn.Close()
+			return
+		}
+		io.Copy(info.Conn, info.Conn)
+		info.Conn.Close()
+	}, func(info netLayer.UDPRequestInfo) {
+		for {
+			bs, addr, err := info.ReadMsg()
+			if err != nil {
+				return
+			}
+			info.WriteMsg(bs, addr)
+		}
+	})
+	if closer == nil {
+		t.Fatal("hysteria2 server listen failed")
+	}
+	return
+}
+
+func newClient(t *testing.T, port int, password string, extra map[string]any) proxy.Client {
+	c, err := proxy.NewClient(&proxy.DialConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: hysteria2.Name,
+			Host:     "127.0.0.1",
+			Port:     port,
+			UUID:     password,
+			Insecure: true,
+			Extra:    extra,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testTCP(t *testing.T, c proxy.Client) {
+	hello := []byte("hello hysteria2")
+
+	wrc, err := c.Handshake(nil, append([]byte{}, hello...), netLayer.Addr{Network: "tcp", Name: "example.com", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrc.Close()
+	wrc.(net.Conn).SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	buf := make([]byte, len(hello))
+	if _, err = io.ReadFull(wrc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, hello) {
+		t.Fatal("not equal", string(buf))
+	}
+}
+
+func testUDP(t *testing.T, c proxy.Client) {
+	target := netLayer.Addr{Network: "udp", IP: net.IPv4(1, 2, 3, 4), Port: 53}
+
+	mc, err := c.EstablishUDPChannel(nil, []byte("hello udp"), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	mc.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	bs, addr, err := mc.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "hello udp" || addr.Port != 53 || !addr.IP.Equal(target.IP) {
+		t.Fatal("udp echo wrong", string(bs), addr.String())
+	}
+
+	//超过 datagram 大小, 会被分片
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	if err = mc.WriteMsg(big, target); err != nil {
+		t.Fatal(err)
+	}
+	bs, _, err = mc.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, big) {
+		t.Fatal("big udp echo wrong", len(bs))
+	}
+}
+
+func TestTCPAndUDP(t *testing.T) {
+	cases := []struct {
+		name                string
+		serverExtra, cExtra map[string]any
+	}{
+		{name: "plain"},
+		{
+			name:        "salamander",
+			serverExtra: map[string]any{"obfs": hysteria2.ObfsSalamander, "obfs_password": "obfs"},
+			cExtra:      map[string]any{"obfs": hysteria2.ObfsSalamander, "obfs_password": "obfs"},
+		},
+		{
+			name:        "brutal",
+			serverExtra: map[string]any{"up_mbps": 100, "down_mbps": 100},
+			cExtra:      map[string]any{"up_mbps": 100, "down_mbps": 100},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			port, closer := startServer(t, tc.serverExtra)
+			defer closer.Close()
+
+			c := newClient(t, port, testPassword, tc.cExtra)
+			defer c.Stop()
+
+			testTCP(t, c)
+			testUDP(t, c)
+		})
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	port, closer := startServer(t, nil)
+	defer closer.Close()
+
+	c := newClient(t, port, "wrong", nil)
+	defer c.Stop()
+
+	if _, err := c.Handshake(nil, []byte("hello"), netLayer.Addr{Network: "tcp", Name: "example.com", Port: 80}); err == nil {
+		t.Fatal("should fail with wrong password")
+	}
+}
+
+func TestWrongObfsPassword(t *testing.T) {
+	port, closer := startServer(t, map[string]any{"obfs": hysteria2.ObfsSalamander, "obfs_password": "obfs"})
+	defer closer.Close()
+
+	c := newClient(t, port, testPassword, map[string]any{"obfs": hysteria2.ObfsSalamander, "obfs_password": "wrong"})
+	defer c.Stop()
+
+	if _, err := c.Handshake(nil, []byte("hello"), netLayer.Addr{Network: "tcp", Name: "example.com", Port: 80}); err == nil {
+		t.Fatal("should fail with wrong obfs password")
+	}
+}
@@ -0,0 +1,97 @@
+package hysteria2
+
+import (
+	"crypto/rand"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	ObfsSalamander = "salamander"
+
+	salamanderSaltLen = 8
+	salamanderKeyLen  = blake2b.Size256
+)
+
+/*
+salamanderConn 用 salamander 混淆 每个 udp包:
+
+	salt(8) + payload XOR key
+
+其中 key = BLAKE2b-256(password + salt), payload 的第i字节 与 key[i%32] 异或.
+*/
+type salamanderConn struct {
+	net.PacketConn
+	psk []byte
+}
+
+func newSalamanderConn(pc net.PacketConn, password string) *salamanderConn {
+	return &salamanderConn{PacketConn: pc, psk: []byte(password)}
+}
+
+func (c *salamanderConn) key(salt []byte) [salamanderKeyLen]byte {
+	return blake2b.Sum256(append(append(make([]byte, 0, len(c.psk)+len(salt)), c.psk...), salt...))
+}
+
+func (c *salamanderConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buf := utils.GetPacket()
+	defer utils.PutPacket(buf)
+
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		//太短的 包 不可能是 有效的包, 直接丢弃
+		if n <= salamanderSaltLen {
+			continue
+		}
+		key := c.key(buf[:salamanderSaltLen])
+		n = copy(p, buf[salamanderSaltLen:n])
+		for i := 0; i < n; i++ {
+			p[i] ^= key[i%salamanderKeyLen]
+		}
+		return
+	}
+}
+
+func (c *salamanderConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buf := utils.GetBytes(salamanderSaltLen + len(p))
+	defer utils.PutBytes(buf)
+	buf = buf[:salamanderSaltLen+len(p)]
+
+	if _, err = rand.Read(buf[:salamanderSaltLen]); err != nil {
+		return
+	}
+	key := c.key(buf[:salamanderSaltLen])
+	for i, b := range p {
+		buf[salamanderSaltLen+i] = b ^ key[i%salamanderKeyLen]
+	}
+
+	if _, err = c.PacketConn.WriteTo(buf, addr); err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+// 从 extra 中读取 obfs 配置; obfs 为空 表示 不混淆
+func getObfs(extra map[string]any) (obfs, password string, err error) {
+	if extra == nil {
+		return
+	}
+	obfs, _ = extra["obfs"].(string)
+	switch obfs {
+	case "":
+		return
+	case ObfsSalamander:
+		password, _ = extra["obfs_password"].(string)
+		if password == "" {
+			err = utils.ErrInErr{ErrDesc: "hysteria2 salamander requires obfs_password", ErrDetail: utils.ErrInvalidData}
+		}
+	default:
+		err = utils.ErrInErr{ErrDesc: "hysteria2 obfs not supported", ErrDetail: utils.ErrInvalidData, Data: obfs}
+	}
+	return
+}
@@ -0,0 +1,323 @@
+package hysteria2
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	quicgo "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+const defaultMaxStreamsInOneConn = 1024
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+// hysteria2://password@host:port?obfs=salamander&obfs-password=xxx
+func (ServerCreator) URLToListenConf(u *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	if format != proxy.UrlStandardFormat {
+		return nil, utils.ErrUnImplemented
+	}
+	if lc == nil {
+		lc = &proxy.ListenConf{}
+	}
+	lc.UUID = u.User.Username()
+
+	q := u.Query()
+	if v := q.Get("obfs"); v != "" {
+		if lc.Extra == nil {
+			lc.Extra = make(map[string]any)
+		}
+		lc.Extra["obfs"] = v
+		lc.Extra["obfs_password"] = q.Get("obfs-password")
+	}
+	return lc, nil
+}
+
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	s := &Server{
+		MultiUserMap: utils.NewMultiUserMap(),
+	}
+	s.StoreKeyByStr = true
+
+	if lc.UUID != "" {
+		s.AddUser(NewUser(utils.UserConf{User: lc.UUID}))
+	}
+	for _, uc := range lc.Users {
+		s.AddUser(NewUser(uc))
+	}
+	if len(s.AuthMap) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "hysteria2 server requires at least one password", ErrDetail: utils.ErrInvalidData}
+	}
+
+	if lc.Extra != nil {
+		s.maxTx = getBandwidth(lc.Extra, "up_mbps")
+		s.maxRx = getBandwidth(lc.Extra, "down_mbps")
+		s.hyManual, _ = utils.AnyToBool(lc.Extra["hy_manual"])
+		s.ignoreClientBandwidth, _ = utils.AnyToBool(lc.Extra["ignore_client_bandwidth"])
+	}
+
+	var err error
+	if _, s.obfsPassword, err = getObfs(lc.Extra); err != nil {
+		return nil, err
+	}
+
+	s.tlsConf = tlsLayer.GetTlsConfig(true, tlsLayer.Conf{
+		Insecure: lc.Insecure,
+		AlpnList: quic.DefaultAlpnList,
+		Host:     lc.Host,
+		CertConf: lc.GetCertConf(),
+	})
+
+	return s, nil
+}
+
+// implements proxy.ListenerServer. 自行监听 quic.
+type Server struct {
+	proxy.Base
+
+	*utils.MultiUserMap
+
+	tlsConf *tls.Config
+
+	maxTx, maxRx          uint64 //字节每秒, 0表示 未配置
+	hyManual              bool
+	ignoreClientBandwidth bool
+
+	obfsPassword string
+
+	listener io.Closer
+}
+
+func (*Server) Name() string { return Name }
+
+// true, 1, 1
+func (*Server) SelfListen() (is bool, tcp, udp int) {
+	return true, 1, 1
+}
+
+func (*Server) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
+	return nil, nil, netLayer.Addr{}, utils.ErrUnImplemented
+}
+
+func (s *Server) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) io.Closer {
+	udpConn, err := quic.ListenUDP(s.GetListenAddrs())
+	if err != nil {
+		if ce := utils.CanLogErr("hysteria2 listen udp failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return nil
+	}
+	var pc net.PacketConn = udpConn
+	if s.obfsPassword != "" {
+		pc = newSalamanderConn(udpConn, s.obfsPassword)
+	}
+
+	qConf := quic.GetCommonConfig(true)
+	qConf.EnableDatagrams = true
+	qConf.MaxIncomingStreams = defaultMaxStreamsInOneConn
+	qConf.MaxIncomingUniStreams = 0 //http3 的 控制流 等 需要 单向流, 0 表示 使用 quic-go 的默认值
+
+	l, err := quicgo.ListenEarly(pc, s.tlsConf, &qConf)
+	if err != nil {
+		udpConn.Close()
+		if ce := utils.CanLogErr("hysteria2 listen quic failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return nil
+	}
+	s.listener = &listenerCloser{Closer: l, udpConn: udpConn}
+
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				if ce := utils.CanLogDebug("hysteria2 accept failed"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+				return
+			}
+			go s.handleConn(conn, tcpFunc, udpFunc)
+		}
+	}()
+
+	return s.listener
+}
+
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *Server) ReleaseCerts() {
+	s.Base.ReleaseCerts()
+	tlsLayer.ReleaseTlsConfig(s.tlsConf)
+}
+
+// quic-go 的 listener 不会 关闭 由我们传入的 PacketConn
+type listenerCloser struct {
+	io.Closer
+	udpConn net.PacketConn
+}
+
+func (lc *listenerCloser) Close() error {
+	err := lc.Closer.Close()
+	lc.udpConn.Close()
+	return err
+}
+
+// 服务端 的 一个 quic连接
+type serverSession struct {
+	conn quicgo.Connection
+	udp  *udpRelay
+
+	authOnce   sync.Once
+	authedChan chan struct{}
+	user       utils.User
+}
+
+func (ss *serverSession) isAuthed() bool {
+	select {
+	case <-ss.authedChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// 阻塞
+func (s *Server) handleConn(conn quicgo.EarlyConnection, tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) {
+	ss := &serverSession{
+		conn:       conn,
+		udp:        newUDPRelay(conn, false, s.IsFullcone),
+		authedChan: make(chan struct{}),
+	}
+	ss.udp.onNewSession = func(us *udpSession, target netLayer.Addr) {
+		go udpFunc(netLayer.UDPRequestInfo{MsgConn: us, Target: target})
+	}
+
+	go func() {
+		<-conn.Context().Done()
+		ss.udp.closeAll()
+	}()
+
+	h3s := &http3.Server{
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.handleAuth(ss, w, r)
+		}),
+		StreamHijacker: func(ft http3.FrameType, _ quicgo.Connection, stream quicgo.Stream, err error) (bool, error) {
+			if err != nil || ft != frameTypeTCPRequest {
+				return false, nil
+			}
+			if !ss.isAuthed() {
+				//和 官方实现 一样, 未认证的 tcp请求 直接关闭
+				stream.CancelRead(0)
+				stream.Close()
+				return true, nil
+			}
+			go s.handleStream(ss, stream, tcpFunc)
+			return true, nil
+		},
+	}
+
+	if err := h3s.ServeQUICConn(conn); err != nil {
+		if ce := utils.CanLogDebug("hysteria2 serve conn ended"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+	}
+}
+
+// 处理 http/3 请求; 只有 /auth 会被 当作 认证, 其它请求 及 认证失败的 一律 返回 404.
+func (s *Server) handleAuth(ss *serverSession, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Host != authURLHost || r.URL.Path != authURLPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	u := s.AuthUserByStr(r.Header.Get(headerAuth))
+	if u == nil {
+		if ce := utils.CanLogWarn("hysteria2 authentication failed"); ce != nil {
+			ce.Write(zap.String("from", ss.conn.RemoteAddr().String()))
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	clientRx, _ := strconv.ParseUint(r.Header.Get(headerCCRX), 10, 64)
+
+	rxStr := formatRx(s.maxRx)
+	if s.ignoreClientBandwidth {
+		rxStr = ccRXAuto
+	}
+	w.Header().Set(headerUDP, "true")
+	w.Header().Set(headerCCRX, rxStr)
+	w.Header().Set(headerPadding, authResponsePadding.String())
+	w.WriteHeader(statusAuthOK)
+
+	ss.authOnce.Do(func() {
+		s.setCongestion(ss.conn, clientRx)
+		ss.user = u
+		close(ss.authedChan)
+		go ss.udp.loopReadDatagram()
+	})
+}
+
+// 客户端 的 接收速率 为 0 或 配置了 ignore_client_bandwidth 时, 使用 默认阻控; 否则 以 min(up_mbps, 客户端接收速率) 使用 brutal.
+func (s *Server) setCongestion(conn quicgo.Connection, clientRx uint64) {
+	if s.ignoreClientBandwidth || clientRx == 0 {
+		return
+	}
+	tx := actualTx(s.maxTx, clientRx)
+	if ce := utils.CanLogDebug("hysteria2 using brutal congestion control"); ce != nil {
+		ce.Write(zap.Uint64("tx", tx))
+	}
+	quic.SetBrutalForConn(conn, s.hyManual, int(tx), true)
+}
+
+func (s *Server) handleStream(ss *serverSession, stream quicgo.Stream, tcpFunc func(netLayer.TCPRequestInfo)) {
+	sc := &streamConn{Stream: stream, laddr: ss.conn.LocalAddr(), raddr: ss.conn.RemoteAddr()}
+
+	addrStr, err := readTCPRequest(stream)
+	var target netLayer.Addr
+	if err == nil {
+		target, err = parseAddr(addrStr, "tcp")
+	}
+	if err != nil {
+		if ce := utils.CanLogDebug("hysteria2 read tcp request failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		sc.Close()
+		return
+	}
+
+	//我们 在 拨号之前 就 回复 成功, 拨号失败时 直接 关闭 流. 官方客户端 会 等待 回复, 所以 不能 延迟到 第一次写入 时 回复.
+	if _, err = stream.Write(appendTCPResponse(nil, true, "")); err != nil {
+		sc.Close()
+		return
+	}
+
+	tcpFunc(netLayer.TCPRequestInfo{Conn: &userStreamConn{streamConn: sc, User: ss.user}, Target: target})
+}
+
+// implements utils.User, 以便 记录 用户
+type userStreamConn struct {
+	*streamConn
+	utils.User
+}
@@ -0,0 +1,234 @@
+package hysteria2
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/zap"
+)
+
+// hysteria2 没有 关闭 udp会话 的命令, 服务端 靠 超时 关闭 会话, 与 官方实现 的 默认值 相同.
+const serverUDPIdleTimeout = time.Minute
+
+/*
+udpRelay 管理 一个 quic.Connection 上的 所有 udp 会话, 客户端 和 服务端 共用.
+
+会话id 由 客户端 分配; 服务端 收到 未知 会话id 的包 时 新建会话.
+*/
+type udpRelay struct {
+	conn     quic.Connection
+	isClient bool
+	fullcone bool
+
+	mutex         sync.Mutex
+	sessions      map[uint32]*udpSession
+	nextSessionID uint32
+
+	//服务端 新建会话 时 调用; 客户端 为 nil.
+	onNewSession func(*udpSession, netLayer.Addr)
+}
+
+func newUDPRelay(conn quic.Connection, isClient, fullcone bool) *udpRelay {
+	return &udpRelay{
+		conn:     conn,
+		isClient: isClient,
+		fullcone: fullcone,
+		sessions: make(map[uint32]*udpSession),
+	}
+}
+
+func (r *udpRelay) newSession(id uint32) *udpSession {
+	s := &udpSession{
+		relay:     r,
+		id:        id,
+		msgChan:   make(chan netLayer.AddrData, 64),
+		closeChan: make(chan struct{}),
+	}
+	s.InitEasyDeadline()
+	if !r.isClient {
+		s.idleTimer = time.AfterFunc(serverUDPIdleTimeout, func() { s.Close() })
+	}
+	r.sessions[id] = s
+	return s
+}
+
+// 客户端 新建一个 udp 会话
+func (r *udpRelay) newClientSession() *udpSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for {
+		r.nextSessionID++
+		if _, has := r.sessions[r.nextSessionID]; !has {
+			return r.newSession(r.nextSessionID)
+		}
+	}
+}
+
+// 发送 一个 udp包; 若 超过 datagram 最大长度, 则 分片 发送.
+func (r *udpRelay) send(m udpMessage) error {
+	err := r.conn.SendMessage(m.appendTo(make([]byte, 0, m.headerLen()+len(m.data))))
+
+	var tooLarge quic.ErrMessageToLarge
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+
+	m.packetID = uint16(rand.Intn(0xffff)) + 1
+	for _, fm := range fragment(m, int(tooLarge)) {
+		if err = r.conn.SendMessage(fm.appendTo(make([]byte, 0, int(tooLarge)))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 阻塞. 循环读取 datagram.
+func (r *udpRelay) loopReadDatagram() {
+	for {
+		bs, err := r.conn.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		m, err := parseUDPMessage(bs)
+		if err != nil {
+			if ce := utils.CanLogDebug("hysteria2 read udp message failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			continue
+		}
+		r.handleMessage(m)
+	}
+}
+
+// 只在 loopReadDatagram 中调用, 所以 defrag 与 announced 不需要 加锁
+func (r *udpRelay) handleMessage(m udpMessage) {
+	r.mutex.Lock()
+	s := r.sessions[m.sessionID]
+	if s == nil {
+		if r.onNewSession == nil {
+			r.mutex.Unlock()
+			return
+		}
+		s = r.newSession(m.sessionID)
+	}
+	r.mutex.Unlock()
+
+	data := s.defrag.feed(m)
+	if data == nil {
+		return
+	}
+	addr, err := parseAddr(m.addr, "udp")
+	if err != nil {
+		if ce := utils.CanLogDebug("hysteria2 udp message with bad address"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return
+	}
+
+	if r.onNewSession != nil && !s.announced {
+		s.announced = true
+		r.onNewSession(s, addr)
+	}
+	s.resetIdle()
+
+	select {
+	case s.msgChan <- netLayer.AddrData{Data: data, Addr: addr}:
+	case <-s.closeChan:
+	default:
+		//和 真实的 udp 一样, 读得太慢 就丢包
+	}
+}
+
+func (r *udpRelay) closeAll() {
+	r.mutex.Lock()
+	ss := make([]*udpSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		ss = append(ss, s)
+	}
+	r.mutex.Unlock()
+
+	for _, s := range ss {
+		s.Close()
+	}
+}
+
+// udpSession 是 一个 hysteria2 的 udp 会话. implements netLayer.MsgConn.
+type udpSession struct {
+	netLayer.EasyDeadline
+
+	relay *udpRelay
+	id    uint32
+
+	defrag    defragger
+	announced bool //服务端 是否 已经 调用过 onNewSession
+
+	idleTimer *time.Timer //仅 服务端 使用
+
+	msgChan   chan netLayer.AddrData
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *udpSession) resetIdle() {
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(serverUDPIdleTimeout)
+	}
+}
+
+func (s *udpSession) ReadMsg() ([]byte, netLayer.Addr, error) {
+	select {
+	case msg := <-s.msgChan:
+		return msg.Data, msg.Addr, nil
+	case <-s.closeChan:
+		return nil, netLayer.Addr{}, io.EOF
+	case <-s.relay.conn.Context().Done():
+		return nil, netLayer.Addr{}, io.EOF
+	case <-s.ReadTimeoutChan():
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *udpSession) WriteMsg(data []byte, peer netLayer.Addr) error {
+	select {
+	case <-s.closeChan:
+		return io.ErrClosedPipe
+	default:
+	}
+	s.resetIdle()
+	return s.relay.send(udpMessage{
+		sessionID: s.id,
+		fragCount: 1,
+		addr:      peer.String(),
+		data:      data,
+	})
+}
+
+func (s *udpSession) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return s.Close()
+}
+
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+		if s.idleTimer != nil {
+			s.idleTimer.Stop()
+		}
+
+		s.relay.mutex.Lock()
+		delete(s.relay.sessions, s.id)
+		s.relay.mutex.Unlock()
+	})
+	return nil
+}
+
+func (s *udpSession) Fullcone() bool {
+	return s.relay.fullcone
+}
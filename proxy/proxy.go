@@ -68,6 +68,24 @@ type UserClient interface {
 	GetUser() utils.User
 }
 
+// SelfDialClient 自行处理 拨号 及其以下的所有层级, 调用者无需为其拨号, 其 Handshake 和 EstablishUDPChannel 所传入的 underlay 为 nil.
+// 如 proxy/wireguard, proxy/reverse.
+type SelfDialClient interface {
+	Client
+	IsSelfDial() bool
+}
+
+// TunnelClient 不自行拨号, 而是使用 由对端主动发来的 隧道连接 进行 Handshake。 见 proxy/reverse.
+type TunnelClient interface {
+	SelfDialClient
+
+	//判断 target 是否是 对端用于建立隧道的 请求
+	IsTunnelTarget(target netLayer.Addr) bool
+
+	//在 underlay 上建立隧道, 阻塞直到 隧道关闭。firstPayload 为 已经从 underlay 中读到的数据，可为空。
+	ServeTunnel(underlay net.Conn, firstPayload []byte)
+}
+
 // Server is used for listening clients.
 // Because Server is "target agnostic"，Handshake should return the target addr that the Client requested.
 //
@@ -87,6 +105,9 @@ type Server interface {
 	//
 	//is表示开启自监听; 此时若 tcp=1, 表示监听tcp, 若tcp=0, 表示自己不监听tcp, 但需要vs进行监听; 若tcp<0, 则表示自己不监听, 也不要vs监听; udp同理; 开启SelfListen同时表明 Server实现了 ListenerServer
 	SelfListen() (is bool, tcp, udp int)
+
+	//释放 tls 证书 等 在 Stop 后 仍然 保留 的 资源, 在 服务端 被 删除 时 调用. Stop 后 服务端 还可以 再次 监听, ReleaseCerts 后 则 不行.
+	ReleaseCerts()
 }
 
 type ListenerServer interface {
@@ -0,0 +1,216 @@
+package reverse
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/simplesocks"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/xtaci/smux"
+	"go.uber.org/zap"
+)
+
+// 隧道断开后 重新拨号 的间隔
+const bridgeRedialInterval = time.Second * 5
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+// true
+func (ServerCreator) MultiTransportLayer() bool {
+	return true
+}
+
+func (ServerCreator) URLToListenConf(u *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	if lc == nil {
+		return nil, utils.ErrNilParameter
+	}
+	if d := u.Query().Get("domain"); d != "" {
+		if lc.Extra == nil {
+			lc.Extra = make(map[string]any)
+		}
+		lc.Extra["domain"] = d
+	}
+	return lc, nil
+}
+
+// use lc.Extra["domain"], 可选 lc.TargetAddr
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	domain, err := getDomainFromExtra(lc.Extra)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bridge{
+		domain:    domain,
+		closeChan: make(chan struct{}),
+	}
+	if lc.TargetAddr != "" {
+		b.targetAddr, err = netLayer.NewAddrByURL(lc.TargetAddr)
+		if err != nil {
+			return nil, err
+		}
+		b.hasTarget = true
+	}
+
+	return b, nil
+}
+
+// Bridge 是 反向代理 在 内网端 的 proxy.Server, implements proxy.ListenerServer.
+//
+// Bridge 不监听任何端口, 而是通过 tcpFunc 主动发起 隧道请求, 并一直保持该隧道.
+type Bridge struct {
+	proxy.Base
+
+	domain string
+
+	targetAddr netLayer.Addr
+	hasTarget  bool
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func (*Bridge) Name() string { return Name }
+
+func (b *Bridge) SelfListen() (is bool, tcp, udp int) {
+	//隧道本身 总是通过 tcpFunc 发出的, 所以 tcp 总为 1
+	tcp = 1
+	if b.Network() == "tcp" {
+		udp = -1
+	} else {
+		udp = 1
+	}
+
+	is = true
+
+	return
+}
+
+func (b *Bridge) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
+	return nil, nil, netLayer.Addr{}, utils.ErrUnImplemented
+}
+
+func (b *Bridge) Close() error {
+	b.Stop()
+	return nil
+}
+
+func (b *Bridge) Stop() {
+	b.closeOnce.Do(func() {
+		close(b.closeChan)
+		b.Base.Stop()
+	})
+}
+
+// 非阻塞. tcpFunc 必须非nil, 因为隧道本身 是通过 tcpFunc 发出的.
+func (b *Bridge) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) io.Closer {
+
+	go func() {
+		for {
+			select {
+			case <-b.closeChan:
+				return
+			default:
+			}
+
+			session := b.dialTunnel(tcpFunc)
+			if session != nil {
+				b.acceptLoop(session, tcpFunc, udpFunc)
+			}
+
+			select {
+			case <-b.closeChan:
+				return
+			case <-time.After(bridgeRedialInterval):
+			}
+
+			if ce := utils.CanLogInfo("reverse bridge redialing tunnel"); ce != nil {
+				ce.Write(zap.String("domain", b.domain))
+			}
+		}
+	}()
+
+	return b
+}
+
+// 将 net.Pipe 的一端 作为一个 请求 交给 tcpFunc, 由 vs 进行分流和拨号; 另一端则作为隧道 建立 smux.
+func (b *Bridge) dialTunnel(tcpFunc func(netLayer.TCPRequestInfo)) *smux.Session {
+	c1, c2 := net.Pipe()
+
+	go tcpFunc(netLayer.TCPRequestInfo{
+		Conn:   c1,
+		Target: tunnelAddr(b.domain),
+	})
+
+	b.Lock()
+	b.CloseInnerMuxSession()
+	session := b.GetClientInnerMuxSession(c2)
+	b.Unlock()
+
+	if session == nil {
+		c2.Close()
+		return nil
+	}
+
+	if ce := utils.CanLogInfo("reverse bridge tunnel started"); ce != nil {
+		ce.Write(zap.String("domain", b.domain))
+	}
+
+	return session
+}
+
+func (b *Bridge) acceptLoop(session *smux.Session, tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if ce := utils.CanLogWarn("reverse bridge tunnel closed"); ce != nil {
+				ce.Write(zap.String("domain", b.domain), zap.Error(err))
+			}
+			session.Close()
+			return
+		}
+
+		go b.handleStream(stream, tcpFunc, udpFunc)
+	}
+}
+
+func (b *Bridge) handleStream(stream *smux.Stream, tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) {
+	ss := &simplesocks.Server{}
+
+	conn, msgConn, target, err := ss.Handshake(stream)
+	if err != nil {
+		if ce := utils.CanLogWarn("reverse bridge stream handshake failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		stream.Close()
+		return
+	}
+
+	if b.hasTarget {
+		network := target.Network
+		target = b.targetAddr
+		target.Network = network
+	}
+
+	if ce := utils.CanLogDebug("reverse bridge got new stream"); ce != nil {
+		ce.Write(zap.String("target", target.String()))
+	}
+
+	if msgConn != nil {
+		if udpFunc == nil {
+			msgConn.Close()
+			return
+		}
+		udpFunc(netLayer.UDPRequestInfo{MsgConn: msgConn, Target: target})
+	} else {
+		tcpFunc(netLayer.TCPRequestInfo{Conn: conn, Target: target})
+	}
+}
@@ -0,0 +1,212 @@
+package reverse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/simplesocks"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/xtaci/smux"
+	"go.uber.org/zap"
+)
+
+var ErrNoTunnel = errors.New("reverse portal has no available tunnel")
+
+func init() {
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+// true
+func (ClientCreator) MultiTransportLayer() bool {
+	return true
+}
+
+func (ClientCreator) URLToDialConf(u *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	if dc == nil {
+		dc = &proxy.DialConf{}
+	}
+	if d := u.Query().Get("domain"); d != "" {
+		if dc.Extra == nil {
+			dc.Extra = make(map[string]any)
+		}
+		dc.Extra["domain"] = d
+	}
+	return dc, nil
+}
+
+// use dc.Extra["domain"]
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	domain, err := getDomainFromExtra(dc.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if dc.Network == "" {
+		dc.Network = netLayer.DualNetworkName
+	}
+
+	return &Portal{
+		domain: domain,
+	}, nil
+}
+
+// Portal 是 反向代理 在 公网端 的 proxy.Client, implements proxy.TunnelClient.
+//
+// Portal 记录 所有 bridge 发来的 隧道, 每次 Handshake 时 随机选一个 可用的隧道, 在其上 打开一个新的 stream.
+type Portal struct {
+	proxy.Base
+
+	domain string
+
+	tunnelMutex sync.RWMutex
+	tunnels     []*smux.Session
+}
+
+func (*Portal) Name() string { return Name }
+
+func (*Portal) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+// true
+func (*Portal) IsSelfDial() bool { return true }
+
+func (p *Portal) IsTunnelTarget(target netLayer.Addr) bool {
+	return target.Name == p.domain
+}
+
+// 可用的 隧道 数量
+func (p *Portal) TunnelCount() int {
+	p.tunnelMutex.RLock()
+	defer p.tunnelMutex.RUnlock()
+	return len(p.tunnels)
+}
+
+func (p *Portal) ServeTunnel(underlay net.Conn, firstPayload []byte) {
+	if len(firstPayload) > 0 {
+		underlay = &netLayer.ReadWrapper{
+			Conn:              underlay,
+			OptionalReader:    bytes.NewReader(firstPayload),
+			RemainFirstBufLen: len(firstPayload),
+		}
+	}
+
+	session := p.GetServerInnerMuxSession(underlay)
+	if session == nil {
+		return
+	}
+
+	p.tunnelMutex.Lock()
+	p.tunnels = append(p.tunnels, session)
+	p.tunnelMutex.Unlock()
+
+	if ce := utils.CanLogInfo("reverse portal got new tunnel"); ce != nil {
+		ce.Write(zap.String("domain", p.domain), zap.String("from", underlay.RemoteAddr().String()))
+	}
+
+	//portal 只负责 打开 stream, bridge 不应主动打开 stream; 这里 AcceptStream 仅用于 阻塞到 隧道关闭
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			break
+		}
+		stream.Close()
+	}
+	session.Close()
+
+	p.removeTunnel(session)
+
+	if ce := utils.CanLogInfo("reverse portal tunnel closed"); ce != nil {
+		ce.Write(zap.String("domain", p.domain))
+	}
+}
+
+func (p *Portal) removeTunnel(session *smux.Session) {
+	p.tunnelMutex.Lock()
+	defer p.tunnelMutex.Unlock()
+
+	for i, s := range p.tunnels {
+		if s == session {
+			p.tunnels = append(p.tunnels[:i], p.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+// 随机选一个隧道打开 stream, 若打开失败则关闭该隧道并尝试下一个.
+func (p *Portal) openStream() (*smux.Stream, error) {
+	for {
+		p.tunnelMutex.RLock()
+		n := len(p.tunnels)
+		var session *smux.Session
+		if n > 0 {
+			session = p.tunnels[rand.Intn(n)]
+		}
+		p.tunnelMutex.RUnlock()
+
+		if session == nil {
+			return nil, ErrNoTunnel
+		}
+
+		stream, err := session.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+
+		if ce := utils.CanLogDebug("reverse portal open stream failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		session.Close()
+		p.removeTunnel(session)
+	}
+}
+
+// underlay 不会被使用, 一般为nil
+func (p *Portal) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	stream, err := p.openStream()
+	if err != nil {
+		return nil, err
+	}
+	ssc := &simplesocks.Client{}
+	wrc, err := ssc.Handshake(stream, firstPayload, target)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return wrc, nil
+}
+
+// underlay 不会被使用, 一般为nil
+func (p *Portal) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	stream, err := p.openStream()
+	if err != nil {
+		return nil, err
+	}
+	ssc := &simplesocks.Client{}
+	ssc.IsFullcone = p.IsFullcone
+	mc, err := ssc.EstablishUDPChannel(stream, firstPayload, target)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+func (p *Portal) Stop() {
+	p.tunnelMutex.Lock()
+	for _, s := range p.tunnels {
+		s.Close()
+	}
+	p.tunnels = nil
+	p.tunnelMutex.Unlock()
+
+	p.Base.Stop()
+}
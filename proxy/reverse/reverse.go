@@ -0,0 +1,99 @@
+/*
+Package reverse implements reverse proxy (portal/bridge) for proxy.Server and proxy.Client.
+
+反向代理用于将 位于 NAT 后面的 内网服务 通过一个公网的 vs 服务端 暴露出去。
+
+# 角色
+
+bridge 位于内网, 是一个 proxy.ListenerServer, 它并不监听任何端口, 而是主动向 portal 拨号。
+拨号时请求的目标地址为 配置的 隧道域名 (extra.domain), 该请求和普通请求一样经过 bridge 的分流, 发往指向 portal 的 dial。
+连接建立后, bridge 在该连接上建立 smux (复用 proxy.Base.GetClientInnerMuxSession), 然后不断 Accept portal 发来的 stream,
+每个 stream 内部使用 simplesocks 协议 给出真实目标, 之后再交由 bridge 的分流进行处理 (一般是direct 到内网服务)。
+若配置了 target, 则 bridge 会忽略 portal 给出的目标, 一律发往 target。
+
+portal 位于公网, 是一个 proxy.Client, 实现了 proxy.TunnelClient。
+portal 所在的 vs 要配置一条分流规则, 将 隧道域名 分流到 portal 的 tag; 这样 bridge 发来的隧道连接 就会被 portal 记录下来。
+之后, 任何被分流到 portal 的请求 (比如 来自某个公网 dokodemo 监听的请求), 都会通过 隧道 发往 bridge。
+
+可配置多个 portal/bridge 对, 每对使用不同的 隧道域名 和 tag, 通过 域名分流 来决定 哪个 bridge 处理哪个请求。
+
+# Config
+
+bridge 端:
+
+	[[listen]]
+	protocol = "reverse"
+	tag = "bridge"
+	extra = { domain = "bridge1.reverse" }
+
+	[[dial]]
+	tag = "toPortal"
+	protocol = "vlesss"
+	# ...
+
+	[[route]]
+	domain = ["full:bridge1.reverse"]
+	toTag = "toPortal"
+
+	[[route]]
+	fromTag = ["bridge"]
+	toTag = "direct"
+
+portal 端:
+
+	[[listen]]
+	protocol = "vlesss"
+	# ...
+
+	[[listen]]
+	tag = "public"
+	protocol = "dokodemo"
+	port = 8080
+	target = "tcp://127.0.0.1:80"
+
+	[[dial]]
+	protocol = "reverse"
+	tag = "portal"
+	extra = { domain = "bridge1.reverse" }
+
+	[[route]]
+	domain = ["full:bridge1.reverse"]
+	toTag = "portal"
+
+	[[route]]
+	fromTag = ["public"]
+	toTag = "portal"
+*/
+package reverse
+
+import (
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	Name = "reverse"
+
+	//隧道请求 所使用的端口, 只是为了 让 Addr 合法, 实际不会被使用
+	tunnelPort = 443
+)
+
+// 从 extra 中读取 隧道域名
+func getDomainFromExtra(extra map[string]any) (string, error) {
+	if len(extra) > 0 {
+		if thing := extra["domain"]; thing != nil {
+			if str, ok := thing.(string); ok && str != "" {
+				return str, nil
+			}
+		}
+	}
+	return "", utils.ErrInErr{ErrDesc: "reverse requires extra.domain", ErrDetail: utils.ErrInvalidData}
+}
+
+func tunnelAddr(domain string) netLayer.Addr {
+	return netLayer.Addr{
+		Network: "tcp",
+		Name:    domain,
+		Port:    tunnelPort,
+	}
+}
@@ -0,0 +1,78 @@
+package reverse_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/reverse"
+)
+
+func TestReverseTCP(t *testing.T) {
+	const domain = "bridge1.reverse"
+
+	c, err := proxy.NewClient(&proxy.DialConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: reverse.Name,
+			Extra:    map[string]any{"domain": domain},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	portal := c.(*reverse.Portal)
+	defer portal.Stop()
+
+	s, err := proxy.NewServer(&proxy.ListenConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: reverse.Name,
+			Extra:    map[string]any{"domain": domain},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge := s.(proxy.ListenerServer)
+
+	//模拟 vs 的分流: 隧道请求 交给 portal, 其它请求 echo 回去
+	closer := bridge.StartListen(func(info netLayer.TCPRequestInfo) {
+		if portal.IsTunnelTarget(info.Target) {
+			portal.ServeTunnel(info.Conn, nil)
+			return
+		}
+		if info.Target.Name != "internal.service" || info.Target.Port != 80 {
+			t.Log("wrong target", info.Target.String())
+			info.Conn.Close()
+			return
+		}
+		io.Copy(info.Conn, info.Conn)
+		info.Conn.Close()
+	}, nil)
+	defer closer.Close()
+
+	for i := 0; portal.TunnelCount() == 0; i++ {
+		if i > 100 {
+			t.Fatal("tunnel not established")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	hello := []byte("hello reverse")
+
+	wrc, err := portal.Handshake(nil, hello, netLayer.Addr{Network: "tcp", Name: "internal.service", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrc.Close()
+
+	buf := make([]byte, len(hello))
+	if _, err = io.ReadFull(wrc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, hello) {
+		t.Fatal("not equal", string(buf))
+	}
+}
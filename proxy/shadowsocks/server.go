@@ -168,79 +168,97 @@ func (m *Server) removeUDPByHash(hash netLayer.HashableAddr) {
 
 // 非阻塞
 func (s *Server) StartListen(_ func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) io.Closer {
-	uc, err := net.ListenUDP("udp", s.LUA)
-	if err != nil {
-		log.Panicln("shadowsocks listen udp failed", err)
+	var closers []io.Closer
+
+	//监听 多个 地址 时, 每个 socket 各自 读取, 回包 时 从 收到 的 那个 socket 发出
+	for i, a := range s.GetListenAddrs() {
+		lua := s.LUA
+		if i > 0 {
+			var err error
+			lua, err = net.ResolveUDPAddr("udp", a)
+			if err != nil {
+				log.Panicln("shadowsocks resolve udp listen addr failed", err)
+			}
+		}
+		uc, err := net.ListenUDP("udp", lua)
+		if err != nil {
+			log.Panicln("shadowsocks listen udp failed", err)
+		}
+		closers = append(closers, uc)
+
+		if ce := utils.CanLogInfo("shadowsocks listening udp"); ce != nil {
+			ce.Write(zap.String("listen addr", lua.String()))
+		}
+		go s.loopReadUDP(s.cipher.PacketConn(uc), udpFunc)
 	}
-	pc := s.cipher.PacketConn(uc)
 
-	if ce := utils.CanLogInfo("shadowsocks listening udp"); ce != nil {
-		ce.Write(zap.String("listen addr", s.LUA.String()))
+	if len(closers) == 1 {
+		return closers[0]
 	}
-	//逻辑完全类似tproxy，使用一个map存储不同终端的链接
-	go func() {
+	return &utils.MultiCloser{Closers: closers}
+}
 
-		for {
-			bs := utils.GetPacket()
+// 阻塞, 直到 pc 被关闭
+func (s *Server) loopReadUDP(pc net.PacketConn, udpFunc func(netLayer.UDPRequestInfo)) {
+	//逻辑完全类似tproxy，使用一个map存储不同终端的链接
+	for {
+		bs := utils.GetPacket()
 
-			n, addr, err := pc.ReadFrom(bs)
-			if err != nil {
-				return
+		n, addr, err := pc.ReadFrom(bs)
+		if err != nil {
+			return
+		}
+		ad, err := netLayer.NewAddrFromAny(addr)
+		if err != nil {
+			if ce := utils.CanLogWarn("shadowsocks GetAddrFrom err"); ce != nil {
+				ce.Write(zap.Error(err))
 			}
-			ad, err := netLayer.NewAddrFromAny(addr)
-			if err != nil {
-				if ce := utils.CanLogWarn("shadowsocks GetAddrFrom err"); ce != nil {
-					ce.Write(zap.Error(err))
-				}
-				return
+			return
+		}
+		hash := ad.GetHashable()
+
+		s.m.RLock()
+		conn, found := s.udpMsgConnMap[hash]
+		s.m.RUnlock()
+
+		if !found {
+			conn = &serverMsgConn{
+				raddr:         addr,
+				ourPacketConn: pc,
+				readChan:      make(chan netLayer.AddrData, 5),
+				closeChan:     make(chan struct{}),
+				server:        s,
+				hash:          hash,
+				User:          s.mp,
 			}
-			hash := ad.GetHashable()
-
-			s.m.RLock()
-			conn, found := s.udpMsgConnMap[hash]
-			s.m.RUnlock()
-
-			if !found {
-				conn = &serverMsgConn{
-					raddr:         addr,
-					ourPacketConn: pc,
-					readChan:      make(chan netLayer.AddrData, 5),
-					closeChan:     make(chan struct{}),
-					server:        s,
-					hash:          hash,
-					User:          s.mp,
-				}
-				conn.InitEasyDeadline()
-
-				s.m.Lock()
-				s.udpMsgConnMap[hash] = conn
-				s.m.Unlock()
+			conn.InitEasyDeadline()
 
-			}
+			s.m.Lock()
+			s.udpMsgConnMap[hash] = conn
+			s.m.Unlock()
 
-			readbuf := bytes.NewBuffer(bs[:n])
+		}
 
-			destAddr, err := GetAddrFrom(readbuf)
-			if err != nil {
-				if ce := utils.CanLogWarn("shadowsocks GetAddrFrom err"); ce != nil {
-					ce.Write(zap.Error(err))
-				}
-				continue
+		readbuf := bytes.NewBuffer(bs[:n])
+
+		destAddr, err := GetAddrFrom(readbuf)
+		if err != nil {
+			if ce := utils.CanLogWarn("shadowsocks GetAddrFrom err"); ce != nil {
+				ce.Write(zap.Error(err))
 			}
-			destAddr.Network = "udp"
+			continue
+		}
+		destAddr.Network = "udp"
 
-			conn.readChan <- netLayer.AddrData{Data: readbuf.Bytes(), Addr: destAddr}
+		conn.readChan <- netLayer.AddrData{Data: readbuf.Bytes(), Addr: destAddr}
 
-			if !found {
-
-				go udpFunc(netLayer.UDPRequestInfo{
-					MsgConn: conn, Target: destAddr,
-				})
-			}
+		if !found {
 
+			go udpFunc(netLayer.UDPRequestInfo{
+				MsgConn: conn, Target: destAddr,
+			})
 		}
 
-	}()
-	return uc
+	}
 
 }
@@ -76,7 +76,11 @@ func prepareTLS_forClient(com BaseInterface, dc *DialConf) error {
 		Extra:        dc.Extra,
 	}
 
-	clic.Tls_c = tlsLayer.NewClient(conf)
+	tlsclient, err := tlsLayer.NewClient(conf)
+	if err != nil {
+		return err
+	}
+	clic.Tls_c = tlsclient
 	return nil
 }
 
@@ -91,10 +95,8 @@ func prepareTLS_forServer(com BaseInterface, lc *ListenConf) error {
 	alpnList := updateAlpnListByAdvLayer(com, lc.Alpn)
 
 	conf := tlsLayer.Conf{
-		Host: lc.Host,
-		CertConf: &tlsLayer.CertConf{
-			CertFile: lc.TLSCert, KeyFile: lc.TLSKey, CA: lc.CA,
-		},
+		Host:     lc.Host,
+		CertConf: lc.GetCertConf(),
 		Tls_type: tlsLayer.StrToType(lc.TlsType),
 
 		Insecure: lc.Insecure,
@@ -118,6 +120,14 @@ func prepareTLS_forServer(com BaseInterface, lc *ListenConf) error {
 	return nil
 }
 
+// use lc.TLSCert, lc.TLSKey, lc.CA, lc.Certs, lc.CertDir
+func (lc *ListenConf) GetCertConf() *tlsLayer.CertConf {
+	return &tlsLayer.CertConf{
+		CertFile: lc.TLSCert, KeyFile: lc.TLSKey, CA: lc.CA,
+		Pairs: lc.Certs, Dir: lc.CertDir,
+	}
+}
+
 func getTlsMinVerFromExtra(extra map[string]any) uint16 {
 	if len(extra) > 0 {
 		if thing := extra["tls_minVersion"]; thing != nil {
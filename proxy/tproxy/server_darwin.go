@@ -46,7 +46,7 @@ func (ServerCreator) AfterCommonConfServer(ps proxy.Server) (err error) {
 	s := ps.(*Server)
 
 	if s.shouldSetRoute {
-		err = tproxy.SetRouteByPort(s.ListenConf.Port)
+		err = tproxy.SetRouteByPort(s.ListenConf.FirstPort())
 	}
 	return
 }
@@ -95,7 +95,7 @@ func (s *Server) StartListen(tcpFunc func(netLayer.TCPRequestInfo), _ func(netLa
 
 	if lt > 0 {
 
-		lis, err := netLayer.ListenAndAccept("tcp", s.Addr, s.Sockopt, 0, func(conn net.Conn) {
+		lis, err := netLayer.ListenAndAccept("tcp", s.Addr, s.Sockopt, 0, nil, func(conn net.Conn) {
 			tcpconn := conn.(*net.TCPConn)
 			ta, err := tproxy.HandshakeTCP(tcpconn)
 			if err != nil {
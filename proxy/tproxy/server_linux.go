@@ -49,7 +49,7 @@ func (ServerCreator) AfterCommonConfServer(ps proxy.Server) (err error) {
 		s.Sockopt = &netLayer.Sockopt{TProxy: true}
 	}
 	if s.shouldSetIPTable {
-		err = tproxy.SetRouteByPort(s.ListenConf.Port)
+		err = tproxy.SetRouteByPort(s.ListenConf.FirstPort())
 	}
 	return
 }
@@ -109,7 +109,7 @@ func (s *Server) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func
 
 	if lt > 0 {
 
-		lis, err := netLayer.ListenAndAccept("tcp", s.Addr, s.Sockopt, 0, func(conn net.Conn) {
+		lis, err := netLayer.ListenAndAccept("tcp", s.Addr, s.Sockopt, 0, nil, func(conn net.Conn) {
 			tcpconn := conn.(*net.TCPConn)
 			targetAddr := tproxy.HandshakeTCP(tcpconn)
 
@@ -235,10 +235,14 @@ func GenerateOfficialDraftShareURL(dialconf *proxy.DialConf) string {
 
 	}
 	if dialconf.AdvancedLayer != "" {
-		q.Add("type", dialconf.AdvancedLayer)
+		if dialconf.AdvancedLayer == "h2" {
+			q.Add("type", "http") //v2ray/xray 把 h2 传输 叫做 http
+		} else {
+			q.Add("type", dialconf.AdvancedLayer)
+		}
 
 		switch dialconf.AdvancedLayer {
-		case "ws":
+		case "ws", "httpupgrade", "splithttp", "h2":
 			if dialconf.Path != "" {
 				q.Add("path", dialconf.Path)
 			}
@@ -246,6 +250,13 @@ func GenerateOfficialDraftShareURL(dialconf *proxy.DialConf) string {
 				q.Add("host", dialconf.Host)
 
 			}
+		case "kcp":
+			if ht, ok := dialconf.Extra["kcp_header"].(string); ok && ht != "" {
+				q.Add("headerType", ht)
+			}
+			if seed, ok := dialconf.Extra["kcp_seed"].(string); ok && seed != "" {
+				q.Add("seed", seed)
+			}
 		case "grpc":
 
 			//该草案并没有提及grpc, 所以实际上不完美。本作trojan也是可以支持grpc、quic的
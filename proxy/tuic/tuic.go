@@ -0,0 +1,322 @@
+/*
+Package tuic implements tuic v5 for proxy.Client and proxy.Server.
+
+tuic 是一个 基于 quic 的代理协议, 它直接使用 quic.Connection, 所以它 不走 vs 的 advLayer, 而是 自己 拨号/监听 quic;
+阻控 的配置 与 advLayer quic 相同, 即 extra.congestion_control = "hy" 等.
+
+# Protocol
+
+见 https://github.com/EAimTY/tuic/blob/dev/SPEC.md
+
+每个命令的头部为 VER(1) TYPE(1), VER 固定为 5:
+
+	Authenticate 0x00: UUID(16) TOKEN(32)	使用 单向流 发送. TOKEN 为 TLS Keying Material Exporter 以 uuid 为 label, password 为 context 导出的 32字节.
+	Connect      0x01: ADDR				使用 双向流 发送, 之后 该流 即为 tcp 数据.
+	Packet       0x02: ASSOC_ID(2) PKT_ID(2) FRAG_TOTAL(1) FRAG_ID(1) SIZE(2) ADDR, 之后为 SIZE 长度的 udp数据.
+	                                    native 模式 使用 quic datagram 发送, quic 模式 则 每个包 使用 一个 单向流 发送.
+	Dissociate   0x03: ASSOC_ID(2)		使用 单向流 发送, 表示 关闭 该 udp 会话.
+	Heartbeat    0x04:					使用 quic datagram 发送, 用于 保活.
+
+ADDR 为 TYPE(1) ADDR PORT(2), TYPE: 0xff 无地址(没有PORT), 0x00 域名(首字节为长度), 0x01 ipv4, 0x02 ipv6.
+
+服务端 在 认证成功之前 不会处理 其它命令, 而是 等待 认证; 因此 客户端 使用 0-RTT 时, 可以 在 握手完成前 就发送 Connect 等命令.
+
+# Config
+
+客户端:
+
+	[[dial]]
+	protocol = "tuic"
+	uuid = "user:a684455c-b14f-11ea-bf0d-42010aaa0003\npass:mypassword"
+	host = "example.com"
+	port = 443
+	alpn = ["h3"]
+	extra = { udp_relay_mode = "native", heartbeat = 10 }	# udp_relay_mode 可为 native 或 quic, 默认为 native; heartbeat 单位为秒
+
+服务端:
+
+	[[listen]]
+	protocol = "tuic"
+	uuid = "user:a684455c-b14f-11ea-bf0d-42010aaa0003\npass:mypassword"
+	host = "0.0.0.0"
+	port = 443
+	cert = "cert.pem"
+	key = "cert.key"
+	users = [ {user = "2c1a35d4-2c32-4b3c-84e6-1b8a4ac0b6c3", pass = "password2"} ]
+
+两端 都可以 设置 early = true 以 开启 0-RTT.
+*/
+package tuic
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	Name = "tuic"
+
+	Version byte = 5
+)
+
+const (
+	CmdAuthenticate byte = iota
+	CmdConnect
+	CmdPacket
+	CmdDissociate
+	CmdHeartbeat
+)
+
+const (
+	addrTypeDomain byte = 0x00
+	addrTypeIPv4   byte = 0x01
+	addrTypeIPv6   byte = 0x02
+	addrTypeNone   byte = 0xff
+)
+
+const (
+	UDPRelayModeNative = "native"
+	UDPRelayModeQuic   = "quic"
+
+	DefaultHeartbeat = time.Second * 10
+
+	tokenLen = 32
+
+	//Packet 命令中 ADDR之前 的 固定长度部分: VER TYPE ASSOC_ID PKT_ID FRAG_TOTAL FRAG_ID SIZE
+	packetFixedHeaderLen = 2 + 2 + 2 + 1 + 1 + 2
+
+	//一个 datagram 的 最大长度. quic-go 所允许的 datagram frame 最大为 1200, 我们留一些余量.
+	maxDatagramLen = 1150
+
+	authTimeout = time.Second * 3
+)
+
+var (
+	ErrVersion = errors.New("tuic version not supported")
+	ErrAuth    = errors.New("tuic authentication failed")
+)
+
+// 依照 tuic 的格式 写入 地址. 若 addr 为空, 写入 addrTypeNone.
+func writeAddr(buf []byte, addr *netLayer.Addr) []byte {
+	if addr == nil || (addr.Name == "" && len(addr.IP) == 0) {
+		return append(buf, addrTypeNone)
+	}
+	abs, atyp := addr.AddressBytes()
+
+	buf = append(buf, v2rayAtypToTuic(atyp))
+	buf = append(buf, abs...)
+	return binary.BigEndian.AppendUint16(buf, uint16(addr.Port))
+}
+
+// v2ray 的 atyp 中 ipv4为1, 域名为2, ipv6为3; 而 tuic 中 域名为0, ipv4为1, ipv6为2
+func v2rayAtypToTuic(atyp byte) byte {
+	switch atyp {
+	case netLayer.AtypIP4:
+		return addrTypeIPv4
+	case netLayer.AtypIP6:
+		return addrTypeIPv6
+	default:
+		return addrTypeDomain
+	}
+}
+
+func addrLen(addr *netLayer.Addr) int {
+	if addr == nil || (addr.Name == "" && len(addr.IP) == 0) {
+		return 1
+	}
+	if addr.IP != nil {
+		if addr.IP.To4() != nil {
+			return 1 + net.IPv4len + 2
+		}
+		return 1 + net.IPv6len + 2
+	}
+	return 1 + 1 + len(addr.Name) + 2
+}
+
+// 读取 tuic 格式的 地址; 若为 addrTypeNone, 返回 空地址.
+func readAddr(r io.Reader) (addr netLayer.Addr, err error) {
+	var b [1]byte
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		return
+	}
+
+	switch b[0] {
+	case addrTypeNone:
+		return
+	case addrTypeDomain:
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		if b[0] == 0 {
+			err = utils.ErrInErr{ErrDesc: "tuic got domain with length 0", ErrDetail: utils.ErrInvalidData}
+			return
+		}
+		bs := make([]byte, b[0])
+		if _, err = io.ReadFull(r, bs); err != nil {
+			return
+		}
+		addr.Name = string(bs)
+	case addrTypeIPv4:
+		addr.IP = make(net.IP, net.IPv4len)
+		if _, err = io.ReadFull(r, addr.IP); err != nil {
+			return
+		}
+	case addrTypeIPv6:
+		addr.IP = make(net.IP, net.IPv6len)
+		if _, err = io.ReadFull(r, addr.IP); err != nil {
+			return
+		}
+	default:
+		err = utils.ErrInErr{ErrDesc: "tuic got unknown address type", ErrDetail: utils.ErrInvalidData, Data: b[0]}
+		return
+	}
+
+	var pb [2]byte
+	if _, err = io.ReadFull(r, pb[:]); err != nil {
+		return
+	}
+	addr.Port = int(binary.BigEndian.Uint16(pb[:]))
+	return
+}
+
+// 读取 VER TYPE
+func readHeader(r io.Reader) (cmd byte, err error) {
+	var bs [2]byte
+	if _, err = io.ReadFull(r, bs[:]); err != nil {
+		return
+	}
+	if bs[0] != Version {
+		err = utils.ErrInErr{ErrDesc: "tuic header", ErrDetail: ErrVersion, Data: bs[0]}
+		return
+	}
+	return bs[1], nil
+}
+
+// 一个 Packet 命令 (的一个分片)
+type packet struct {
+	assocID   uint16
+	pktID     uint16
+	fragTotal uint8
+	fragID    uint8
+	addr      netLayer.Addr
+	data      []byte
+}
+
+// 写入 Packet 命令 的 头部与数据
+func (p *packet) appendTo(buf []byte) []byte {
+	buf = append(buf, Version, CmdPacket)
+	buf = binary.BigEndian.AppendUint16(buf, p.assocID)
+	buf = binary.BigEndian.AppendUint16(buf, p.pktID)
+	buf = append(buf, p.fragTotal, p.fragID)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(p.data)))
+	buf = writeAddr(buf, &p.addr)
+	return append(buf, p.data...)
+}
+
+// 读取 Packet 命令 VER TYPE 之后的部分
+func readPacket(r io.Reader) (p packet, err error) {
+	var bs [packetFixedHeaderLen - 2]byte
+	if _, err = io.ReadFull(r, bs[:]); err != nil {
+		return
+	}
+	p.assocID = binary.BigEndian.Uint16(bs[0:])
+	p.pktID = binary.BigEndian.Uint16(bs[2:])
+	p.fragTotal = bs[4]
+	p.fragID = bs[5]
+	size := binary.BigEndian.Uint16(bs[6:])
+
+	if p.fragTotal == 0 || p.fragID >= p.fragTotal {
+		err = utils.ErrInErr{ErrDesc: "tuic packet fragment invalid", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+
+	if p.addr, err = readAddr(r); err != nil {
+		return
+	}
+	if !p.addr.IsEmpty() {
+		p.addr.Network = "udp"
+	}
+
+	p.data = make([]byte, size)
+	_, err = io.ReadFull(r, p.data)
+	return
+}
+
+// 将 udp数据 按 maxLen 分片, 只有 第一个分片 含有 地址. maxLen<=0 表示 不分片.
+func fragment(assocID, pktID uint16, addr netLayer.Addr, data []byte, maxLen int) []packet {
+	if maxLen <= 0 {
+		return []packet{{assocID: assocID, pktID: pktID, fragTotal: 1, addr: addr, data: data}}
+	}
+
+	firstMax := maxLen - packetFixedHeaderLen - addrLen(&addr)
+	restMax := maxLen - packetFixedHeaderLen - 1
+
+	if len(data) <= firstMax {
+		return []packet{{assocID: assocID, pktID: pktID, fragTotal: 1, addr: addr, data: data}}
+	}
+
+	total := 1 + (len(data)-firstMax+restMax-1)/restMax
+
+	ps := make([]packet, 0, total)
+	ps = append(ps, packet{assocID: assocID, pktID: pktID, fragTotal: uint8(total), addr: addr, data: data[:firstMax]})
+	data = data[firstMax:]
+	for i := 1; i < total; i++ {
+		n := restMax
+		if n > len(data) {
+			n = len(data)
+		}
+		ps = append(ps, packet{assocID: assocID, pktID: pktID, fragTotal: uint8(total), fragID: uint8(i), data: data[:n]})
+		data = data[n:]
+	}
+	return ps
+}
+
+// 从 "user:<uuid>\npass:<password>" 格式的 字符串中 读取 tuic 用户
+func getUserFromStr(str string) (uuid utils.UUID, password []byte, err error) {
+	var up utils.UserPass
+	if !up.InitWithStr(str) {
+		err = utils.ErrInErr{ErrDesc: "tuic requires uuid in the form of user:<uuid>\\npass:<password>", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+	return getUser(string(up.UserID), string(up.Password))
+}
+
+func getUser(uuidStr, pass string) (uuid utils.UUID, password []byte, err error) {
+	uuid, err = utils.StrToUUID(uuidStr)
+	if err != nil {
+		err = utils.ErrInErr{ErrDesc: "tuic uuid invalid", ErrDetail: err, Data: uuidStr}
+		return
+	}
+	if pass == "" {
+		err = utils.ErrInErr{ErrDesc: "tuic requires password", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+	return uuid, []byte(pass), nil
+}
+
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// 返回 握手完成 时 关闭的 chan. 只有 0-RTT 的连接 (quic.EarlyConnection) 需要等待, 其它连接 拿到时 握手 就已经完成了.
+func handshakeDone(conn quic.Connection) <-chan struct{} {
+	if ec, ok := conn.(quic.EarlyConnection); ok {
+		return ec.HandshakeComplete().Done()
+	}
+	return closedChan
+}
+
+// 计算 Authenticate 命令中的 TOKEN. 必须在 握手完成后 调用.
+func getToken(conn quic.Connection, uuid []byte, password []byte) ([]byte, error) {
+	cs := conn.ConnectionState().TLS
+	return cs.ExportKeyingMaterial(string(uuid), password, tokenLen)
+}
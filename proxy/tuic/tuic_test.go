@@ -0,0 +1,168 @@
+package tuic_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/tuic"
+)
+
+const testUser = "user:a684455c-b14f-11ea-bf0d-42010aaa0003\npass:tuic_password"
+
+func startServer(t *testing.T, early bool) (port int, closer io.Closer) {
+	port = netLayer.RandPort(true, true, 0)
+
+	s, err := proxy.NewServer(&proxy.ListenConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: tuic.Name,
+			Host:     "127.0.0.1",
+			Port:     port,
+			UUID:     testUser,
+			IsEarly:  early,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closer = s.(proxy.ListenerServer).StartListen(func(info netLayer.TCPRequestInfo) {
+		if info.Target.Name != "example.com" || info.Target.Port != 80 {
+			t.Log("wrong target", info.Target.String())
+			info.Conn.Close()
+			return
+		}
+		io.Copy(info.Conn, info.Conn)
+		info.Conn.Close()
+	}, func(info netLayer.UDPRequestInfo) {
+		for {
+			bs, addr, err := info.ReadMsg()
+			if err != nil {
+				return
+			}
+			info.WriteMsg(bs, addr)
+		}
+	})
+	if closer == nil {
+		t.Fatal("tuic server listen failed")
+	}
+	return
+}
+
+func newClient(t *testing.T, port int, user string, extra map[string]any, early bool) proxy.Client {
+	c, err := proxy.NewClient(&proxy.DialConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: tuic.Name,
+			Host:     "127.0.0.1",
+			Port:     port,
+			UUID:     user,
+			Insecure: true,
+			IsEarly:  early,
+			Extra:    extra,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testTCP(t *testing.T, c proxy.Client) {
+	hello := []byte("hello tuic")
+
+	wrc, err := c.Handshake(nil, append([]byte{}, hello...), netLayer.Addr{Network: "tcp", Name: "example.com", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrc.Close()
+	wrc.(net.Conn).SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	buf := make([]byte, len(hello))
+	if _, err = io.ReadFull(wrc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, hello) {
+		t.Fatal("not equal", string(buf))
+	}
+}
+
+func testUDP(t *testing.T, c proxy.Client) {
+	target := netLayer.Addr{Network: "udp", IP: net.IPv4(1, 2, 3, 4), Port: 53}
+
+	mc, err := c.EstablishUDPChannel(nil, []byte("hello udp"), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	mc.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	bs, addr, err := mc.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "hello udp" || addr.Port != 53 || !addr.IP.Equal(target.IP) {
+		t.Fatal("udp echo wrong", string(bs), addr.String())
+	}
+
+	//超过 datagram 大小, native 模式下 会被分片
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	if err = mc.WriteMsg(big, target); err != nil {
+		t.Fatal(err)
+	}
+	bs, _, err = mc.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, big) {
+		t.Fatal("big udp echo wrong", len(bs))
+	}
+}
+
+func TestTCPAndUDP(t *testing.T) {
+	port, closer := startServer(t, false)
+	defer closer.Close()
+
+	for _, mode := range []string{tuic.UDPRelayModeNative, tuic.UDPRelayModeQuic} {
+		t.Run(mode, func(t *testing.T) {
+			c := newClient(t, port, testUser, map[string]any{"udp_relay_mode": mode}, false)
+			defer c.Stop()
+
+			testTCP(t, c)
+			testUDP(t, c)
+		})
+	}
+}
+
+func TestEarly(t *testing.T) {
+	port, closer := startServer(t, true)
+	defer closer.Close()
+
+	c := newClient(t, port, testUser, nil, true)
+	defer c.Stop()
+
+	testTCP(t, c)
+	testTCP(t, c)
+}
+
+func TestWrongPassword(t *testing.T) {
+	port, closer := startServer(t, false)
+	defer closer.Close()
+
+	c := newClient(t, port, "user:a684455c-b14f-11ea-bf0d-42010aaa0003\npass:wrong", nil, false)
+	defer c.Stop()
+
+	wrc, err := c.Handshake(nil, []byte("hello"), netLayer.Addr{Network: "tcp", Name: "example.com", Port: 80})
+	if err != nil {
+		return
+	}
+	defer wrc.Close()
+	wrc.(net.Conn).SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err = wrc.Read(make([]byte, 10)); err == nil {
+		t.Fatal("should fail with wrong password")
+	}
+}
@@ -0,0 +1,350 @@
+package tuic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/zap"
+)
+
+const (
+	fragTimeout = time.Second * 10
+
+	maxPendingFrags = 256
+)
+
+// 一个 未完成的 分片 包
+type fragBuf struct {
+	parts    [][]byte
+	received int
+	addr     netLayer.Addr
+	start    time.Time
+}
+
+/*
+udpRelay 管理 一个 quic.Connection 上的 所有 udp 会话, 客户端 和 服务端 共用.
+
+native 模式下 使用 quic datagram 发送 Packet 命令, 超过 maxDatagramLen 的包 会被 分片;
+quic 模式下 每个包 都使用 一个 单向流 发送, 不分片.
+
+客户端 的模式 由配置决定; 服务端 则对 每个会话 使用 与 客户端 相同的模式 回复.
+*/
+type udpRelay struct {
+	conn     quic.Connection
+	quicMode bool //仅 客户端 使用
+	isClient bool
+	fullcone bool
+
+	mutex    sync.Mutex
+	sessions map[uint16]*udpSession
+	frags    map[uint32]*fragBuf
+
+	nextAssocID uint32
+	nextPktID   uint32
+
+	//服务端 收到 未知 ASSOC_ID 的包时 调用, 用于 新建会话; 客户端 为 nil.
+	onNewSession func(*udpSession, netLayer.Addr)
+}
+
+func newUDPRelay(conn quic.Connection, quicMode, isClient, fullcone bool) *udpRelay {
+	return &udpRelay{
+		conn:     conn,
+		quicMode: quicMode,
+		isClient: isClient,
+		fullcone: fullcone,
+		sessions: make(map[uint16]*udpSession),
+		frags:    make(map[uint32]*fragBuf),
+	}
+}
+
+func (r *udpRelay) newSession(assocID uint16, quicMode bool) *udpSession {
+	s := &udpSession{
+		relay:     r,
+		assocID:   assocID,
+		quicMode:  quicMode,
+		msgChan:   make(chan netLayer.AddrData, 64),
+		closeChan: make(chan struct{}),
+	}
+	s.InitEasyDeadline()
+	r.sessions[assocID] = s
+	return s
+}
+
+// 客户端 新建一个 udp 会话
+func (r *udpRelay) newClientSession() *udpSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for {
+		id := uint16(atomic.AddUint32(&r.nextAssocID, 1))
+		if _, has := r.sessions[id]; !has {
+			return r.newSession(id, r.quicMode)
+		}
+	}
+}
+
+// 发送 一个 udp包
+func (r *udpRelay) sendPacket(assocID uint16, quicMode bool, addr netLayer.Addr, data []byte) error {
+	pktID := uint16(atomic.AddUint32(&r.nextPktID, 1))
+
+	if quicMode {
+		p := fragment(assocID, pktID, addr, data, 0)[0]
+
+		stream, err := r.conn.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write(p.appendTo(make([]byte, 0, packetFixedHeaderLen+addrLen(&addr)+len(data))))
+		stream.Close()
+		return err
+	}
+
+	for _, p := range fragment(assocID, pktID, addr, data, maxDatagramLen) {
+		if err := r.conn.SendMessage(p.appendTo(make([]byte, 0, maxDatagramLen))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 处理 收到的 Packet 命令; 分片 会被 重组 后 再交给 对应的 会话. fromStream 表示 该包 是 quic模式 发来的.
+func (r *udpRelay) handlePacket(p packet, fromStream bool) {
+	r.mutex.Lock()
+
+	data, addr := p.data, p.addr
+
+	if p.fragTotal > 1 {
+		key := uint32(p.assocID)<<16 | uint32(p.pktID)
+		fb := r.frags[key]
+		if fb == nil {
+			if len(r.frags) >= maxPendingFrags {
+				r.trimFrags()
+			}
+			fb = &fragBuf{parts: make([][]byte, p.fragTotal), start: time.Now()}
+			r.frags[key] = fb
+		}
+		if int(p.fragTotal) != len(fb.parts) || fb.parts[p.fragID] != nil {
+			r.mutex.Unlock()
+			return
+		}
+		fb.parts[p.fragID] = p.data
+		fb.received++
+		if p.fragID == 0 {
+			fb.addr = p.addr
+		}
+		if fb.received < len(fb.parts) {
+			r.mutex.Unlock()
+			return
+		}
+		delete(r.frags, key)
+		data, addr = bytes.Join(fb.parts, nil), fb.addr
+	}
+
+	s := r.sessions[p.assocID]
+	if s == nil {
+		if r.onNewSession == nil {
+			r.mutex.Unlock()
+			return
+		}
+		s = r.newSession(p.assocID, fromStream)
+		r.mutex.Unlock()
+
+		r.onNewSession(s, addr)
+	} else {
+		r.mutex.Unlock()
+	}
+
+	select {
+	case s.msgChan <- netLayer.AddrData{Data: data, Addr: addr}:
+	case <-s.closeChan:
+	default:
+		//和 真实的 udp 一样, 读得太慢 就丢包
+	}
+}
+
+// 移除 超时的 分片; 若都没有超时, 则 全部移除.
+func (r *udpRelay) trimFrags() {
+	for k, fb := range r.frags {
+		if time.Since(fb.start) > fragTimeout {
+			delete(r.frags, k)
+		}
+	}
+	if len(r.frags) >= maxPendingFrags {
+		r.frags = make(map[uint32]*fragBuf)
+	}
+}
+
+func (r *udpRelay) handleDissociate(assocID uint16) {
+	r.mutex.Lock()
+	s := r.sessions[assocID]
+	r.mutex.Unlock()
+
+	if s != nil {
+		s.close(false)
+	}
+}
+
+func (r *udpRelay) sendDissociate(assocID uint16) error {
+	stream, err := r.conn.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(binary.BigEndian.AppendUint16([]byte{Version, CmdDissociate}, assocID))
+	stream.Close()
+	return err
+}
+
+// 读取 一个 datagram 中的命令
+func (r *udpRelay) handleDatagram(bs []byte) {
+	rd := bytes.NewReader(bs)
+	cmd, err := readHeader(rd)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case CmdPacket:
+		p, err := readPacket(rd)
+		if err != nil {
+			if ce := utils.CanLogDebug("tuic read datagram packet failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return
+		}
+		r.handlePacket(p, false)
+	case CmdHeartbeat:
+	}
+}
+
+// 阻塞. 循环读取 datagram.
+func (r *udpRelay) loopReadDatagram() {
+	for {
+		bs, err := r.conn.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		r.handleDatagram(bs)
+	}
+}
+
+// 读取 quic模式 下 使用 单向流 发送的 Packet 命令, 或 Dissociate 命令. 头部 已被读取.
+func (r *udpRelay) handleUniStream(cmd byte, stream quic.ReceiveStream) {
+	switch cmd {
+	case CmdPacket:
+		p, err := readPacket(stream)
+		if err != nil {
+			if ce := utils.CanLogDebug("tuic read stream packet failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return
+		}
+		r.handlePacket(p, true)
+
+	case CmdDissociate:
+		var bs [2]byte
+		if _, err := io.ReadFull(stream, bs[:]); err != nil {
+			return
+		}
+		r.handleDissociate(binary.BigEndian.Uint16(bs[:]))
+	}
+}
+
+func (r *udpRelay) closeAll() {
+	r.mutex.Lock()
+	ss := make([]*udpSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		ss = append(ss, s)
+	}
+	r.mutex.Unlock()
+
+	for _, s := range ss {
+		s.close(false)
+	}
+}
+
+// 定时 发送 Heartbeat 命令, 直到 conn 关闭. 阻塞.
+func loopHeartbeat(conn quic.Connection, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.SendMessage([]byte{Version, CmdHeartbeat}); err != nil {
+				return
+			}
+		case <-conn.Context().Done():
+			return
+		}
+	}
+}
+
+// udpSession 是 一个 tuic 的 udp 会话 (association). implements netLayer.MsgConn.
+type udpSession struct {
+	netLayer.EasyDeadline
+
+	relay    *udpRelay
+	assocID  uint16
+	quicMode bool
+
+	msgChan   chan netLayer.AddrData
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *udpSession) ReadMsg() ([]byte, netLayer.Addr, error) {
+	select {
+	case msg := <-s.msgChan:
+		return msg.Data, msg.Addr, nil
+	case <-s.closeChan:
+		return nil, netLayer.Addr{}, io.EOF
+	case <-s.relay.conn.Context().Done():
+		return nil, netLayer.Addr{}, io.EOF
+	case <-s.ReadTimeoutChan():
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *udpSession) WriteMsg(data []byte, peer netLayer.Addr) error {
+	select {
+	case <-s.closeChan:
+		return io.ErrClosedPipe
+	default:
+	}
+	return s.relay.sendPacket(s.assocID, s.quicMode, peer, data)
+}
+
+func (s *udpSession) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return s.Close()
+}
+
+// 客户端 关闭时 会 通知 服务端 Dissociate
+func (s *udpSession) Close() error {
+	s.close(s.relay.isClient)
+	return nil
+}
+
+func (s *udpSession) close(sendDissociate bool) {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+
+		s.relay.mutex.Lock()
+		delete(s.relay.sessions, s.assocID)
+		s.relay.mutex.Unlock()
+
+		if sendDissociate {
+			s.relay.sendDissociate(s.assocID)
+		}
+	})
+}
+
+func (s *udpSession) Fullcone() bool {
+	return s.relay.fullcone
+}
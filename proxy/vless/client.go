@@ -9,6 +9,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
@@ -30,6 +31,18 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 		user: id,
 	}
 
+	if dc.Extra != nil {
+		if flow, ok := dc.Extra["flow"].(string); ok && flow != "" {
+			if flow != FlowVision {
+				return nil, utils.ErrInErr{ErrDesc: "vless flow not supported", ErrDetail: utils.ErrUnImplemented, Data: flow}
+			}
+			if dc.Version != 0 || dc.Mux {
+				return nil, utils.ErrInErr{ErrDesc: "vless flow can only be used in v0 without mux", ErrDetail: utils.ErrInvalidData, Data: flow}
+			}
+			c.flow = flow
+		}
+	}
+
 	v := dc.Version
 	if v > 0 {
 
@@ -82,6 +95,8 @@ type Client struct {
 
 	udp_multi bool
 	use_mux   bool
+
+	flow string //只在 v0 中使用, 目前只支持 FlowVision
 }
 
 func (*Client) GetCreator() proxy.ClientCreator {
@@ -123,12 +138,20 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 	port := target.Port
 	addr, atyp := target.AddressBytes()
 
+	var tlsConn tlsLayer.Conn
+	if c.flow == FlowVision {
+		var ok bool
+		if tlsConn, ok = underlay.(tlsLayer.Conn); !ok {
+			return nil, errVisionNotDirectTLS
+		}
+	}
+
 	var buf *bytes.Buffer
 	if c.use_mux {
-		buf = c.getBufWithCmd(CmdMux)
+		buf = c.getBufWithCmd(CmdMux, "")
 
 	} else {
-		buf = c.getBufWithCmd(CmdTCP)
+		buf = c.getBufWithCmd(CmdTCP, c.flow)
 	}
 
 	buf.WriteByte(byte(uint16(port) >> 8))
@@ -137,7 +160,18 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 	buf.WriteByte(atyp)
 	buf.Write(addr)
 
-	if len(firstPayload) > 0 {
+	var vc *VisionConn
+	if tlsConn != nil {
+		//vision 的 第一个块 总是 和 请求头 一起 发送, 就算 firstPayload 为空
+		vc, err = newVisionConn(nil, tlsConn, c.user, true)
+		if err != nil {
+			utils.PutBuf(buf)
+			return nil, err
+		}
+		vc.pad(buf, firstPayload)
+		utils.PutBytes(firstPayload)
+
+	} else if len(firstPayload) > 0 {
 		buf.Write(firstPayload)
 		utils.PutBytes(firstPayload)
 	}
@@ -167,6 +201,11 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 			uc.mw = mw
 		}
 
+		if vc != nil {
+			vc.Conn = uc
+			return vc, nil
+		}
+
 		return uc, nil
 	} else {
 		return underlay, nil
@@ -176,7 +215,7 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 
 func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
 
-	buf := c.getBufWithCmd(CmdUDP)
+	buf := c.getBufWithCmd(CmdUDP, "") //和 xray 不同, 我们 不会 把 udp 转为 mux.cool, 所以 udp 不使用 flow
 	port := target.Port
 
 	buf.WriteByte(byte(uint16(port) >> 8))
@@ -206,13 +245,20 @@ func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, tar
 
 }
 
-func (c *Client) getBufWithCmd(cmd byte) *bytes.Buffer {
+// flow 只在 v0 中 有效
+func (c *Client) getBufWithCmd(cmd byte, flow string) *bytes.Buffer {
 	v := c.version
 	buf := utils.GetBuf()
 	buf.WriteByte(byte(c.version)) //version
 	buf.Write(c.user[:])
 	if v == 0 {
-		buf.WriteByte(0) //addon length
+		if flow == "" {
+			buf.WriteByte(0) //addon length
+		} else {
+			addon := appendAddonFlow(nil, flow)
+			buf.WriteByte(byte(len(addon)))
+			buf.Write(addon)
+		}
 	} else {
 		switch {
 		default:
@@ -10,6 +10,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"go.uber.org/zap"
 )
@@ -141,6 +142,7 @@ func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLaye
 
 	readbuf := bytes.NewBuffer(readbs[:wholeReadLen])
 	var use_udp_multi bool
+	var flow string
 
 	goto realPart
 
@@ -185,16 +187,21 @@ realPart:
 			return
 		}
 		if addonLenByte != 0 {
-			//v2ray的vless中没有对应的任何处理。
-			//v2ray 的 vless 虽然有一个没用的Flow，但是 EncodeBodyAddons里根本没向里写任何数据。所以理论上正常这部分始终应该为0
-			if ce := utils.CanLogWarn("Vless potential illegal client"); ce != nil {
-				ce.Write(zap.Uint8("addonLenByte", addonLenByte))
-			}
+			//v2ray 的 vless 虽然有一个没用的Flow，但是 EncodeBodyAddons里根本没向里写任何数据。
+			//xray 则会在 addon 中 写入 Flow, 我们 只支持 xtls-rprx-vision
 
-			if tmpbs := readbuf.Next(int(addonLenByte)); len(tmpbs) != int(addonLenByte) {
+			tmpbs := readbuf.Next(int(addonLenByte))
+			if len(tmpbs) != int(addonLenByte) {
 				returnErr = errors.New("vless short read in addon")
 				return
 			}
+			flow, err = parseAddonFlow(tmpbs)
+			if err != nil || (flow != "" && flow != FlowVision) {
+				if ce := utils.CanLogWarn("Vless potential illegal client"); ce != nil {
+					ce.Write(zap.Uint8("addonLenByte", addonLenByte), zap.String("flow", flow), zap.Error(err))
+				}
+				flow = ""
+			}
 		}
 	} else {
 		addonFlagByte, err := readbuf.ReadByte()
@@ -312,6 +319,21 @@ realPart:
 		if mw, ok := underlay.(utils.MultiWriter); ok {
 			uc.mw = mw
 		}
+
+		if flow == FlowVision {
+			tlsConn, ok := underlay.(tlsLayer.Conn)
+			if !ok {
+				returnErr = errVisionNotDirectTLS
+				return
+			}
+			vc, err := newVisionConn(uc, tlsConn, thisUUIDBytes, false)
+			if err != nil {
+				returnErr = err
+				return
+			}
+			return vc, nil, targetAddr, nil
+		}
+
 		return uc, nil, targetAddr, nil
 
 	}
@@ -0,0 +1,498 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+/*
+xtls-rprx-vision 流控, 与 xray 互通. 只用于 vless v0 直接 承载于 tls 之上 的 tcp 请求.
+
+vless 请求头的 addon 中 用 protobuf 写入 Flow 字段 以 标明 使用 vision.
+之后 两个方向的 数据 都会被 分成 若干 块 并 填充:
+
+	[uuid] command(1) contentLen(2) paddingLen(2) content padding
+
+每个方向 的 第一块 前面 有 16字节 的 用户uuid. command 为 0 表示 后面还有块, 为 1 表示 填充结束, 之后的数据 不再 填充,
+为 2 表示 填充结束 且 之后的数据 不再 经过 外层tls 而是 直接 读写 底层tcp连接 (这时就可以 splice了).
+
+只有 探测到 内层流量 为 tls1.3 时 才会 发送 2, 这样 外层tls 和 内层tls 的 衔接处 对 审查者 来说 与 普通的 tls流量 无异.
+探测 clienthello 和 serverhello 使用 tlsLayer.ComSniff.
+*/
+
+const FlowVision = "xtls-rprx-vision"
+
+const (
+	visionCmdContinue byte = iota
+	visionCmdEnd
+	visionCmdDirect
+)
+
+const (
+	visionPacketsToFilter = 8    //与 xray 一样, 最多 探测 前 8 个包 (两个方向 共用)
+	visionMaxBlockLen     = 8192 //xray 的 buf.Size, 一个块(包括uuid) 不超过 这个长度
+	visionHeadLen         = 5
+	visionMaxContentLen   = visionMaxBlockLen - 16 - visionHeadLen
+
+	tls13CipherAES128CCM8 = 0x1305 //内层 使用 这个 套件 时 不 直连, 同xray
+)
+
+var tlsAppDataStart = []byte{0x17, 0x03, 0x03}
+
+// vless v0 的 addon 是 protobuf 编码的 Addons{ string Flow = 1; bytes Seed = 2; }
+func appendAddonFlow(bs []byte, flow string) []byte {
+	bs = append(bs, 0x0a)
+	bs = binary.AppendUvarint(bs, uint64(len(flow)))
+	return append(bs, flow...)
+}
+
+// 从 addon 中 读取 Flow, 忽略 其它 字段.
+func parseAddonFlow(bs []byte) (flow string, err error) {
+	for len(bs) > 0 {
+		tag, n := binary.Uvarint(bs)
+		if n <= 0 {
+			return "", utils.ErrInvalidData
+		}
+		bs = bs[n:]
+
+		switch tag & 7 {
+		case 0: //varint
+			_, n = binary.Uvarint(bs)
+			if n <= 0 {
+				return "", utils.ErrInvalidData
+			}
+			bs = bs[n:]
+		case 2: //length-delimited
+			l, n := binary.Uvarint(bs)
+			if n <= 0 || uint64(len(bs)-n) < l {
+				return "", utils.ErrInvalidData
+			}
+			if tag>>3 == 1 {
+				flow = string(bs[n : n+int(l)])
+			}
+			bs = bs[n+int(l):]
+		default:
+			return "", utils.ErrInvalidData
+		}
+	}
+	return
+}
+
+// 内层流量的 tls 探测 状态, 读写 两个方向 共用.
+type visionFilter struct {
+	mutex sync.Mutex
+
+	remaining int
+
+	clientHello, serverHello         tlsLayer.ComSniff
+	clientHelloDone, serverHelloDone bool
+
+	isTLS          bool
+	isTLS12orAbove bool
+	enableDirect   bool //内层为 tls1.3 时 为 true
+}
+
+func (f *visionFilter) init() {
+	f.remaining = visionPacketsToFilter
+	f.clientHello.LinkPeer(&f.serverHello)
+}
+
+// fromTlsClient 表示 p 是否是 从 内层tls的 客户端 发往 其 服务端 的 数据
+func (f *visionFilter) filter(p []byte, fromTlsClient bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.remaining <= 0 {
+		return
+	}
+	f.remaining--
+
+	if len(p) < 6 || p[0] != 0x16 || p[1] != 3 {
+		return
+	}
+
+	if fromTlsClient {
+		if !f.clientHelloDone && p[5] == 1 {
+			f.clientHelloDone = true
+			f.clientHello.CommonDetect(p, true, true)
+			f.isTLS = !f.clientHello.DefinitelyNotTLS
+		}
+		return
+	}
+
+	if f.serverHelloDone || p[2] != 3 || p[5] != 2 {
+		return
+	}
+	f.serverHelloDone = true
+	f.isTLS = true
+	f.isTLS12orAbove = true
+
+	f.serverHello.CommonDetect(p, false, true)
+	if f.serverHello.HandshakeVersion() == tls.VersionTLS13 {
+		//record头(5) + handshake头(4) + version(2) + random(32) 之后 是 session id 的 长度
+		if len(p) > 43 {
+			if i := 44 + int(p[43]); len(p) >= i+2 {
+				f.enableDirect = binary.BigEndian.Uint16(p[i:]) != tls13CipherAES128CCM8
+			}
+		}
+	}
+	f.remaining = 0
+}
+
+// 返回 isTLS, isTLS12orAbove, enableDirect, remaining
+func (f *visionFilter) state() (bool, bool, bool, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.isTLS, f.isTLS12orAbove, f.enableDirect, f.remaining
+}
+
+// VisionConn 实现 xtls-rprx-vision 的 填充 与 直连.
+//
+// 实现 net.Conn, io.ReaderFrom, utils.User, netLayer.Splicer, netLayer.SpliceReader
+type VisionConn struct {
+	net.Conn //*UserTCPConn, 负责 vless 的 头部
+
+	utils.V2rayUser
+
+	tlsConn tlsLayer.Conn
+	rawConn net.Conn //tlsConn 的 底层连接
+
+	isClient bool
+
+	filter visionFilter
+
+	//写
+
+	writeUUID    bool
+	writePadding bool
+	writeDirect  bool
+
+	//读
+
+	readPadding bool
+	readDirect  bool
+	readBuf     []byte
+	pending     []byte //已解出 但 还没被 Read 取走 的 数据
+
+	remainingCommand, remainingContent, remainingPadding int
+	currentCommand                                       int
+}
+
+// tlsConn 的 外层tls 必须是 tls1.3
+func newVisionConn(uc net.Conn, tlsConn tlsLayer.Conn, user utils.V2rayUser, isClient bool) (*VisionConn, error) {
+	if v := tlsConn.GetVersion(); v != tls.VersionTLS13 {
+		return nil, utils.ErrInErr{ErrDesc: "vless vision requires outer tls 1.3", ErrDetail: utils.ErrInvalidData, Data: v}
+	}
+	raw, input, rawInput := tlsConn.GetRawAndBuffers()
+	if raw == nil || input == nil || rawInput == nil {
+		return nil, utils.ErrInErr{ErrDesc: "vless vision can't get raw conn of tls", ErrDetail: utils.ErrUnImplemented}
+	}
+
+	vc := &VisionConn{
+		Conn:             uc,
+		V2rayUser:        user,
+		tlsConn:          tlsConn,
+		rawConn:          raw,
+		isClient:         isClient,
+		writeUUID:        true,
+		writePadding:     true,
+		readPadding:      true,
+		remainingCommand: -1,
+		remainingContent: -1,
+		remainingPadding: -1,
+	}
+	vc.filter.init()
+	return vc, nil
+}
+
+// 从 tls 的 客户端 发往 服务端 的方向 即 vision 客户端 的 写 方向
+func (c *VisionConn) writeIsFromTlsClient() bool {
+	return c.isClient
+}
+
+// 将 p 填充后 写入 buf. 若 p 过长, 则分成多块, 只有 最后一块 使用 cmd.
+func (c *VisionConn) appendBlocks(buf *bytes.Buffer, p []byte, cmd byte, longPadding bool) {
+	for {
+		thisCmd := cmd
+		content := p
+		if len(content) > visionMaxContentLen {
+			content = content[:visionMaxContentLen]
+			thisCmd = visionCmdContinue
+		}
+		c.appendBlock(buf, content, thisCmd, longPadding)
+
+		p = p[len(content):]
+		if len(p) == 0 {
+			return
+		}
+	}
+}
+
+func (c *VisionConn) appendBlock(buf *bytes.Buffer, content []byte, cmd byte, longPadding bool) {
+	contentLen := len(content)
+
+	var paddingLen int
+	if contentLen < 900 && longPadding {
+		paddingLen = rand.Intn(500) + 900 - contentLen
+	} else {
+		paddingLen = rand.Intn(256)
+	}
+	if max := visionMaxBlockLen - 16 - visionHeadLen - contentLen; paddingLen > max {
+		paddingLen = max
+	}
+
+	if c.writeUUID {
+		c.writeUUID = false
+		buf.Write(c.V2rayUser[:])
+	}
+	buf.WriteByte(cmd)
+	buf.WriteByte(byte(contentLen >> 8))
+	buf.WriteByte(byte(contentLen))
+	buf.WriteByte(byte(paddingLen >> 8))
+	buf.WriteByte(byte(paddingLen))
+	buf.Write(content)
+	buf.Write(make([]byte, paddingLen))
+}
+
+// 探测 p 并将其 填充后 写入 buf, 更新 写 状态.
+func (c *VisionConn) pad(buf *bytes.Buffer, p []byte) {
+	c.filter.filter(p, c.writeIsFromTlsClient())
+
+	isTLS, isTLS12orAbove, enableDirect, remaining := c.filter.state()
+
+	var cmd byte
+	switch {
+	case isTLS && len(p) > 6 && bytes.Equal(p[:3], tlsAppDataStart):
+		//内层tls 握手完毕 (tls1.3 时 这里实际上 还包括 加密后的 握手包, 但 已经 无需 再 填充 了)
+		cmd = visionCmdEnd
+		if enableDirect {
+			cmd = visionCmdDirect
+		}
+	case !isTLS12orAbove && remaining <= 1:
+		//不是 tls, 或者 没探测到 serverhello, 那么 就在 探测结束时 停止 填充
+		cmd = visionCmdEnd
+	default:
+		cmd = visionCmdContinue
+	}
+
+	c.appendBlocks(buf, p, cmd, isTLS)
+
+	switch cmd {
+	case visionCmdEnd:
+		c.writePadding = false
+	case visionCmdDirect:
+		c.writePadding = false
+		c.writeDirect = true
+	}
+}
+
+func (c *VisionConn) Write(p []byte) (int, error) {
+	if c.writeDirect {
+		return c.rawConn.Write(p)
+	}
+	if !c.writePadding {
+		c.filter.filter(p, c.writeIsFromTlsClient())
+		return c.Conn.Write(p)
+	}
+
+	buf := utils.GetBuf()
+	c.pad(buf, p)
+	_, err := c.Conn.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 解开 b 中的 填充, 将 内容 追加到 c.pending.
+func (c *VisionConn) unpad(b []byte) {
+	if c.remainingCommand == -1 && c.remainingContent == -1 && c.remainingPadding == -1 {
+		if len(b) >= 16+visionHeadLen && bytes.Equal(b[:16], c.V2rayUser[:]) {
+			b = b[16:]
+			c.remainingCommand = visionHeadLen
+		} else {
+			c.pending = append(c.pending, b...)
+			return
+		}
+	}
+
+	for len(b) > 0 {
+		switch {
+		case c.remainingCommand > 0:
+			switch c.remainingCommand {
+			case 5:
+				c.currentCommand = int(b[0])
+			case 4:
+				c.remainingContent = int(b[0]) << 8
+			case 3:
+				c.remainingContent |= int(b[0])
+			case 2:
+				c.remainingPadding = int(b[0]) << 8
+			case 1:
+				c.remainingPadding |= int(b[0])
+			}
+			b = b[1:]
+			c.remainingCommand--
+
+		case c.remainingContent > 0:
+			l := c.remainingContent
+			if len(b) < l {
+				l = len(b)
+			}
+			c.pending = append(c.pending, b[:l]...)
+			b = b[l:]
+			c.remainingContent -= l
+
+		default:
+			l := c.remainingPadding
+			if len(b) < l {
+				l = len(b)
+			}
+			b = b[l:]
+			c.remainingPadding -= l
+		}
+
+		if c.remainingCommand <= 0 && c.remainingContent <= 0 && c.remainingPadding <= 0 {
+			if c.currentCommand == int(visionCmdContinue) {
+				c.remainingCommand = visionHeadLen
+			} else {
+				c.remainingCommand = -1
+				c.remainingContent = -1
+				c.remainingPadding = -1
+
+				//不应发生
+				c.pending = append(c.pending, b...)
+				return
+			}
+		}
+	}
+}
+
+// 根据 解填充的 状态 判断 是否 已经 结束填充 或 需要 直连.
+func (c *VisionConn) checkReadCommand() error {
+	if c.remainingCommand > 0 || c.remainingContent > 0 || c.remainingPadding > 0 || c.currentCommand == int(visionCmdContinue) {
+		return nil
+	}
+
+	switch byte(c.currentCommand) {
+	case visionCmdEnd:
+		c.readPadding = false
+	case visionCmdDirect:
+		c.readPadding = false
+		c.readDirect = true
+
+		//外层tls 可能 已经 从 底层连接 读取了 直连的数据, 要取出来
+		_, input, rawInput := c.tlsConn.GetRawAndBuffers()
+		if input.Len() > 0 {
+			l := len(c.pending)
+			c.pending = append(c.pending, make([]byte, input.Len())...)
+			input.Read(c.pending[l:])
+		}
+		if rawInput.Len() > 0 {
+			c.pending = append(c.pending, rawInput.Bytes()...)
+			rawInput.Reset()
+		}
+	default:
+		return utils.ErrInErr{ErrDesc: "vless vision unknown command", ErrDetail: utils.ErrInvalidData, Data: c.currentCommand}
+	}
+	if c.readBuf != nil {
+		utils.PutPacket(c.readBuf)
+		c.readBuf = nil
+	}
+	return nil
+}
+
+func (c *VisionConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.readDirect {
+		return c.rawConn.Read(p)
+	}
+	if !c.readPadding {
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.filter.filter(p[:n], !c.writeIsFromTlsClient())
+		}
+		return n, err
+	}
+
+	if c.readBuf == nil {
+		//要 足够大, 以 一次 读完 一个 tls record, 否则 直连 时 input 中 残留的 填充 会被 当作 数据
+		c.readBuf = utils.GetPacket()
+	}
+
+	for {
+		n, err := c.Conn.Read(c.readBuf)
+		if n > 0 {
+			c.pending = c.pending[:0]
+			c.unpad(c.readBuf[:n])
+			if len(c.pending) > 0 {
+				c.filter.filter(c.pending, !c.writeIsFromTlsClient())
+			}
+			if e := c.checkReadCommand(); e != nil {
+				return 0, e
+			}
+		}
+
+		if len(c.pending) > 0 {
+			n = copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !c.readPadding {
+			return c.Read(p)
+		}
+	}
+}
+
+func (c *VisionConn) Upstream() net.Conn {
+	return c.Conn
+}
+
+func (c *VisionConn) EverPossibleToSpliceRead() bool {
+	return netLayer.IsTCP(c.rawConn) != nil || netLayer.IsUnix(c.rawConn) != nil
+}
+
+// 只有 直连 且 之前 取出的 数据 都被 读完 时 才能 splice
+func (c *VisionConn) CanSpliceRead() (bool, *net.TCPConn, *net.UnixConn) {
+	if c.readDirect && len(c.pending) == 0 {
+		return netLayer.ReturnSpliceRead(c.rawConn)
+	}
+	return false, nil, nil
+}
+
+func (c *VisionConn) EverPossibleToSpliceWrite() bool {
+	return netLayer.IsTCP(c.rawConn) != nil
+}
+
+func (c *VisionConn) CanSpliceWrite() (bool, *net.TCPConn) {
+	if c.writeDirect {
+		if tc := netLayer.IsTCP(c.rawConn); tc != nil {
+			return true, tc
+		}
+	}
+	return false, nil
+}
+
+func (c *VisionConn) ReadFrom(r io.Reader) (written int64, err error) {
+	return netLayer.TryReadFrom_withSplice(c, c, r, func() bool { return c.writeDirect })
+}
+
+var errVisionNotDirectTLS = errors.New("vless vision requires underlay to be tls directly, without any advanced layer")
@@ -0,0 +1,204 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+)
+
+const testVisionUUID = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+
+func TestAddonFlow(t *testing.T) {
+	bs := appendAddonFlow(nil, FlowVision)
+	if flow, err := parseAddonFlow(bs); err != nil || flow != FlowVision {
+		t.Fatal(flow, err)
+	}
+
+	//带有 seed 字段 时 也能 读出 flow
+	bs = append([]byte{0x12, 2, 1, 2}, bs...)
+	if flow, err := parseAddonFlow(bs); err != nil || flow != FlowVision {
+		t.Fatal(flow, err)
+	}
+
+	if _, err := parseAddonFlow([]byte{0x0a, 10, 1}); err == nil {
+		t.Fatal("should fail on short addon")
+	}
+}
+
+// 返回 客户端 和 服务端 的 VisionConn
+func visionPair(t *testing.T, serverTlsConf, clientTlsConf tlsLayer.Conf) (cvc, svc *VisionConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server, err := newServerWithConf(testVisionUUID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsServer, err := tlsLayer.NewServer(serverTlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverResult := make(chan net.Conn, 1)
+	go func() {
+		lc, err := listener.Accept()
+		if err != nil {
+			serverResult <- nil
+			return
+		}
+		tlsConn, err := tlsServer.Handshake(lc)
+		if err != nil {
+			t.Log("server tls handshake failed", err)
+			serverResult <- nil
+			return
+		}
+		wlc, _, target, err := server.Handshake(tlsConn)
+		if err != nil || target.String() != "dummy.com:443" {
+			t.Log("server vless handshake failed", err, target.String())
+			serverResult <- nil
+			return
+		}
+		serverResult <- wlc
+	}()
+
+	client, err := ClientCreator{}.NewClient(&proxy.DialConf{CommonConf: proxy.CommonConf{
+		UUID:  testVisionUUID,
+		Extra: map[string]any{"flow": FlowVision},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsClient, err := tlsLayer.NewClient(clientTlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, err := tlsClient.Handshake(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrc, err := client.Handshake(tlsConn, nil, netLayer.Addr{Name: "dummy.com", Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wlc := <-serverResult
+	if wlc == nil {
+		t.Fatal("server failed")
+	}
+	return wrc.(*VisionConn), wlc.(*VisionConn)
+}
+
+func TestVisionTLSInTLS(t *testing.T) {
+	cvc, svc := visionPair(t, tlsLayer.Conf{}, tlsLayer.Conf{Insecure: true})
+	testVisionTLSInTLS(t, cvc, svc)
+}
+
+// 外层 为 reality 时 也能 切换到 直连
+func TestVisionReality(t *testing.T) {
+	privateKey, publicKey, err := tlsLayer.GenerateRealityKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cvc, svc := visionPair(t, tlsLayer.Conf{
+		Tls_type: tlsLayer.Reality_t,
+		Host:     "www.example.com",
+		Extra:    map[string]any{"reality_private_key": privateKey},
+	}, tlsLayer.Conf{
+		Tls_type: tlsLayer.Reality_t,
+		Host:     "www.example.com",
+		Minver:   tls.VersionTLS13,
+		Maxver:   tls.VersionTLS13,
+		Extra:    map[string]any{"reality_public_key": publicKey},
+	})
+	testVisionTLSInTLS(t, cvc, svc)
+}
+
+func testVisionTLSInTLS(t *testing.T, cvc, svc *VisionConn) {
+	defer cvc.Close()
+	defer svc.Close()
+	cvc.SetDeadline(time.Now().Add(time.Second * 10))
+	svc.SetDeadline(time.Now().Add(time.Second * 10))
+
+	data := bytes.Repeat([]byte("verysimple"), 100*1024)
+
+	//服务端 与 真实的 tls 服务器 之间 用 TryCopy 转发, 以 测试 直连后 的 splice
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetListener.Close()
+	go func() {
+		c, err := targetListener.Accept()
+		if err != nil {
+			return
+		}
+		inner := tls.Server(c, &tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert()})
+		io.CopyN(inner, inner, int64(len(data)))
+		inner.Close()
+	}()
+	tc, err := net.Dial("tcp", targetListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	go netLayer.TryCopy(tc, svc, 0)
+	go netLayer.TryCopy(svc, tc, 0)
+
+	inner := tls.Client(cvc, &tls.Config{InsecureSkipVerify: true})
+	go inner.Write(data)
+
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(inner, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("not equal")
+	}
+
+	if !cvc.writeDirect || !cvc.readDirect || !svc.writeDirect || !svc.readDirect {
+		t.Fatal("vision didn't switch to direct", cvc.writeDirect, cvc.readDirect, svc.writeDirect, svc.readDirect)
+	}
+}
+
+func TestVisionPlain(t *testing.T) {
+	cvc, svc := visionPair(t, tlsLayer.Conf{}, tlsLayer.Conf{Insecure: true})
+	defer cvc.Close()
+	defer svc.Close()
+	cvc.SetDeadline(time.Now().Add(time.Second * 10))
+	svc.SetDeadline(time.Now().Add(time.Second * 10))
+
+	go io.Copy(svc, svc)
+
+	for i := 0; i < 20; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 100+i*1000)
+		if _, err := cvc.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(cvc, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatal("not equal", i)
+		}
+	}
+
+	if cvc.writePadding || cvc.readPadding || cvc.writeDirect || cvc.readDirect {
+		t.Fatal("plain traffic should end padding without direct")
+	}
+}
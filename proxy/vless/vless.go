@@ -76,11 +76,18 @@ func GenerateXrayShareURL(dc *proxy.DialConf) string {
 
 		//}
 	}
+	if flow, ok := dc.Extra["flow"].(string); ok && flow != "" {
+		q.Add("flow", flow)
+	}
 	if dc.AdvancedLayer != "" {
-		q.Add("type", dc.AdvancedLayer)
+		if dc.AdvancedLayer == "h2" {
+			q.Add("type", "http") //v2ray/xray 把 h2 传输 叫做 http
+		} else {
+			q.Add("type", dc.AdvancedLayer)
+		}
 
 		switch dc.AdvancedLayer {
-		case "ws":
+		case "ws", "httpupgrade", "splithttp", "h2":
 			if dc.Path != "" {
 				q.Add("path", dc.Path)
 			}
@@ -88,6 +95,13 @@ func GenerateXrayShareURL(dc *proxy.DialConf) string {
 				q.Add("host", dc.Host)
 
 			}
+		case "kcp":
+			if ht, ok := dc.Extra["kcp_header"].(string); ok && ht != "" {
+				q.Add("headerType", ht)
+			}
+			if seed, ok := dc.Extra["kcp_seed"].(string); ok && seed != "" {
+				q.Add("seed", seed)
+			}
 		case "grpc":
 			if dc.Path != "" {
 				q.Add("serviceName", dc.Path)
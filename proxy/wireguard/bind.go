@@ -0,0 +1,39 @@
+package wireguard
+
+import (
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// reservedBind 在发送时 将 wireguard 消息头中 三个保留字节 设为 指定值, 接收时 再将其清零.
+//
+// 一些 wireguard 服务商 (如 cloudflare warp) 会用这三个字节 来识别客户端.
+type reservedBind struct {
+	conn.Bind
+	reserved [3]byte
+}
+
+func (b *reservedBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i, fn := range fns {
+		fn := fn
+		fns[i] = func(buf []byte) (n int, ep conn.Endpoint, err error) {
+			n, ep, err = fn(buf)
+			if n > 3 {
+				buf[1], buf[2], buf[3] = 0, 0, 0
+			}
+			return
+		}
+	}
+	return fns, actualPort, nil
+}
+
+func (b *reservedBind) Send(buf []byte, ep conn.Endpoint) error {
+	if len(buf) > 3 {
+		copy(buf[1:4], b.reserved[:])
+	}
+	return b.Bind.Send(buf, ep)
+}
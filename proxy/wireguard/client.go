@@ -0,0 +1,273 @@
+package wireguard
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+func init() {
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+// true
+func (ClientCreator) MultiTransportLayer() bool {
+	return true
+}
+
+// 可用的 query: private_key, public_key, endpoint, address, allowed_ips, reserved, mtu, keepalive.
+func (ClientCreator) URLToDialConf(u *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	if dc == nil {
+		dc = &proxy.DialConf{}
+	}
+	if dc.Extra == nil {
+		dc.Extra = make(map[string]any)
+	}
+	q := u.Query()
+	for _, key := range []string{"private_key", "public_key", "endpoint", "address", "allowed_ips", "reserved", "mtu", "keepalive"} {
+		if v := q.Get(key); v != "" {
+			dc.Extra[key] = v
+		}
+	}
+	return dc, nil
+}
+
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	conf, err := getConfFromDialConf(dc)
+	if err != nil {
+		return nil, err
+	}
+
+	if dc.Network == "" {
+		dc.Network = netLayer.DualNetworkName
+	}
+
+	return newClient(conf)
+}
+
+// Client 在 gvisor 协议栈上 运行一个 用户态的 wireguard peer, 所有 tcp/udp 请求都通过 该 wireguard 隧道 发出.
+// implements proxy.SelfDialClient.
+type Client struct {
+	proxy.Base
+
+	dev  *device.Device
+	tnet *netTun
+}
+
+func newClient(conf *Conf) (*Client, error) {
+	tnet, err := newNetTun(conf.Addresses, conf.MTU)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard create netstack failed", ErrDetail: err}
+	}
+
+	var bind conn.Bind = conn.NewDefaultBind()
+	if conf.Reserved != [3]byte{} {
+		bind = &reservedBind{Bind: bind, reserved: conf.Reserved}
+	}
+
+	dev := device.NewDevice(tnet, bind, &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			if ce := utils.CanLogDebug("wireguard"); ce != nil {
+				ce.Write(zap.String("msg", fmt.Sprintf(format, args...)))
+			}
+		},
+		Errorf: func(format string, args ...any) {
+			if ce := utils.CanLogErr("wireguard"); ce != nil {
+				ce.Write(zap.String("msg", fmt.Sprintf(format, args...)))
+			}
+		},
+	})
+
+	if err = dev.IpcSet(conf.uapiString()); err != nil {
+		dev.Close()
+		return nil, utils.ErrInErr{ErrDesc: "wireguard config device failed", ErrDetail: err}
+	}
+	if err = dev.Up(); err != nil {
+		dev.Close()
+		return nil, utils.ErrInErr{ErrDesc: "wireguard device up failed", ErrDetail: err}
+	}
+
+	return &Client{
+		dev:  dev,
+		tnet: tnet,
+	}, nil
+}
+
+func (*Client) Name() string { return Name }
+
+func (*Client) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+// true
+func (*Client) IsSelfDial() bool { return true }
+
+// 若 target 没有ip, 则 在本地 解析域名. 优先使用 隧道支持的 ip版本.
+func (c *Client) resolve(target netLayer.Addr) (netip.AddrPort, error) {
+	if len(target.IP) > 0 {
+		if addr, ok := netip.AddrFromSlice(target.IP); ok {
+			return netip.AddrPortFrom(addr.Unmap(), uint16(target.Port)), nil
+		}
+	}
+	if target.Name == "" {
+		return netip.AddrPort{}, utils.ErrInErr{ErrDesc: "wireguard target has no ip or domain", ErrDetail: utils.ErrInvalidData}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), netLayer.DialTimeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", target.Name)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if (ip.Is4() && c.tnet.hasV4) || (ip.Is6() && c.tnet.hasV6) {
+			return netip.AddrPortFrom(ip, uint16(target.Port)), nil
+		}
+	}
+	return netip.AddrPort{}, errNoSuitableAddress
+}
+
+// underlay 不会被使用, 一般为nil
+func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	ap, err := c.resolve(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), netLayer.DialTimeout)
+	defer cancel()
+
+	tcpConn, err := c.tnet.DialTCP(ctx, ap)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(firstPayload) > 0 {
+		_, err = tcpConn.Write(firstPayload)
+		utils.PutBytes(firstPayload)
+		if err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+	}
+
+	return tcpConn, nil
+}
+
+// underlay 不会被使用, 一般为nil
+func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	ap, err := c.resolve(target)
+	if err != nil {
+		return nil, err
+	}
+
+	uc, err := c.tnet.ListenUDP(ap.Addr().Is6())
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &udpMsgConn{UDPConn: uc, client: c}
+
+	if len(firstPayload) > 0 {
+		_, err = uc.WriteTo(firstPayload, net.UDPAddrFromAddrPort(ap))
+		if err != nil {
+			uc.Close()
+			return nil, err
+		}
+	}
+	return mc, nil
+}
+
+func (c *Client) Stop() {
+	c.dev.Close()
+	c.Base.Stop()
+}
+
+// implements netLayer.MsgConn
+type udpMsgConn struct {
+	*gonet.UDPConn
+	client *Client
+}
+
+func (mc *udpMsgConn) ReadMsg() ([]byte, netLayer.Addr, error) {
+	bs := utils.GetPacket()
+	n, addr, err := mc.ReadFrom(bs)
+	if err != nil {
+		utils.PutPacket(bs)
+		return nil, netLayer.Addr{}, err
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		utils.PutPacket(bs)
+		return nil, netLayer.Addr{}, utils.ErrInvalidData
+	}
+	return bs[:n], netLayer.NewAddrFromUDPAddr(ua), nil
+}
+
+func (mc *udpMsgConn) WriteMsg(p []byte, peer netLayer.Addr) error {
+	ap, err := mc.client.resolve(peer)
+	if err != nil {
+		return err
+	}
+	_, err = mc.WriteTo(p, net.UDPAddrFromAddrPort(ap))
+	return err
+}
+
+func (mc *udpMsgConn) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return mc.Close()
+}
+
+func (mc *udpMsgConn) Fullcone() bool {
+	return mc.client.IsFullcone
+}
+
+// 从 base64 或 hex 格式 转为 wireguard uapi 所使用的 hex 格式
+func keyToHex(key string) (string, error) {
+	if bs, err := base64.StdEncoding.DecodeString(key); err == nil && len(bs) == device.NoisePublicKeySize {
+		return hex.EncodeToString(bs), nil
+	}
+	if bs, err := hex.DecodeString(key); err == nil && len(bs) == device.NoisePublicKeySize {
+		return key, nil
+	}
+	return "", errors.New("wireguard key must be 32 bytes in base64 or hex")
+}
+
+func (conf *Conf) uapiString() string {
+	var sb strings.Builder
+	sb.WriteString("private_key=")
+	sb.WriteString(conf.PrivateKey)
+	sb.WriteString("\npublic_key=")
+	sb.WriteString(conf.PublicKey)
+	if conf.Endpoint != "" {
+		sb.WriteString("\nendpoint=")
+		sb.WriteString(conf.Endpoint)
+	}
+	for _, p := range conf.AllowedIPs {
+		sb.WriteString("\nallowed_ip=")
+		sb.WriteString(p.String())
+	}
+	if conf.KeepAlive > 0 {
+		fmt.Fprintf(&sb, "\npersistent_keepalive_interval=%d", conf.KeepAlive)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
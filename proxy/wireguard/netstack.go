@@ -0,0 +1,214 @@
+package wireguard
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const nicID = 1
+
+var errNoSuitableAddress = errors.New("wireguard netstack has no local address for this ip version")
+
+/*
+netTun 是一个 运行在 gvisor 用户态协议栈上的 wireguard tun.Device.
+
+wireguard 解密后的 ip包 被注入到 gvisor协议栈中, 协议栈 发出的 ip包 则被 wireguard 读取并加密发出;
+这样我们就可以 在协议栈上 直接 拨号 tcp/udp, 而无需创建系统的 tun设备.
+
+参考了 golang.zx2c4.com/wireguard/tun/netstack, 因为其所依赖的 gvisor 版本 与 我们的不同, 所以无法直接使用.
+*/
+type netTun struct {
+	ep     *channel.Endpoint
+	stack  *stack.Stack
+	events chan tun.Event
+
+	incomingPacket chan *bufferv2.View
+	closeChan      chan struct{}
+	closeOnce      sync.Once
+
+	mtu          int
+	hasV4, hasV6 bool
+}
+
+func newNetTun(localAddresses []netip.Addr, mtu int) (*netTun, error) {
+	t := &netTun{
+		ep: channel.New(1024, uint32(mtu), ""),
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+			HandleLocal:        true,
+		}),
+		events:         make(chan tun.Event, 10),
+		incomingPacket: make(chan *bufferv2.View),
+		closeChan:      make(chan struct{}),
+		mtu:            mtu,
+	}
+	t.ep.AddNotify(t)
+
+	if err := t.stack.CreateNIC(nicID, t.ep); err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	for _, ip := range localAddresses {
+		var pn tcpip.NetworkProtocolNumber
+		if ip.Is4() {
+			pn = ipv4.ProtocolNumber
+			t.hasV4 = true
+		} else {
+			pn = ipv6.ProtocolNumber
+			t.hasV6 = true
+		}
+		if err := t.stack.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+			Protocol:          pn,
+			AddressWithPrefix: tcpip.Address(ip.AsSlice()).WithPrefix(),
+		}, stack.AddressProperties{}); err != nil {
+			return nil, errors.New(err.String())
+		}
+	}
+	if t.hasV4 {
+		t.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nicID})
+	}
+	if t.hasV6 {
+		t.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: nicID})
+	}
+
+	t.events <- tun.EventUp
+	return t, nil
+}
+
+func (t *netTun) Name() (string, error) { return "vs_wireguard", nil }
+
+func (t *netTun) File() *os.File { return nil }
+
+func (t *netTun) Events() chan tun.Event { return t.events }
+
+func (t *netTun) MTU() (int, error) { return t.mtu, nil }
+
+func (t *netTun) Flush() error { return nil }
+
+// 由 wireguard 调用, 读取 协议栈 发出的ip包
+func (t *netTun) Read(buf []byte, offset int) (int, error) {
+	select {
+	case view := <-t.incomingPacket:
+		n, err := view.Read(buf[offset:])
+		view.Release()
+		return n, err
+	case <-t.closeChan:
+		return 0, os.ErrClosed
+	}
+}
+
+// 由 wireguard 调用, 将解密后的ip包 注入协议栈
+func (t *netTun) Write(buf []byte, offset int) (int, error) {
+	packet := buf[offset:]
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(packet)})
+	switch packet[0] >> 4 {
+	case 4:
+		t.ep.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case 6:
+		t.ep.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	}
+	pkb.DecRef()
+
+	return len(buf), nil
+}
+
+// implements channel.Notification
+func (t *netTun) WriteNotify() {
+	pkt := t.ep.Read()
+	if pkt.IsNil() {
+		return
+	}
+
+	view := pkt.ToView()
+	pkt.DecRef()
+
+	select {
+	case t.incomingPacket <- view:
+	case <-t.closeChan:
+		view.Release()
+	}
+}
+
+func (t *netTun) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closeChan)
+		t.stack.RemoveNIC(nicID)
+		close(t.events)
+		t.ep.Close()
+	})
+	return nil
+}
+
+func (t *netTun) fullAddr(ap netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	addr := ap.Addr().Unmap()
+
+	var pn tcpip.NetworkProtocolNumber
+	if addr.Is4() {
+		if !t.hasV4 {
+			return tcpip.FullAddress{}, 0, errNoSuitableAddress
+		}
+		pn = ipv4.ProtocolNumber
+	} else {
+		if !t.hasV6 {
+			return tcpip.FullAddress{}, 0, errNoSuitableAddress
+		}
+		pn = ipv6.ProtocolNumber
+	}
+	return tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(addr.AsSlice()),
+		Port: ap.Port(),
+	}, pn, nil
+}
+
+func (t *netTun) DialTCP(ctx context.Context, ap netip.AddrPort) (net.Conn, error) {
+	fa, pn, err := t.fullAddr(ap)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.DialContextTCP(ctx, t.stack, fa, pn)
+}
+
+// 返回一个未连接的 udp 连接, 可以向 任意 同ip版本的地址 发送数据.
+func (t *netTun) ListenUDP(isV6 bool) (*gonet.UDPConn, error) {
+	pn := ipv4.ProtocolNumber
+	if isV6 {
+		if !t.hasV6 {
+			return nil, errNoSuitableAddress
+		}
+		pn = ipv6.ProtocolNumber
+	} else if !t.hasV4 {
+		return nil, errNoSuitableAddress
+	}
+	return gonet.DialUDP(t.stack, nil, nil, pn)
+}
+
+func (t *netTun) ListenTCP(ap netip.AddrPort) (net.Listener, error) {
+	fa, pn, err := t.fullAddr(ap)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.ListenTCP(t.stack, fa, pn)
+}
@@ -0,0 +1,178 @@
+/*
+Package wireguard implements a wireguard proxy.Client on top of gvisor netstack.
+
+wireguard 是一个 用户态的 wireguard peer, 它不需要创建 系统tun设备, 而是 在 gvisor 用户态协议栈 上 拨号 tcp/udp,
+这样就可以把 wireguard 出口 (如 商用的 wireguard vpn, warp 等) 作为 普通的 dial 使用, 参与分流.
+
+注意, 域名 是 在本地 解析的, 而不是 通过 隧道 解析.
+
+# Config
+
+	[[dial]]
+	tag = "wg"
+	protocol = "wireguard"
+	host = "engage.cloudflareclient.com"	# endpoint 地址, 也可以用 extra.endpoint 指定
+	port = 2408
+	extra = { private_key = "...", public_key = "...", address = ["172.16.0.2/32", "fd01::2/128"], allowed_ips = ["0.0.0.0/0", "::/0"], reserved = [1,2,3], mtu = 1280, keepalive = 25 }
+
+private_key 为本地私钥, public_key 为 对端公钥, 均可为 base64 或 hex 格式.
+
+address 为 本地在隧道中的 ip 地址, 必须给出. allowed_ips 默认为 全部地址.
+
+reserved 为 wireguard 消息头中 三个保留字节 的值, 可为 [1,2,3] 或 "1,2,3" 的形式, 默认为 全0.
+
+mtu 默认为 1420.
+*/
+package wireguard
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	Name = "wireguard"
+
+	DefaultMTU = 1420
+)
+
+// wireguard 的配置, 由 DialConf.Extra 得到
+type Conf struct {
+	PrivateKey string //hex
+	PublicKey  string //hex
+	Endpoint   string //ip:port
+
+	Addresses  []netip.Addr
+	AllowedIPs []netip.Prefix
+
+	Reserved  [3]byte
+	MTU       int
+	KeepAlive int
+}
+
+func getConfFromDialConf(dc *proxy.DialConf) (conf *Conf, err error) {
+	extra := dc.Extra
+	if extra == nil {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard requires extra config", ErrDetail: utils.ErrNilParameter}
+	}
+
+	conf = &Conf{
+		MTU: DefaultMTU,
+	}
+
+	pk, _ := extra["private_key"].(string)
+	if conf.PrivateKey, err = keyToHex(pk); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard private_key invalid", ErrDetail: err}
+	}
+	pub, _ := extra["public_key"].(string)
+	if conf.PublicKey, err = keyToHex(pub); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard public_key invalid", ErrDetail: err}
+	}
+
+	endpoint, _ := extra["endpoint"].(string)
+	if endpoint == "" {
+		endpoint = dc.GetAddrStr()
+	}
+	ua, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard endpoint invalid", ErrDetail: err, Data: endpoint}
+	}
+	ap := ua.AddrPort()
+	conf.Endpoint = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String() //否则 ipv4 会被当作 ipv6 发送
+
+	addrs, ok := utils.AnyToStringArray(extra["address"])
+	if !ok || len(addrs) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "wireguard requires address", ErrDetail: utils.ErrInvalidData}
+	}
+	for _, s := range addrs {
+		var addr netip.Addr
+		if strings.Contains(s, "/") {
+			var p netip.Prefix
+			p, err = netip.ParsePrefix(s)
+			addr = p.Addr()
+		} else {
+			addr, err = netip.ParseAddr(s)
+		}
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "wireguard address invalid", ErrDetail: err, Data: s}
+		}
+		conf.Addresses = append(conf.Addresses, addr)
+	}
+
+	allowed, _ := utils.AnyToStringArray(extra["allowed_ips"])
+	if len(allowed) == 0 {
+		allowed = []string{"0.0.0.0/0", "::/0"}
+	}
+	for _, s := range allowed {
+		var p netip.Prefix
+		p, err = netip.ParsePrefix(s)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "wireguard allowed_ips invalid", ErrDetail: err, Data: s}
+		}
+		conf.AllowedIPs = append(conf.AllowedIPs, p)
+	}
+
+	if thing := extra["reserved"]; thing != nil {
+		if conf.Reserved, err = getReserved(thing); err != nil {
+			return nil, err
+		}
+	}
+
+	if thing := extra["mtu"]; thing != nil {
+		if mtu, ok := utils.AnyToInt64(thing); ok && mtu > 0 {
+			conf.MTU = int(mtu)
+		}
+	}
+	if thing := extra["keepalive"]; thing != nil {
+		if ka, ok := utils.AnyToInt64(thing); ok && ka > 0 {
+			conf.KeepAlive = int(ka)
+		}
+	}
+
+	return conf, nil
+}
+
+func getReserved(thing any) (r [3]byte, err error) {
+	var list []int64
+
+	switch value := thing.(type) {
+	case string:
+		for _, s := range strings.Split(value, ",") {
+			var i int
+			i, err = strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return
+			}
+			list = append(list, int64(i))
+		}
+	case []any:
+		for _, v := range value {
+			i, ok := utils.AnyToInt64(v)
+			if !ok {
+				err = utils.ErrInErr{ErrDesc: "wireguard reserved invalid", ErrDetail: utils.ErrInvalidData, Data: value}
+				return
+			}
+			list = append(list, i)
+		}
+	case []int64:
+		list = value
+	}
+
+	if len(list) != 3 {
+		err = utils.ErrInErr{ErrDesc: "wireguard reserved must have 3 bytes", ErrDetail: utils.ErrInvalidData, Data: thing}
+		return
+	}
+	for i, v := range list {
+		if v < 0 || v > 255 {
+			err = utils.ErrInErr{ErrDesc: "wireguard reserved out of range", ErrDetail: utils.ErrInvalidData, Data: v}
+			return
+		}
+		r[i] = byte(v)
+	}
+	return
+}
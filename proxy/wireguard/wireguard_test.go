@@ -0,0 +1,206 @@
+package wireguard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"golang.org/x/crypto/curve25519"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func genKeyPair(t *testing.T) (priv, pub []byte) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		t.Fatal(err)
+	}
+	priv[0] &= 248
+	priv[31] = (priv[31] & 127) | 64
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// 对端 peer, 监听 udp 端口, 在 10.0.0.1 上 运行 tcp 和 udp 的 echo.
+//
+// wireguard-go 将 消息类型 作为 4字节 读取, 所以 对端 也要 使用 reservedBind 以清除 reserved字节.
+func newTestPeer(t *testing.T, priv, peerPub []byte) (*Client, int) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+
+	peer, err := newClient(&Conf{
+		PrivateKey: hex.EncodeToString(priv),
+		PublicKey:  hex.EncodeToString(peerPub),
+		Addresses:  []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+		Reserved:   [3]byte{1, 2, 3},
+		MTU:        DefaultMTU,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.dev.IpcSet(fmt.Sprintf("listen_port=%d\n", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := peer.tnet.ListenTCP(netip.MustParseAddrPort("10.0.0.1:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	uc, err := gonet.DialUDP(peer.tnet.stack, &tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(net.IPv4(10, 0, 0, 1).To4()), Port: 53}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := uc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			uc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return peer, port
+}
+
+func TestWireguard(t *testing.T) {
+	privA, pubA := genKeyPair(t)
+	privB, pubB := genKeyPair(t)
+
+	peer, port := newTestPeer(t, privB, pubA)
+	defer peer.Stop()
+
+	c, err := proxy.NewClient(&proxy.DialConf{
+		CommonConf: proxy.CommonConf{
+			Protocol: Name,
+			IP:       "127.0.0.1",
+			Port:     port,
+			Extra: map[string]any{
+				"private_key": base64.StdEncoding.EncodeToString(privA),
+				"public_key":  hex.EncodeToString(pubB),
+				"address":     "10.0.0.2/32",
+				"allowed_ips": []any{"10.0.0.0/24"},
+				"reserved":    "1,2,3",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	if sdc, ok := c.(proxy.SelfDialClient); !ok || !sdc.IsSelfDial() {
+		t.Fatal("wireguard client should be a SelfDialClient")
+	}
+
+	target := netLayer.Addr{Network: "tcp", IP: net.IPv4(10, 0, 0, 1), Port: 80}
+
+	hello := []byte("hello wireguard")
+
+	rwc, err := c.Handshake(nil, append([]byte{}, hello...), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+
+	if conn, ok := rwc.(net.Conn); ok {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	}
+
+	buf := make([]byte, len(hello))
+	if _, err = io.ReadFull(rwc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, hello) {
+		t.Fatalf("tcp echo mismatch, got %q", buf)
+	}
+
+	rwc.Write([]byte("again"))
+	buf = buf[:5]
+	if _, err = io.ReadFull(rwc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "again" {
+		t.Fatalf("tcp echo mismatch, got %q", buf)
+	}
+
+	udpTarget := netLayer.Addr{Network: "udp", IP: net.IPv4(10, 0, 0, 1), Port: 53}
+
+	mc, err := c.EstablishUDPChannel(nil, []byte("udp1"), udpTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	mc.SetReadDeadline(time.Now().Add(time.Second * 10))
+
+	bs, raddr, err := mc.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "udp1" || raddr.Port != 53 {
+		t.Fatalf("udp echo mismatch, got %q from %v", bs, raddr.String())
+	}
+
+	if err = mc.WriteMsg([]byte("udp2"), udpTarget); err != nil {
+		t.Fatal(err)
+	}
+	bs, _, err = mc.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "udp2" {
+		t.Fatalf("udp echo mismatch, got %q", bs)
+	}
+}
+
+func TestReservedParse(t *testing.T) {
+	for _, thing := range []any{"1,2,3", []any{int64(1), int64(2), int64(3)}, []int64{1, 2, 3}} {
+		r, err := getReserved(thing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != [3]byte{1, 2, 3} {
+			t.Fatal("reserved mismatch", r)
+		}
+	}
+	if _, err := getReserved("1,2"); err == nil {
+		t.Fatal("should fail with 2 bytes")
+	}
+	if _, err := getReserved([]any{int64(1), int64(2), int64(300)}); err == nil {
+		t.Fatal("should fail when out of range")
+	}
+}
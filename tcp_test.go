@@ -4,8 +4,10 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"testing"
 
 	"github.com/e1732a364fed/v2ray_simple"
@@ -185,3 +187,93 @@ func tryGetHttp(t *testing.T, client *http.Client, path string) {
 	}
 
 }
+
+// 一个 ListenConf 监听 多个 端口 和 多个 ip, 共用 同一个 inServer
+func TestTCP_multiPort(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	p1, p2 := netLayer.RandPort(true, false, 0), netLayer.RandPort(true, false, 0)
+	for p2 == p1 {
+		p2 = netLayer.RandPort(true, false, 0)
+	}
+
+	conf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "dokodemo"
+host = "127.0.0.1"
+port = "%d,%d"
+ips = ["127.0.0.2"]
+target = "tcp://%s"
+
+[[dial]]
+protocol = "direct"
+`, p1, p2, echo.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inServer, err := proxy.NewServer(conf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"127.0.0.1:" + strconv.Itoa(p1), "127.0.0.1:" + strconv.Itoa(p2),
+		"127.0.0.2:" + strconv.Itoa(p1), "127.0.0.2:" + strconv.Itoa(p2),
+	}
+	if addrs := inServer.GetBase().GetListenAddrs(); fmt.Sprint(addrs) != fmt.Sprint(want) || inServer.AddrStr() != want[0] {
+		t.Fatal("listen addrs", addrs, inServer.AddrStr())
+	}
+
+	outClient, err := proxy.NewClient(conf.Dial[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closer := v2ray_simple.ListenSer(inServer, outClient, nil, nil)
+	if closer == nil {
+		t.Fatal("ListenSer failed")
+	}
+
+	for _, a := range want {
+		c, err := net.Dial("tcp", a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(a))
+		buf := make([]byte, len(a))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != a {
+			t.Fatal(a, string(buf), err)
+		}
+		c.Close()
+	}
+
+	closer.Close()
+	if c, err := net.Dial("tcp", want[3]); err == nil {
+		c.Close()
+		t.Fatal("all addrs should be closed")
+	}
+
+	//端口 格式 错误
+	if _, err := proxy.LoadStandardConfFromTomlStr("[[listen]]\nport = \"443-80\"\n"); err == nil {
+		t.Fatal("invalid port range should fail")
+	}
+}
@@ -0,0 +1,277 @@
+package tlsLayer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/exp/slices"
+)
+
+/*
+acme 自动证书, 使用 golang.org/x/crypto/acme/autocert.
+
+在 tls 服务端 的 extra 中 配置:
+
+	acme = true
+	acme_domains = ["a.com","b.com"]  # 默认为 host
+	acme_email = "a@b.com"
+	acme_dir = "acme_certs"  # 证书 与 账户密钥 存放 的 目录
+	acme_ca = "https://acme-v02.api.letsencrypt.org/directory"  # 默认 为 Let's Encrypt
+	acme_ca_root = "pebble.minica.pem"  # 可选, 用于 信任 自建的 acme 服务器 (如 pebble)
+	acme_renew_before = 30  # 单位 天, 证书 过期 前 多久 续期
+
+支持 两种 验证方式:
+
+tls-alpn-01 在 tls 端口 上 直接 回答, 即 Server.Handshake 中, 在 分派 给 代理协议 之前 就会 处理掉 acme-tls/1 的 握手.
+
+http-01 则 通过 回落 路径 回答: 80端口 上 的 任意 监听 (非tls) 在 回落 时 若 发现 请求路径 为 /.well-known/acme-challenge/,
+会 调用 ServeAcmeHttp01 来 回复.
+
+配置了 ca 时 普通 连接 仍然 必须 在 握手 时 提供 客户端证书, 只有 acme-tls/1 的 握手 不要求.
+
+证书 存放 在 acme_dir 中, 重启 后 直接 读取, 不会 重新 申请. 续期 在 后台 自动 进行,
+运行中的 Server 通过 GetCertificate 获取 证书, 所以 续期 后 无需 重启 即可 使用 新证书.
+*/
+
+const acmeHttp01PathPrefix = "/.well-known/acme-challenge/"
+
+var ErrAcmeChallengeDone = errors.New("acme tls-alpn-01 challenge answered")
+
+type AcmeConf struct {
+	Domains     []string
+	Email       string
+	Dir         string
+	CA          string
+	CARoot      string
+	RenewBefore time.Duration
+}
+
+// 若 extra 中 未开启 acme, 返回 nil
+func getAcmeConfFromExtra(extra map[string]any, host string) *AcmeConf {
+	if len(extra) == 0 {
+		return nil
+	}
+	if is, ok := utils.AnyToBool(extra["acme"]); !ok || !is {
+		return nil
+	}
+	ac := &AcmeConf{
+		Email:  getStringFromExtra(extra, "acme_email"),
+		Dir:    getStringFromExtra(extra, "acme_dir"),
+		CA:     getStringFromExtra(extra, "acme_ca"),
+		CARoot: getStringFromExtra(extra, "acme_ca_root"),
+	}
+	if thing := extra["acme_domains"]; thing != nil {
+		ac.Domains, _ = utils.AnyToStringArray(thing)
+	}
+	if len(ac.Domains) == 0 && host != "" {
+		ac.Domains = []string{host}
+	}
+	if ac.Dir == "" {
+		ac.Dir = "acme_certs"
+	}
+	if ac.CA == "" {
+		ac.CA = autocert.DefaultACMEDirectory
+	}
+	if days, ok := utils.AnyToInt64(extra["acme_renew_before"]); ok && days > 0 {
+		ac.RenewBefore = time.Duration(days) * 24 * time.Hour
+	}
+	return ac
+}
+
+var (
+	acmeManagersMutex sync.RWMutex
+	acmeManagers      = map[string]*acmeManager{} //domain -> manager
+)
+
+type acmeManager struct {
+	*autocert.Manager
+	httpHandler http.Handler
+}
+
+// 同一个 域名 只会有 一个 manager, 多个 监听 或 热加载 时 共用.
+func getAcmeManager(ac *AcmeConf) (*acmeManager, error) {
+	if len(ac.Domains) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "acme requires domains or host", ErrDetail: utils.ErrInvalidData}
+	}
+
+	acmeManagersMutex.Lock()
+	defer acmeManagersMutex.Unlock()
+
+	for _, d := range ac.Domains {
+		if m := acmeManagers[d]; m != nil {
+			return m, nil
+		}
+	}
+
+	client := &acme.Client{DirectoryURL: ac.CA}
+	if ac.CARoot != "" {
+		pool, err := LoadCA(ac.CARoot)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "acme load ca root failed", ErrDetail: err, Data: ac.CARoot}
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+
+	m := &acmeManager{Manager: &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(utils.GetFilePath(ac.Dir)),
+		HostPolicy:  autocert.HostWhitelist(ac.Domains...),
+		Email:       ac.Email,
+		RenewBefore: ac.RenewBefore,
+		Client:      client,
+	}}
+	//调用 HTTPHandler 后 autocert 才会 尝试 http-01
+	m.httpHandler = m.HTTPHandler(nil)
+
+	for _, d := range ac.Domains {
+		acmeManagers[d] = m
+	}
+
+	if ce := utils.CanLogInfo("acme enabled"); ce != nil {
+		ce.Write(zap.Strings("domains", ac.Domains), zap.String("ca", ac.CA), zap.String("dir", ac.Dir))
+	}
+	return m, nil
+}
+
+func getAcmeTlsConfig(conf Conf, ac *AcmeConf) (*tls.Config, error) {
+	m, err := getAcmeManager(ac)
+	if err != nil {
+		return nil, err
+	}
+
+	tConf := &tls.Config{
+		NextProtos:     conf.AlpnList,
+		ServerName:     conf.Host,
+		MinVersion:     conf.Minver,
+		MaxVersion:     conf.Maxver,
+		CipherSuites:   conf.CipherSuites,
+		GetCertificate: m.GetCertificate,
+	}
+	if !slices.Contains(tConf.NextProtos, acme.ALPNProto) {
+		tConf.NextProtos = append(tConf.NextProtos, acme.ALPNProto)
+	}
+
+	if conf.CertConf != nil && conf.CertConf.CA != "" {
+		certPool, err := LoadCA(conf.CertConf.CA)
+		if err != nil {
+			if ce := utils.CanLogErr("Failed in loading CA"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+		} else {
+			tConf.ClientCAs = certPool
+			tConf.ClientAuth = tls.RequireAndVerifyClientCert
+
+			//acme 验证 请求 不会 带 客户端证书, 所以 只对 acme-tls/1 的 握手 使用 不要求 客户端证书 的 配置.
+			// 该 配置 只 支持 acme-tls/1, 协商 成功 后 checkAcmeHandshake 会 直接 关闭 连接, 不会 被 用于 代理.
+			tConf.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+				if !slices.Contains(chi.SupportedProtos, acme.ALPNProto) {
+					return nil, nil
+				}
+				c := tConf.Clone()
+				c.GetConfigForClient = nil
+				c.ClientAuth = tls.NoClientCert
+				c.ClientCAs = nil
+				c.NextProtos = []string{acme.ALPNProto}
+				return c, nil
+			}
+		}
+	}
+	return tConf, nil
+}
+
+// 握手 协商出 acme-tls/1 时, 证书 已经 由 GetCertificate 回复, 直接 关闭 即可.
+func checkAcmeHandshake(tlsConn *tls.Conn) error {
+	if tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		tlsConn.Close()
+		return ErrAcmeChallengeDone
+	}
+	return nil
+}
+
+// 若 firstData 为 acme http-01 请求, 则 回复 并 返回 true. 调用者 之后 应 关闭 conn.
+func ServeAcmeHttp01(conn net.Conn, firstData []byte) bool {
+	if !bytes.HasPrefix(firstData, []byte("GET "+acmeHttp01PathPrefix)) {
+		return false
+	}
+
+	acmeManagersMutex.RLock()
+	empty := len(acmeManagers) == 0
+	acmeManagersMutex.RUnlock()
+	if empty {
+		return false
+	}
+
+	rq, err := http.ReadRequest(bufio.NewReader(io.MultiReader(bytes.NewReader(firstData), conn)))
+	if err != nil {
+		return false
+	}
+
+	host := rq.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	acmeManagersMutex.RLock()
+	m := acmeManagers[strings.ToLower(host)]
+	acmeManagersMutex.RUnlock()
+
+	rw := &acmeResponseWriter{header: http.Header{}}
+	if m == nil {
+		rw.WriteHeader(http.StatusNotFound)
+	} else {
+		m.httpHandler.ServeHTTP(rw, rq)
+	}
+
+	if ce := utils.CanLogInfo("acme http-01 request"); ce != nil {
+		ce.Write(zap.String("host", host), zap.String("path", rq.URL.Path), zap.Int("status", rw.status))
+	}
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rsp := &http.Response{
+		StatusCode:    rw.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header,
+		ContentLength: int64(rw.body.Len()),
+		Body:          io.NopCloser(&rw.body),
+		Close:         true,
+	}
+	rsp.Write(conn)
+	return true
+}
+
+type acmeResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *acmeResponseWriter) Header() http.Header { return rw.header }
+
+func (rw *acmeResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *acmeResponseWriter) Write(p []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(p)
+}
@@ -0,0 +1,439 @@
+package tlsLayer_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/crypto/acme"
+)
+
+// 一个 极简 的 pebble 替身, 不验证 jws 签名, 但 会 真正 去 验证 challenge 并 签发 证书
+type fakeAcme struct {
+	*httptest.Server
+
+	challengeType string
+	tlsAddr       string //tls-alpn-01 验证 时 拨号 的 地址
+	httpAddr      string //http-01 验证 时 拨号 的 地址
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	thumbprint string
+	domain     string
+	token      string
+	authzValid bool
+	certDER    []byte
+
+	issued int32
+}
+
+func newFakeAcme(t *testing.T, challengeType string) *fakeAcme {
+	fa := &fakeAcme{challengeType: challengeType}
+
+	fa.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &fa.caKey.PublicKey, fa.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa.caCert, _ = x509.ParseCertificate(der)
+
+	fa.Server = httptest.NewTLSServer(http.HandlerFunc(fa.serve))
+	return fa
+}
+
+// 把 acme 服务器 的 证书 写入 文件, 用于 acme_ca_root
+func (fa *fakeAcme) rootFile(t *testing.T) string {
+	fn := filepath.Join(t.TempDir(), "root.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fa.Certificate().Raw})
+	if err := os.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func (fa *fakeAcme) url(p string) string { return fa.URL + p }
+
+func (fa *fakeAcme) keyAuth() string { return fa.token + "." + fa.thumbprint }
+
+func (fa *fakeAcme) order() map[string]any {
+	o := map[string]any{
+		"status":         "pending",
+		"identifiers":    []any{map[string]string{"type": "dns", "value": fa.domain}},
+		"authorizations": []string{fa.url("/authz")},
+		"finalize":       fa.url("/finalize"),
+	}
+	if fa.authzValid {
+		o["status"] = "ready"
+	}
+	if fa.certDER != nil {
+		o["status"] = "valid"
+		o["certificate"] = fa.url("/cert")
+	}
+	return o
+}
+
+func (fa *fakeAcme) authz() map[string]any {
+	status := "pending"
+	if fa.authzValid {
+		status = "valid"
+	}
+	return map[string]any{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": fa.domain},
+		"challenges": []any{map[string]string{
+			"type": fa.challengeType, "url": fa.url("/chal"), "token": fa.token, "status": status,
+		}},
+	}
+}
+
+func (fa *fakeAcme) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce": fa.url("/nonce"), "newAccount": fa.url("/account"), "newOrder": fa.url("/order"),
+			"revokeCert": fa.url("/revoke"), "keyChange": fa.url("/keychange"),
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/account":
+		var h struct {
+			JWK struct{ Crv, X, Y string }
+		}
+		json.Unmarshal(protected, &h)
+		x, _ := base64.RawURLEncoding.DecodeString(h.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(h.JWK.Y)
+		fa.thumbprint, _ = acme.JWKThumbprint(&ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)})
+
+		w.Header().Set("Location", fa.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &req)
+		fa.domain = req.Identifiers[0].Value
+		fa.token = fmt.Sprint("token", time.Now().UnixNano())
+		fa.authzValid = false
+		fa.certDER = nil
+
+		w.Header().Set("Location", fa.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(fa.order())
+
+	case "/order/1":
+		w.Header().Set("Location", fa.url("/order/1"))
+		json.NewEncoder(w).Encode(fa.order())
+
+	case "/authz":
+		json.NewEncoder(w).Encode(fa.authz())
+
+	case "/chal":
+		fa.authzValid = fa.validate() == nil
+		json.NewEncoder(w).Encode(fa.authz()["challenges"].([]any)[0])
+
+	case "/finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil || !fa.authzValid {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: fa.domain},
+			DNSNames:     []string{fa.domain},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		fa.certDER, _ = x509.CreateCertificate(rand.Reader, template, fa.caCert, csr.PublicKey, fa.caKey)
+		atomic.AddInt32(&fa.issued, 1)
+
+		w.Header().Set("Location", fa.url("/order/1"))
+		json.NewEncoder(w).Encode(fa.order())
+
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: fa.certDER})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: fa.caCert.Raw})
+
+	default:
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	}
+}
+
+func (fa *fakeAcme) validate() error {
+	switch fa.challengeType {
+	case "tls-alpn-01":
+		conn, err := tls.Dial("tcp", fa.tlsAddr, &tls.Config{
+			ServerName:         fa.domain,
+			NextProtos:         []string{acme.ALPNProto},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		want := sha256.Sum256([]byte(fa.keyAuth()))
+		idPeAcmeIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+		for _, ext := range conn.ConnectionState().PeerCertificates[0].Extensions {
+			if ext.Id.Equal(idPeAcmeIdentifier) {
+				var got []byte
+				asn1.Unmarshal(ext.Value, &got)
+				if string(got) == string(want[:]) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("tls-alpn-01 key authorization not match")
+
+	case "http-01":
+		conn, err := net.Dial("tcp", fa.httpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET /.well-known/acme-challenge/%s HTTP/1.1\r\nHost: %s\r\n\r\n", fa.token, fa.domain)
+		rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		if strings.TrimSpace(string(body)) != fa.keyAuth() {
+			return fmt.Errorf("http-01 key authorization not match: %s", body)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown challenge type")
+}
+
+// 启动 开启了 acme 的 tls 服务端, 握手成功 的 连接 回复 "ok"
+func startAcmeTlsServer(t *testing.T, fa *fakeAcme, domain, dir string, certConf *tlsLayer.CertConf) net.Listener {
+	server, err := tlsLayer.NewServer(tlsLayer.Conf{
+		Host:     domain,
+		CertConf: certConf,
+		Extra: map[string]any{
+			"acme":         true,
+			"acme_ca":      fa.url("/dir"),
+			"acme_ca_root": fa.rootFile(t),
+			"acme_dir":     dir,
+			"acme_email":   "a@b.com",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:"+netLayer.RandPortStr(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tlsConn, err := server.Handshake(c)
+				if err != nil {
+					c.Close()
+					return
+				}
+				tlsConn.Write([]byte("ok"))
+				tlsConn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func dialAcmeTlsServer(t *testing.T, fa *fakeAcme, addr, domain string, clientCerts ...tls.Certificate) *x509.Certificate {
+	pool := x509.NewCertPool()
+	pool.AddCert(fa.caCert)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: domain, RootCAs: pool, Certificates: clientCerts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	got, _ := io.ReadAll(conn)
+	if string(got) != "ok" {
+		t.Fatal("got", string(got))
+	}
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestAcmeTlsAlpn01(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	const domain = "alpn.example.com"
+	dir := t.TempDir()
+
+	fa := newFakeAcme(t, "tls-alpn-01")
+	defer fa.Close()
+
+	l := startAcmeTlsServer(t, fa, domain, dir, nil)
+	defer l.Close()
+	fa.tlsAddr = l.Addr().String()
+
+	cert := dialAcmeTlsServer(t, fa, l.Addr().String(), domain)
+	if cert.Subject.CommonName != domain {
+		t.Fatal("wrong cert", cert.Subject)
+	}
+	if atomic.LoadInt32(&fa.issued) != 1 {
+		t.Fatal("should issue once", fa.issued)
+	}
+
+	//证书 应 存放 在 磁盘 上
+	if _, err := os.Stat(filepath.Join(dir, domain)); err != nil {
+		t.Fatal(err)
+	}
+
+	//再次 连接 不应 重新 申请
+	dialAcmeTlsServer(t, fa, l.Addr().String(), domain)
+	if atomic.LoadInt32(&fa.issued) != 1 {
+		t.Fatal("should not issue again", fa.issued)
+	}
+}
+
+func TestAcmeHttp01(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	const domain = "http.example.com"
+
+	fa := newFakeAcme(t, "http-01")
+	defer fa.Close()
+
+	l := startAcmeTlsServer(t, fa, domain, t.TempDir(), nil)
+	defer l.Close()
+
+	//模拟 80端口 上 的 回落 路径
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+	go func() {
+		for {
+			c, err := hl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 4096)
+				n, _ := c.Read(buf)
+				if !tlsLayer.ServeAcmeHttp01(c, buf[:n]) {
+					c.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+				}
+			}()
+		}
+	}()
+	fa.httpAddr = hl.Addr().String()
+
+	cert := dialAcmeTlsServer(t, fa, l.Addr().String(), domain)
+	if cert.Subject.CommonName != domain {
+		t.Fatal("wrong cert", cert.Subject)
+	}
+}
+
+// 配置了 CA 时, acme 验证 不需要 客户端证书, 但 普通 连接 仍然 必须 在 握手 时 提供
+func TestAcmeClientCert(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	const domain = "mtls.example.com"
+
+	fa := newFakeAcme(t, "tls-alpn-01")
+	defer fa.Close()
+
+	ca := newTestCA(t)
+
+	l := startAcmeTlsServer(t, fa, domain, t.TempDir(), &tlsLayer.CertConf{CA: ca.file})
+	defer l.Close()
+	fa.tlsAddr = l.Addr().String()
+
+	cert := dialAcmeTlsServer(t, fa, l.Addr().String(), domain, ca.issueClientCert(t, "user1"))
+	if cert.Subject.CommonName != domain {
+		t.Fatal("wrong cert", cert.Subject)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(fa.caCert)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: domain, RootCAs: pool})
+	if err == nil {
+		//tls1.3 中 客户端 先 完成 握手, 服务端 的 拒绝 在 读取 时 才能 收到
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		var got []byte
+		got, err = io.ReadAll(conn)
+		conn.Close()
+		if string(got) == "ok" {
+			t.Fatal("client without certificate should fail the handshake")
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "certificate required") {
+		t.Fatal("expect certificate required alert, got", err)
+	}
+}
@@ -26,6 +26,9 @@ var ErrCAFileWrong = errors.New("ca file is somehow wrong")
 type CertConf struct {
 	CA                string
 	CertFile, KeyFile string
+
+	Pairs []CertPair //额外的 证书, 服务端 根据 sni 选择
+	Dir   string     //证书目录, 其中 的 xxx.crt/xxx.cer/xxx.pem 与 xxx.key 会 被 当作 一对 证书
 }
 
 func LoadCA(caFile string) (cp *x509.CertPool, err error) {
@@ -181,28 +184,46 @@ func rejectUnknownGetCertificateFunc(certs []*tls.Certificate) func(hello *tls.C
 		}
 		sni := strings.ToLower(hello.ServerName)
 
-		gsni := "*"
-		if index := strings.IndexByte(sni, '.'); index != -1 {
-			gsni += sni[index:]
+		cert, err := matchCertBySni(certs, sni)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "rejectUnknown: x509.ParseCertificate failed ", ErrDetail: err}
+		}
+		if cert == nil {
+			return nil, utils.ErrInErr{ErrDesc: "rejectUnknownSNI", ErrDetail: utils.ErrInvalidData, Data: sni}
 		}
+		return cert, nil
+	}
+}
+
+// 先找 完全匹配 sni 的 证书, 再找 通配符 匹配的, 都没有 则 返回 nil
+func matchCertBySni(certs []*tls.Certificate, sni string) (*tls.Certificate, error) {
+	if sni == "" {
+		return nil, nil
+	}
+	gsni := "*"
+	if index := strings.IndexByte(sni, '.'); index != -1 {
+		gsni += sni[index:]
+	}
+
+	for _, name := range []string{sni, gsni} {
 		for _, cert := range certs {
 			if cert.Leaf == nil {
 				var e error
 				cert.Leaf, e = x509.ParseCertificate(cert.Certificate[0])
 				if e != nil {
-					return nil, utils.ErrInErr{ErrDesc: "rejectUnknown: x509.ParseCertificate failed ", ErrDetail: e}
+					return nil, e
 				}
 			}
 
-			if cert.Leaf.Subject.CommonName == sni || cert.Leaf.Subject.CommonName == gsni {
+			if strings.ToLower(cert.Leaf.Subject.CommonName) == name {
 				return cert, nil
 			}
-			for _, name := range cert.Leaf.DNSNames {
-				if name == sni || name == gsni {
+			for _, n := range cert.Leaf.DNSNames {
+				if strings.ToLower(n) == name {
 					return cert, nil
 				}
 			}
 		}
-		return nil, utils.ErrInErr{ErrDesc: "rejectUnknownSNI", ErrDetail: utils.ErrInvalidData, Data: sni}
 	}
+	return nil, nil
 }
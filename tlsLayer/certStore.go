@@ -0,0 +1,330 @@
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 服务端 每隔 这么久 检查 一次 证书文件 是否 变动, 变动了 就 重新加载, 无需 重启.
+// 检查 在 握手时 进行, 没有 单独的 goroutine.
+var CertCheckInterval = time.Second * 10
+
+type CertPair struct {
+	CertFile string `toml:"cert"`
+	KeyFile  string `toml:"key"`
+}
+
+// 证书目录 中 的 证书文件 后缀, 密钥文件 为 同名 的 .key 文件
+var certDirExts = []string{".crt", ".cer", ".pem"}
+
+// 返回 CertFile/KeyFile, Pairs 以及 Dir 中 的 所有 证书对
+func (cc *CertConf) allPairs() (pairs []CertPair) {
+	if cc.CertFile != "" && cc.KeyFile != "" {
+		pairs = append(pairs, CertPair{CertFile: cc.CertFile, KeyFile: cc.KeyFile})
+	}
+	for _, p := range cc.Pairs {
+		if p.CertFile != "" && p.KeyFile != "" {
+			pairs = append(pairs, p)
+		}
+	}
+	if cc.Dir != "" {
+		dir := utils.GetFilePath(cc.Dir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if ce := utils.CanLogErr("Failed in reading cert dir"); ce != nil {
+				ce.Write(zap.String("dir", dir), zap.Error(err))
+			}
+			return
+		}
+		var names []string
+		for _, e := range entries {
+			if !e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ext := filepath.Ext(name)
+			isCert := false
+			for _, ce := range certDirExts {
+				if strings.EqualFold(ext, ce) {
+					isCert = true
+					break
+				}
+			}
+			if !isCert {
+				continue
+			}
+			keyFile := filepath.Join(dir, strings.TrimSuffix(name, ext)+".key")
+			if utils.FileExist(keyFile) {
+				pairs = append(pairs, CertPair{CertFile: filepath.Join(dir, name), KeyFile: keyFile})
+			}
+		}
+	}
+	return
+}
+
+func (cc *CertConf) storeKey() string {
+	var sb strings.Builder
+	sb.WriteString(cc.CertFile + "|" + cc.KeyFile + ";")
+	for _, p := range cc.Pairs {
+		sb.WriteString(p.CertFile + "|" + p.KeyFile + ";")
+	}
+	sb.WriteString(cc.Dir)
+	return sb.String()
+}
+
+type loadedCert struct {
+	CertPair
+	cert    *tls.Certificate
+	modTime [2]time.Time
+	err     error
+}
+
+// certStore 保存 一个 监听 所使用的 所有 证书, 根据 sni 选择, 文件 变动 时 自动 重新加载.
+type certStore struct {
+	conf CertConf
+	key  string
+
+	mu    sync.RWMutex
+	certs []*loadedCert
+
+	lastCheck int64 //unix nano
+
+	refs int //由 certStoresMutex 保护
+}
+
+var (
+	certStoresMutex sync.Mutex
+	certStores      = map[string]*certStore{} //storeKey -> *certStore
+
+	configCertStores sync.Map //*tls.Config -> *certStore
+)
+
+// 若 conf 中 没有 能加载 的 证书, 返回 nil. 相同配置 共用 同一个 certStore, 以便 热加载.
+//
+// 返回的 certStore 的 引用计数 会 加一, 不再使用 时 要 调用 release.
+func getCertStore(conf CertConf) *certStore {
+	key := conf.storeKey()
+
+	certStoresMutex.Lock()
+	defer certStoresMutex.Unlock()
+
+	store := certStores[key]
+	if store == nil {
+		store = &certStore{conf: conf, key: key}
+	}
+	store.reload()
+	if !store.hasCert() {
+		return nil
+	}
+	store.refs++
+	certStores[key] = store
+	return store
+}
+
+// 引用计数 归零 时 删除 store, 之后 GetCertInfos 不再 输出 它的 证书
+func (s *certStore) release() {
+	certStoresMutex.Lock()
+	defer certStoresMutex.Unlock()
+
+	s.refs--
+	if s.refs <= 0 && certStores[s.key] == s {
+		delete(certStores, s.key)
+	}
+}
+
+// 释放 GetTlsConfig 为 tConf 加载 的 证书. 使用 tConf 的 服务端 被 删除 时 调用, 多次 调用 无副作用.
+func ReleaseTlsConfig(tConf *tls.Config) {
+	if tConf == nil {
+		return
+	}
+	if s, ok := configCertStores.LoadAndDelete(tConf); ok {
+		s.(*certStore).release()
+	}
+}
+
+func (s *certStore) hasCert() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, lc := range s.certs {
+		if lc.cert != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func modTimeOf(fn string) time.Time {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// 重新 扫描 证书文件, 只 加载 有变动 的. 加载 失败 时 继续 使用 旧证书.
+func (s *certStore) reload() {
+	atomic.StoreInt64(&s.lastCheck, time.Now().UnixNano())
+
+	s.mu.RLock()
+	old := make(map[CertPair]*loadedCert, len(s.certs))
+	for _, lc := range s.certs {
+		old[lc.CertPair] = lc
+	}
+	s.mu.RUnlock()
+
+	var newCerts []*loadedCert
+	changed := false
+	for _, p := range s.conf.allPairs() {
+		certFile, keyFile := utils.GetFilePath(p.CertFile), utils.GetFilePath(p.KeyFile)
+		modTime := [2]time.Time{modTimeOf(certFile), modTimeOf(keyFile)}
+
+		oldLc := old[p]
+		if oldLc != nil && oldLc.modTime == modTime {
+			newCerts = append(newCerts, oldLc)
+			continue
+		}
+		changed = true
+
+		lc := &loadedCert{CertPair: p, modTime: modTime}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err != nil {
+			if ce := utils.CanLogErr("Failed in loading cert"); ce != nil {
+				ce.Write(zap.String("cert", p.CertFile), zap.String("key", p.KeyFile), zap.Error(err))
+			}
+			lc.err = err
+			if oldLc != nil {
+				lc.cert = oldLc.cert
+			}
+		} else {
+			lc.cert = &cert
+			if oldLc != nil {
+				if ce := utils.CanLogInfo("cert reloaded"); ce != nil {
+					ce.Write(zap.String("cert", p.CertFile), zap.Time("notAfter", cert.Leaf.NotAfter))
+				}
+			}
+		}
+		newCerts = append(newCerts, lc)
+	}
+	if len(newCerts) != len(old) {
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	s.mu.Lock()
+	s.certs = newCerts
+	s.mu.Unlock()
+}
+
+func (s *certStore) checkReload() {
+	last := atomic.LoadInt64(&s.lastCheck)
+	if time.Since(time.Unix(0, last)) < CertCheckInterval {
+		return
+	}
+	//只让 一个 握手 去 检查
+	if atomic.CompareAndSwapInt64(&s.lastCheck, last, time.Now().UnixNano()) {
+		s.reload()
+	}
+}
+
+func (s *certStore) getCertificateFunc(rejectUnknownSni bool) func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.checkReload()
+
+		s.mu.RLock()
+		certs := make([]*tls.Certificate, 0, len(s.certs))
+		for _, lc := range s.certs {
+			if lc.cert != nil {
+				certs = append(certs, lc.cert)
+			}
+		}
+		s.mu.RUnlock()
+
+		if len(certs) == 0 {
+			return nil, utils.ErrInErr{ErrDesc: "len(certs) == 0", ErrDetail: utils.ErrInvalidData}
+		}
+
+		sni := strings.ToLower(hello.ServerName)
+		cert, _ := matchCertBySni(certs, sni)
+		if cert != nil {
+			return cert, nil
+		}
+		if rejectUnknownSni {
+			return nil, utils.ErrInErr{ErrDesc: "rejectUnknownSNI", ErrDetail: utils.ErrInvalidData, Data: sni}
+		}
+		return certs[0], nil
+	}
+}
+
+// CertInfo 是 服务端 所加载的 一个 证书 的 信息, api server 的 certs 会 输出 所有 证书 的 CertInfo.
+type CertInfo struct {
+	CertFile  string    `json:"cert"`
+	KeyFile   string    `json:"key"`
+	Names     []string  `json:"names"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	DaysLeft  int       `json:"daysLeft"`
+	Error     string    `json:"error,omitempty"` //最近一次 加载 的 错误, 此时 仍在 使用 旧证书
+}
+
+// 返回 所有 监听 所使用的 证书文件 的 信息, 同一 文件 只出现 一次
+func GetCertInfos() (infos []CertInfo) {
+	seen := map[CertPair]bool{}
+
+	certStoresMutex.Lock()
+	stores := make([]*certStore, 0, len(certStores))
+	for _, s := range certStores {
+		stores = append(stores, s)
+	}
+	certStoresMutex.Unlock()
+
+	for _, s := range stores {
+		s.mu.RLock()
+
+		for _, lc := range s.certs {
+			if seen[lc.CertPair] {
+				continue
+			}
+			seen[lc.CertPair] = true
+
+			info := CertInfo{CertFile: lc.CertFile, KeyFile: lc.KeyFile}
+			if lc.err != nil {
+				info.Error = lc.err.Error()
+			}
+			if lc.cert != nil {
+				leaf := lc.cert.Leaf
+				if leaf.Subject.CommonName != "" {
+					info.Names = append(info.Names, leaf.Subject.CommonName)
+				}
+				for _, n := range leaf.DNSNames {
+					if n != leaf.Subject.CommonName {
+						info.Names = append(info.Names, n)
+					}
+				}
+				info.NotBefore = leaf.NotBefore
+				info.NotAfter = leaf.NotAfter
+				info.DaysLeft = int(time.Until(leaf.NotAfter).Hours() / 24)
+			}
+			infos = append(infos, info)
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CertFile < infos[j].CertFile })
+	return
+}
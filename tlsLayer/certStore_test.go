@@ -0,0 +1,199 @@
+package tlsLayer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 生成 含有 指定 域名 的 自签名证书, 写入 dir/name.crt 与 dir/name.key
+func writeTestCert(t *testing.T, dir, name string, notAfter time.Time, dnsNames ...string) (certFile, keyFile string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	//确保 修改时间 变化, 以便 被 检测到
+	testCertModTime = testCertModTime.Add(time.Second)
+	os.Chtimes(certFile, testCertModTime, testCertModTime)
+	os.Chtimes(keyFile, testCertModTime, testCertModTime)
+	return
+}
+
+var testCertModTime = time.Now()
+
+// 用 指定 sni 握手, 返回 服务端 所用 证书
+func handshakeWithSni(conf *tls.Config, sni string) (*x509.Certificate, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go tls.Server(c2, conf).Handshake()
+
+	client := tls.Client(c1, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestMultiCertSni(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	oldInterval := tlsLayer.CertCheckInterval
+	tlsLayer.CertCheckInterval = 0
+	defer func() { tlsLayer.CertCheckInterval = oldInterval }()
+
+	dir := t.TempDir()
+	pairDir := t.TempDir()
+	expire := time.Now().Add(30 * 24 * time.Hour)
+
+	writeTestCert(t, dir, "a", expire, "a.example.com")
+	writeTestCert(t, dir, "wild", expire, "*.wild.com")
+	bCert, bKey := writeTestCert(t, pairDir, "b", expire, "b.example.com")
+
+	conf := tlsLayer.GetTlsConfig(true, tlsLayer.Conf{
+		CertConf: &tlsLayer.CertConf{
+			Pairs: []tlsLayer.CertPair{{CertFile: bCert, KeyFile: bKey}},
+			Dir:   dir,
+		},
+	})
+
+	for sni, want := range map[string]string{
+		"b.example.com": "b.example.com",
+		"a.example.com": "a.example.com",
+		"x.wild.com":    "*.wild.com",
+		"unknown.com":   "b.example.com", //没有匹配的 则 使用 第一个
+	} {
+		cert, err := handshakeWithSni(conf, sni)
+		if err != nil {
+			t.Fatal(sni, err)
+		}
+		if cert.Subject.CommonName != want {
+			t.Fatal(sni, "got", cert.Subject.CommonName, "want", want)
+		}
+	}
+
+	//rejectUnknownSni
+	rejectConf := tlsLayer.GetTlsConfig(true, tlsLayer.Conf{
+		RejectUnknownSni: true,
+		CertConf:         &tlsLayer.CertConf{Dir: dir},
+	})
+	if _, err := handshakeWithSni(rejectConf, "unknown.com"); err == nil {
+		t.Fatal("should reject unknown sni")
+	}
+	if _, err := handshakeWithSni(rejectConf, "y.wild.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	//替换 证书 与 新增 证书, 无需 重新 生成 tls.Config
+	newExpire := time.Now().Add(60 * 24 * time.Hour)
+	writeTestCert(t, pairDir, "b", newExpire, "b.example.com")
+	writeTestCert(t, dir, "c", expire, "c.example.com")
+
+	cert, err := handshakeWithSni(conf, "b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.NotAfter.Unix() != newExpire.Unix() {
+		t.Fatal("cert not reloaded", cert.NotAfter, newExpire)
+	}
+	cert, err = handshakeWithSni(conf, "c.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "c.example.com" {
+		t.Fatal("new cert not loaded", cert.Subject.CommonName)
+	}
+
+	//损坏的 证书 不影响 继续 使用 旧证书
+	os.WriteFile(bCert, []byte("broken"), 0600)
+	testCertModTime = testCertModTime.Add(time.Second)
+	os.Chtimes(bCert, testCertModTime, testCertModTime)
+	cert, err = handshakeWithSni(conf, "b.example.com")
+	if err != nil || cert.NotAfter.Unix() != newExpire.Unix() {
+		t.Fatal("should keep old cert", err)
+	}
+
+	found := false
+	for _, info := range tlsLayer.GetCertInfos() {
+		if info.CertFile == bCert {
+			found = true
+			if info.NotAfter.Unix() != newExpire.Unix() || info.DaysLeft < 59 || info.Error == "" {
+				t.Fatal("wrong cert info", info)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("cert info not found")
+	}
+}
+
+// 服务端 被 删除 后 不再 输出 它的 证书; 共用 的 store 在 最后 一个 服务端 被 删除 时 才 删除
+func TestReleaseCertStore(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "r", time.Now().Add(30*24*time.Hour), "r.example.com")
+
+	hasCert := func() bool {
+		for _, info := range tlsLayer.GetCertInfos() {
+			if info.CertFile == certFile {
+				return true
+			}
+		}
+		return false
+	}
+
+	cc := tlsLayer.CertConf{CertFile: certFile, KeyFile: keyFile}
+	conf1 := tlsLayer.GetTlsConfig(true, tlsLayer.Conf{CertConf: &cc})
+	conf2 := tlsLayer.GetTlsConfig(true, tlsLayer.Conf{CertConf: &cc})
+	if !hasCert() {
+		t.Fatal("cert info not found")
+	}
+
+	tlsLayer.ReleaseTlsConfig(conf1)
+	tlsLayer.ReleaseTlsConfig(conf1)
+	if !hasCert() {
+		t.Fatal("store released while still in use")
+	}
+	if _, err := handshakeWithSni(conf1, "r.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsLayer.ReleaseTlsConfig(conf2)
+	if hasCert() {
+		t.Fatal("store not released")
+	}
+}
@@ -22,10 +22,18 @@ type Client struct {
 	alpnList   []string
 
 	shadowTlsPassword string
+	shadowTlsStrict   bool
 	utlsFingerprint   utls.ClientHelloID
+	utlsSpec          *utlsSpec //由 utls_spec_file 给出, 优先于 utlsFingerprint
+
+	reality    *realityClientConf
+	realityErr error
+
+	ech    *echClientConf
+	echErr error //配置了 ECH 却 无法 使用 时 不为 nil, 此时 握手 直接 失败
 }
 
-func NewClient(conf Conf) *Client {
+func NewClient(conf Conf) (*Client, error) {
 
 	c := &Client{
 		tlsType: conf.Tls_type,
@@ -34,6 +42,20 @@ func NewClient(conf Conf) *Client {
 	c.alpnList = conf.AlpnList
 
 	switch conf.Tls_type {
+	case Reality_t:
+		c.uTlsConfig = GetUTlsConfig(conf)
+		c.utlsFingerprint = getUtlsFingerprintFromExtra(conf.Extra)
+		c.utlsSpec = getUtlsSpecFromExtra(conf.Extra)
+
+		c.reality, c.realityErr = newRealityClientConf(conf.Extra)
+		if c.realityErr != nil {
+			if ce := utils.CanLogErr("Failed in init reality client"); ce != nil {
+				ce.Write(zap.Error(c.realityErr))
+			}
+		}
+	case ShadowTls3_t:
+		c.shadowTlsStrict = getShadowTlsStrictFromExtra(conf.Extra)
+		fallthrough
 	case ShadowTls2_t:
 		fallthrough
 	case ShadowTls_t:
@@ -44,43 +66,8 @@ func NewClient(conf Conf) *Client {
 	case UTls_t:
 		c.uTlsConfig = GetUTlsConfig(conf)
 
-		if len(conf.Extra) > 0 {
-			if thing := conf.Extra["utls_fingerprint"]; thing != nil {
-				if str, ok := thing.(string); ok {
-					str = strings.ToLower(str)
-					switch str {
-					case "chrome":
-						fallthrough
-					default:
-						c.utlsFingerprint = utls.HelloChrome_Auto
-					case "firefox":
-						c.utlsFingerprint = utls.HelloFirefox_Auto
-
-					case "ios":
-						c.utlsFingerprint = utls.HelloIOS_Auto
-
-					case "safari":
-						c.utlsFingerprint = utls.HelloSafari_Auto
-
-					case "golang":
-						c.utlsFingerprint = utls.HelloGolang
-
-					case "android":
-						c.utlsFingerprint = utls.HelloAndroid_11_OkHttp
-
-					case "360":
-						c.utlsFingerprint = utls.Hello360_Auto
-
-					case "edge":
-						c.utlsFingerprint = utls.HelloEdge_Auto
-
-					case "random":
-						c.utlsFingerprint = utls.HelloRandomized
-
-					}
-				}
-			}
-		}
+		c.utlsFingerprint = getUtlsFingerprintFromExtra(conf.Extra)
+		c.utlsSpec = getUtlsSpecFromExtra(conf.Extra)
 
 		if ce := utils.CanLogInfo("Using uTls and Chrome fingerprint for"); ce != nil {
 			ce.Write(zap.String("host", conf.Host))
@@ -90,22 +77,56 @@ func NewClient(conf Conf) *Client {
 
 	}
 
-	return c
+	if c.tlsType == Tls_t || c.tlsType == UTls_t {
+		if err := c.initECH(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// utls 配置了 ECH 时 返回 错误; 其它 无法 使用 ECH 的 情况 只 记录 在 echErr 中, 握手 时 失败
+func (c *Client) initECH(conf Conf) error {
+	c.ech, c.echErr = getECHClientConfFromExtra(conf.Extra, conf.Host)
+	if c.ech == nil && c.echErr == nil {
+		return nil
+	}
+	if c.tlsType == UTls_t {
+		//目前 使用 的 utls 版本 不支持 ECH, 在 加载 配置 时 就 拒绝, 而不是 等到 握手 时 才 失败
+		return utils.ErrInErr{ErrDesc: "ECH is not supported by the utls version in use, use tls_type = \"tls\" instead", ErrDetail: utils.ErrUnImplemented, Data: conf.Host}
+	}
+	if c.echErr == nil && !echClientSupported {
+		c.echErr = utils.ErrInErr{ErrDesc: "ECH client requires go1.23 or later", ErrDetail: utils.ErrUnImplemented}
+	}
+	if c.echErr != nil {
+		if ce := utils.CanLogErr("Failed in init ECH client, handshakes will fail"); ce != nil {
+			ce.Write(zap.String("host", conf.Host), zap.Error(c.echErr))
+		}
+		return nil
+	}
+	if ce := utils.CanLogInfo("Using ECH for"); ce != nil {
+		ce.Write(zap.String("host", conf.Host), zap.String("dns", c.ech.dnsDomain))
+	}
+	return nil
 }
 
-// utls和tls时返回tlsLayer.Conn, shadowTls1时返回underlay, shadowTls2时返回 普通 net.Conn
+// utls,tls和reality时返回tlsLayer.Conn, shadowTls1时返回underlay, shadowTls2和shadowTls3时返回 普通 net.Conn
 func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
+	if c.echErr != nil {
+		return nil, c.echErr
+	}
 
 	switch c.tlsType {
 	case UTls_t:
 		configCopy := c.uTlsConfig //发现uTlsConfig竟然没法使用指针，握手一次后配置文件就会被污染，只能拷贝
 		//否则的话接下来的握手客户端会报错： tls: CurvePreferences includes unsupported curve
 
-		if (c.utlsFingerprint == utls.ClientHelloID{}) {
-			c.utlsFingerprint = utls.HelloChrome_Auto
+		var utlsConn *utls.UConn
+		utlsConn, err = c.newUClient(underlay, &configCopy)
+		if err != nil {
+			return
 		}
-
-		utlsConn := utls.UClient(underlay, &configCopy, c.utlsFingerprint)
 		err = utlsConn.Handshake()
 		if err != nil {
 			return
@@ -116,8 +137,13 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 			tlsType: UTls_t,
 		}
 	case Tls_t:
-		officialConn := tls.Client(underlay, c.tlsConfig)
-		err = officialConn.Handshake()
+		var officialConn *tls.Conn
+		if c.ech != nil {
+			officialConn, err = c.echHandshake(underlay)
+		} else {
+			officialConn = tls.Client(underlay, c.tlsConfig)
+			err = officialConn.Handshake()
+		}
 		if err != nil {
 			return
 		}
@@ -127,6 +153,10 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 			ptr:     unsafe.Pointer(officialConn),
 			tlsType: Tls_t,
 		}
+	case Reality_t:
+		return c.realityHandshake(underlay)
+	case ShadowTls3_t:
+		return c.shadowTls3Handshake(underlay)
 	case ShadowTls_t:
 
 		err = tls.Client(underlay, c.tlsConfig).Handshake()
@@ -161,3 +191,86 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 
 	return
 }
+
+// 使用 utlsSpec 或 utlsFingerprint 生成 utls 连接, 都没有 则 使用 chrome
+func (c *Client) newUClient(underlay net.Conn, config *utls.Config) (*utls.UConn, error) {
+	if c.utlsSpec != nil {
+		spec, err := c.utlsSpec.newSpec()
+		if err != nil {
+			return nil, err
+		}
+		uconn := utls.UClient(underlay, config, utls.HelloCustom)
+		if err = uconn.ApplyPreset(spec); err != nil {
+			return nil, err
+		}
+		return uconn, nil
+	}
+
+	fingerprint := c.utlsFingerprint
+	if (fingerprint == utls.ClientHelloID{}) {
+		fingerprint = utls.HelloChrome_Auto
+	}
+	return utls.UClient(underlay, config, fingerprint), nil
+}
+
+// 从 extra.utls_spec_file 加载 ClientHello, 加载 失败 则 打印 错误 并 返回 nil, 此时 仍会 使用 utls_fingerprint
+func getUtlsSpecFromExtra(extra map[string]any) *utlsSpec {
+	fn := getStringFromExtra(extra, "utls_spec_file")
+	if fn == "" {
+		return nil
+	}
+	spec, err := loadUtlsSpecFile(fn)
+	if err != nil {
+		if ce := utils.CanLogErr("Failed in loading utls spec file"); ce != nil {
+			ce.Write(zap.String("file", fn), zap.Error(err))
+		}
+		return nil
+	}
+	if ce := utils.CanLogInfo("Using utls spec file"); ce != nil {
+		ce.Write(zap.String("file", fn))
+	}
+	return spec
+}
+
+// 从 extra.utls_fingerprint 读取 指纹, 没有配置 则 返回 空值, 握手时 会 使用 chrome
+func getUtlsFingerprintFromExtra(extra map[string]any) (fp utls.ClientHelloID) {
+	if len(extra) > 0 {
+		if thing := extra["utls_fingerprint"]; thing != nil {
+			if str, ok := thing.(string); ok {
+				str = strings.ToLower(str)
+				switch str {
+				case "chrome":
+					fallthrough
+				default:
+					return utls.HelloChrome_Auto
+				case "firefox":
+					return utls.HelloFirefox_Auto
+
+				case "ios":
+					return utls.HelloIOS_Auto
+
+				case "safari":
+					return utls.HelloSafari_Auto
+
+				case "golang":
+					return utls.HelloGolang
+
+				case "android":
+					return utls.HelloAndroid_11_OkHttp
+
+				case "360":
+					return utls.Hello360_Auto
+
+				case "edge":
+					return utls.HelloEdge_Auto
+
+				case "random":
+					return utls.HelloRandomized
+
+				}
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,124 @@
+package tlsLayer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+/*
+双向tls (给出了 ca) 时, 把 客户端证书 映射为 utils.User, 这样 分流的 user 规则 对于 只靠 客户端证书 认证 的 连接 也 能用,
+比如 socks5 over tls 这种 代理协议 本身 没有 用户 的 情况.
+
+extra.tls_clientUserBy 指定 用 证书 的 哪一项 作为 用户名:
+
+	"cn"   证书 的 Subject CommonName, 默认
+	"san"  证书 的 第一个 SAN (dns, email, uri, ip 依次)
+	"spki" 证书 公钥 (SubjectPublicKeyInfo) 的 sha256 的 hex
+
+extra.tls_clientUserMap 可选, 把 上面 得到的 名称 再 映射 为 别的 用户名, 如 { "alice.example.com" = "alice" }.
+by 为 san 时 会 依次 尝试 证书 的 所有 san, 用 第一个 能 映射 的.
+*/
+
+const (
+	ClientUserByCN   = "cn"
+	ClientUserBySAN  = "san"
+	ClientUserBySPKI = "spki"
+)
+
+// CertUser 是 由 客户端证书 得到的 用户, 实现 utils.User
+type CertUser struct {
+	Name        string
+	Fingerprint string //证书 公钥 的 sha256 hex
+}
+
+func (u *CertUser) IdentityStr() string   { return u.Name }
+func (u *CertUser) IdentityBytes() []byte { return []byte(u.Name) }
+func (u *CertUser) AuthStr() string       { return u.Name + ":" + u.Fingerprint }
+func (u *CertUser) AuthBytes() []byte     { return []byte(u.AuthStr()) }
+
+// 可以 获取 客户端证书 用户 的 连接, 如 tls 服务端 握手 后 得到的 Conn
+type UserConn interface {
+	GetClientUser() utils.User
+}
+
+type clientUserConf struct {
+	by    string
+	table map[string]string
+}
+
+func getClientUserConfFromExtra(extra map[string]any) (cuc clientUserConf) {
+	cuc.by = strings.ToLower(getStringFromExtra(extra, "tls_clientUserBy"))
+	switch cuc.by {
+	case ClientUserBySAN, ClientUserBySPKI:
+	default:
+		cuc.by = ClientUserByCN
+	}
+
+	if len(extra) > 0 {
+		if m, ok := extra["tls_clientUserMap"].(map[string]any); ok {
+			cuc.table = make(map[string]string, len(m))
+			for k, v := range m {
+				if s, ok := v.(string); ok {
+					cuc.table[k] = s
+				}
+			}
+		}
+	}
+	return
+}
+
+func SpkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func certSANs(cert *x509.Certificate) (sans []string) {
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return
+}
+
+// 找不到 名称 时 返回 nil
+func (cuc *clientUserConf) userFromCert(cert *x509.Certificate) *CertUser {
+	fp := SpkiFingerprint(cert)
+
+	var candidates []string
+	switch cuc.by {
+	case ClientUserBySPKI:
+		candidates = []string{fp}
+	case ClientUserBySAN:
+		candidates = certSANs(cert)
+	default:
+		if cert.Subject.CommonName != "" {
+			candidates = []string{cert.Subject.CommonName}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	for _, c := range candidates {
+		if mapped, ok := cuc.table[c]; ok {
+			return &CertUser{Name: mapped, Fingerprint: fp}
+		}
+	}
+	return &CertUser{Name: candidates[0], Fingerprint: fp}
+}
+
+func (cuc *clientUserConf) userFromState(state tls.ConnectionState) *CertUser {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return cuc.userFromCert(state.PeerCertificates[0])
+}
@@ -0,0 +1,155 @@
+package tlsLayer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{key: key}
+	ca.cert, _ = x509.ParseCertificate(der)
+	ca.file = filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	return ca
+}
+
+func (ca *testCA) issueClientCert(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// 用 客户端证书 握手, 返回 服务端 得到的 用户名
+func clientCertUser(t *testing.T, server *tlsLayer.Server, cert *tls.Certificate) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c1, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c1.Close()
+
+		conf := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			conf.Certificates = []tls.Certificate{*cert}
+		}
+		tc := tls.Client(c1, conf)
+		tc.Handshake()
+		tc.Read(make([]byte, 1))
+	}()
+
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	conn, err := server.Handshake(c2)
+	if err != nil {
+		return "", err
+	}
+	u := conn.(tlsLayer.UserConn).GetClientUser()
+	if u == nil {
+		return "", nil
+	}
+	return u.IdentityStr(), nil
+}
+
+func TestClientCertUser(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	ca := newTestCA(t)
+	alice := ca.issueClientCert(t, "alice", "alice.example.com", "a.example.com")
+	bob := ca.issueClientCert(t, "bob")
+
+	newServer := func(extra map[string]any) *tlsLayer.Server {
+		s, err := tlsLayer.NewServer(tlsLayer.Conf{
+			Host:     "www.example.com",
+			CertConf: &tlsLayer.CertConf{CA: ca.file},
+			Extra:    extra,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	for _, c := range []struct {
+		extra map[string]any
+		cert  *tls.Certificate
+		want  string
+	}{
+		{nil, &alice, "alice"},
+		{nil, &bob, "bob"},
+		{map[string]any{"tls_clientUserBy": "san"}, &alice, "alice.example.com"},
+		{map[string]any{"tls_clientUserBy": "san", "tls_clientUserMap": map[string]any{"a.example.com": "A"}}, &alice, "A"},
+		{map[string]any{"tls_clientUserBy": "spki"}, &bob, tlsLayer.SpkiFingerprint(bob.Leaf)},
+		{map[string]any{"tls_clientUserMap": map[string]any{"bob": "b"}}, &bob, "b"},
+	} {
+		got, err := clientCertUser(t, newServer(c.extra), c.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Fatal("got", got, "want", c.want, c.extra)
+		}
+	}
+
+	//没有 客户端证书 则 握手 失败
+	if _, err := clientCertUser(t, newServer(nil), nil); err == nil {
+		t.Fatal("should fail without client cert")
+	}
+}
@@ -1,10 +1,13 @@
 package tlsLayer
 
 import (
+	"bytes"
 	"crypto/tls"
 	"net"
+	"reflect"
 	"unsafe"
 
+	"github.com/e1732a364fed/v2ray_simple/utils"
 	utls "github.com/refraction-networking/utls"
 )
 
@@ -23,12 +26,42 @@ type Conn interface {
 	GetTeeConn() *TeeConn
 	GetAlpn() string
 	GetSni() string
+	GetVersion() uint16
+	GetRawAndBuffers() (raw net.Conn, input *bytes.Reader, rawInput *bytes.Buffer)
+}
+
+// tls.Conn 和 utls.Conn 中 input 与 rawInput 字段的偏移, 见 GetRawAndBuffers
+var tlsInputOffset, tlsRawInputOffset, utlsInputOffset, utlsRawInputOffset uintptr
+
+func init() {
+	tlsInputOffset, tlsRawInputOffset = getInputOffsets(reflect.TypeOf((*tls.Conn)(nil)).Elem())
+	utlsInputOffset, utlsRawInputOffset = getInputOffsets(reflect.TypeOf((*utls.Conn)(nil)).Elem())
+}
+
+func getInputOffsets(t reflect.Type) (input, rawInput uintptr) {
+	if f, ok := t.FieldByName("input"); ok && f.Type == reflect.TypeOf(bytes.Reader{}) {
+		input = f.Offset
+	}
+	if f, ok := t.FieldByName("rawInput"); ok && f.Type == reflect.TypeOf(bytes.Buffer{}) {
+		rawInput = f.Offset
+	}
+	return
 }
 
 type conn struct {
 	net.Conn
 	ptr     unsafe.Pointer
 	tlsType int
+
+	user *CertUser //服务端 双向tls 时 由 客户端证书 得到
+}
+
+// 实现 UserConn. 没有 客户端证书 时 返回 nil
+func (c *conn) GetClientUser() utils.User {
+	if c.user == nil {
+		return nil
+	}
+	return c.user
 }
 
 func (c *conn) GetRaw(tls_lazy_encrypt bool) *net.TCPConn {
@@ -101,3 +134,49 @@ func (c *conn) GetSni() string {
 	return ""
 
 }
+
+// 返回 协商出的 tls版本, 如 tls.VersionTLS13
+func (c *conn) GetVersion() uint16 {
+	switch c.tlsType {
+	case UTls_t:
+		cc := (*utls.Conn)(c.ptr)
+		if cc == nil {
+			return 0
+		}
+		return cc.ConnectionState().Version
+
+	case Tls_t:
+		cc := (*tls.Conn)(c.ptr)
+		if cc == nil {
+			return 0
+		}
+		return cc.ConnectionState().Version
+
+	}
+	return 0
+}
+
+// GetRawAndBuffers 返回 tls连接 的 底层连接, 以及 tls内部 已读取 但 还没被 Read 取走 的 明文(input) 和 还未解密 的 原始数据(rawInput).
+//
+// 用于 vless 的 xtls-rprx-vision: 切换到 直接读写 底层连接 时, 要先 取走 这两部分数据; 之后 就不能 再读 tls连接 了.
+// 若 上游tls库 的 结构 发生改变 而 无法获取, 则 input 和 rawInput 为 nil.
+func (c *conn) GetRawAndBuffers() (raw net.Conn, input *bytes.Reader, rawInput *bytes.Buffer) {
+	if c.ptr == nil {
+		return
+	}
+	raw = (*faketlsconn)(c.ptr).conn
+
+	var inputOffset, rawInputOffset uintptr
+	switch c.tlsType {
+	case UTls_t:
+		inputOffset, rawInputOffset = utlsInputOffset, utlsRawInputOffset
+	case Tls_t:
+		inputOffset, rawInputOffset = tlsInputOffset, tlsRawInputOffset
+	}
+	if inputOffset == 0 || rawInputOffset == 0 {
+		return
+	}
+	input = (*bytes.Reader)(unsafe.Add(c.ptr, inputOffset))
+	rawInput = (*bytes.Buffer)(unsafe.Add(c.ptr, rawInputOffset))
+	return
+}
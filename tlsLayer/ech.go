@@ -0,0 +1,419 @@
+package tlsLayer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+)
+
+/*
+ECH (Encrypted Client Hello) 把 真正的 ClientHello (含 sni, alpn 等) 加密 后 放在 外层 ClientHello 中,
+外层 的 sni 是 ECHConfig 中 的 public_name, 这样 审查者 就 看不到 真正 要 访问 的 域名 了.
+见 https://datatracker.ietf.org/doc/draft-ietf-tls-esni/
+
+客户端 extra:
+
+	ech_config = "AEX+DQBB..."   # base64 的 ECHConfigList, 可用 -gech 命令 生成
+	ech_dns = true               # 或 一个 域名, 从 该域名 (为 true 时 即 host) 的 HTTPS 记录 中 获取 ECHConfigList, 需要 配置 dns
+
+同时 给出 时 优先 使用 dns 查到的, 查询 失败 则 使用 ech_config. 服务端 拒绝 ECH 并 给出 retry_configs 时, 之后的 连接 会 使用 retry_configs.
+
+客户端 需要 tls_type 为 tls, 且 用 go1.23 以上 编译. 目前 使用 的 utls 版本 不支持 ECH, tls_type 为 utls 时 配置 ECH 会 在 加载 配置 时 报错.
+其它 配置了 ECH 却 无法 使用 的 情况, 握手 会 直接 失败, 而不会 退回 到 明文 sni.
+
+服务端 extra:
+
+	ech_key_files = ["ech.pem", "ech_old.pem"]
+
+每个 文件 含有 一个 x25519 的 PRIVATE KEY (pkcs8) 和 对应的 ECHCONFIG (ECHConfigList), 与 openssl 的 ech pem 格式 相同.
+第一个 文件 是 当前 的 密钥, 客户端 使用 的 配置 不对 时, 服务端 会把 它 作为 retry_configs 发给 客户端;
+其余 文件 只 用于 解密, 这样 轮换 密钥 时 还在 使用 旧配置 的 客户端 仍能 连上. 文件 变动 后 自动 重新加载, 检查 间隔 为 CertCheckInterval.
+
+服务端 需要 用 go1.25 以上 编译. 服务端 要有 public_name 的 证书, 否则 客户端 (insecure 的 除外) 无法 接受 retry_configs.
+*/
+
+const (
+	echVersion = 0xfe0d
+
+	hpkeKemX25519         = 0x0020
+	hpkeKdfHkdfSha256     = 0x0001
+	hpkeAeadAes128Gcm     = 0x0001
+	hpkeAeadChaCha20Poly1 = 0x0003
+
+	//dns 查到的 ECHConfigList 至少 缓存 这么久
+	echDnsMinTTL = time.Minute
+)
+
+// x25519 私钥 的 pkcs8 编码 的 固定 前缀, 后接 32字节 私钥
+var x25519Pkcs8Prefix = []byte{0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x6e, 0x04, 0x22, 0x04, 0x20}
+
+type echConfig struct {
+	raw        []byte //整个 ECHConfig, 含 version 和 length
+	id         uint8
+	kemId      uint16
+	publicKey  []byte
+	publicName string
+}
+
+// list 为 ECHConfigList, 含 2字节 长度 前缀. 不认识 的 版本 会被 跳过.
+func parseECHConfigList(list []byte) (result []echConfig, err error) {
+	s := cryptobyte.String(list)
+	var configs cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&configs) || !s.Empty() {
+		return nil, utils.ErrInErr{ErrDesc: "ECH, malformed ECHConfigList", ErrDetail: utils.ErrInvalidData}
+	}
+	for !configs.Empty() {
+		start := configs
+
+		var version uint16
+		var contents cryptobyte.String
+		if !configs.ReadUint16(&version) || !configs.ReadUint16LengthPrefixed(&contents) {
+			return nil, utils.ErrInErr{ErrDesc: "ECH, malformed ECHConfig", ErrDetail: utils.ErrInvalidData}
+		}
+		if version != echVersion {
+			continue
+		}
+
+		c := echConfig{raw: start[:len(start)-len(configs)]}
+		var publicKey, suites, publicName, extensions cryptobyte.String
+		var maxNameLen uint8
+		if !contents.ReadUint8(&c.id) || !contents.ReadUint16(&c.kemId) ||
+			!contents.ReadUint16LengthPrefixed(&publicKey) || !contents.ReadUint16LengthPrefixed(&suites) ||
+			!contents.ReadUint8(&maxNameLen) || !contents.ReadUint8LengthPrefixed(&publicName) ||
+			!contents.ReadUint16LengthPrefixed(&extensions) || !contents.Empty() {
+			return nil, utils.ErrInErr{ErrDesc: "ECH, malformed ECHConfig contents", ErrDetail: utils.ErrInvalidData}
+		}
+		c.publicKey = publicKey
+		c.publicName = string(publicName)
+		result = append(result, c)
+	}
+	if len(result) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "ECH, no supported ECHConfig in list", ErrDetail: utils.ErrInvalidData}
+	}
+	return
+}
+
+// GenerateECHKey 生成 一个 x25519 的 ECH 密钥, 返回 服务端 ech_key_files 所用 的 pem 文件 内容, 以及 客户端 ech_config 所用 的 ECHConfigList.
+// publicName 会 作为 外层 ClientHello 的 sni, 一般 填 一个 普通 的 域名, 服务端 要有 它的 证书.
+func GenerateECHKey(publicName string) (keyPem, configList []byte, err error) {
+	if publicName == "" || len(publicName) > 255 {
+		return nil, nil, utils.ErrInErr{ErrDesc: "ECH, invalid public name", ErrDetail: utils.ErrInvalidData, Data: publicName}
+	}
+
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(priv); err != nil {
+		return
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	var id [1]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(echVersion)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(id[0])
+			b.AddUint16(hpkeKemX25519)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(pub)
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, aead := range []uint16{hpkeAeadAes128Gcm, hpkeAeadChaCha20Poly1} {
+					b.AddUint16(hpkeKdfHkdfSha256)
+					b.AddUint16(aead)
+				}
+			})
+			b.AddUint8(0) //maximum_name_length, 0 表示 由 客户端 自行 决定 填充 长度
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(publicName))
+			})
+			b.AddUint16(0) //extensions
+		})
+	})
+	if configList, err = b.Bytes(); err != nil {
+		return
+	}
+
+	keyPem = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: append(append([]byte{}, x25519Pkcs8Prefix...), priv...)})
+	keyPem = append(keyPem, pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: configList})...)
+	return
+}
+
+type echKey struct {
+	config      []byte //单个 ECHConfig
+	privateKey  []byte
+	sendAsRetry bool
+}
+
+func parseECHKeyPem(bs []byte) (keys []echKey, err error) {
+	var priv, configList []byte
+	for {
+		var block *pem.Block
+		block, bs = pem.Decode(bs)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			if len(block.Bytes) != len(x25519Pkcs8Prefix)+curve25519.ScalarSize || !bytes.HasPrefix(block.Bytes, x25519Pkcs8Prefix) {
+				return nil, utils.ErrInErr{ErrDesc: "ECH, only x25519 private key is supported", ErrDetail: utils.ErrInvalidData}
+			}
+			priv = block.Bytes[len(x25519Pkcs8Prefix):]
+		case "ECHCONFIG":
+			configList = block.Bytes
+		}
+	}
+	if priv == nil || configList == nil {
+		return nil, utils.ErrInErr{ErrDesc: "ECH, key file needs both PRIVATE KEY and ECHCONFIG", ErrDetail: utils.ErrInvalidData}
+	}
+
+	configs, err := parseECHConfigList(configList)
+	if err != nil {
+		return
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	for _, c := range configs {
+		if c.kemId != hpkeKemX25519 || !bytes.Equal(c.publicKey, pub) {
+			return nil, utils.ErrInErr{ErrDesc: "ECH, ECHCONFIG doesn't match the private key", ErrDetail: utils.ErrInvalidData, Data: c.id}
+		}
+		keys = append(keys, echKey{config: c.raw, privateKey: priv})
+	}
+	return
+}
+
+// echKeyStore 保存 服务端 的 所有 ECH 密钥, 文件 变动 时 自动 重新加载.
+// 与 certStore 一样, 检查 在 握手时 进行.
+type echKeyStore struct {
+	files []string
+
+	mu       sync.RWMutex
+	keys     []echKey
+	modTimes []time.Time
+
+	lastCheck int64 //unix nano
+}
+
+func newECHKeyStore(files []string) (*echKeyStore, error) {
+	ks := &echKeyStore{files: files}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// 加载 所有 文件, 任何一个 失败 都 返回 错误, 并 继续 使用 旧的 密钥
+func (ks *echKeyStore) load() error {
+	atomic.StoreInt64(&ks.lastCheck, time.Now().UnixNano())
+
+	var keys []echKey
+	modTimes := make([]time.Time, len(ks.files))
+	for i, fn := range ks.files {
+		path := utils.GetFilePath(fn)
+		modTimes[i] = modTimeOf(path)
+
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return utils.ErrInErr{ErrDesc: "Failed in reading ECH key file", ErrDetail: err, Data: fn}
+		}
+		fileKeys, err := parseECHKeyPem(bs)
+		if err != nil {
+			return utils.ErrInErr{ErrDesc: "Failed in loading ECH key file", ErrDetail: err, Data: fn}
+		}
+		if i == 0 {
+			for j := range fileKeys {
+				fileKeys[j].sendAsRetry = true
+			}
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.modTimes = modTimes
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *echKeyStore) getKeys() []echKey {
+	now := time.Now().UnixNano()
+	if last := atomic.LoadInt64(&ks.lastCheck); now-last > int64(CertCheckInterval) && atomic.CompareAndSwapInt64(&ks.lastCheck, last, now) {
+		ks.reloadIfChanged()
+	}
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys
+}
+
+func (ks *echKeyStore) reloadIfChanged() {
+	ks.mu.RLock()
+	changed := false
+	for i, fn := range ks.files {
+		if !modTimeOf(utils.GetFilePath(fn)).Equal(ks.modTimes[i]) {
+			changed = true
+			break
+		}
+	}
+	ks.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := ks.load(); err != nil {
+		if ce := utils.CanLogErr("Failed in reloading ECH keys, still using old keys"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return
+	}
+	if ce := utils.CanLogInfo("ECH keys reloaded"); ce != nil {
+		ce.Write(zap.Strings("files", ks.files))
+	}
+}
+
+var echDnsMachine atomic.Pointer[netLayer.DNSMachine]
+
+// SetECHDnsMachine 设置 ech_dns 查询 HTTPS 记录 时 所用 的 DNSMachine, 在 加载 dns 配置 后 调用.
+func SetECHDnsMachine(dm *netLayer.DNSMachine) {
+	echDnsMachine.Store(dm)
+}
+
+type echClientConf struct {
+	configList []byte //ech_config
+	dnsDomain  string //ech_dns, 为空 则 不 查询 dns
+
+	mu     sync.Mutex
+	cached []byte //dns 查到的 或 服务端 给的 retry_configs
+	expire time.Time
+}
+
+func getECHClientConfFromExtra(extra map[string]any, host string) (*echClientConf, error) {
+	ec := &echClientConf{}
+
+	if str := getStringFromExtra(extra, "ech_config"); str != "" {
+		list, err := decodeHexOrBase64(str)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "ECH, ech_config is not base64", ErrDetail: err}
+		}
+		if _, err = parseECHConfigList(list); err != nil {
+			return nil, err
+		}
+		ec.configList = list
+	}
+
+	switch v := extra["ech_dns"].(type) {
+	case bool:
+		if v {
+			if host == "" {
+				return nil, utils.ErrInErr{ErrDesc: "ECH, ech_dns = true requires host", ErrDetail: utils.ErrInvalidData}
+			}
+			ec.dnsDomain = host
+		}
+	case string:
+		ec.dnsDomain = v
+	}
+	if ec.configList == nil && ec.dnsDomain == "" {
+		return nil, nil
+	}
+	return ec, nil
+}
+
+// 返回 握手 所用 的 ECHConfigList. 优先 使用 未过期 的 缓存, 然后 查询 dns, 最后 使用 ech_config.
+func (ec *echClientConf) getConfigList() ([]byte, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.cached != nil && time.Now().Before(ec.expire) {
+		return ec.cached, nil
+	}
+	if ec.dnsDomain == "" {
+		return ec.configList, nil
+	}
+
+	list, err := ec.queryDns()
+	if err == nil {
+		return list, nil
+	}
+	if ce := utils.CanLogErr("Failed in querying ECH config from dns"); ce != nil {
+		ce.Write(zap.String("domain", ec.dnsDomain), zap.Error(err))
+	}
+	if ec.configList != nil {
+		return ec.configList, nil
+	}
+	if ec.cached != nil {
+		return ec.cached, nil //过期的 也比 没有 好
+	}
+	return nil, err
+}
+
+// 调用者 需 持有 ec.mu
+func (ec *echClientConf) queryDns() ([]byte, error) {
+	dm := echDnsMachine.Load()
+	if dm == nil {
+		return nil, utils.ErrInErr{ErrDesc: "ECH, ech_dns requires dns config", ErrDetail: utils.ErrNilParameter}
+	}
+	list, ttl, err := dm.QueryECHConfig(ec.dnsDomain)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = parseECHConfigList(list); err != nil {
+		return nil, err
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d < echDnsMinTTL {
+		d = echDnsMinTTL
+	}
+	ec.cached = list
+	ec.expire = time.Now().Add(d)
+	return list, nil
+}
+
+// 服务端 拒绝 ECH 时 给出 的 新配置, 之后的 握手 使用 它
+func (ec *echClientConf) setRetryConfigs(list []byte) {
+	if _, err := parseECHConfigList(list); err != nil {
+		return
+	}
+	if ce := utils.CanLogInfo("ECH rejected by server, will use retry configs"); ce != nil {
+		ce.Write()
+	}
+	ec.mu.Lock()
+	ec.cached = list
+	ec.expire = time.Now().Add(echDnsMinTTL)
+	ec.mu.Unlock()
+}
+
+func getECHKeyFilesFromExtra(extra map[string]any) (files []string) {
+	switch v := extra["ech_key_files"].(type) {
+	case string:
+		if v != "" {
+			files = append(files, v)
+		}
+	case []any:
+		for _, f := range v {
+			if s, ok := f.(string); ok && s != "" {
+				files = append(files, s)
+			}
+		}
+	case []string:
+		files = v
+	}
+	return
+}
@@ -0,0 +1,34 @@
+//go:build go1.23
+
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+const echClientSupported = true
+
+// 用 go 的 crypto/tls 进行 ECH 握手. 服务端 拒绝 ECH 时 握手 失败, 但 会 记下 服务端 给的 retry_configs 供 之后 使用.
+func (c *Client) echHandshake(underlay net.Conn) (*tls.Conn, error) {
+	list, err := c.ech.getConfigList()
+	if err != nil {
+		return nil, err
+	}
+	config := c.tlsConfig.Clone()
+	config.EncryptedClientHelloConfigList = list
+	if config.InsecureSkipVerify {
+		//被拒绝 时 go 默认 要 验证 public_name 的 证书, 即使 设了 InsecureSkipVerify; 既然 用户 选了 insecure, 这里 也 不验证
+		config.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return nil }
+	}
+
+	tlsConn := tls.Client(underlay, config)
+	err = tlsConn.Handshake()
+
+	var rejectErr *tls.ECHRejectionError
+	if errors.As(err, &rejectErr) && len(rejectErr.RetryConfigList) > 0 {
+		c.ech.setRetryConfigs(rejectErr.RetryConfigList)
+	}
+	return tlsConn, err
+}
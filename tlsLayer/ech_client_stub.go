@@ -0,0 +1,16 @@
+//go:build !go1.23
+
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const echClientSupported = false
+
+func (c *Client) echHandshake(underlay net.Conn) (*tls.Conn, error) {
+	return nil, utils.ErrInErr{ErrDesc: "ECH client requires go1.23 or later", ErrDetail: utils.ErrUnImplemented}
+}
@@ -0,0 +1,18 @@
+//go:build go1.25
+
+package tlsLayer
+
+import "crypto/tls"
+
+const echServerSupported = true
+
+func (ks *echKeyStore) applyTo(conf *tls.Config) {
+	conf.GetEncryptedClientHelloKeys = func(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+		keys := ks.getKeys()
+		result := make([]tls.EncryptedClientHelloKey, len(keys))
+		for i, k := range keys {
+			result[i] = tls.EncryptedClientHelloKey{Config: k.config, PrivateKey: k.privateKey, SendAsRetry: k.sendAsRetry}
+		}
+		return result, nil
+	}
+}
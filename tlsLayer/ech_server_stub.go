@@ -0,0 +1,9 @@
+//go:build !go1.25
+
+package tlsLayer
+
+import "crypto/tls"
+
+const echServerSupported = false
+
+func (ks *echKeyStore) applyTo(conf *tls.Config) {}
@@ -0,0 +1,197 @@
+//go:build go1.25
+
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+)
+
+func generateECHFile(t *testing.T, fn string) []byte {
+	keyPem, configList, err := GenerateECHKey("public.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(fn, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configList
+}
+
+// 在 tcp 上 进行 一次 握手, 返回 客户端 和 服务端 的 ECHAccepted 以及 服务端 看到的 sni
+func echHandshake(t *testing.T, c *Client, s *Server) (clientAccepted, serverAccepted bool, serverName string, err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		state tls.ConnectionState
+		err   error
+	}
+	serverResult := make(chan result, 1)
+	go func() {
+		sc, err := ln.Accept()
+		if err != nil {
+			serverResult <- result{err: err}
+			return
+		}
+		defer sc.Close()
+		tc, err := s.Handshake(sc)
+		if err != nil {
+			serverResult <- result{err: err}
+			return
+		}
+		serverResult <- result{state: tc.(*conn).Conn.(*tls.Conn).ConnectionState()}
+	}()
+
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	tc, err := c.Handshake(cc)
+	if err != nil {
+		return
+	}
+	clientAccepted = tc.(*conn).Conn.(*tls.Conn).ConnectionState().ECHAccepted
+
+	r := <-serverResult
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return clientAccepted, r.state.ECHAccepted, r.state.ServerName, nil
+}
+
+func newECHClient(t *testing.T, extra map[string]any) *Client {
+	c, err := NewClient(Conf{Host: "secret.example.com", Insecure: true, Extra: extra})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestECH(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	dir := t.TempDir()
+	cur, old := filepath.Join(dir, "ech.pem"), filepath.Join(dir, "ech_old.pem")
+	list0 := generateECHFile(t, old)
+	list1 := generateECHFile(t, cur)
+
+	s, err := NewServer(Conf{Host: "secret.example.com", Extra: map[string]any{"ech_key_files": []any{cur, old}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := newECHClient(t, map[string]any{"ech_config": base64.StdEncoding.EncodeToString(list1)})
+	ca, sa, sni, err := echHandshake(t, c1, s)
+	if err != nil || !ca || !sa || sni != "secret.example.com" {
+		t.Fatal("ech with current key", ca, sa, sni, err)
+	}
+
+	//外层 ClientHello 中 只有 public_name
+	cs := ComSniff{}
+	cs.CommonDetect(captureClientHello(t, c1), true, true)
+	if cs.SniffedServerName != "public.example.com" {
+		t.Fatal("outer sni", cs.SniffedServerName)
+	}
+
+	c0 := newECHClient(t, map[string]any{"ech_config": base64.StdEncoding.EncodeToString(list0)})
+	if ca, sa, _, err = echHandshake(t, c0, s); err != nil || !ca || !sa {
+		t.Fatal("ech with old key", ca, sa, err)
+	}
+
+	//轮换: 当前 密钥 变为 旧的, 最早的 密钥 不再 可用
+	oldInterval := CertCheckInterval
+	CertCheckInterval = 0
+	defer func() { CertCheckInterval = oldInterval }()
+
+	bs, _ := os.ReadFile(cur)
+	os.WriteFile(old, bs, 0600)
+	list2 := generateECHFile(t, cur)
+	time.Sleep(time.Millisecond)
+
+	if ca, sa, _, err = echHandshake(t, c1, s); err != nil || !ca || !sa {
+		t.Fatal("ech with rotated old key", ca, sa, err)
+	}
+
+	//c0 的 配置 已 失效, 握手 失败, 之后 使用 服务端 给的 retry_configs
+	if _, _, _, err = echHandshake(t, c0, s); err == nil {
+		t.Fatal("should be rejected with removed key")
+	}
+	if got, _ := c0.ech.getConfigList(); string(got) != string(list2) {
+		t.Fatal("retry configs not used", err)
+	}
+	if ca, sa, _, err = echHandshake(t, c0, s); err != nil || !ca || !sa {
+		t.Fatal("ech with retry configs", ca, sa, err)
+	}
+
+	//utls 不支持 ECH, 加载 配置 时 就 应 报错
+	if _, err = NewClient(Conf{Host: "secret.example.com", Tls_type: UTls_t, Insecure: true, Extra: map[string]any{"ech_config": base64.StdEncoding.EncodeToString(list2)}}); err == nil {
+		t.Fatal("utls with ech_config should be rejected")
+	}
+	if _, err = NewClient(Conf{Host: "secret.example.com", Tls_type: UTls_t, Insecure: true, Extra: map[string]any{"ech_dns": true}}); err == nil {
+		t.Fatal("utls with ech_dns should be rejected")
+	}
+}
+
+func TestECHFromDNS(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "ech.pem")
+	list := generateECHFile(t, fn)
+
+	s, err := NewServer(Conf{Host: "secret.example.com", Extra: map[string]any{"ech_key_files": fn}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsServer := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeHTTPS && q.Name == "secret.example.com." {
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300}
+			m.Answer = append(m.Answer,
+				&dns.HTTPS{SVCB: dns.SVCB{Hdr: hdr, Priority: 2, Target: ".", Value: []dns.SVCBKeyValue{&dns.SVCBECHConfig{ECH: []byte{0, 0}}}}},
+				&dns.HTTPS{SVCB: dns.SVCB{Hdr: hdr, Priority: 1, Target: ".", Value: []dns.SVCBKeyValue{&dns.SVCBECHConfig{ECH: list}}}},
+			)
+		}
+		w.WriteMsg(m)
+	})}
+	go dnsServer.ActivateAndServe()
+	defer dnsServer.Shutdown()
+
+	c := newECHClient(t, map[string]any{"ech_dns": true})
+
+	SetECHDnsMachine(nil)
+	if _, _, _, err = echHandshake(t, c, s); err == nil {
+		t.Fatal("ech_dns without dns machine should fail")
+	}
+
+	SetECHDnsMachine(netLayer.LoadDnsMachine(&netLayer.DnsConf{Servers: []any{"udp://" + pc.LocalAddr().String()}}))
+	defer SetECHDnsMachine(nil)
+
+	ca, sa, sni, err := echHandshake(t, c, s)
+	if err != nil || !ca || !sa || sni != "secret.example.com" {
+		t.Fatal("ech from dns", ca, sa, sni, err)
+	}
+}
@@ -0,0 +1,307 @@
+package tlsLayer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+/*
+HelloFingerprint 是 由 ClientHello 计算出的 客户端 指纹, 可用于 日志, 分流 和 回落, 以 识别 扫描器 等 非浏览器 客户端.
+
+JA3 见 https://github.com/salesforce/ja3
+
+	SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+
+JA4 见 https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+
+	如 t13d1516h2_8daaf6152771_e5627efa2ab1
+
+两者 都 忽略 GREASE 值.
+*/
+type HelloFingerprint struct {
+	JA3     string `json:"ja3"`
+	JA3Hash string `json:"ja3_hash"` //JA3 的 md5 hex, 一般 说的 ja3 指纹 指的 就是 这个
+	JA4     string `json:"ja4"`
+}
+
+// 返回 用于 匹配 的 所有 指纹 字符串, 即 JA4 和 JA3Hash
+func (fp *HelloFingerprint) Strings() []string {
+	return []string{fp.JA4, fp.JA3Hash}
+}
+
+const (
+	et_ec_point_formats = 11
+)
+
+func isGreaseValue(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// 从 r 读取 第一个 完整 的 tls 记录 到 buf, 返回 读到 的 长度; ClientHello 可能 被 分 在 多个 tcp 段 中 (如 较大 的 后量子 key share),
+// 所以 要 按 记录头 中 的 长度 读完, 才能 用 ParseHelloFingerprint 解析.
+// 不是 握手 记录 时 只 返回 记录头, 交给 之后 的 tls 握手 去 报错.
+func ReadHelloRecord(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf[:5])
+	if err != nil || buf[0] != 22 {
+		return n, err
+	}
+	recordLen := 5 + (int(buf[3])<<8 | int(buf[4]))
+	if recordLen > len(buf) {
+		return n, nil
+	}
+	m, err := io.ReadFull(r, buf[5:recordLen])
+	return n + m, err
+}
+
+// p 为 含有 记录头 的 tls 记录, 其中 要有 完整的 ClientHello
+func ParseHelloFingerprint(p []byte) (*HelloFingerprint, error) {
+	if len(p) < 5 || p[0] != 22 {
+		return nil, utils.ErrInErr{ErrDesc: "ParseHelloFingerprint, not a tls handshake record", ErrDetail: utils.ErrInvalidData}
+	}
+	recordLen := int(p[3])<<8 | int(p[4])
+	if len(p) < 5+recordLen {
+		return nil, utils.ErrInErr{ErrDesc: "ParseHelloFingerprint, record not complete", ErrDetail: utils.ErrInvalidData, Data: len(p)}
+	}
+	return parseHelloMsgFingerprint(p[5:5+recordLen], 't')
+}
+
+type helloFingerprintFields struct {
+	version           uint16
+	ciphers           []uint16
+	extensions        []uint16
+	curves            []uint16
+	pointFormats      []uint8
+	sigAlgs           []uint16
+	supportedVersions []uint16
+	alpn              string //第一个 alpn
+	hasSni            bool
+}
+
+// msg 为 握手消息, 从 HandshakeType 开始. proto 为 ja4 的 第一个 字符, tcp 为 't', quic 为 'q'
+func parseHelloMsgFingerprint(msg []byte, proto byte) (*HelloFingerprint, error) {
+	var f helloFingerprintFields
+
+	if !f.parse(msg) {
+		return nil, utils.ErrInErr{ErrDesc: "ParseHelloFingerprint, malformed ClientHello", ErrDetail: utils.ErrInvalidData}
+	}
+	return &HelloFingerprint{
+		JA3:     f.ja3(),
+		JA3Hash: f.ja3Hash(),
+		JA4:     f.ja4(proto),
+	}, nil
+}
+
+func readUint16List(s *cryptobyte.String, list *[]uint16) bool {
+	for !s.Empty() {
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return false
+		}
+		*list = append(*list, v)
+	}
+	return true
+}
+
+func (f *helloFingerprintFields) parse(msg []byte) bool {
+	s := cryptobyte.String(msg)
+
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) {
+		return false
+	}
+
+	var sessionId, suites, compressions cryptobyte.String
+	if !body.ReadUint16(&f.version) || !body.Skip(32) || !body.ReadUint8LengthPrefixed(&sessionId) ||
+		!body.ReadUint16LengthPrefixed(&suites) || !readUint16List(&suites, &f.ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compressions) {
+		return false
+	}
+	if body.Empty() {
+		return true
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return false
+	}
+	for !extensions.Empty() {
+		var et uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&et) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return false
+		}
+		f.extensions = append(f.extensions, et)
+
+		switch et {
+		case et_server_name:
+			f.hasSni = true
+		case et_supported_groups:
+			var list cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&list) || !readUint16List(&list, &f.curves) {
+				return false
+			}
+		case et_ec_point_formats:
+			if !ext.ReadUint8LengthPrefixed((*cryptobyte.String)(&f.pointFormats)) {
+				return false
+			}
+		case et_signature_algorithms:
+			var list cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&list) || !readUint16List(&list, &f.sigAlgs) {
+				return false
+			}
+		case et_supported_versions:
+			var list cryptobyte.String
+			if !ext.ReadUint8LengthPrefixed(&list) || !readUint16List(&list, &f.supportedVersions) {
+				return false
+			}
+		case et_application_layer_protocol_negotiation:
+			var list, proto cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&list) || !list.ReadUint8LengthPrefixed(&proto) {
+				return false
+			}
+			f.alpn = string(proto)
+		}
+	}
+	return true
+}
+
+func joinUint16s(list []uint16, sep string, format func(uint16) string) string {
+	strs := make([]string, 0, len(list))
+	for _, v := range list {
+		if !isGreaseValue(v) {
+			strs = append(strs, format(v))
+		}
+	}
+	return strings.Join(strs, sep)
+}
+
+func decUint16(v uint16) string { return strconv.Itoa(int(v)) }
+func hexUint16(v uint16) string { return fmt.Sprintf("%04x", v) }
+
+func (f *helloFingerprintFields) ja3() string {
+	points := make([]string, len(f.pointFormats))
+	for i, v := range f.pointFormats {
+		points[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join([]string{
+		decUint16(f.version),
+		joinUint16s(f.ciphers, "-", decUint16),
+		joinUint16s(f.extensions, "-", decUint16),
+		joinUint16s(f.curves, "-", decUint16),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+func (f *helloFingerprintFields) ja3Hash() string {
+	sum := md5.Sum([]byte(f.ja3()))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlnum(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func (f *helloFingerprintFields) ja4(proto byte) string {
+	var sb strings.Builder
+	sb.WriteByte(proto)
+
+	//有 supported_versions 时 使用 其中 最高的 版本
+	version := f.version
+	if len(f.supportedVersions) > 0 {
+		version = 0
+		for _, v := range f.supportedVersions {
+			if !isGreaseValue(v) && v > version {
+				version = v
+			}
+		}
+	}
+	switch version {
+	case 0x0304:
+		sb.WriteString("13")
+	case 0x0303:
+		sb.WriteString("12")
+	case 0x0302:
+		sb.WriteString("11")
+	case 0x0301:
+		sb.WriteString("10")
+	case 0x0300:
+		sb.WriteString("s3")
+	default:
+		sb.WriteString("00")
+	}
+
+	if f.hasSni {
+		sb.WriteByte('d')
+	} else {
+		sb.WriteByte('i')
+	}
+
+	var ciphers, extensions, sortedExts []uint16
+	for _, v := range f.ciphers {
+		if !isGreaseValue(v) {
+			ciphers = append(ciphers, v)
+		}
+	}
+	for _, v := range f.extensions {
+		if isGreaseValue(v) {
+			continue
+		}
+		extensions = append(extensions, v)
+		if v != et_server_name && v != et_application_layer_protocol_negotiation {
+			sortedExts = append(sortedExts, v)
+		}
+	}
+	count := func(n int) string {
+		if n > 99 {
+			n = 99
+		}
+		return fmt.Sprintf("%02d", n)
+	}
+	sb.WriteString(count(len(ciphers)))
+	sb.WriteString(count(len(extensions)))
+
+	switch alpn := f.alpn; {
+	case alpn == "":
+		sb.WriteString("00")
+	case isAlnum(alpn[0]) && isAlnum(alpn[len(alpn)-1]):
+		sb.WriteByte(alpn[0])
+		sb.WriteByte(alpn[len(alpn)-1])
+	default:
+		h := hex.EncodeToString([]byte(alpn))
+		sb.WriteByte(h[0])
+		sb.WriteByte(h[len(h)-1])
+	}
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+
+	sb.WriteByte('_')
+	sb.WriteString(ja4Hash(joinUint16s(ciphers, ",", hexUint16)))
+	sb.WriteByte('_')
+
+	extStr := joinUint16s(sortedExts, ",", hexUint16)
+	if extStr != "" && len(f.sigAlgs) > 0 {
+		extStr += "_" + joinUint16s(f.sigAlgs, ",", hexUint16)
+	}
+	sb.WriteString(ja4Hash(extStr))
+
+	return sb.String()
+}
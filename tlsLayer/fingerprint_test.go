@@ -0,0 +1,216 @@
+package tlsLayer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestHelloFingerprint(t *testing.T) {
+	conf := utlsSpecConf{
+		TlsVersion:   "0x0303",
+		CipherSuites: []any{"GREASE", "TLS_AES_128_GCM_SHA256", float64(0xc02b)},
+		Extensions: []utlsSpecExtConf{
+			{Type: "GREASE"},
+			{Type: "server_name"},
+			{Type: "supported_groups", Data: "0006 0a0a 001d 0017"},
+			{Type: "ec_point_formats", Data: "0100"},
+			{Type: "signature_algorithms", Data: "0004 0403 0804"},
+			{Type: "alpn", Data: "000c 02683208687474702f312e31"},
+			{Type: float64(43), Data: "04 0a0a 0304"},
+		},
+	}
+	raw, err := conf.buildClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := ParseHelloFingerprint(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantJA3 := "771,4865-49195,0-10-11-13-16-43,29-23,0"
+	if fp.JA3 != wantJA3 {
+		t.Fatal("ja3", fp.JA3, "want", wantJA3)
+	}
+	sum := md5.Sum([]byte(wantJA3))
+	if fp.JA3Hash != hex.EncodeToString(sum[:]) {
+		t.Fatal("ja3 hash", fp.JA3Hash)
+	}
+
+	hash12 := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+	wantJA4 := "t13d0206h2_" + hash12("1301,c02b") + "_" + hash12("000a,000b,000d,002b_0403,0804")
+	if fp.JA4 != wantJA4 {
+		t.Fatal("ja4", fp.JA4, "want", wantJA4)
+	}
+
+	//ComSniff 探测 时 也会 计算 指纹
+	cs := ComSniff{ShouldSniffFingerprint: true}
+	cs.CommonDetect(raw, true, true)
+	if cs.SniffedFingerprint == nil || *cs.SniffedFingerprint != *fp {
+		t.Fatal("ComSniff fingerprint not match", cs.SniffedFingerprint)
+	}
+
+	//不完整 的 记录
+	if _, err := ParseHelloFingerprint(raw[:len(raw)-1]); err == nil {
+		t.Fatal("should fail with incomplete record")
+	}
+}
+
+// ClientHello 分 在 两个 tcp 段 中 时 也要 读到 完整 的 记录 再 计算 指纹
+func TestReadHelloRecordSplit(t *testing.T) {
+	conf := utlsSpecConf{
+		TlsVersion:   "0x0303",
+		CipherSuites: []any{"TLS_AES_128_GCM_SHA256"},
+		Extensions: []utlsSpecExtConf{
+			{Type: "server_name"},
+			{Type: "supported_groups", Data: "0002 001d"},
+		},
+	}
+	raw, err := conf.buildClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ParseHelloFingerprint(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		c1.Write(raw[:len(raw)/2])
+		c1.Write(raw[len(raw)/2:])
+		c1.Write([]byte("after"))
+		c1.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	n, err := ReadHelloRecord(c2, buf)
+	if err != nil || n != len(raw) {
+		t.Fatal(n, len(raw), err)
+	}
+	fp, err := ParseHelloFingerprint(buf[:n])
+	if err != nil || *fp != *want {
+		t.Fatal(fp, err)
+	}
+
+	//记录 之后 的 数据 不应 被 读走
+	rest := make([]byte, 5)
+	if _, err := readFull(c2, rest); err != nil || string(rest) != "after" {
+		t.Fatal(string(rest), err)
+	}
+}
+
+// 返回 客户端 发出的 第一个 tls 记录
+func captureClientHello(t *testing.T, c *Client) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	go func() {
+		c.Handshake(c1)
+		c1.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := readFull(c2, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(header[3])<<8+int(header[4]))
+	copy(record, header)
+	if _, err := readFull(c2, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func readFull(c net.Conn, p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := c.Read(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func TestUtlsSpecFile(t *testing.T) {
+	//用 utls 的 chrome 预设 生成 一个 ClientHello, 作为 "抓包" 结果
+	uconn := utls.UClient(nil, &utls.Config{ServerName: "www.example.com"}, utls.HelloChrome_102)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	msg := uconn.HandshakeState.Hello.Raw
+	captured := append([]byte{22, 3, 1, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	want, err := ParseHelloFingerprint(captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//公开的 chrome ja4
+	if want.JA4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Fatal("chrome ja4", want.JA4)
+	}
+
+	fn := filepath.Join(t.TempDir(), "chrome.json")
+	os.WriteFile(fn, []byte(`{ "client_hello": "`+hex.EncodeToString(captured)+`" }`), 0600)
+
+	c, err := NewClient(Conf{
+		Host:     "www.example.com",
+		Tls_type: UTls_t,
+		Extra:    map[string]any{"utls_spec_file": fn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.utlsSpec == nil {
+		t.Fatal("spec not loaded")
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := ParseHelloFingerprint(captureClientHello(t, c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != *want {
+			t.Fatal("fingerprint not match", got, want)
+		}
+	}
+
+	//默认 使用 chrome, 与 firefox 的 指纹 不同
+	firefox, err := NewClient(Conf{
+		Host:     "www.example.com",
+		Tls_type: UTls_t,
+		Extra:    map[string]any{"utls_fingerprint": "firefox"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseHelloFingerprint(captureClientHello(t, firefox))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.JA3Hash == want.JA3Hash || !strings.HasPrefix(got.JA4, "t13d") {
+		t.Fatal("unexpected firefox fingerprint", got)
+	}
+
+	//utls 不支持 的 扩展
+	if _, err := newUtlsSpec(utlsSpecConf{
+		CipherSuites: []any{"0x1301"},
+		Extensions:   []utlsSpecExtConf{{Type: "0x1234"}},
+	}); err == nil {
+		t.Fatal("should fail with unknown extension")
+	}
+}
@@ -0,0 +1,507 @@
+package tlsLayer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	utls "github.com/refraction-networking/utls"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+REALITY, 与 xray 的 实现 互通. https://github.com/XTLS/REALITY
+
+客户端 用 utls 指纹 发出 ClientHello, session id 中 放的是 用 认证密钥 加密的 版本号, 时间 与 short id;
+认证密钥 由 客户端 key_share 中的 x25519 临时公钥 与 服务端 的 静态公钥 协商 得到:
+
+	authKey = hkdf(sha256, x25519(clientKeyShare, serverKey), salt=random[:20], info="REALITY")
+	sessionId = aes_gcm(authKey).Seal(nonce=random[20:], plaintext=ver(3) 0 time(4) shortId(8), aad=ClientHello(session id 为全0))
+
+服务端 能 解开 且 short id 正确, 就 完成 tls1.3 握手, 发给 客户端 的 证书 是 临时的 ed25519 证书,
+其 签名 被 替换成了 hmac_sha512(authKey, 证书公钥), 客户端 以此 确认 对方 是 真服务端.
+
+否则 服务端 就 把 连接 原封不动 地 转发 到 dest (一个 真实的 tls1.3 网站), 与 shadowTls 类似, 审查者 看到的 是 真网站的 证书.
+
+配置 均在 extra 中:
+
+服务端: reality_private_key, reality_short_ids, reality_server_names (默认 为 host), reality_dest (默认 为 host:443),
+reality_max_time_diff (秒, 默认 不检查)
+
+客户端: reality_public_key, reality_short_id, utls_fingerprint (默认 chrome; 必须是 首个 key_share 为 x25519 的 tls1.3 指纹,
+如 chrome, firefox, safari, ios, edge)
+
+密钥 格式 与 xray x25519 命令 输出的 相同 (base64 RawURLEncoding), 可用 GenerateRealityKeyPair 生成.
+*/
+
+const (
+	realityShortIdMaxLen = 8
+
+	helloSessionIdOffset = 39 //ClientHello 中 session id 的 固定位置: 握手头(4) 版本(2) random(32) session id 长度(1)
+)
+
+// 放在 session id 前3字节 的 客户端版本号, xray 服务端 可以 按它 限制 客户端版本
+var realityClientVersion = [3]byte{1, 8, 0}
+
+// GenerateRealityKeyPair 生成 一对 x25519 密钥, 私钥 给 服务端, 公钥 给 客户端.
+func GenerateRealityKeyPair() (privateKey, publicKey string, err error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(priv); err != nil {
+		return
+	}
+	//与 xray 一样 clamp
+	priv[0] &= 248
+	priv[31] &= 127
+	priv[31] |= 64
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	privateKey = base64.RawURLEncoding.EncodeToString(priv)
+	publicKey = base64.RawURLEncoding.EncodeToString(pub)
+	return
+}
+
+func decodeRealityKey(str string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != curve25519.ScalarSize {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY key length must be 32", ErrDetail: utils.ErrInvalidData, Data: len(key)}
+	}
+	return key, nil
+}
+
+// short id 为 至多16位 的 十六进制字符串, 可以为空
+func decodeRealityShortId(str string) (id [realityShortIdMaxLen]byte, err error) {
+	if len(str) > realityShortIdMaxLen*2 {
+		err = utils.ErrInErr{ErrDesc: "REALITY short id too long", ErrDetail: utils.ErrInvalidData, Data: str}
+		return
+	}
+	_, err = hex.Decode(id[:], []byte(str))
+	return
+}
+
+// 由 认证密钥 导出 aes-gcm, 两端 通用
+func newRealityAEAD(sharedKey, random []byte) (authKey []byte, aead cipher.AEAD, err error) {
+	authKey = sharedKey
+	if _, err = hkdf.New(sha256.New, authKey, random[:20], []byte("REALITY")).Read(authKey); err != nil {
+		return
+	}
+	block, err := aes.NewCipher(authKey)
+	if err != nil {
+		return
+	}
+	aead, err = cipher.NewGCM(block)
+	return
+}
+
+func realityCertSignature(authKey []byte, pub ed25519.PublicKey) []byte {
+	h := hmac.New(sha512.New, authKey)
+	h.Write(pub)
+	return h.Sum(nil)
+}
+
+type realityClientConf struct {
+	publicKey []byte
+	shortId   [realityShortIdMaxLen]byte
+}
+
+func newRealityClientConf(extra map[string]any) (rc *realityClientConf, err error) {
+	rc = new(realityClientConf)
+	if rc.publicKey, err = decodeRealityKey(getStringFromExtra(extra, "reality_public_key")); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY client invalid reality_public_key", ErrDetail: err}
+	}
+	if rc.shortId, err = decodeRealityShortId(getStringFromExtra(extra, "reality_short_id")); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY client invalid reality_short_id", ErrDetail: err}
+	}
+	return
+}
+
+func (c *Client) realityHandshake(underlay net.Conn) (result net.Conn, err error) {
+	if c.reality == nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY client not configured", ErrDetail: c.realityErr}
+	}
+
+	var authKey []byte
+
+	configCopy := c.uTlsConfig.Clone()
+	configCopy.SessionTicketsDisabled = true
+	configCopy.InsecureSkipVerify = true //证书 是 服务端 临时生成的, 靠 VerifyPeerCertificate 验证
+	configCopy.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) > 0 {
+			if cert, err := x509.ParseCertificate(rawCerts[0]); err == nil {
+				if pub, ok := cert.PublicKey.(ed25519.PublicKey); ok && hmac.Equal(realityCertSignature(authKey, pub), cert.Signature) {
+					return nil
+				}
+			}
+		}
+		return errors.New("REALITY: processed invalid connection")
+	}
+
+	uconn, err := c.newUClient(underlay, configCopy)
+	if err != nil {
+		return
+	}
+	if err = uconn.BuildHandshakeState(); err != nil {
+		return
+	}
+	hello := uconn.HandshakeState.Hello
+	ecdhe := uconn.HandshakeState.State13.EcdheParams
+	if ecdhe == nil || ecdhe.CurveID() != utls.X25519 || len(hello.Raw) < helloSessionIdOffset+32 {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY requires a utls fingerprint whose first key share is x25519", ErrDetail: utils.ErrInvalidData, Data: uconn.ClientHelloID.Str()}
+	}
+
+	hello.SessionId = make([]byte, 32)
+	copy(hello.Raw[helloSessionIdOffset:], hello.SessionId)
+
+	copy(hello.SessionId, realityClientVersion[:])
+	binary.BigEndian.PutUint32(hello.SessionId[4:], uint32(time.Now().Unix()))
+	copy(hello.SessionId[8:], c.reality.shortId[:])
+
+	sharedKey := ecdhe.SharedKey(c.reality.publicKey)
+	if sharedKey == nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY client failed to compute shared key", ErrDetail: utils.ErrInvalidData}
+	}
+	var aead cipher.AEAD
+	authKey, aead, err = newRealityAEAD(sharedKey, hello.Random)
+	if err != nil {
+		return
+	}
+	aead.Seal(hello.SessionId[:0], hello.Random[20:], hello.SessionId[:16], hello.Raw)
+	copy(hello.Raw[helloSessionIdOffset:], hello.SessionId)
+
+	if err = uconn.Handshake(); err != nil {
+		return
+	}
+	result = &conn{
+		Conn:    uconn,
+		ptr:     unsafe.Pointer(uconn.Conn),
+		tlsType: UTls_t,
+	}
+	return
+}
+
+type realityServer struct {
+	privateKey  []byte
+	shortIds    map[[realityShortIdMaxLen]byte]bool
+	serverNames map[string]bool
+	dest        string
+	maxTimeDiff time.Duration
+	alpnList    []string
+
+	certKey ed25519.PrivateKey
+	certDER []byte //签名 部分 在 每次握手时 被 替换
+}
+
+func newRealityServer(conf Conf) (rs *realityServer, err error) {
+	rs = &realityServer{
+		shortIds:    make(map[[realityShortIdMaxLen]byte]bool),
+		serverNames: make(map[string]bool),
+		alpnList:    conf.AlpnList,
+	}
+	if rs.privateKey, err = decodeRealityKey(getStringFromExtra(conf.Extra, "reality_private_key")); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY server invalid reality_private_key", ErrDetail: err}
+	}
+
+	shortIds := getStringsFromExtra(conf.Extra, "reality_short_ids")
+	if len(shortIds) == 0 {
+		shortIds = []string{""}
+	}
+	for _, str := range shortIds {
+		id, err := decodeRealityShortId(str)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "REALITY server invalid reality_short_ids", ErrDetail: err}
+		}
+		rs.shortIds[id] = true
+	}
+
+	serverNames := getStringsFromExtra(conf.Extra, "reality_server_names")
+	if len(serverNames) == 0 && conf.Host != "" {
+		serverNames = []string{conf.Host}
+	}
+	if len(serverNames) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY server requires reality_server_names or host", ErrDetail: utils.ErrInvalidData}
+	}
+	for _, name := range serverNames {
+		rs.serverNames[strings.ToLower(name)] = true
+	}
+
+	rs.dest = getStringFromExtra(conf.Extra, "reality_dest")
+	if rs.dest == "" {
+		rs.dest = serverNames[0] + ":443"
+	}
+
+	if sec, ok := utils.AnyToInt64(conf.Extra["reality_max_time_diff"]); ok && sec > 0 {
+		rs.maxTimeDiff = time.Duration(sec) * time.Second
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	rs.certKey = priv
+	template := &x509.Certificate{SerialNumber: big.NewInt(0)}
+	rs.certDER, err = x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	return
+}
+
+// 只有 tls1.3 且 带有 x25519 key_share 的 ClientHello 才可能 是 reality 客户端
+type realityClientHello struct {
+	raw           []byte //握手消息, 不含 记录头
+	random        []byte
+	sessionId     []byte
+	cipherSuites  []uint16
+	serverName    string
+	alpnProtocols []string
+	keyShare      []byte //x25519
+	supportsTLS13 bool
+}
+
+func parseRealityClientHello(raw []byte) (*realityClientHello, bool) {
+	m := &realityClientHello{raw: raw}
+	s := cryptobyte.String(raw)
+
+	var msgType uint8
+	var body cryptobyte.String
+	var legacyVersion uint16
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) || !s.Empty() ||
+		!body.ReadUint16(&legacyVersion) || !body.ReadBytes(&m.random, 32) ||
+		!body.ReadUint8LengthPrefixed((*cryptobyte.String)(&m.sessionId)) {
+		return nil, false
+	}
+
+	var suites, compressions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&suites) || !body.ReadUint8LengthPrefixed(&compressions) {
+		return nil, false
+	}
+	for !suites.Empty() {
+		var suite uint16
+		if !suites.ReadUint16(&suite) {
+			return nil, false
+		}
+		m.cipherSuites = append(m.cipherSuites, suite)
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) || !body.Empty() {
+		return nil, false
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return nil, false
+		}
+		switch extType {
+		case et_server_name:
+			var names cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&names) {
+				return nil, false
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					return nil, false
+				}
+				if nameType == 0 {
+					m.serverName = string(name)
+				}
+			}
+		case et_application_layer_protocol_negotiation:
+			var protos cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&protos) {
+				return nil, false
+			}
+			for !protos.Empty() {
+				var proto cryptobyte.String
+				if !protos.ReadUint8LengthPrefixed(&proto) {
+					return nil, false
+				}
+				m.alpnProtocols = append(m.alpnProtocols, string(proto))
+			}
+		case et_supported_versions:
+			var versions cryptobyte.String
+			if !ext.ReadUint8LengthPrefixed(&versions) {
+				return nil, false
+			}
+			for !versions.Empty() {
+				var v uint16
+				if !versions.ReadUint16(&v) {
+					return nil, false
+				}
+				if v == tls.VersionTLS13 {
+					m.supportsTLS13 = true
+				}
+			}
+		case et_key_share:
+			var shares cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&shares) {
+				return nil, false
+			}
+			for !shares.Empty() {
+				var group uint16
+				var key cryptobyte.String
+				if !shares.ReadUint16(&group) || !shares.ReadUint16LengthPrefixed(&key) {
+					return nil, false
+				}
+				if group == uint16(utls.X25519) && m.keyShare == nil {
+					m.keyShare = key
+				}
+			}
+		}
+	}
+	return m, true
+}
+
+// 验证 客户端. 返回 认证密钥, 失败 时 返回 原因
+func (rs *realityServer) auth(hello *realityClientHello) (authKey []byte, reason string) {
+	if !hello.supportsTLS13 {
+		return nil, "no tls1.3"
+	}
+	if !rs.serverNames[strings.ToLower(hello.serverName)] {
+		return nil, "server name not allowed"
+	}
+	if len(hello.sessionId) != 32 || len(hello.keyShare) != curve25519.PointSize {
+		return nil, "no x25519 key share or session id"
+	}
+
+	sharedKey, err := curve25519.X25519(rs.privateKey, hello.keyShare)
+	if err != nil {
+		return nil, "bad key share"
+	}
+	authKey, aead, err := newRealityAEAD(sharedKey, hello.random)
+	if err != nil {
+		return nil, "bad auth key"
+	}
+
+	aad := make([]byte, len(hello.raw))
+	copy(aad, hello.raw)
+	copy(aad[helloSessionIdOffset:helloSessionIdOffset+32], make([]byte, 32))
+
+	plain, err := aead.Open(nil, hello.random[20:], hello.sessionId, aad)
+	if err != nil || len(plain) != 16 {
+		return nil, "decrypt session id failed"
+	}
+
+	var shortId [realityShortIdMaxLen]byte
+	copy(shortId[:], plain[8:])
+	if !rs.shortIds[shortId] {
+		return nil, "short id not allowed"
+	}
+
+	if rs.maxTimeDiff > 0 {
+		diff := time.Since(time.Unix(int64(binary.BigEndian.Uint32(plain[4:8])), 0))
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > rs.maxTimeDiff {
+			return nil, "time diff too large"
+		}
+	}
+	return authKey, ""
+}
+
+// 读取 ClientHello 所在的 记录. 返回 读到的 所有数据 (包括记录头), 以便 回落时 原样 转发
+func readRealityClientHello(clientConn net.Conn) (record []byte, hello *realityClientHello, err error) {
+	netLayer.SetCommonReadTimeout(clientConn)
+	defer netLayer.PersistRead(clientConn)
+
+	var header [recordHeaderLen]byte
+	if _, err = io.ReadFull(clientConn, header[:]); err != nil {
+		return
+	}
+	record = header[:]
+
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if header[0] != recordTypeHandshake || length > maxPlaintext {
+		return
+	}
+	record = make([]byte, recordHeaderLen+length)
+	copy(record, header[:])
+	if _, err = io.ReadFull(clientConn, record[recordHeaderLen:]); err != nil {
+		return
+	}
+
+	hello, _ = parseRealityClientHello(record[recordHeaderLen:])
+	return
+}
+
+func (rs *realityServer) handshake(clientConn net.Conn) (net.Conn, error) {
+	record, hello, err := readRealityClientHello(clientConn)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY failed to read ClientHello", ErrDetail: err}
+	}
+
+	reason := "not a tls1.3 ClientHello"
+	if hello != nil {
+		var authKey []byte
+		if authKey, reason = rs.auth(hello); authKey != nil {
+			if ce := utils.CanLogDebug("REALITY client authenticated"); ce != nil {
+				ce.Write(zap.String("sni", hello.serverName))
+			}
+			return rs.serverHandshake(clientConn, hello, authKey)
+		}
+	}
+
+	if ce := utils.CanLogWarn("REALITY not a valid client, fallback to dest"); ce != nil {
+		ce.Write(zap.String("reason", reason), zap.String("dest", rs.dest))
+	}
+	return nil, rs.fallback(clientConn, record, reason)
+}
+
+// 把 连接 透明地 转发到 dest
+func (rs *realityServer) fallback(clientConn net.Conn, firstData []byte, reason string) error {
+	destConn, err := net.Dial("tcp", rs.dest)
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "REALITY failed to dial dest", ErrDetail: err, Data: rs.dest}
+	}
+	if _, err = destConn.Write(firstData); err != nil {
+		destConn.Close()
+		return utils.ErrInErr{ErrDesc: "REALITY failed to write to dest", ErrDetail: err, Data: rs.dest}
+	}
+
+	go func() {
+		io.Copy(destConn, clientConn)
+		destConn.Close()
+		clientConn.Close()
+	}()
+	go func() {
+		io.Copy(clientConn, destConn)
+		destConn.Close()
+		clientConn.Close()
+	}()
+
+	return utils.ErrInErr{ErrDesc: "REALITY fallback", ErrDetail: netLayer.ErrDoNotClose, Data: reason}
+}
+
+// 证书 签名 部分 为 hmac, 见 包顶 的 说明
+func (rs *realityServer) certificate(authKey []byte) []byte {
+	cert := append([]byte(nil), rs.certDER...)
+	copy(cert[len(cert)-ed25519.SignatureSize:], realityCertSignature(authKey, rs.certKey.Public().(ed25519.PublicKey)))
+	return cert
+}
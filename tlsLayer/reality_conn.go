@@ -0,0 +1,601 @@
+package tlsLayer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// reality 服务端 的 tls1.3 握手 与 记录层.
+//
+// 不能 直接用 crypto/tls: 我们的 证书 是 ed25519 的, 而 chrome 等 指纹 的 signature_algorithms 中 没有 ed25519,
+// crypto/tls 会 拒绝 握手. xray 是 魔改 crypto/tls 强行 使用 ed25519 的, utls 客户端 只检查 自己 是否 支持 该算法, 所以 能通.
+// 这里 实现了 一个 只支持 tls1.3 与 x25519 的 最小 服务端, 握手后 不发 NewSessionTicket.
+
+const (
+	recordHeaderLen = 5
+	maxPlaintext    = 16384
+	maxCiphertext   = maxPlaintext + 256
+
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+	recordTypeApplicationData  = 23
+
+	handshakeTypeServerHello         = 2
+	handshakeTypeEncryptedExtensions = 8
+	handshakeTypeCertificate         = 11
+	handshakeTypeCertificateVerify   = 15
+	handshakeTypeFinished            = 20
+	handshakeTypeKeyUpdate           = 24
+
+	alertCloseNotify = 0
+
+	maxHandshakeBufLen = 1 << 16
+)
+
+type realitySuite struct {
+	id     uint16
+	keyLen int
+	hash   crypto.Hash
+	aead   func(key []byte) (cipher.AEAD, error)
+}
+
+var realitySuites = []realitySuite{
+	{tls.TLS_AES_128_GCM_SHA256, 16, crypto.SHA256, newAESGCM},
+	{tls.TLS_AES_256_GCM_SHA384, 32, crypto.SHA384, newAESGCM},
+	{tls.TLS_CHACHA20_POLY1305_SHA256, chacha20poly1305.KeySize, crypto.SHA256, chacha20poly1305.New},
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 按 客户端 的 顺序 选择
+func selectRealitySuite(clientSuites []uint16) *realitySuite {
+	for _, id := range clientSuites {
+		for i := range realitySuites {
+			if realitySuites[i].id == id {
+				return &realitySuites[i]
+			}
+		}
+	}
+	return nil
+}
+
+// RFC 8446 7.1 HKDF-Expand-Label
+func (s *realitySuite) expandLabel(secret []byte, label string, context []byte, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 "))
+		b.AddBytes([]byte(label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(context)
+	})
+	out := make([]byte, length)
+	hkdf.Expand(s.hash.New, secret, b.BytesOrPanic()).Read(out)
+	return out
+}
+
+func (s *realitySuite) deriveSecret(secret []byte, label string, transcript hash.Hash) []byte {
+	if transcript == nil {
+		transcript = s.hash.New()
+	}
+	return s.expandLabel(secret, label, transcript.Sum(nil), s.hash.Size())
+}
+
+func (s *realitySuite) extract(newSecret, currentSecret []byte) []byte {
+	if newSecret == nil {
+		newSecret = make([]byte, s.hash.Size())
+	}
+	return hkdf.Extract(s.hash.New, newSecret, currentSecret)
+}
+
+func (s *realitySuite) finishedHash(baseKey []byte, transcript hash.Hash) []byte {
+	h := hmac.New(s.hash.New, s.expandLabel(baseKey, "finished", nil, s.hash.Size()))
+	h.Write(transcript.Sum(nil))
+	return h.Sum(nil)
+}
+
+// 单方向 的 加密 状态
+type realityHalfConn struct {
+	suite  *realitySuite
+	secret []byte
+	aead   cipher.AEAD
+	iv     []byte
+	seq    uint64
+	nonce  [12]byte
+}
+
+func (hc *realityHalfConn) setSecret(suite *realitySuite, secret []byte) error {
+	aead, err := suite.aead(suite.expandLabel(secret, "key", nil, suite.keyLen))
+	if err != nil {
+		return err
+	}
+	hc.suite = suite
+	hc.secret = secret
+	hc.aead = aead
+	hc.iv = suite.expandLabel(secret, "iv", nil, len(hc.nonce))
+	hc.seq = 0
+	return nil
+}
+
+func (hc *realityHalfConn) update() error {
+	return hc.setSecret(hc.suite, hc.suite.expandLabel(hc.secret, "traffic upd", nil, hc.suite.hash.Size()))
+}
+
+func (hc *realityHalfConn) nextNonce() []byte {
+	copy(hc.nonce[:], hc.iv)
+	for i := 0; i < 8; i++ {
+		hc.nonce[len(hc.nonce)-1-i] ^= byte(hc.seq >> (8 * i))
+	}
+	hc.seq++
+	return hc.nonce[:]
+}
+
+// 读到 至少 N 字节 后 返回 io.EOF, 用于 bytes.Buffer.ReadFrom. 参考 crypto/tls
+type atLeastReader struct {
+	R io.Reader
+	N int64
+}
+
+func (r *atLeastReader) Read(p []byte) (int, error) {
+	if r.N <= 0 {
+		return 0, io.EOF
+	}
+	n, err := r.R.Read(p)
+	r.N -= int64(n)
+	if r.N > 0 && err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if r.N <= 0 && err == nil {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// reality 服务端 握手后 得到的 连接, 实现 Conn
+type realityConn struct {
+	net.Conn //底层连接
+
+	alpn, sni string
+
+	in, out realityHalfConn
+
+	readMutex sync.Mutex
+	input     bytes.Reader //已解密 但 还没被 Read 取走 的 数据
+	rawInput  bytes.Buffer //还未解密 的 数据
+	plain     []byte
+	hsBuf     []byte
+	readErr   error
+
+	writeMutex      sync.Mutex
+	writeBuf        []byte
+	closeNotifySent bool
+}
+
+func (c *realityConn) readFromUntil(n int) error {
+	if c.rawInput.Len() >= n {
+		return nil
+	}
+	needs := n - c.rawInput.Len()
+	c.rawInput.Grow(needs + bytes.MinRead)
+	_, err := c.rawInput.ReadFrom(&atLeastReader{c.Conn, int64(needs)})
+	if err == io.ErrUnexpectedEOF && c.rawInput.Len() == 0 {
+		err = io.EOF
+	}
+	return err
+}
+
+// 读 一个 记录 并 解密. 返回的 data 在 下一次 readRecord 前 有效
+func (c *realityConn) readRecord() (typ byte, data []byte, err error) {
+	if err = c.readFromUntil(recordHeaderLen); err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(c.rawInput.Bytes()[3:]))
+	if length > maxCiphertext {
+		err = utils.ErrInErr{ErrDesc: "REALITY tls record overflow", ErrDetail: utils.ErrInvalidData, Data: length}
+		return
+	}
+	if err = c.readFromUntil(recordHeaderLen + length); err != nil {
+		return
+	}
+	record := c.rawInput.Next(recordHeaderLen + length)
+
+	typ = record[0]
+	if typ == recordTypeChangeCipherSpec {
+		return
+	}
+	if typ != recordTypeApplicationData || c.in.aead == nil {
+		err = utils.ErrInErr{ErrDesc: "REALITY unexpected tls record", ErrDetail: utils.ErrInvalidData, Data: typ}
+		return
+	}
+
+	c.plain, err = c.in.aead.Open(c.plain[:0], c.in.nextNonce(), record[recordHeaderLen:], record[:recordHeaderLen])
+	if err != nil {
+		err = utils.ErrInErr{ErrDesc: "REALITY tls record decrypt failed", ErrDetail: err}
+		return
+	}
+	i := len(c.plain) - 1
+	for i >= 0 && c.plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		err = utils.ErrInErr{ErrDesc: "REALITY tls record without content type", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+	return c.plain[i], c.plain[:i], nil
+}
+
+// 返回 hsBuf 中 下一个 完整的 握手消息, 没有 则 返回 nil
+func (c *realityConn) nextHandshakeMsg() []byte {
+	if len(c.hsBuf) < 4 {
+		return nil
+	}
+	n := 4 + (int(c.hsBuf[1])<<16 | int(c.hsBuf[2])<<8 | int(c.hsBuf[3]))
+	if len(c.hsBuf) < n {
+		return nil
+	}
+	msg := c.hsBuf[:n:n]
+	c.hsBuf = c.hsBuf[n:]
+	return msg
+}
+
+func (c *realityConn) appendHandshake(data []byte) error {
+	if len(c.hsBuf)+len(data) > maxHandshakeBufLen {
+		return utils.ErrInErr{ErrDesc: "REALITY tls handshake message too long", ErrDetail: utils.ErrInvalidData}
+	}
+	c.hsBuf = append(c.hsBuf, data...)
+	return nil
+}
+
+func (c *realityConn) readHandshakeMsg() ([]byte, error) {
+	for {
+		if msg := c.nextHandshakeMsg(); msg != nil {
+			return msg, nil
+		}
+		typ, data, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case recordTypeChangeCipherSpec:
+		case recordTypeHandshake:
+			if err = c.appendHandshake(data); err != nil {
+				return nil, err
+			}
+		case recordTypeAlert:
+			return nil, utils.ErrInErr{ErrDesc: "REALITY received tls alert during handshake", Data: data}
+		default:
+			return nil, utils.ErrInErr{ErrDesc: "REALITY unexpected tls record during handshake", ErrDetail: utils.ErrInvalidData, Data: typ}
+		}
+	}
+}
+
+// 握手后 客户端 只可能 发 KeyUpdate
+func (c *realityConn) handlePostHandshake(data []byte) error {
+	if err := c.appendHandshake(data); err != nil {
+		return err
+	}
+	for msg := c.nextHandshakeMsg(); msg != nil; msg = c.nextHandshakeMsg() {
+		if msg[0] != handshakeTypeKeyUpdate || len(msg) != 5 {
+			return utils.ErrInErr{ErrDesc: "REALITY unexpected post handshake message", ErrDetail: utils.ErrInvalidData, Data: msg[0]}
+		}
+		if err := c.in.update(); err != nil {
+			return err
+		}
+		if msg[4] == 1 { //update_requested
+			c.writeMutex.Lock()
+			err := c.writeRecordLocked(recordTypeHandshake, []byte{handshakeTypeKeyUpdate, 0, 0, 1, 0})
+			if err == nil {
+				err = c.out.update()
+			}
+			c.writeMutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *realityConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for c.input.Len() == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		typ, data, err := c.readRecord()
+		if err != nil {
+			c.readErr = err
+			continue
+		}
+		switch typ {
+		case recordTypeApplicationData:
+			c.input.Reset(data)
+		case recordTypeAlert:
+			if len(data) == 2 && data[1] == alertCloseNotify {
+				c.readErr = io.EOF
+			} else {
+				c.readErr = utils.ErrInErr{ErrDesc: "REALITY received tls alert", Data: data}
+			}
+		case recordTypeHandshake:
+			c.readErr = c.handlePostHandshake(data)
+		}
+	}
+	return c.input.Read(p)
+}
+
+// 握手时 out.aead 为 nil, 写 明文 记录
+func (c *realityConn) writeRecordLocked(typ byte, data []byte) error {
+	buf := append(c.writeBuf[:0], typ, 3, 3, 0, 0)
+	if c.out.aead == nil {
+		binary.BigEndian.PutUint16(buf[3:], uint16(len(data)))
+		buf = append(buf, data...)
+	} else {
+		buf[0] = recordTypeApplicationData
+		binary.BigEndian.PutUint16(buf[3:], uint16(len(data)+1+c.out.aead.Overhead()))
+		buf = append(buf, data...)
+		buf = append(buf, typ)
+		buf = c.out.aead.Seal(buf[:recordHeaderLen], c.out.nextNonce(), buf[recordHeaderLen:], buf[:recordHeaderLen])
+	}
+	c.writeBuf = buf
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *realityConn) Write(p []byte) (n int, err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	for len(p) > 0 {
+		m := len(p)
+		if m > maxPlaintext {
+			m = maxPlaintext
+		}
+		if err = c.writeRecordLocked(recordTypeApplicationData, p[:m]); err != nil {
+			return
+		}
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+func (c *realityConn) Close() error {
+	//防止 Write 阻塞 导致 拿不到 锁
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+
+	c.writeMutex.Lock()
+	if !c.closeNotifySent {
+		c.closeNotifySent = true
+		c.writeRecordLocked(recordTypeAlert, []byte{1, alertCloseNotify})
+	}
+	c.writeMutex.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *realityConn) GetRaw(tls_lazy_encrypt bool) *net.TCPConn {
+	tc, _ := c.Conn.(*net.TCPConn)
+	return tc
+}
+
+// reality 不支持 tls lazy
+func (c *realityConn) GetTeeConn() *TeeConn {
+	return nil
+}
+
+func (c *realityConn) GetAlpn() string {
+	return c.alpn
+}
+
+func (c *realityConn) GetSni() string {
+	return c.sni
+}
+
+func (c *realityConn) GetVersion() uint16 {
+	return tls.VersionTLS13
+}
+
+func (c *realityConn) GetRawAndBuffers() (raw net.Conn, input *bytes.Reader, rawInput *bytes.Buffer) {
+	return c.Conn, &c.input, &c.rawInput
+}
+
+func (c *realityConn) Upstream() any {
+	return c.Conn
+}
+
+// 与 crypto/tls 一样 按 服务端 的 顺序 选择
+func negotiateRealityAlpn(serverProtos, clientProtos []string) string {
+	for _, s := range serverProtos {
+		for _, c := range clientProtos {
+			if s == c {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// 客户端 已通过 认证, 与它 完成 tls1.3 握手
+func (rs *realityServer) serverHandshake(raw net.Conn, hello *realityClientHello, authKey []byte) (result net.Conn, err error) {
+	suite := selectRealitySuite(hello.cipherSuites)
+	if suite == nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY no supported tls1.3 cipher suite", ErrDetail: utils.ErrInvalidData}
+	}
+
+	netLayer.SetCommonReadTimeout(raw)
+	netLayer.SetCommonWriteTimeout(raw)
+	defer netLayer.PersistConn(raw)
+
+	c := &realityConn{
+		Conn: raw,
+		sni:  hello.serverName,
+		alpn: negotiateRealityAlpn(rs.alpnList, hello.alpnProtocols),
+	}
+
+	ecdhePriv := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(ecdhePriv); err != nil {
+		return
+	}
+	ecdhePub, err := curve25519.X25519(ecdhePriv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	sharedKey, err := curve25519.X25519(ecdhePriv, hello.keyShare)
+	if err != nil {
+		return
+	}
+	serverRandom := make([]byte, 32)
+	if _, err = rand.Read(serverRandom); err != nil {
+		return
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(handshakeTypeServerHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(tls.VersionTLS12)
+		b.AddBytes(serverRandom)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(hello.sessionId)
+		})
+		b.AddUint16(suite.id)
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(et_supported_versions)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(tls.VersionTLS13)
+			})
+			b.AddUint16(et_key_share)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(uint16(utls.X25519))
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(ecdhePub)
+				})
+			})
+		})
+	})
+	serverHello := b.BytesOrPanic()
+
+	transcript := suite.hash.New()
+	transcript.Write(hello.raw)
+	transcript.Write(serverHello)
+
+	if err = c.writeRecordLocked(recordTypeHandshake, serverHello); err != nil {
+		return
+	}
+	if err = c.writeRecordLocked(recordTypeChangeCipherSpec, []byte{1}); err != nil {
+		return
+	}
+
+	handshakeSecret := suite.extract(sharedKey, suite.deriveSecret(suite.extract(nil, nil), "derived", nil))
+	clientSecret := suite.deriveSecret(handshakeSecret, "c hs traffic", transcript)
+	serverSecret := suite.deriveSecret(handshakeSecret, "s hs traffic", transcript)
+	if err = c.in.setSecret(suite, clientSecret); err != nil {
+		return
+	}
+	if err = c.out.setSecret(suite, serverSecret); err != nil {
+		return
+	}
+
+	//EncryptedExtensions, Certificate, CertificateVerify, Finished 放在 同一个 记录 中
+	var flight []byte
+	addMsg := func(msgType uint8, body func(b *cryptobyte.Builder)) {
+		var b cryptobyte.Builder
+		b.AddUint8(msgType)
+		b.AddUint24LengthPrefixed(body)
+		msg := b.BytesOrPanic()
+		transcript.Write(msg)
+		flight = append(flight, msg...)
+	}
+
+	addMsg(handshakeTypeEncryptedExtensions, func(b *cryptobyte.Builder) {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if c.alpn != "" {
+				b.AddUint16(et_application_layer_protocol_negotiation)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes([]byte(c.alpn))
+						})
+					})
+				})
+			}
+		})
+	})
+	addMsg(handshakeTypeCertificate, func(b *cryptobyte.Builder) {
+		b.AddUint8(0) //certificate_request_context
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(rs.certificate(authKey))
+			})
+			b.AddUint16(0) //extensions
+		})
+	})
+
+	signed := append(bytes.Repeat([]byte{0x20}, 64), "TLS 1.3, server CertificateVerify\x00"...)
+	signed = transcript.Sum(signed)
+	addMsg(handshakeTypeCertificateVerify, func(b *cryptobyte.Builder) {
+		b.AddUint16(uint16(tls.Ed25519))
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(ed25519.Sign(rs.certKey, signed))
+		})
+	})
+	addMsg(handshakeTypeFinished, func(b *cryptobyte.Builder) {
+		b.AddBytes(suite.finishedHash(serverSecret, transcript))
+	})
+
+	if err = c.writeRecordLocked(recordTypeHandshake, flight); err != nil {
+		return
+	}
+
+	masterSecret := suite.extract(nil, suite.deriveSecret(handshakeSecret, "derived", nil))
+	clientAppSecret := suite.deriveSecret(masterSecret, "c ap traffic", transcript)
+	serverAppSecret := suite.deriveSecret(masterSecret, "s ap traffic", transcript)
+	expectedFinished := suite.finishedHash(clientSecret, transcript)
+
+	if err = c.out.setSecret(suite, serverAppSecret); err != nil {
+		return
+	}
+
+	msg, err := c.readHandshakeMsg()
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "REALITY failed to read client Finished", ErrDetail: err}
+	}
+	if msg[0] != handshakeTypeFinished || !hmac.Equal(msg[4:], expectedFinished) || len(c.hsBuf) > 0 {
+		return nil, errors.New("REALITY invalid client Finished")
+	}
+	if err = c.in.setSecret(suite, clientAppSecret); err != nil {
+		return
+	}
+	return c, nil
+}
@@ -0,0 +1,190 @@
+package tlsLayer_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 启动 一个 假的 dest 网站, 握手后 回复 "dest"
+func startRealityDest(t *testing.T) net.Listener {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: tlsLayer.GenerateRandomTLSCert()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.Write([]byte("dest"))
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// 启动 reality 服务端, 认证通过的 连接 会被 echo
+func startRealityServer(t *testing.T, privateKey, dest string) net.Listener {
+	server, err := tlsLayer.NewServer(tlsLayer.Conf{
+		Tls_type: tlsLayer.Reality_t,
+		Host:     "www.example.com",
+		Extra: map[string]any{
+			"reality_private_key": privateKey,
+			"reality_short_ids":   []any{"", "0123abcd"},
+			"reality_dest":        dest,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:"+netLayer.RandPortStr(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tlsConn, err := server.Handshake(c)
+				if err != nil {
+					return
+				}
+				io.Copy(tlsConn, tlsConn)
+				tlsConn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func newRealityClient(t *testing.T, publicKey, shortId string) *tlsLayer.Client {
+	c, err := tlsLayer.NewClient(tlsLayer.Conf{
+		Tls_type: tlsLayer.Reality_t,
+		Host:     "www.example.com",
+		Minver:   tls.VersionTLS13,
+		Maxver:   tls.VersionTLS13,
+		Extra: map[string]any{
+			"reality_public_key": publicKey,
+			"reality_short_id":   shortId,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReality(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	privateKey, publicKey, err := tlsLayer.GenerateRealityKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := startRealityDest(t)
+	defer dest.Close()
+	l := startRealityServer(t, privateKey, dest.Addr().String())
+	defer l.Close()
+
+	for _, fp := range []string{"chrome", "firefox", "safari", "ios", "edge"} {
+		t.Run(fp, func(t *testing.T) {
+			client, err := tlsLayer.NewClient(tlsLayer.Conf{
+				Tls_type: tlsLayer.Reality_t,
+				Host:     "www.example.com",
+				Minver:   tls.VersionTLS13,
+				Maxver:   tls.VersionTLS13,
+				Extra: map[string]any{
+					"reality_public_key": publicKey,
+					"reality_short_id":   "0123abcd",
+					"utls_fingerprint":   fp,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rc, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConn, err := client.Handshake(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tlsConn.Close()
+
+			if v := tlsConn.(tlsLayer.Conn).GetVersion(); v != tls.VersionTLS13 {
+				t.Fatal("not tls1.3", v)
+			}
+
+			data := make([]byte, 100*1024)
+			rand.Read(data)
+			go tlsConn.Write(data)
+
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(tlsConn, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("not equal")
+			}
+		})
+	}
+}
+
+func TestRealityFallback(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	privateKey, publicKey, _ := tlsLayer.GenerateRealityKeyPair()
+	_, wrongPublicKey, _ := tlsLayer.GenerateRealityKeyPair()
+
+	dest := startRealityDest(t)
+	defer dest.Close()
+	l := startRealityServer(t, privateKey, dest.Addr().String())
+	defer l.Close()
+
+	//普通 tls 客户端 看到的 是 dest
+	rc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := tls.Client(rc, &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+	got, err := io.ReadAll(tc)
+	tc.Close()
+	if string(got) != "dest" {
+		t.Fatal("should reach dest", string(got), err)
+	}
+
+	//密钥 或 short id 不对 的 reality 客户端 也会 被 转发到 dest, 客户端 发现 证书 不对, 握手 失败
+	for _, client := range []*tlsLayer.Client{
+		newRealityClient(t, wrongPublicKey, "0123abcd"),
+		newRealityClient(t, publicKey, "ffff"),
+	} {
+		rc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Handshake(rc)
+		rc.Close()
+		if err == nil {
+			t.Fatal("handshake should fail")
+		}
+	}
+}
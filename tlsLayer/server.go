@@ -15,8 +15,16 @@ type Server struct {
 	tlstype int
 
 	//用于shadowTls，使用shadowTls时 我们不使用 tlsConfig
-	serverName string
-	shadowpass string
+	serverName   string
+	shadowDest   string
+	shadowpass   string
+	shadowStrict bool
+
+	reality *realityServer
+
+	acme bool
+
+	clientUser clientUserConf //双向tls 时 用于 把 客户端证书 映射为 用户
 }
 
 // 如 certFile, keyFile 有一项没给出，则会自动生成随机证书
@@ -39,32 +47,73 @@ func NewServer(conf Conf) (*Server, error) {
 	}
 
 	s := &Server{
-		tlstype: conf.Tls_type,
+		tlstype:    conf.Tls_type,
+		clientUser: getClientUserConfFromExtra(conf.Extra),
 	}
 
 	if conf.IsShadowTls() {
 		s.serverName = conf.Host
+		s.shadowDest = getShadowTlsDestFromExtra(conf.Extra, conf.Host)
 
-		if conf.Tls_type == ShadowTls2_t {
+		if conf.Tls_type == ShadowTls2_t || conf.Tls_type == ShadowTls3_t {
 			s.shadowpass = getShadowTlsPasswordFromExtra(conf.Extra)
 		}
+		if conf.Tls_type == ShadowTls3_t {
+			if s.shadowpass == "" {
+				return nil, utils.ErrInErr{ErrDesc: "shadowTls3 server requires extra.shadowtls_password", ErrDetail: utils.ErrInvalidData}
+			}
+			s.shadowStrict = getShadowTlsStrictFromExtra(conf.Extra)
+		}
+	} else if conf.Tls_type == Reality_t {
+		var err error
+		s.reality, err = newRealityServer(conf)
+		if err != nil {
+			return nil, err
+		}
+	} else if ac := getAcmeConfFromExtra(conf.Extra, conf.Host); ac != nil {
+		var err error
+		s.tlsConfig, err = getAcmeTlsConfig(conf, ac)
+		if err != nil {
+			return nil, err
+		}
+		s.acme = true
 	} else {
 		s.tlsConfig = GetTlsConfig(true, conf)
 
 	}
 
+	if files := getECHKeyFilesFromExtra(conf.Extra); len(files) > 0 && s.tlsConfig != nil {
+		if !echServerSupported {
+			return nil, utils.ErrInErr{ErrDesc: "ECH server requires go1.25 or later", ErrDetail: utils.ErrUnImplemented}
+		}
+		ks, err := newECHKeyStore(files)
+		if err != nil {
+			return nil, err
+		}
+		ks.applyTo(s.tlsConfig)
+	}
+
 	return s, nil
 }
 
-// tls时返回 tlsLayer.Conn, shadowTls1时返回原 clientConn, shadowTls2时返回 FakeAppDataConn
+// 释放 服务端 加载 的 证书, 服务端 被 删除 时 调用
+func (s *Server) ReleaseCerts() {
+	ReleaseTlsConfig(s.tlsConfig)
+}
+
+// tls 和 reality 时返回 tlsLayer.Conn, shadowTls1时返回原 clientConn, shadowTls2时返回 FakeAppDataConn, shadowTls3时返回 shadowTls3Conn
 func (s *Server) Handshake(clientConn net.Conn) (result net.Conn, err error) {
 
 	switch s.tlstype {
 	case ShadowTls_t:
 
-		return clientConn, shadowTls1(s.serverName, clientConn)
+		return clientConn, shadowTls1(s.shadowDest, clientConn)
 	case ShadowTls2_t:
-		return shadowTls2(s.serverName, clientConn, s.shadowpass)
+		return shadowTls2(s.shadowDest, clientConn, s.shadowpass)
+	case ShadowTls3_t:
+		return shadowTls3(s.shadowDest, clientConn, s.shadowpass, s.shadowStrict)
+	case Reality_t:
+		return s.reality.handshake(clientConn)
 
 	}
 
@@ -75,11 +124,20 @@ func (s *Server) Handshake(clientConn net.Conn) (result net.Conn, err error) {
 
 		return
 	}
+	if s.acme {
+		if err = checkAcmeHandshake(rawTlsConn); err != nil {
+			return
+		}
+	}
 
-	result = &conn{
+	c := &conn{
 		Conn: rawTlsConn,
 		ptr:  unsafe.Pointer(rawTlsConn),
 	}
+	if s.tlsConfig.ClientCAs != nil {
+		c.user = s.clientUser.userFromState(rawTlsConn.ConnectionState())
+	}
+	result = c
 
 	return
 
@@ -27,10 +27,22 @@ func getShadowTlsPasswordFromExtra(extra map[string]any) string {
 	return ""
 }
 
+// 握手服务器 地址, 默认为 host:443
+func getShadowTlsDestFromExtra(extra map[string]any, host string) string {
+	if len(extra) > 0 {
+		if thing := extra["shadowtls_dest"]; thing != nil {
+			if str, ok := thing.(string); ok && str != "" {
+				return str
+			}
+		}
+	}
+	return net.JoinHostPort(host, "443")
+}
+
 // 转发并判断tls1.2握手结束后直接返回
-func shadowTls1(servername string, clientConn net.Conn) (err error) {
+func shadowTls1(dest string, clientConn net.Conn) (err error) {
 	var fakeConn net.Conn
-	fakeConn, err = net.Dial("tcp", servername+":443")
+	fakeConn, err = net.Dial("tcp", dest)
 	if err != nil {
 		if ce := utils.CanLogErr("Failed shadowTls server fake dial server "); ce != nil {
 			ce.Write(zap.Error(err))
@@ -84,9 +96,9 @@ func shadowTls1(servername string, clientConn net.Conn) (err error) {
 	return
 }
 
-func shadowTls2(servername string, clientConn net.Conn, password string) (result *FakeAppDataConn, err error) {
+func shadowTls2(dest string, clientConn net.Conn, password string) (result *FakeAppDataConn, err error) {
 	var fakeConn net.Conn
-	fakeConn, err = net.Dial("tcp", servername+":443")
+	fakeConn, err = net.Dial("tcp", dest)
 	if err != nil {
 		if ce := utils.CanLogErr("Failed shadowTls2 server fake dial server "); ce != nil {
 			ce.Write(zap.Error(err))
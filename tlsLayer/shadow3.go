@@ -0,0 +1,535 @@
+package tlsLayer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+/*
+shadowTls v3, 与 https://github.com/ihciah/shadow-tls 互通.
+https://github.com/ihciah/shadow-tls/blob/master/docs/protocol-v3-en.md
+
+客户端 ClientHello 的 session id 后4字节 为 hmac(password, ClientHello), 计算时 这4字节 为0; 服务端 据此 识别 客户端,
+识别 失败 则 与 v1/v2 一样 把 连接 转发到 握手服务器.
+
+识别 成功 后 服务端 照常 转发 握手, 但 握手服务器 发来的 ApplicationData 会被 修改:
+数据 先与 sha256(password + ServerRandom) 循环异或, 再在 前面 加上 4字节的 HMAC_ServerRandom; 客户端 验证 并 还原 后 交给 tls.
+这样 中间人 即使 把 客户端 劫持 到 真网站, 客户端 也能 发现.
+
+握手后 双方 都 按 ApplicationData 格式 发送 数据, 每个 记录 以 4字节 hmac 开头:
+客户端 发的 用 HMAC_ServerRandomC, 服务端 发的 用 HMAC_ServerRandomS. 服务端 收到 第一个 能 通过 验证 的 记录 时 停止 转发 握手.
+客户端 会 丢弃 带有 HMAC_ServerRandom 的 记录 (握手服务器 随后 发来的 NewSessionTicket 等).
+
+以上 hmac 均为 hmac-sha1 截取 前4字节, key 为 password, 且 是 累积的 (包含 之前 所有 记录 的 数据).
+
+strict 模式 (extra.shadowtls_strict) 下 要求 握手 为 tls1.3, 否则 服务端 直接 转发, 客户端 报错.
+*/
+
+const (
+	shadowTls3HmacLen = 4
+
+	shadowTls3MaxDataLen = maxPlaintext - shadowTls3HmacLen
+)
+
+func getShadowTlsStrictFromExtra(extra map[string]any) bool {
+	if len(extra) > 0 {
+		if thing := extra["shadowtls_strict"]; thing != nil {
+			if is, ok := utils.AnyToBool(thing); ok && is {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 可以 试算 的 累积 hmac-sha1. crypto/hmac 不能 回滚, 所以 自己 实现, 利用 sha1 可以 保存 状态 来 回滚.
+type shadowTls3Hmac struct {
+	inner    hash.Hash
+	outerKey [sha1.BlockSize]byte
+}
+
+func newShadowTls3Hmac(password string, init ...[]byte) *shadowTls3Hmac {
+	key := []byte(password)
+	if len(key) > sha1.BlockSize {
+		sum := sha1.Sum(key)
+		key = sum[:]
+	}
+	h := &shadowTls3Hmac{inner: sha1.New()}
+
+	var innerKey [sha1.BlockSize]byte
+	copy(innerKey[:], key)
+	copy(h.outerKey[:], key)
+	for i := range innerKey {
+		innerKey[i] ^= 0x36
+		h.outerKey[i] ^= 0x5c
+	}
+	h.inner.Write(innerKey[:])
+
+	for _, b := range init {
+		h.inner.Write(b)
+	}
+	return h
+}
+
+// 返回 写入 data 后 的 hmac. commit 为 false 时 不改变 状态
+func (h *shadowTls3Hmac) sum(data []byte, commit bool) []byte {
+	var state []byte
+	if !commit {
+		state, _ = h.inner.(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	h.inner.Write(data)
+
+	outer := sha1.New()
+	outer.Write(h.outerKey[:])
+	outer.Write(h.inner.Sum(nil))
+
+	if !commit {
+		h.inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	}
+	return outer.Sum(nil)[:shadowTls3HmacLen]
+}
+
+// 验证 通过 才 更新 状态
+func (h *shadowTls3Hmac) verify(data, tag []byte) bool {
+	if hmac.Equal(h.sum(data, false), tag) {
+		h.inner.Write(data)
+		return true
+	}
+	return false
+}
+
+// 由 ServerRandom 导出 的 各个 hmac 与 异或 密钥
+type shadowTls3State struct {
+	sr, c, s *shadowTls3Hmac
+	key      []byte
+}
+
+func newShadowTls3State(password string, serverRandom []byte) *shadowTls3State {
+	key := sha256.New()
+	key.Write([]byte(password))
+	key.Write(serverRandom)
+
+	return &shadowTls3State{
+		sr:  newShadowTls3Hmac(password, serverRandom),
+		c:   newShadowTls3Hmac(password, serverRandom, []byte("C")),
+		s:   newShadowTls3Hmac(password, serverRandom, []byte("S")),
+		key: key.Sum(nil),
+	}
+}
+
+func (st *shadowTls3State) xor(data []byte) {
+	for i := range data {
+		data[i] ^= st.key[i%len(st.key)]
+	}
+}
+
+// 服务端 修改 握手服务器 发来的 ApplicationData
+func (st *shadowTls3State) modify(frame []byte) []byte {
+	data := frame[recordHeaderLen:]
+	st.xor(data)
+
+	result := make([]byte, len(frame)+shadowTls3HmacLen)
+	copy(result, frame[:3])
+	binary.BigEndian.PutUint16(result[3:], uint16(len(data)+shadowTls3HmacLen))
+	copy(result[recordHeaderLen:], st.sr.sum(data, true))
+	copy(result[recordHeaderLen+shadowTls3HmacLen:], data)
+	return result
+}
+
+// 客户端 还原 ApplicationData, 不是 服务端 修改过的 则 返回 false
+func (st *shadowTls3State) restore(frame []byte) ([]byte, bool) {
+	if len(frame) < recordHeaderLen+shadowTls3HmacLen {
+		return frame, false
+	}
+	data := frame[recordHeaderLen+shadowTls3HmacLen:]
+	if !st.sr.verify(data, frame[recordHeaderLen:recordHeaderLen+shadowTls3HmacLen]) {
+		return frame, false
+	}
+	st.xor(data)
+
+	result := frame[shadowTls3HmacLen:]
+	copy(result, frame[:3])
+	binary.BigEndian.PutUint16(result[3:], uint16(len(data)))
+	return result, true
+}
+
+// 读取 一个 完整的 tls 记录, 包括 记录头. buf 容量 不够 时 会 重新分配
+func readTlsFrame(r io.Reader, buf []byte) ([]byte, error) {
+	if cap(buf) < recordHeaderLen {
+		buf = make([]byte, recordHeaderLen, recordHeaderLen+maxCiphertext)
+	}
+	buf = buf[:recordHeaderLen]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(buf[3:]))
+	if cap(buf) < recordHeaderLen+length {
+		newBuf := make([]byte, recordHeaderLen+length)
+		copy(newBuf, buf)
+		buf = newBuf
+	} else {
+		buf = buf[:recordHeaderLen+length]
+	}
+	_, err := io.ReadFull(r, buf[recordHeaderLen:])
+	return buf, err
+}
+
+func shadowTls3VerifyClientHello(frame []byte, password string) bool {
+	const sessionIdLenIdx = recordHeaderLen + helloSessionIdOffset - 1
+	const hmacIdx = sessionIdLenIdx + 1 + 32 - shadowTls3HmacLen
+
+	if len(frame) < hmacIdx+shadowTls3HmacLen || frame[0] != recordTypeHandshake || frame[recordHeaderLen] != 1 || frame[sessionIdLenIdx] != 32 {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(password))
+	mac.Write(frame[recordHeaderLen:hmacIdx])
+	mac.Write(make([]byte, shadowTls3HmacLen))
+	mac.Write(frame[hmacIdx+shadowTls3HmacLen:])
+	return hmac.Equal(mac.Sum(nil)[:shadowTls3HmacLen], frame[hmacIdx:hmacIdx+shadowTls3HmacLen])
+}
+
+func isServerHelloFrame(frame []byte) bool {
+	return len(frame) >= recordHeaderLen+4+2+32 && frame[0] == recordTypeHandshake && frame[recordHeaderLen] == handshakeTypeServerHello
+}
+
+// ServerHello 中 的 ServerRandom
+func serverRandomOfFrame(frame []byte) []byte {
+	const start = recordHeaderLen + 4 + 2
+	return frame[start : start+32]
+}
+
+// ServerHello 的 supported_versions 是否 为 tls1.3
+func serverHelloIsTls13(frame []byte) bool {
+	s := cryptobyte.String(frame[recordHeaderLen+4:])
+
+	var sessionId, extensions cryptobyte.String
+	if !s.Skip(2+32) || !s.ReadUint8LengthPrefixed(&sessionId) || !s.Skip(3) || !s.ReadUint16LengthPrefixed(&extensions) {
+		return false
+	}
+	for !extensions.Empty() {
+		var extType, version uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return false
+		}
+		if extType == et_supported_versions {
+			return ext.ReadUint16(&version) && version == tls.VersionTLS13
+		}
+	}
+	return false
+}
+
+func clientHelloIsTls13(frame []byte) bool {
+	hello, ok := parseRealityClientHello(frame[recordHeaderLen:])
+	return ok && hello.supportsTLS13
+}
+
+// 把 连接 透明地 转发 到 握手服务器
+func shadowTls3Fallback(fakeConn, clientConn net.Conn, firstData []byte) error {
+	if len(firstData) > 0 {
+		if _, err := fakeConn.Write(firstData); err != nil {
+			fakeConn.Close()
+			return utils.ErrInErr{ErrDesc: "shadowTls3 fallback write failed", ErrDetail: err}
+		}
+	}
+	go io.Copy(clientConn, fakeConn)
+	go io.Copy(fakeConn, clientConn)
+
+	return utils.ErrInErr{ErrDetail: netLayer.ErrDoNotClose, ErrDesc: "not real shadowTls3 client, fallback"}
+}
+
+func shadowTls3(dest string, clientConn net.Conn, password string, strict bool) (result net.Conn, err error) {
+	netLayer.SetCommonReadTimeout(clientConn)
+	clientHello, err := readTlsFrame(clientConn, nil)
+	netLayer.PersistRead(clientConn)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "shadowTls3, read ClientHello failed", ErrDetail: err}
+	}
+
+	fakeConn, err := net.Dial("tcp", dest)
+	if err != nil {
+		if ce := utils.CanLogErr("Failed shadowTls3 server fake dial server "); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return
+	}
+
+	if !shadowTls3VerifyClientHello(clientHello, password) || (strict && !clientHelloIsTls13(clientHello)) {
+		if ce := utils.CanLogWarn("shadowTls3 ClientHello not verified, fallback"); ce != nil {
+			ce.Write()
+		}
+		return nil, shadowTls3Fallback(fakeConn, clientConn, clientHello)
+	}
+
+	if _, err = fakeConn.Write(clientHello); err != nil {
+		fakeConn.Close()
+		return nil, utils.ErrInErr{ErrDesc: "shadowTls3, write ClientHello failed", ErrDetail: err}
+	}
+
+	netLayer.SetCommonReadTimeout(fakeConn)
+	serverHello, err := readTlsFrame(fakeConn, nil)
+	netLayer.PersistRead(fakeConn)
+	if err != nil {
+		fakeConn.Close()
+		return nil, utils.ErrInErr{ErrDesc: "shadowTls3, read ServerHello failed", ErrDetail: err}
+	}
+
+	if !isServerHelloFrame(serverHello) || (strict && !serverHelloIsTls13(serverHello)) {
+		if ce := utils.CanLogWarn("shadowTls3 handshake server not using tls1.3, fallback"); ce != nil {
+			ce.Write(zap.String("dest", dest))
+		}
+		if _, err = clientConn.Write(serverHello); err != nil {
+			fakeConn.Close()
+			return nil, utils.ErrInErr{ErrDesc: "shadowTls3, write ServerHello failed", ErrDetail: err}
+		}
+		return nil, shadowTls3Fallback(fakeConn, clientConn, nil)
+	}
+
+	st := newShadowTls3State(password, serverRandomOfFrame(serverHello))
+
+	if _, err = clientConn.Write(serverHello); err != nil {
+		fakeConn.Close()
+		return nil, utils.ErrInErr{ErrDesc: "shadowTls3, write ServerHello failed", ErrDetail: err}
+	}
+
+	//握手服务器 -> 客户端, 修改 ApplicationData. 直到 fakeConn 被 关闭
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		var buf []byte
+		for {
+			frame, err := readTlsFrame(fakeConn, buf)
+			if err != nil {
+				return
+			}
+			buf = frame
+			if frame[0] == recordTypeApplicationData {
+				frame = st.modify(frame)
+			}
+			if _, err = clientConn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	stopRelay := func() {
+		fakeConn.Close()
+		<-relayDone
+	}
+
+	//客户端 -> 握手服务器, 直到 收到 客户端 的 第一个 数据
+	var buf []byte
+	for step := 0; ; step++ {
+		netLayer.SetCommonReadTimeout(clientConn)
+		frame, err := readTlsFrame(clientConn, buf)
+		netLayer.PersistRead(clientConn)
+
+		if err != nil {
+			stopRelay()
+			return nil, utils.ErrInErr{ErrDesc: "shadowTls3, read client frame failed", ErrDetail: err, Data: step}
+		}
+		buf = frame
+
+		if frame[0] == recordTypeApplicationData && len(frame) >= recordHeaderLen+shadowTls3HmacLen {
+			data := frame[recordHeaderLen+shadowTls3HmacLen:]
+			if st.c.verify(data, frame[recordHeaderLen:recordHeaderLen+shadowTls3HmacLen]) {
+				stopRelay()
+
+				if ce := utils.CanLogDebug("shadowTls3 fake ok!"); ce != nil {
+					ce.Write(zap.Int("step", step))
+				}
+
+				return &shadowTls3Conn{
+					Conn:     clientConn,
+					readMac:  st.c,
+					writeMac: st.s,
+					pending:  append([]byte(nil), data...),
+				}, nil
+			}
+		}
+
+		if _, err = fakeConn.Write(frame); err != nil {
+			stopRelay()
+			return nil, utils.ErrInErr{ErrDesc: "shadowTls3, write to handshake server failed", ErrDetail: err, Data: step}
+		}
+	}
+}
+
+// 客户端 握手时 包装 底层连接, 记录 ServerRandom 并 还原 服务端 修改过的 ApplicationData
+type shadowTls3HandshakeConn struct {
+	net.Conn
+	password string
+
+	st         *shadowTls3State
+	tls13      bool
+	authorized bool
+
+	buf     []byte
+	pending []byte
+}
+
+func (c *shadowTls3HandshakeConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		frame, err := readTlsFrame(c.Conn, c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = frame
+
+		if c.st == nil {
+			if isServerHelloFrame(frame) {
+				c.st = newShadowTls3State(c.password, serverRandomOfFrame(frame))
+				c.tls13 = serverHelloIsTls13(frame)
+			}
+		} else if frame[0] == recordTypeApplicationData {
+			var ok bool
+			if frame, ok = c.st.restore(frame); ok {
+				c.authorized = true
+			}
+		}
+		c.pending = frame
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Client) shadowTls3Handshake(underlay net.Conn) (result net.Conn, err error) {
+	hc := &shadowTls3HandshakeConn{
+		Conn:     underlay,
+		password: c.shadowTlsPassword,
+	}
+
+	configCopy := c.uTlsConfig.Clone()
+
+	uconn, err := c.newUClient(hc, configCopy)
+	if err != nil {
+		return
+	}
+	if err = uconn.BuildHandshakeState(); err != nil {
+		return
+	}
+	hello := uconn.HandshakeState.Hello
+	if len(hello.Raw) < helloSessionIdOffset+32 {
+		return nil, utils.ErrInErr{ErrDesc: "shadowTls3, ClientHello too short", ErrDetail: utils.ErrInvalidData}
+	}
+
+	hello.SessionId = make([]byte, 32)
+	if _, err = rand.Read(hello.SessionId[:32-shadowTls3HmacLen]); err != nil {
+		return
+	}
+	copy(hello.Raw[helloSessionIdOffset:], hello.SessionId)
+
+	mac := hmac.New(sha1.New, []byte(c.shadowTlsPassword))
+	mac.Write(hello.Raw)
+	copy(hello.SessionId[32-shadowTls3HmacLen:], mac.Sum(nil))
+	copy(hello.Raw[helloSessionIdOffset:], hello.SessionId)
+
+	if err = uconn.Handshake(); err != nil {
+		return
+	}
+
+	if c.shadowTlsStrict && !hc.tls13 {
+		return nil, utils.ErrInErr{ErrDesc: "shadowTls3 strict mode, server not using tls1.3", ErrDetail: utils.ErrInvalidData}
+	}
+	if !hc.authorized {
+		return nil, utils.ErrInErr{ErrDesc: "shadowTls3 server verification failed, traffic hijacked or tls1.3 not supported", ErrDetail: utils.ErrInvalidData}
+	}
+
+	if ce := utils.CanLogDebug("shadowTls3 client handshake ok"); ce != nil {
+		ce.Write()
+	}
+
+	return &shadowTls3Conn{
+		Conn:     underlay,
+		readMac:  hc.st.s,
+		writeMac: hc.st.c,
+		dropMac:  hc.st.sr,
+	}, nil
+}
+
+// shadowTls3 握手后 的 连接, 每个 记录 都以 4字节 hmac 开头
+type shadowTls3Conn struct {
+	net.Conn
+
+	readMac  *shadowTls3Hmac
+	writeMac *shadowTls3Hmac
+	dropMac  *shadowTls3Hmac //客户端 丢弃 握手服务器 发来的 记录
+
+	readBuf  []byte
+	pending  []byte
+	writeBuf []byte
+}
+
+func (c *shadowTls3Conn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		frame, err := readTlsFrame(c.Conn, c.readBuf)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = frame
+
+		if frame[0] == recordTypeAlert {
+			return 0, io.EOF
+		}
+		if frame[0] != recordTypeApplicationData || len(frame) < recordHeaderLen+shadowTls3HmacLen {
+			return 0, utils.ErrInErr{ErrDesc: "shadowTls3, unexpected tls record", ErrDetail: utils.ErrInvalidData, Data: frame[0]}
+		}
+
+		data := frame[recordHeaderLen+shadowTls3HmacLen:]
+		tag := frame[recordHeaderLen : recordHeaderLen+shadowTls3HmacLen]
+
+		switch {
+		case c.readMac.verify(data, tag):
+			c.pending = data
+		case c.dropMac != nil && c.dropMac.verify(data, tag):
+		default:
+			if c.dropMac == nil {
+				//服务端 与 参考实现 一样 回复 bad_record_mac
+				c.Conn.Write([]byte{recordTypeAlert, 3, 3, 0, 2, 2, 20})
+			}
+			return 0, utils.ErrInErr{ErrDesc: "shadowTls3, hmac verification failed", ErrDetail: utils.ErrInvalidData}
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *shadowTls3Conn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := len(p)
+		if m > shadowTls3MaxDataLen {
+			m = shadowTls3MaxDataLen
+		}
+		buf := append(c.writeBuf[:0], recordTypeApplicationData, 3, 3, 0, 0)
+		binary.BigEndian.PutUint16(buf[3:], uint16(m+shadowTls3HmacLen))
+		buf = append(buf, c.writeMac.sum(p[:m], true)...)
+		buf = append(buf, p[:m]...)
+		c.writeBuf = buf
+
+		if _, err = c.Conn.Write(buf); err != nil {
+			return
+		}
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+func (c *shadowTls3Conn) Upstream() any {
+	return c.Conn
+}
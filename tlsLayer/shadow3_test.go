@@ -0,0 +1,192 @@
+package tlsLayer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestShadowTls3Hmac(t *testing.T) {
+	for _, password := range []string{"pass", string(make([]byte, 100))} {
+		h := newShadowTls3Hmac(password, []byte("init"))
+		std := hmac.New(sha1.New, []byte(password))
+		std.Write([]byte("init"))
+
+		//试算 不应 改变 状态
+		h.sum([]byte("garbage"), false)
+
+		for _, data := range []string{"a", "bb", "ccc"} {
+			std.Write([]byte(data))
+			want := std.Sum(nil)[:shadowTls3HmacLen]
+			if !h.verify([]byte(data), want) {
+				t.Fatal("hmac not match", password, data)
+			}
+		}
+		if h.verify([]byte("d"), []byte{0, 0, 0, 0}) {
+			t.Fatal("should not verify")
+		}
+	}
+}
+
+// 启动 一个 tls1.3 握手服务器, 握手后 回复 "dest"
+func startShadowTls3Dest(t *testing.T) net.Listener {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: GenerateRandomTLSCert(),
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.Write([]byte("dest"))
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func startShadowTls3Server(t *testing.T, dest string, strict bool) net.Listener {
+	server, err := NewServer(Conf{
+		Tls_type: ShadowTls3_t,
+		Host:     "www.example.com",
+		Extra: map[string]any{
+			"shadowtls_password": "pass",
+			"shadowtls_dest":     dest,
+			"shadowtls_strict":   strict,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:"+netLayer.RandPortStr(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, err := server.Handshake(c)
+				if err != nil {
+					return
+				}
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestShadowTls3(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	dest := startShadowTls3Dest(t)
+	defer dest.Close()
+
+	for _, strict := range []bool{false, true} {
+		l := startShadowTls3Server(t, dest.Addr().String(), strict)
+		defer l.Close()
+
+		client, err := NewClient(Conf{
+			Tls_type: ShadowTls3_t,
+			Host:     "www.example.com",
+			Insecure: true,
+			Extra: map[string]any{
+				"shadowtls_password": "pass",
+				"shadowtls_strict":   strict,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := client.Handshake(rc)
+		if err != nil {
+			t.Fatal(strict, err)
+		}
+
+		data := make([]byte, 100*1024)
+		rand.Read(data)
+		go conn.Write(data)
+
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("not equal")
+		}
+		conn.Close()
+	}
+}
+
+func TestShadowTls3Fallback(t *testing.T) {
+	utils.LogLevel = utils.Log_warning
+	utils.InitLog("")
+
+	dest := startShadowTls3Dest(t)
+	defer dest.Close()
+	l := startShadowTls3Server(t, dest.Addr().String(), true)
+	defer l.Close()
+
+	//普通 tls 客户端 看到的 是 握手服务器
+	rc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := tls.Client(rc, &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+	got := make([]byte, 4)
+	_, err = io.ReadFull(tc, got)
+	tc.Close()
+	if string(got) != "dest" {
+		t.Fatal("should reach dest", string(got), err)
+	}
+
+	//密码 不对 的 客户端 也会 被 转发, 得不到 服务端 的 认证
+	client, err := NewClient(Conf{
+		Tls_type: ShadowTls3_t,
+		Host:     "www.example.com",
+		Insecure: true,
+		Extra: map[string]any{
+			"shadowtls_password": "wrong",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Handshake(rc)
+	rc.Close()
+	if err == nil {
+		t.Fatal("handshake should fail")
+	}
+}
@@ -98,6 +98,9 @@ type ComSniff struct {
 	ShouldSniffAlpn bool
 	SniffedAlpnList []string
 
+	ShouldSniffFingerprint bool
+	SniffedFingerprint     *HelloFingerprint //clienthello 的 ja3/ja4 指纹, 首包 不完整 时 为 nil
+
 	Isclient  bool //是否是tls拨号端
 	Is_secure bool
 
@@ -117,6 +120,17 @@ func (c *ComSniff) incr() {
 	c.packetCount++
 }
 
+// 将 两个 分别 探测 clienthello 方向 和 serverhello 方向 的 ComSniff 互相关联, 用于 不使用 SniffConn 的 场合, 如 vless 的 xtls-rprx-vision
+func (c *ComSniff) LinkPeer(peer *ComSniff) {
+	c.peer = peer
+	peer.peer = c
+}
+
+// 在 serverhello 被 CommonDetect 探测后, 若 协商出了 tls1.3 则 返回 tls.VersionTLS13
+func (c *ComSniff) HandshakeVersion() uint16 {
+	return c.handshakeVer
+}
+
 func (c *ComSniff) GetFailReason() int {
 	return c.handshakeFailReason
 }
@@ -356,6 +370,10 @@ func (cd *ComSniff) CommonDetect(p []byte, isRead bool, onlyForSni bool) {
 			return
 		}
 
+		if isRead && cd.ShouldSniffFingerprint {
+			cd.SniffedFingerprint, _ = ParseHelloFingerprint(p)
+		}
+
 		if (cd.Is_secure && cd.Isclient) || onlyForSni {
 
 			//VersionTLS10,VersionTLS11,VersionTLS12,VersionTLS13
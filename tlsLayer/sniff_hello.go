@@ -6,7 +6,7 @@ import (
 )
 
 // parse rand, session id, cipher_suites, compression_methods, return bytes after compression_methods.
-func (cd *ComSniff) sniff_commonHelloPre(pAfter []byte) []byte {
+func (cd *ComSniff) sniff_commonHelloPre(pAfter []byte, isclienthello bool) []byte {
 	pAfterRand := pAfter[32:]
 	sessionL := pAfterRand[0]
 
@@ -18,40 +18,54 @@ func (cd *ComSniff) sniff_commonHelloPre(pAfter []byte) []byte {
 
 	pAfterSessionID := pAfterRand[1+sessionL:]
 
-	cipher_suitesLen := uint16(pAfterSessionID[1]) | uint16(pAfterSessionID[0])<<8
+	var pAfterLegacy_compression_methods []byte
 
-	if 2+int(cipher_suitesLen) > len(pAfterSessionID) {
-		cd.DefinitelyNotTLS = true
-		cd.handshakeFailReason = 8
-		return nil
-	}
+	if !isclienthello {
+		//serverhello 中 只有 选定的 一个 cipher_suite(2字节) 和 一个 legacy_compression_method(1字节), 都没有长度头
 
-	pAfterCipherSuites := pAfterSessionID[2+cipher_suitesLen:]
+		if len(pAfterSessionID) < 3 {
+			cd.DefinitelyNotTLS = true
+			cd.handshakeFailReason = 8
+			return nil
+		}
+		pAfterLegacy_compression_methods = pAfterSessionID[3:]
 
-	legacy_compression_methodsLen := pAfterCipherSuites[0]
+	} else {
+		cipher_suitesLen := uint16(pAfterSessionID[1]) | uint16(pAfterSessionID[0])<<8
 
-	/*
-		legacy_compression_methods:  Versions of TLS before 1.3 supported
-		compression with the list of supported compression methods being
-		sent in this field.  For every TLS 1.3 ClientHello, this vector
-		MUST contain exactly one byte, set to zero, which corresponds to
-		the "null" compression method in prior versions of TLS.  If a
-		TLS 1.3 ClientHello is received with any other value in this
-		field, the server MUST abort the handshake with an
-		"illegal_parameter" alert.  Note that TLS 1.3 servers might
-		receive TLS 1.2 or prior ClientHellos which contain other
-		compression methods and (if negotiating such a prior version) MUST
-		follow the procedures for the appropriate prior version of TLS.
-
-		然后对于tls1.3来说，服务端的这一项也必须是0
-	*/
+		if 2+int(cipher_suitesLen) > len(pAfterSessionID) {
+			cd.DefinitelyNotTLS = true
+			cd.handshakeFailReason = 8
+			return nil
+		}
 
-	if 1+int(legacy_compression_methodsLen) > len(pAfterCipherSuites) {
-		cd.DefinitelyNotTLS = true
-		cd.handshakeFailReason = 9
-		return nil
+		pAfterCipherSuites := pAfterSessionID[2+cipher_suitesLen:]
+
+		legacy_compression_methodsLen := pAfterCipherSuites[0]
+
+		/*
+			legacy_compression_methods:  Versions of TLS before 1.3 supported
+			compression with the list of supported compression methods being
+			sent in this field.  For every TLS 1.3 ClientHello, this vector
+			MUST contain exactly one byte, set to zero, which corresponds to
+			the "null" compression method in prior versions of TLS.  If a
+			TLS 1.3 ClientHello is received with any other value in this
+			field, the server MUST abort the handshake with an
+			"illegal_parameter" alert.  Note that TLS 1.3 servers might
+			receive TLS 1.2 or prior ClientHellos which contain other
+			compression methods and (if negotiating such a prior version) MUST
+			follow the procedures for the appropriate prior version of TLS.
+
+			然后对于tls1.3来说，服务端的这一项也必须是0
+		*/
+
+		if 1+int(legacy_compression_methodsLen) > len(pAfterCipherSuites) {
+			cd.DefinitelyNotTLS = true
+			cd.handshakeFailReason = 9
+			return nil
+		}
+		pAfterLegacy_compression_methods = pAfterCipherSuites[1+legacy_compression_methodsLen:]
 	}
-	pAfterLegacy_compression_methods := pAfterCipherSuites[1+legacy_compression_methodsLen:]
 
 	if len(pAfterLegacy_compression_methods) == 0 {
 		//没有多余字节，则表明该连接肯定是tls1.2
@@ -83,7 +97,7 @@ func (cd *ComSniff) sniff_commonHelloPre(pAfter []byte) []byte {
 //
 // 会按情况在返回前 设置cd.DefinitelyNotTLS，cd.handshakeFailReason，cd.CantBeTLS13，cd.handshakeVer，cd.helloPacketPass
 func (cd *ComSniff) sniff_hello(pAfter []byte, isclienthello bool, onlyForSni bool) {
-	pAfterLegacy_compression_methods := cd.sniff_commonHelloPre(pAfter)
+	pAfterLegacy_compression_methods := cd.sniff_commonHelloPre(pAfter, isclienthello)
 
 	if cd.helloPacketPass || cd.DefinitelyNotTLS {
 		return
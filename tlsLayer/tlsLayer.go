@@ -1,5 +1,5 @@
 /*
-Package tlsLayer provides facilities for tls, including uTls,shadowTls, sniffing and random certificate.
+Package tlsLayer provides facilities for tls, including uTls,shadowTls,reality, sniffing and random certificate.
 
 Sniffing can be a part of Tls Lazy Encrypt tech.
 */
@@ -21,6 +21,8 @@ const (
 	UTls_t
 	ShadowTls_t
 	ShadowTls2_t
+	Reality_t
+	ShadowTls3_t
 )
 
 func StrToType(str string) int {
@@ -36,6 +38,10 @@ func StrToType(str string) int {
 		return ShadowTls_t
 	case "shadow2", "shadowtls2", "shadowtlsv2", "shadowtls_v2", "shadowtls v2":
 		return ShadowTls2_t
+	case "reality":
+		return Reality_t
+	case "shadow3", "shadowtls3", "shadowtlsv3", "shadowtls_v3", "shadowtls v3":
+		return ShadowTls3_t
 	}
 }
 
@@ -51,6 +57,10 @@ func TypeToStr(t int) string {
 		return "shadowtls_v1"
 	case ShadowTls2_t:
 		return "shadowtls_v2"
+	case Reality_t:
+		return "reality"
+	case ShadowTls3_t:
+		return "shadowtls_v3"
 	}
 }
 
@@ -67,11 +77,11 @@ type Conf struct {
 	RejectUnknownSni bool //only server
 	CipherSuites     []uint16
 
-	Extra map[string]any //用于shadowTls
+	Extra map[string]any //用于shadowTls 和 reality
 }
 
 func (tConf Conf) IsShadowTls() bool {
-	return tConf.Tls_type == ShadowTls2_t || tConf.Tls_type == ShadowTls_t
+	return tConf.Tls_type == ShadowTls3_t || tConf.Tls_type == ShadowTls2_t || tConf.Tls_type == ShadowTls_t
 }
 
 func GetTlsConfig(mustHasCert bool, conf Conf) *tls.Config {
@@ -79,7 +89,13 @@ func GetTlsConfig(mustHasCert bool, conf Conf) *tls.Config {
 	var err error
 	var randcert bool
 
-	if conf.CertConf != nil || mustHasCert {
+	//服务端 从 文件 加载 证书 时, 使用 certStore, 以 支持 多证书 与 热更新
+	var store *certStore
+	if mustHasCert && conf.CertConf != nil {
+		store = getCertStore(*conf.CertConf)
+	}
+
+	if store == nil && (conf.CertConf != nil || mustHasCert) {
 
 		if conf.CertConf != nil {
 			certArray, err = GetCertArrayFromFile(conf.CertConf.CertFile, conf.CertConf.KeyFile)
@@ -122,7 +138,10 @@ func GetTlsConfig(mustHasCert bool, conf Conf) *tls.Config {
 			tConf.ClientAuth = tls.RequireAndVerifyClientCert
 		}
 	}
-	if conf.RejectUnknownSni {
+	if store != nil {
+		tConf.GetCertificate = store.getCertificateFunc(conf.RejectUnknownSni)
+		configCertStores.Store(tConf, store)
+	} else if conf.RejectUnknownSni {
 		tConf.GetCertificate = rejectUnknownGetCertificateFunc(utils.ArrayToPtrArray(certArray))
 	}
 	if randcert && conf.Host == "" {
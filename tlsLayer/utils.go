@@ -3,6 +3,8 @@ package tlsLayer
 import (
 	"crypto/tls"
 	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
 // 0 means illegal string
@@ -67,3 +69,26 @@ func StrToCipherSuite(str string) uint16 {
 	}
 	return 0
 }
+
+func getStringFromExtra(extra map[string]any, key string) string {
+	if len(extra) > 0 {
+		if str, ok := extra[key].(string); ok {
+			return str
+		}
+	}
+	return ""
+}
+
+func getStringsFromExtra(extra map[string]any, key string) []string {
+	if len(extra) > 0 {
+		if thing := extra[key]; thing != nil {
+			if str, ok := thing.(string); ok {
+				return []string{str}
+			}
+			if strs, ok := utils.AnyToStringArray(thing); ok {
+				return strs
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package tlsLayer
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+/*
+extra.utls_spec_file 给出 一个 json 文件, 从中 加载 完整的 ClientHello 作为 utls 的 指纹, 代替 utls_fingerprint 的 预设.
+这样 就可以 使用 从 真实浏览器 抓到的 ClientHello.
+
+可以 直接 给出 抓包 得到的 ClientHello 记录 (含 5字节 记录头), hex 或 base64 均可:
+
+	{ "client_hello": "16030106...." }
+
+也可以 分项 给出, 扩展 的 data 就是 抓包 中 该扩展 的 内容 (不含 类型 和 长度) 的 hex:
+
+	{
+		"cipher_suites": ["GREASE", "0x1301", 4866, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"],
+		"compression_methods": [0],
+		"extensions": [
+			{ "type": "GREASE" },
+			{ "type": "server_name" },
+			{ "type": "supported_groups", "data": "0008 0a0a 001d 0017 0018" },
+			{ "type": "0xff01", "data": "00" }
+		]
+	}
+
+server_name 的 data 可以 省略, 握手时 会 使用 配置 中的 host.
+
+其它 可选项 对应 utls.Fingerprinter 的 同名 选项: allow_blunt_mimicry, keep_psk, always_add_padding
+*/
+type utlsSpecConf struct {
+	ClientHello string `json:"client_hello"`
+
+	TlsVersion         any               `json:"tls_version"`
+	CipherSuites       []any             `json:"cipher_suites"`
+	CompressionMethods []uint8           `json:"compression_methods"`
+	Extensions         []utlsSpecExtConf `json:"extensions"`
+
+	AllowBluntMimicry bool `json:"allow_blunt_mimicry"`
+	KeepPSK           bool `json:"keep_psk"`
+	AlwaysAddPadding  bool `json:"always_add_padding"`
+}
+
+type utlsSpecExtConf struct {
+	Type any    `json:"type"`
+	Data string `json:"data"`
+}
+
+// utlsSpec 保存 完整的 ClientHello 记录. 每次 握手 都要 重新 生成 ClientHelloSpec, 因为 utls 的 扩展 是 有状态的, 不能 在 连接 之间 共享.
+type utlsSpec struct {
+	raw           []byte
+	fingerprinter utls.Fingerprinter
+}
+
+func (us *utlsSpec) newSpec() (*utls.ClientHelloSpec, error) {
+	return us.fingerprinter.FingerprintClientHello(us.raw)
+}
+
+func loadUtlsSpecFile(fn string) (*utlsSpec, error) {
+	bs, err := os.ReadFile(utils.GetFilePath(fn))
+	if err != nil {
+		return nil, err
+	}
+	var conf utlsSpecConf
+	if err = json.Unmarshal(bs, &conf); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "utls spec file, json format error", ErrDetail: err, Data: fn}
+	}
+	return newUtlsSpec(conf)
+}
+
+func newUtlsSpec(conf utlsSpecConf) (us *utlsSpec, err error) {
+	us = &utlsSpec{
+		fingerprinter: utls.Fingerprinter{
+			AllowBluntMimicry: conf.AllowBluntMimicry,
+			KeepPSK:           conf.KeepPSK,
+			AlwaysAddPadding:  conf.AlwaysAddPadding,
+		},
+	}
+
+	if conf.ClientHello != "" {
+		us.raw, err = decodeHexOrBase64(conf.ClientHello)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "utls spec, client_hello is neither hex nor base64", ErrDetail: err}
+		}
+	} else {
+		us.raw, err = conf.buildClientHello()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//先 生成 一次, 以 检查 是否 有 utls 不支持 的 扩展
+	if _, err = us.newSpec(); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "utls spec, utls can't use this ClientHello", ErrDetail: err}
+	}
+	return
+}
+
+func decodeHexOrBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	if bs, err := hex.DecodeString(s); err == nil {
+		return bs, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// 数字, "0x" 开头的 hex 字符串, 十进制 字符串 或者 "GREASE".
+// nameFunc 用于 把 名称 转换 为 数值, 返回 0 表示 不认识 该名称
+func parseSpecUint16(v any, nameFunc func(string) uint16) (uint16, bool) {
+	switch value := v.(type) {
+	case float64:
+		if value >= 0 && value <= 0xffff && value == float64(uint16(value)) {
+			return uint16(value), true
+		}
+	case string:
+		value = strings.TrimSpace(value)
+		if strings.EqualFold(value, "grease") {
+			return utls.GREASE_PLACEHOLDER, true
+		}
+		if n, err := strconv.ParseUint(value, 0, 16); err == nil {
+			return uint16(n), true
+		}
+		if nameFunc != nil {
+			if n := nameFunc(value); n != 0 {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func extensionTypeByName(name string) uint16 {
+	//server_name 为 0, 会被 当作 不认识, 故 在 buildClientHello 中 单独 处理
+	if strings.EqualFold(name, "alpn") {
+		return et_application_layer_protocol_negotiation
+	}
+	if strings.EqualFold(name, "ec_point_formats") {
+		return et_ec_point_formats
+	}
+	for k, v := range etStrMap {
+		if strings.EqualFold(strings.TrimSpace(v), name) {
+			return uint16(k)
+		}
+	}
+	return 0
+}
+
+func (conf *utlsSpecConf) buildClientHello() ([]byte, error) {
+	if len(conf.CipherSuites) == 0 || len(conf.Extensions) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "utls spec, need client_hello, or both cipher_suites and extensions", ErrDetail: utils.ErrInvalidData}
+	}
+
+	version := uint16(0x0303)
+	if conf.TlsVersion != nil {
+		v, ok := parseSpecUint16(conf.TlsVersion, nil)
+		if !ok {
+			return nil, utils.ErrInErr{ErrDesc: "utls spec, invalid tls_version", ErrDetail: utils.ErrInvalidData, Data: conf.TlsVersion}
+		}
+		version = v
+	}
+
+	compressions := conf.CompressionMethods
+	if len(compressions) == 0 {
+		compressions = []uint8{0}
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(22)
+	b.AddUint16(0x0301)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(1)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(version)
+			b.AddBytes(make([]byte, 32)) //random
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(make([]byte, 32)) //session id
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, c := range conf.CipherSuites {
+					v, ok := parseSpecUint16(c, func(s string) uint16 { return StrToCipherSuite(s) })
+					if !ok {
+						b.SetError(utils.ErrInErr{ErrDesc: "utls spec, invalid cipher suite", ErrDetail: utils.ErrInvalidData, Data: c})
+						return
+					}
+					b.AddUint16(v)
+				}
+			})
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(compressions)
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, e := range conf.Extensions {
+					var et uint16
+					var ok bool
+					if s, isStr := e.Type.(string); isStr && (strings.EqualFold(s, "server_name") || strings.EqualFold(s, "sni")) {
+						et, ok = et_server_name, true
+					} else {
+						et, ok = parseSpecUint16(e.Type, extensionTypeByName)
+					}
+					if !ok {
+						b.SetError(utils.ErrInErr{ErrDesc: "utls spec, invalid extension type", ErrDetail: utils.ErrInvalidData, Data: e.Type})
+						return
+					}
+
+					data, err := hex.DecodeString(strings.Join(strings.Fields(e.Data), ""))
+					if err != nil {
+						b.SetError(utils.ErrInErr{ErrDesc: "utls spec, extension data is not hex", ErrDetail: err, Data: e.Type})
+						return
+					}
+					if et == et_server_name && len(data) == 0 {
+						//utls 只 需要 知道 有 sni 扩展, 实际的 名称 握手时 从 配置 中 获取
+						data = []byte{0, 14, 0, 0, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm'}
+					}
+
+					b.AddUint16(et)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(data)
+					})
+				}
+			})
+		})
+	})
+	return b.Bytes()
+}
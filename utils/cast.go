@@ -199,3 +199,30 @@ func AnyToUInt16Array(a any) ([]uint16, bool) {
 	}
 	return nil, false
 }
+
+// 可将 string, []string 或 []any 转换为 []string; 若为 string, 则按逗号分割.
+func AnyToStringArray(a any) ([]string, bool) {
+	switch value := a.(type) {
+	case string:
+		var vv []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				vv = append(vv, s)
+			}
+		}
+		return vv, true
+	case []string:
+		return value, true
+	case []any:
+		var vv []string
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			vv = append(vv, s)
+		}
+		return vv, true
+	}
+	return nil, false
+}